@@ -0,0 +1,5821 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"runtime"
+	runtimedebug "runtime/debug"
+	"runtime/pprof"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/tantalsec/Mkrul"
+	"github.com/tantalsec/Mkrul/mkruleval"
+	"github.com/tantalsec/Mkrul/mkrulhttp"
+)
+
+func lockCmd(args []string) error {
+	fs := flag.NewFlagSet("lock", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration")
+	update := fs.Bool("update", false, "fetch every pack again instead of keeping the locked ones")
+	fs.StringVar(&opts.CacheDir, "cache-dir", opts.CacheDir, "keep the fetched packs in the given directory")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(*in)
+
+	if err != nil {
+		return err
+	}
+
+	cfg, err := mkrul.ParseConfig(*in, data)
+
+	if err != nil {
+		return err
+	}
+
+	lock, err := opts.ReadLock(mkrul.LockPath(*in))
+
+	if err != nil {
+		return err
+	}
+
+	if *update {
+		lock.Packs = map[string]mkrul.LockedPack{}
+	}
+
+	if lock, err = opts.ImportPacks(&cfg, lock, true); err != nil {
+		return err
+	}
+
+	data, err = json.MarshalIndent(lock, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	slog.Info("packs locked", "count", len(lock.Packs))
+
+	return mkrul.WriteFileAtomic(mkrul.LockPath(*in), append(data, '\n'))
+}
+
+// Progress reports the progress of long compiles on stderr. It stays
+// silent for the first moments, so that quick compiles print nothing.
+type Progress struct {
+	w     io.Writer
+	start time.Time
+	last  time.Time
+	shown bool
+}
+
+// progress is nil unless enabled with -progress.
+var progress *Progress
+
+func newProgress(mode string) (*Progress, error) {
+	switch mode {
+	case "on":
+	case "off":
+		return nil, nil
+	case "auto":
+		if fi, err := os.Stderr.Stat(); *quiet || err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return nil, nil
+		}
+	default:
+		return nil, mkrul.UsageError(fmt.Errorf("unknown progress mode: %s", mode))
+	}
+
+	return &Progress{w: os.Stderr, start: time.Now()}, nil
+}
+
+func (p *Progress) Report(stage string, done, total int) {
+	if p == nil {
+		return
+	}
+
+	now := time.Now()
+
+	if done == total {
+		if p.shown {
+			fmt.Fprint(p.w, "\r\033[K")
+			p.shown = false
+		}
+
+		return
+	}
+
+	if now.Sub(p.start) < 200*time.Millisecond || now.Sub(p.last) < 100*time.Millisecond {
+		return
+	}
+
+	p.last, p.shown = now, true
+	fmt.Fprintf(p.w, "\r\033[K%s %d/%d (%d%%)", stage, done, total, done*100/total)
+}
+
+// readKeyring reads the trusted keys of verify: a key id and an ed25519
+// public key in hex per line, blank lines and lines starting with # are
+// skipped.
+func readKeyring(path string) (map[string]ed25519.PublicKey, error) {
+	result := map[string]ed25519.PublicKey{}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a key id and a public key", path, i+1)
+		}
+
+		key, err := hex.DecodeString(fields[1])
+
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: the public key must be 32 bytes in hex", path, i+1)
+		}
+
+		result[fields[0]] = key
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+
+	return result, nil
+}
+
+// checkSignatures accepts an artifact with a valid signature of a key of
+// the keyring. The signatures of other keys are skipped, so that both the
+// old and the new keys can sign during a rotation, but a signature of a
+// known key must be valid.
+func checkSignatures(data []byte, sigs []mkrul.Signature, keyring map[string]ed25519.PublicKey) error {
+	var ids []string
+
+	valid := false
+
+	for _, sig := range sigs {
+		ids = append(ids, sig.KeyID)
+		key, ok := keyring[sig.KeyID]
+
+		if !ok {
+			continue
+		}
+
+		if !ed25519.Verify(key, data, sig.Sig) {
+			return fmt.Errorf("signature of key %s does not match", sig.KeyID)
+		}
+
+		valid = true
+	}
+
+	if len(sigs) == 0 {
+		return fmt.Errorf("the artifact is not signed")
+	}
+
+	if !valid {
+		return fmt.Errorf("no signature of a key of the keyring (signed by %s)", strings.Join(ids, ", "))
+	}
+
+	return nil
+}
+
+type IR struct {
+	Version      int                    `json:"version"`
+	Sentinels    []mkruleval.Sentinel   `json:"sentinels"`
+	Templates    []mkruleval.Template   `json:"templates"`
+	ContentTypes mkruleval.ContentTypes `json:"content_types,omitempty"`
+}
+
+func writeIR(path string, snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes) error {
+	data, err := json.MarshalIndent(IR{mkrul.VERSION, snts, tmpls, types}, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// outputFormats maps output file extensions to their writers, any other
+// extension (except the reports) gets the binary artifact.
+var outputFormats = map[string]func(string, []mkruleval.Sentinel, []mkruleval.Template, mkruleval.ContentTypes) error{
+	".json": writeIR,
+}
+
+// reportFormats maps the extensions of the review reports to their
+// templates. The reports are rendered from the endpoints, not from the
+// compiled rules, so they are written from the input file.
+var reportFormats = map[string]interface {
+	Execute(io.Writer, any) error
+}{
+	".html":     reportHTML,
+	".md":       reportMarkdown,
+	".markdown": reportMarkdown,
+}
+
+func isReport(path string) bool {
+	_, ok := reportFormats[strings.ToLower(filepath.Ext(path))]
+	return ok
+}
+
+type Outputs []string
+
+func (o *Outputs) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *Outputs) Set(val string) error {
+	*o = append(*o, val)
+	return nil
+}
+
+func (o Outputs) Binary() string {
+	for _, path := range o {
+		if _, ok := outputFormats[filepath.Ext(path)]; !ok && !isReport(path) {
+			return path
+		}
+	}
+
+	return ""
+}
+
+func writeOutputs(paths []string, snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes) error {
+	for _, path := range paths {
+		if isReport(path) {
+			continue
+		}
+
+		write, ok := outputFormats[filepath.Ext(path)]
+
+		if !ok {
+			write = opts.WriteSentinels
+		}
+
+		if err := write(path, snts, tmpls, types); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeReports renders the report outputs from the endpoints of input,
+// after the overlay and the filters the compile applied.
+func writeReports(paths []string, input string) error {
+	var report []ReportEndpoint
+
+	for _, path := range paths {
+		if !isReport(path) {
+			continue
+		}
+
+		if report == nil {
+			data, err := opts.ReadInput(input)
+
+			if err != nil {
+				return err
+			}
+
+			if !mkrul.IsConfig(input, data) {
+				return mkrul.UsageError(fmt.Errorf("%s: reports are rendered from endpoint files only", path))
+			}
+
+			cfg, err := opts.EffectiveConfig(input, data)
+
+			if err != nil {
+				return err
+			}
+
+			report = makeReport(cfg.Endpoints)
+		}
+
+		var buf bytes.Buffer
+
+		if err := reportFormats[strings.ToLower(filepath.Ext(path))].Execute(&buf, report); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// makeChangelog returns the changelog of the artifact of the compiled
+// endpoints: the file given with -changelog followed by the differences
+// with the artifact given with -changelog-base.
+func makeChangelog(snts []mkruleval.Sentinel) (string, error) {
+	var result []string
+
+	if len(*changelogFile) != 0 {
+		data, err := os.ReadFile(*changelogFile)
+
+		if err != nil {
+			return "", err
+		}
+
+		result = append(result, strings.TrimRight(string(data), "\n"))
+	}
+
+	if len(*changelogBase) != 0 {
+		before, _, _, err := opts.Load(*changelogBase)
+
+		if err != nil {
+			return "", fmt.Errorf("changelog base: %w", err)
+		}
+
+		lines, err := diffSentinels(before, snts)
+
+		if err != nil {
+			return "", err
+		}
+
+		if len(lines) == 0 {
+			lines = []string{"no changes"}
+		}
+
+		result = append(result, fmt.Sprintf("Changes from %s:\n%s", filepath.Base(*changelogBase), strings.Join(lines, "\n")))
+	}
+
+	return strings.Join(result, "\n\n"), nil
+}
+
+func printStats(w io.Writer, stats mkrul.Stats) error {
+	var names []string
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "size\t%d\n", stats.Size)
+	fmt.Fprintf(tw, "sentinels\t%d\n", stats.Sentinels)
+	fmt.Fprintf(tw, "rules\t%d\n", stats.Rules)
+	fmt.Fprintf(tw, "shared rules\t%d\n", stats.SharedRules)
+	fmt.Fprintf(tw, "groups\t%d\n", stats.Groups)
+	fmt.Fprintf(tw, "statements\t%d\n", stats.Statements)
+	fmt.Fprintf(tw, "unique regexps\t%d\n", stats.Regexps)
+	fmt.Fprintf(tw, "string bytes\t%d\n", stats.StringBytes)
+	fmt.Fprintf(tw, "largest endpoint\t%s (%d bytes)\n", stats.Largest, stats.LargestSize)
+	fmt.Fprintf(tw, "cost\t%d\n", stats.Cost)
+	fmt.Fprintf(tw, "costliest rule\t%s (%d)\n", stats.Costliest, stats.CostliestCost)
+
+	for name := range stats.Contexts {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(tw, "context %s\t%d\n", name, stats.Contexts[name])
+	}
+
+	return tw.Flush()
+}
+
+func statsCmd(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	keyFlag(fs)
+	asJSON := fs.Bool("json", false, "print json summary")
+
+	files, err := parseCommand(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) != 1 {
+		return fmt.Errorf("usage: mkrul stats [-json] file")
+	}
+
+	snts, tmpls, types, err := opts.Load(files[0])
+
+	if err != nil {
+		return err
+	}
+
+	stats, err := opts.Stats(snts, tmpls, types)
+
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+
+	return printStats(os.Stdout, stats)
+}
+
+// printInspect lists the endpoints of a compiled artifact with their
+// owners and descriptions, and the same for every rule.
+func printInspect(w io.Writer, snts []mkruleval.Sentinel) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	for _, snt := range snts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", snt.Name(), snt.Meta.Owner, snt.Meta.Description)
+
+		for i, rule := range snt.Rules {
+			fmt.Fprintf(tw, "  rule %d (%d groups)\t%s\t%s\n", i, len(rule.Groups), rule.Meta.Owner, rule.Meta.Description)
+		}
+	}
+
+	return tw.Flush()
+}
+
+func inspectCmd(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	keyFlag(fs)
+
+	files, err := parseCommand(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) != 1 {
+		return fmt.Errorf("usage: mkrul inspect file")
+	}
+
+	snts, _, _, err := opts.Load(files[0])
+
+	if err != nil {
+		return err
+	}
+
+	if err = printInspect(os.Stdout, snts); err != nil || len(opts.LoadedChangelog) == 0 {
+		return err
+	}
+
+	_, err = fmt.Printf("\nchangelog:\n%s\n", opts.LoadedChangelog)
+
+	return err
+}
+
+// verifyCmd validates a compiled artifact in depth before it is loaded:
+// the header, the offset table against the records, every record down to
+// the statement codes, and the index section.
+func verifyCmd(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyring := fs.String("keyring", "", "require a valid signature of one of the keys of the file, one key id and ed25519 public key in hex per line")
+	keyFlag(fs)
+
+	files, err := parseCommand(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) != 1 {
+		return mkrul.UsageError(fmt.Errorf("usage: mkrul verify [-keyring file] [-encrypt aes:FILE] file"))
+	}
+
+	data, err := os.ReadFile(files[0])
+
+	if err != nil {
+		return err
+	}
+
+	data, sigs, err := mkrul.SplitSignatures(data)
+
+	if err != nil {
+		return &mkrul.CompileError{Code: mkrul.EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %v", files[0], err)}
+	}
+
+	if len(*keyring) != 0 {
+		keys, err := readKeyring(*keyring)
+
+		if err != nil {
+			return mkrul.UsageError(err)
+		}
+
+		if err = checkSignatures(data, sigs, keys); err != nil {
+			return &mkrul.CompileError{Code: mkrul.EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %v", files[0], err)}
+		}
+	}
+
+	if data, err = opts.DecryptArtifact(data); err != nil {
+		return &mkrul.CompileError{Code: mkrul.EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %v", files[0], err)}
+	}
+
+	snts, problems, err := opts.VerifyArtifact(data)
+
+	if err != nil {
+		return &mkrul.CompileError{Code: mkrul.EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %v", files[0], err)}
+	}
+
+	for _, problem := range problems {
+		slog.Error("verify", "file", files[0], "problem", problem)
+	}
+
+	if len(problems) != 0 {
+		return &mkrul.CompileError{Code: mkrul.EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %d problems", files[0], len(problems))}
+	}
+
+	slog.Info("artifact verified", "file", files[0], "sentinels", len(snts), "signatures", len(sigs))
+
+	return nil
+}
+
+func ruleSummary(i int, rule mkruleval.SentinelRule) string {
+	if act, ok := mkruleval.Action(rule.Groups); ok {
+		return fmt.Sprintf("rule %d: %s", i, mkrul.OpName(act.Op))
+	}
+
+	return fmt.Sprintf("rule %d", i)
+}
+
+// diffSentinels lists the endpoints added, removed and changed between two
+// rule sets. Rules are compared by their compiled form, so formatting
+// changes in the sources do not show up.
+func diffSentinels(before []mkruleval.Sentinel, after []mkruleval.Sentinel) ([]string, error) {
+	var result []string
+
+	index := map[string]int{}
+
+	for i, snt := range after {
+		index[snt.Name()] = i
+	}
+
+	seen := map[string]bool{}
+
+	for _, prev := range before {
+		i, ok := index[prev.Name()]
+		seen[prev.Name()] = true
+
+		if !ok {
+			result = append(result, fmt.Sprintf("- %s (%d rules)", prev.Name(), len(prev.Rules)))
+			continue
+		}
+
+		curr := after[i]
+		var lines []string
+
+		if prev.Flags != curr.Flags || prev.BlockThreshold != curr.BlockThreshold || prev.Window != curr.Window || !slices.Equal(prev.Charsets, curr.Charsets) || !slices.Equal(prev.AllowControl, curr.AllowControl) || !reflect.DeepEqual(prev.Schema, curr.Schema) || !slices.Equal(prev.RequiredHeaders, curr.RequiredHeaders) || !slices.Equal(prev.AllowedHeaders, curr.AllowedHeaders) || prev.Cookies != curr.Cookies || !reflect.DeepEqual(prev.CORS, curr.CORS) || !reflect.DeepEqual(prev.Bots, curr.Bots) || !slices.Equal(prev.AllowedStatus, curr.AllowedStatus) || !reflect.DeepEqual(prev.Sequences, curr.Sequences) {
+			lines = append(lines, "  ~ endpoint settings")
+		}
+
+		if prev.Meta != curr.Meta {
+			lines = append(lines, "  ~ owner or description")
+		}
+
+		prevKeys := map[string]int{}
+		currKeys := map[string]int{}
+
+		for _, rule := range prev.Rules {
+			key, err := mkrul.RuleKey(rule)
+
+			if err != nil {
+				return nil, err
+			}
+
+			prevKeys[key]++
+		}
+
+		for i, rule := range curr.Rules {
+			key, err := mkrul.RuleKey(rule)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if currKeys[key]++; currKeys[key] > prevKeys[key] {
+				lines = append(lines, "  + "+ruleSummary(i, rule))
+			}
+		}
+
+		for i, rule := range prev.Rules {
+			key, _ := mkrul.RuleKey(rule)
+
+			if prevKeys[key]--; prevKeys[key] >= currKeys[key] {
+				lines = append(lines, "  - "+ruleSummary(i, rule))
+			}
+		}
+
+		if len(lines) == 0 && len(prev.Rules) == len(curr.Rules) {
+			for j := range prev.Rules {
+				a, _ := mkrul.RuleKey(prev.Rules[j])
+				b, _ := mkrul.RuleKey(curr.Rules[j])
+
+				if a != b {
+					lines = append(lines, "  ~ rules reordered")
+					break
+				}
+			}
+		}
+
+		if len(lines) != 0 {
+			result = append(result, "~ "+prev.Name())
+			result = append(result, lines...)
+		}
+	}
+
+	for _, curr := range after {
+		if !seen[curr.Name()] {
+			result = append(result, fmt.Sprintf("+ %s (%d rules)", curr.Name(), len(curr.Rules)))
+		}
+	}
+
+	return result, nil
+}
+
+func diffCmd(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	keyFlag(fs)
+
+	files, err := parseCommand(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) != 2 {
+		return mkrul.UsageError(fmt.Errorf("usage: mkrul diff old new"))
+	}
+
+	before, _, _, err := opts.Load(files[0])
+
+	if err != nil {
+		return err
+	}
+
+	after, _, _, err := opts.Load(files[1])
+
+	if err != nil {
+		return err
+	}
+
+	lines, err := diffSentinels(before, after)
+
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+
+	return nil
+}
+
+// Plan is what apply changes in the deployed artifact, counted like
+// terraform does.
+type Plan struct {
+	Add     int      `json:"add"`
+	Change  int      `json:"change"`
+	Destroy int      `json:"destroy"`
+	Changes []string `json:"changes"`
+
+	data []byte
+}
+
+// makePlan compiles the input and compares it with the deployed artifact,
+// a missing state is planned as created from scratch.
+func makePlan(in string, state string) (Plan, error) {
+	var plan Plan
+	var buf bytes.Buffer
+	var before []mkruleval.Sentinel
+	var tmpls []mkruleval.Template
+
+	snts, after, types, err := opts.Compile(in)
+
+	if err != nil {
+		return plan, err
+	}
+
+	if err = opts.EncodeSentinels(&buf, snts, after, types); err != nil {
+		return plan, err
+	}
+
+	plan.data = buf.Bytes()
+	prev, err := os.ReadFile(state)
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return plan, err
+	}
+
+	if err == nil {
+		if before, tmpls, _, err = opts.DecodeSentinels(bytes.NewReader(prev)); err != nil {
+			return plan, &mkrul.CompileError{Code: mkrul.EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %v", state, err)}
+		}
+	}
+
+	if plan.Changes, err = diffSentinels(before, snts); err != nil {
+		return plan, err
+	}
+
+	for _, line := range plan.Changes {
+		switch {
+		case strings.HasPrefix(line, "+ "):
+			plan.Add++
+		case strings.HasPrefix(line, "- "):
+			plan.Destroy++
+		case strings.HasPrefix(line, "~ "):
+			plan.Change++
+		}
+	}
+
+	if prev != nil && !slices.Equal(tmpls, after) {
+		plan.Changes = append(plan.Changes, "~ responses")
+		plan.Change++
+	}
+
+	if prev != nil && plan.Add+plan.Change+plan.Destroy == 0 && !bytes.Equal(prev, plan.data) {
+		plan.Changes = append(plan.Changes, "~ artifact settings or format")
+		plan.Change++
+	}
+
+	if plan.Changes == nil {
+		plan.Changes = []string{}
+	}
+
+	return plan, nil
+}
+
+func (plan Plan) Empty() bool {
+	return plan.Add+plan.Change+plan.Destroy == 0
+}
+
+func printPlan(w io.Writer, plan Plan, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(plan)
+	}
+
+	if plan.Empty() {
+		_, err := fmt.Fprintln(w, "No changes. The deployed rules match the input.")
+		return err
+	}
+
+	for _, line := range plan.Changes {
+		fmt.Fprintln(w, line)
+	}
+
+	_, err := fmt.Fprintf(w, "\nPlan: %d to add, %d to change, %d to destroy.\n", plan.Add, plan.Change, plan.Destroy)
+
+	return err
+}
+
+func planCmd(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration")
+	state := fs.String("state", "sentinels.bin", "deployed artifact to compare with")
+	asJSON := fs.Bool("json", false, "print the plan as JSON")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	plan, err := makePlan(*in, *state)
+
+	if err != nil {
+		return err
+	}
+
+	return printPlan(os.Stdout, plan, *asJSON)
+}
+
+func applyCmd(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration")
+	state := fs.String("state", "sentinels.bin", "deployed artifact, replaced by the new one")
+	target := fs.String("publish", "", "also upload the artifact to s3://, gs:// or http(s):// url, {hash} is replaced with the content hash")
+	approve := fs.Bool("auto-approve", false, "apply without asking for confirmation")
+	asJSON := fs.Bool("json", false, "print the plan as JSON")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	plan, err := makePlan(*in, *state)
+
+	if err != nil {
+		return err
+	}
+
+	if err = printPlan(os.Stdout, plan, *asJSON); err != nil || plan.Empty() {
+		return err
+	}
+
+	if !*approve {
+		var answer string
+
+		fmt.Print("\nApply these changes? Only 'yes' will be accepted: ")
+		fmt.Scanln(&answer)
+
+		if answer != "yes" {
+			return fmt.Errorf("apply cancelled")
+		}
+	}
+
+	if err = mkrul.WriteFileAtomic(*state, plan.data); err != nil {
+		return err
+	}
+
+	slog.Info("applied", "state", *state, "add", plan.Add, "change", plan.Change, "destroy", plan.Destroy)
+
+	if len(*target) != 0 {
+		dst, err := publish(*target, plan.data)
+
+		if err != nil {
+			return err
+		}
+
+		slog.Info("published", "target", dst)
+	}
+
+	return nil
+}
+
+// TestCase is a request with the action the rules are expected to take.
+type TestCase struct {
+	Name    string            `json:"name"`
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Expect  string            `json:"expect"`
+}
+
+// name returns the name of the i-th test case, its index if it has none.
+func (tc TestCase) name(i int) string {
+	if len(tc.Name) == 0 {
+		return fmt.Sprintf("#%d", i)
+	}
+
+	return tc.Name
+}
+
+func (tc TestCase) request() (*http.Request, error) {
+	method := tc.Method
+
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(method, "http://localhost"+tc.URL, strings.NewReader(tc.Body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for key, val := range tc.Headers {
+		req.Header.Set(key, val)
+
+		if strings.EqualFold(key, "Host") {
+			req.Host = val
+		}
+	}
+
+	return req, nil
+}
+
+// evaluate runs a test case through the guard at the given time.
+func (tc TestCase) evaluate(g *mkruleval.Guard, i int, now time.Time) (mkruleval.Evaluation, error) {
+	req, err := tc.request()
+
+	if err != nil {
+		return mkruleval.Evaluation{}, fmt.Errorf("test %s: %v", tc.name(i), err)
+	}
+
+	return g.Evaluate(req, []byte(tc.Body), now), nil
+}
+
+func readTestCases(files []string) ([]TestCase, error) {
+	var cases []TestCase
+
+	for _, path := range files {
+		var batch []TestCase
+
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal(data, &batch); err != nil {
+			return nil, &mkrul.CompileError{Code: mkrul.EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %w", path, err)}
+		}
+
+		cases = append(cases, batch...)
+	}
+
+	return cases, nil
+}
+
+func runTests(g *mkruleval.Guard, cases []TestCase) (int, error) {
+	failed := 0
+	now := time.Now()
+
+	for i, tc := range cases {
+		name := tc.name(i)
+		eval, err := tc.evaluate(g, i, now)
+
+		if err != nil {
+			return failed, err
+		}
+
+		verdict := eval.Verdict
+
+		if got := mkruleval.ActionNames[verdict.Action]; got != tc.Expect {
+			failed++
+			slog.Error("test failed", "test", name, "expected", tc.Expect, "got", got, "endpoint", verdict.Endpoint, "rule", verdict.Rule)
+		} else {
+			slog.Debug("test passed", "test", name)
+		}
+	}
+
+	return failed, nil
+}
+
+func testCmd(args []string) error {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration or compiled artifact")
+
+	files, err := parseCommand(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return mkrul.UsageError(fmt.Errorf("usage: mkrul test [-i file] cases.json..."))
+	}
+
+	cases, err := readTestCases(files)
+
+	if err != nil {
+		return err
+	}
+
+	snts, tmpls, types, err := opts.Compile(*in)
+
+	if err != nil {
+		return err
+	}
+
+	g, err := mkruleval.NewGuard(snts, tmpls, types)
+
+	if err != nil {
+		return err
+	}
+
+	fixDraws(g, 1)
+
+	failed, err := runTests(g, cases)
+
+	if err != nil {
+		return err
+	}
+
+	slog.Info("tests finished", "passed", len(cases)-failed, "failed", failed)
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d tests failed", failed, len(cases))
+	}
+
+	return nil
+}
+
+// fixDraws makes the verdicts of the guard the same on every run, for the
+// commands checking the rules: sampled rules apply to every request, and
+// requests are given the given variant of every experiment, the last one
+// of those with fewer variants.
+func fixDraws(g *mkruleval.Guard, variant uint8) {
+	g.Sampled = func(uint16) bool { return true }
+	g.Variant = func(_ string, n uint8) uint8 { return min(variant, n) }
+}
+
+// maxVariants returns the largest number of variants of an experiment of
+// the sentinels, 1 without experiments.
+func maxVariants(snts []mkruleval.Sentinel) uint8 {
+	n := uint8(1)
+
+	for _, snt := range snts {
+		for _, rule := range snt.Rules {
+			n = max(n, rule.Variants)
+		}
+	}
+
+	return n
+}
+
+// coverageCmd runs the test cases and lists the rules none of them
+// matched.
+func coverageCmd(args []string) error {
+	fs := flag.NewFlagSet("coverage", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration or compiled artifact")
+	minimum := fs.Float64("min", 0, "fail if less than the given percentage of the rules is covered")
+
+	files, err := parseCommand(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return mkrul.UsageError(fmt.Errorf("usage: mkrul coverage [-i file] [-min percent] cases.json..."))
+	}
+
+	cases, err := readTestCases(files)
+
+	if err != nil {
+		return err
+	}
+
+	snts, tmpls, types, err := opts.Compile(*in)
+
+	if err != nil {
+		return err
+	}
+
+	g, err := mkruleval.NewGuard(snts, tmpls, types)
+
+	if err != nil {
+		return err
+	}
+
+	fixDraws(g, 1)
+
+	covered := map[[2]int]bool{}
+	now := time.Now()
+
+	// the cases are run once per variant to cover every experiment
+	for v := uint8(1); v <= maxVariants(snts); v++ {
+		g.Tracker = mkruleval.NewTracker()
+		fixDraws(g, v)
+
+		for i, tc := range cases {
+			eval, err := tc.evaluate(g, i, now)
+
+			if err != nil {
+				return err
+			}
+
+			for _, rule := range eval.Matched {
+				covered[[2]int{eval.Endpoint, rule}] = true
+			}
+		}
+	}
+
+	total := 0
+
+	for i, snt := range snts {
+		for j, rule := range snt.Rules {
+			total++
+
+			if !covered[[2]int{i, j}] {
+				fmt.Printf("%s rule %d: %s\n", snt.Name(), j, ruleString(rule))
+			}
+		}
+	}
+
+	percent := 100.0
+
+	if total != 0 {
+		percent = float64(len(covered)) * 100 / float64(total)
+	}
+
+	fmt.Printf("\n%d of %d rules covered (%.1f%%)\n", len(covered), total, percent)
+
+	if percent < *minimum {
+		return mkrul.Invalid(fmt.Errorf("coverage %.1f%% is below %.1f%%", percent, *minimum))
+	}
+
+	return nil
+}
+
+// impactCmd runs the test cases against the deployed and the new rules
+// and lists the ones whose action changes.
+func impactCmd(args []string) error {
+	fs := flag.NewFlagSet("impact", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "new endpoints configuration or compiled artifact")
+	old := fs.String("old", "sentinels.bin", "deployed artifact or endpoints configuration")
+
+	files, err := parseCommand(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return mkrul.UsageError(fmt.Errorf("usage: mkrul impact [-i file] [-old file] cases.json..."))
+	}
+
+	cases, err := readTestCases(files)
+
+	if err != nil {
+		return err
+	}
+
+	var guards [2]*mkruleval.Guard
+
+	variants := uint8(1)
+
+	for i, path := range []string{*old, *in} {
+		snts, tmpls, types, err := opts.Compile(path)
+
+		if err != nil {
+			return err
+		}
+
+		if guards[i], err = mkruleval.NewGuard(snts, tmpls, types); err != nil {
+			return err
+		}
+
+		variants = max(variants, maxVariants(snts))
+	}
+
+	changed := map[int]bool{}
+	now := time.Now()
+
+	// the cases are run once per variant, both sides given the same one,
+	// so that every variant of the experiments is compared
+	for v := uint8(1); v <= variants; v++ {
+		for _, g := range guards {
+			g.Tracker = mkruleval.NewTracker()
+			fixDraws(g, v)
+		}
+
+		for i, tc := range cases {
+			before, err := tc.evaluate(guards[0], i, now)
+
+			if err != nil {
+				return err
+			}
+
+			after, err := tc.evaluate(guards[1], i, now)
+
+			if err != nil {
+				return err
+			}
+
+			if changed[i] || before.Action == after.Action && before.Status == after.Status {
+				continue
+			}
+
+			changed[i] = true
+			fmt.Printf("%s: %s %d -> %s %d", tc.name(i), mkruleval.ActionNames[before.Action], before.Status, mkruleval.ActionNames[after.Action], after.Status)
+
+			if variants > 1 {
+				fmt.Printf(" (variant %d)", v)
+			}
+
+			fmt.Println()
+		}
+	}
+
+	fmt.Printf("\n%d of %d requests change\n", len(changed), len(cases))
+
+	return nil
+}
+
+// Sample is a generated request aimed at a rule of an endpoint, or at
+// none of them with a rule of -1.
+type Sample struct {
+	TestCase
+	Endpoint int
+	Rule     int
+}
+
+// classRune picks a plain character of a character class.
+func classRune(ranges []rune) (rune, bool) {
+	for _, r := range "a0A _-" {
+		for i := 0; i+1 < len(ranges); i += 2 {
+			if ranges[i] <= r && r <= ranges[i+1] {
+				return r, true
+			}
+		}
+	}
+
+	for i := 0; i+1 < len(ranges); i += 2 {
+		for r := ranges[i]; r <= ranges[i+1] && r-ranges[i] < 256; r++ {
+			if unicode.IsPrint(r) {
+				return r, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// sampleRegexp returns a string the regexp matches: the first branch of
+// alternations, the fewest repetitions and a plain character of classes.
+func sampleRegexp(src string) (string, bool) {
+	var sb strings.Builder
+	var walk func(re *syntax.Regexp) bool
+
+	re, err := syntax.Parse(src, syntax.Perl)
+
+	if err != nil {
+		return "", false
+	}
+
+	walk = func(re *syntax.Regexp) bool {
+		switch re.Op {
+		case syntax.OpNoMatch:
+			return false
+		case syntax.OpLiteral:
+			sb.WriteString(string(re.Rune))
+		case syntax.OpCharClass:
+			r, ok := classRune(re.Rune)
+
+			if !ok {
+				return false
+			}
+
+			sb.WriteRune(r)
+		case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+			sb.WriteByte('a')
+		case syntax.OpCapture, syntax.OpPlus, syntax.OpAlternate:
+			return walk(re.Sub[0])
+		case syntax.OpRepeat:
+			for i := 0; i < re.Min; i++ {
+				if !walk(re.Sub[0]) {
+					return false
+				}
+			}
+		case syntax.OpConcat:
+			for _, sub := range re.Sub {
+				if !walk(sub) {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	if !walk(re) {
+		return "", false
+	}
+
+	ok, _ := regexp.MatchString(src, sb.String())
+
+	return sb.String(), ok
+}
+
+// operand returns a value a key or value statement accepts.
+func operand(stmt mkruleval.Stmt) (string, bool) {
+	switch {
+	case len(stmt.Regexp) != 0:
+		return sampleRegexp(mkruleval.RegexpSource(stmt))
+	case len(stmt.Bytes) != 0:
+		return string(stmt.Bytes), true
+	}
+
+	return stmt.Val, true
+}
+
+// sampleRule builds a request carrying a key and value accepted by the
+// first group of a rule in its context, false if the rule has no such
+// simple form. mutate, if not nil, changes the key and value before they
+// are placed, to derive benign requests.
+func sampleRule(base TestCase, rule mkruleval.SentinelRule, mutate func(key, val string) (string, string)) (TestCase, bool) {
+	var ok bool
+
+	ctx, key, val := "", "x", "x"
+	tc := base
+	tc.Headers = maps.Clone(base.Headers)
+
+	if tc.Headers == nil {
+		tc.Headers = map[string]string{}
+	}
+
+	if len(rule.Groups) == 0 {
+		return tc, false
+	}
+
+	for _, stmt := range rule.Groups[0] {
+		// the request only needs not to meet the exceptions, which the
+		// guard checks
+		if stmt.Var == 0 || stmt.Mods&mkruleval.MOD_EXCEPT != 0 {
+			continue
+		}
+
+		if stmt.Op != mkruleval.EQ || len(stmt.Transforms) != 0 {
+			return tc, false
+		}
+
+		switch stmt.Var {
+		case mkruleval.CTX:
+			ctx, _, _ = strings.Cut(stmt.Val, "|")
+		case mkruleval.KEY:
+			key, ok = operand(stmt)
+		case mkruleval.VAL:
+			val, ok = operand(stmt)
+		case mkruleval.COOKIE_VAL:
+			ctx, key = "cookie", stmt.Arg
+			val, ok = operand(stmt)
+		case mkruleval.SCHEME:
+			ctx = "auth_header"
+			key, ok = operand(stmt)
+		default:
+			return tc, false
+		}
+
+		if stmt.Var != mkruleval.CTX && !ok {
+			return tc, false
+		}
+	}
+
+	if mutate != nil {
+		key, val = mutate(key, val)
+	}
+
+	switch strings.TrimSpace(ctx) {
+	case "headers":
+		tc.Headers[key] = val
+	case "urlenc":
+		tc.URL += "?" + url.Values{key: {val}}.Encode()
+	case "cookie":
+		tc.Headers["Cookie"] = (&http.Cookie{Name: key, Value: val}).String()
+	case "json", "json_obj":
+		data, _ := json.Marshal(map[string]string{key: val})
+		tc.Headers["Content-Type"] = "application/json"
+		tc.Body = string(data)
+	case "auth_header":
+		tc.Headers["Authorization"] = key + " " + val
+	default:
+		return tc, false
+	}
+
+	return tc, true
+}
+
+// benignMutations turn the request of a rule into one the rule should not
+// match, tried in order.
+var benignMutations = []func(key, val string) (string, string){
+	func(key, val string) (string, string) { return key, "hello" },
+	func(key, val string) (string, string) { return "x-benign", val },
+	func(key, val string) (string, string) { return "x-benign", "hello" },
+}
+
+// samples generates a request per endpoint and a request per rule with a
+// simple form, kept only if the guard finds it matches the rule, and with
+// benign a request derived from each of those that the rule does not
+// match.
+func samples(g *mkruleval.Guard, snts []mkruleval.Sentinel, benign bool) ([]Sample, error) {
+	var result []Sample
+
+	now := time.Now()
+
+	for i, snt := range snts {
+		method := snt.Method
+
+		if len(method) == 0 || method == "*" {
+			method = http.MethodGet
+		}
+
+		base := TestCase{Name: snt.Name() + " baseline", Method: method, URL: mkrul.SamplePath(snt.Path)}
+		eval, err := base.evaluate(g, 0, now)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if eval.Endpoint == i {
+			base.Expect = mkruleval.ActionNames[eval.Action]
+			result = append(result, Sample{base, i, -1})
+		}
+
+		for j, rule := range snt.Rules {
+			tc, ok := sampleRule(base, rule, nil)
+
+			if !ok {
+				continue
+			}
+
+			tc.Name = fmt.Sprintf("%s rule %d", snt.Name(), j)
+
+			if eval, err = tc.evaluate(g, 0, now); err != nil {
+				return nil, err
+			}
+
+			if eval.Endpoint != i || !slices.Contains(eval.Matched, j) {
+				continue
+			}
+
+			tc.Expect = mkruleval.ActionNames[eval.Action]
+			result = append(result, Sample{tc, i, j})
+
+			if !benign {
+				continue
+			}
+
+			for _, mutate := range benignMutations {
+				tc, _ = sampleRule(base, rule, mutate)
+				tc.Name = fmt.Sprintf("%s rule %d benign", snt.Name(), j)
+
+				if eval, err = tc.evaluate(g, 0, now); err != nil {
+					return nil, err
+				}
+
+				if eval.Endpoint == i && !slices.Contains(eval.Matched, j) {
+					tc.Expect = mkruleval.ActionNames[eval.Action]
+					result = append(result, Sample{tc, i, j})
+					break
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// genTestsCmd writes the generated requests as test cases, expecting the
+// actions the rules take on them now.
+func genTestsCmd(args []string) error {
+	fs := flag.NewFlagSet("gen-tests", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration or compiled artifact")
+	out := fs.String("o", "", "output file (default stdout)")
+	benign := fs.Bool("benign", true, "also generate the requests the rules should not match")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	snts, tmpls, types, err := opts.Compile(*in)
+
+	if err != nil {
+		return err
+	}
+
+	g, err := mkruleval.NewGuard(snts, tmpls, types)
+
+	if err != nil {
+		return err
+	}
+
+	fixDraws(g, 1)
+
+	list, err := samples(g, snts, *benign)
+
+	if err != nil {
+		return err
+	}
+
+	cases := []TestCase{}
+	covered, total := map[[2]int]bool{}, 0
+
+	for _, sample := range list {
+		cases = append(cases, sample.TestCase)
+
+		if sample.Rule >= 0 {
+			covered[[2]int{sample.Endpoint, sample.Rule}] = true
+		}
+	}
+
+	for _, snt := range snts {
+		total += len(snt.Rules)
+	}
+
+	slog.Info("tests generated", "cases", len(cases), "rules", len(covered), "total_rules", total)
+
+	data, err := json.MarshalIndent(cases, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if len(*out) == 0 {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+
+	return mkrul.WriteFileAtomic(*out, append(data, '\n'))
+}
+
+// conformanceCmd sends the generated samples and the test cases to a WAF
+// and compares the status codes with the verdicts of the local engine.
+func conformanceCmd(args []string) error {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration or compiled artifact deployed on the target")
+	target := fs.String("target", "", "base url of the WAF under test")
+	passStatus := fs.Int("pass-status", http.StatusOK, "status of the upstream behind the target for passed requests")
+	timeout := fs.Duration("timeout", 5*time.Second, "timeout of a request")
+
+	files, err := parseCommand(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(*target) == 0 {
+		return mkrul.UsageError(fmt.Errorf("usage: mkrul conformance [-i file] -target url [cases.json...]"))
+	}
+
+	cases, err := readTestCases(files)
+
+	if err != nil {
+		return err
+	}
+
+	snts, tmpls, types, err := opts.Compile(*in)
+
+	if err != nil {
+		return err
+	}
+
+	g, err := mkruleval.NewGuard(snts, tmpls, types)
+
+	if err != nil {
+		return err
+	}
+
+	fixDraws(g, 1)
+
+	list, err := samples(g, snts, true)
+
+	if err != nil {
+		return err
+	}
+
+	for _, tc := range cases {
+		list = append(list, Sample{tc, -1, -1})
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	diverged := map[string]int{}
+	now := time.Now()
+
+	for i, sample := range list {
+		eval, err := sample.evaluate(g, i, now)
+
+		if err != nil {
+			return err
+		}
+
+		want := eval.Status
+
+		if eval.Action == mkruleval.PASS {
+			want = *passStatus
+		}
+
+		req, err := sample.request()
+
+		if err != nil {
+			return err
+		}
+
+		if req.URL, err = url.Parse(strings.TrimSuffix(*target, "/") + sample.URL); err != nil {
+			return mkrul.UsageError(err)
+		}
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			return err
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == want {
+			continue
+		}
+
+		rule := sample.Rule
+
+		if rule < 0 {
+			rule = eval.Rule
+		}
+
+		where := "no endpoint"
+
+		if eval.Endpoint >= 0 {
+			where = snts[eval.Endpoint].Name()
+
+			if rule >= 0 {
+				where += fmt.Sprintf(" rule %d", rule)
+			}
+		}
+
+		diverged[where]++
+		fmt.Printf("%s: expected %s %d, got %d\n", sample.name(i), mkruleval.ActionNames[eval.Action], want, resp.StatusCode)
+	}
+
+	total := 0
+
+	for _, where := range slices.Sorted(maps.Keys(diverged)) {
+		total += diverged[where]
+		fmt.Printf("%s: %d divergences\n", where, diverged[where])
+	}
+
+	fmt.Printf("\n%d of %d requests agree\n", len(list)-total, len(list))
+
+	if total != 0 {
+		return mkrul.Invalid(fmt.Errorf("%d requests diverge from the local engine", total))
+	}
+
+	return nil
+}
+
+func mergeSentinels(dst []mkruleval.Sentinel, src []mkruleval.Sentinel, policy string) ([]mkruleval.Sentinel, error) {
+	index := map[string]int{}
+
+	for i, snt := range dst {
+		index[snt.Name()] = i
+	}
+
+	for _, snt := range src {
+		i, ok := index[snt.Name()]
+
+		if !ok {
+			index[snt.Name()] = len(dst)
+			dst = append(dst, snt)
+			continue
+		}
+
+		switch policy {
+		case "error":
+			return nil, fmt.Errorf("endpoint %s is defined twice", snt.Name())
+		case "first-wins":
+			slog.Warn("endpoint skipped", "endpoint", snt.Name())
+		case "concat-rules":
+			if err := mergeEndpoint(&dst[i], snt); err != nil {
+				return nil, err
+			}
+
+			if j := slices.IndexFunc(dst[i].Rules, mkrul.MatchesAll); j >= 0 && len(snt.Rules) != 0 {
+				slog.Warn("rules unreachable after a catch-all", "endpoint", snt.Name(), "rule", j, "count", len(snt.Rules))
+			}
+
+			dst[i].Rules = append(dst[i].Rules, snt.Rules...)
+		default:
+			return nil, fmt.Errorf("unknown conflict policy: %s", policy)
+		}
+	}
+
+	return dst, nil
+}
+
+// mergeField sets a setting of an endpoint merged with concat-rules: it is
+// taken from the endpoint that has it, both must agree when both do.
+func mergeField[T any](name string, dst *T, src T) error {
+	switch {
+	case reflect.ValueOf(src).IsZero() || reflect.DeepEqual(*dst, src):
+		return nil
+	case reflect.ValueOf(*dst).IsZero():
+		*dst = src
+		return nil
+	}
+
+	return fmt.Errorf("%s differs", name)
+}
+
+// mergeEndpoint merges the settings of an endpoint defined again into the
+// first definition, the rules aside.
+func mergeEndpoint(dst *mkruleval.Sentinel, src mkruleval.Sentinel) error {
+	err := errors.Join(
+		mergeField("flags", &dst.Flags, src.Flags),
+		mergeField("block_threshold", &dst.BlockThreshold, src.BlockThreshold),
+		mergeField("active", &dst.Window, src.Window),
+		mergeField("charsets", &dst.Charsets, src.Charsets),
+		mergeField("allow_control_chars", &dst.AllowControl, src.AllowControl),
+		mergeField("schema", &dst.Schema, src.Schema),
+		mergeField("required_headers", &dst.RequiredHeaders, src.RequiredHeaders),
+		mergeField("allowed_headers", &dst.AllowedHeaders, src.AllowedHeaders),
+		mergeField("cookie_policy", &dst.Cookies, src.Cookies),
+		mergeField("cors", &dst.CORS, src.CORS),
+		mergeField("bot_policy", &dst.Bots, src.Bots),
+		mergeField("sequences", &dst.Sequences, src.Sequences),
+		mergeField("allowed_status", &dst.AllowedStatus, src.AllowedStatus),
+	)
+
+	if err != nil {
+		return fmt.Errorf("endpoint %s: %w", src.Name(), err)
+	}
+
+	if len(dst.Meta.Owner) == 0 {
+		dst.Meta.Owner = src.Meta.Owner
+	}
+
+	if len(dst.Meta.Description) == 0 {
+		dst.Meta.Description = src.Meta.Description
+	}
+
+	return nil
+}
+
+func mergeTemplates(dst []mkruleval.Template, src []mkruleval.Template) ([]mkruleval.Template, error) {
+	index := map[string]mkruleval.Template{}
+
+	for _, tmpl := range dst {
+		index[tmpl.Name] = tmpl
+	}
+
+	for _, tmpl := range src {
+		prev, ok := index[tmpl.Name]
+
+		if !ok {
+			index[tmpl.Name] = tmpl
+			dst = append(dst, tmpl)
+		} else if prev != tmpl {
+			return nil, fmt.Errorf("response %s is defined twice", tmpl.Name)
+		}
+	}
+
+	sort.Slice(dst, func(i, j int) bool {
+		return dst[i].Name < dst[j].Name
+	})
+
+	return dst, nil
+}
+
+func mergeCmd(args []string) error {
+	var snts []mkruleval.Sentinel
+	var tmpls []mkruleval.Template
+
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := fs.String("o", "merged.bin", "merged binary data")
+	policy := fs.String("conflict", "error", "method+path conflict policy: error, first-wins or concat-rules")
+
+	files, err := parseCommand(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) < 2 {
+		return fmt.Errorf("usage: mkrul merge [-conflict policy] [-o file] a.bin b.bin...")
+	}
+
+	types := mkruleval.ContentTypes{}
+
+	for _, file := range files {
+		s, t, ct, err := opts.Load(file)
+
+		if err != nil {
+			return err
+		}
+
+		for contentType, ctx := range ct {
+			if err = types.Register(contentType, ctx); err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+		}
+
+		if snts, err = mergeSentinels(snts, s, *policy); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+
+		if tmpls, err = mergeTemplates(tmpls, t); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	if err = opts.CheckSentinels(snts); err != nil {
+		return mkrul.Invalid(err)
+	}
+
+	if err = opts.CheckLimits(snts, tmpls, types); err != nil {
+		return err
+	}
+
+	return opts.WriteSentinels(*out, snts, tmpls, types)
+}
+
+// underPrefix tells whether requests under the prefix can reach the
+// endpoint: its path segments match those of the prefix as far as both go,
+// so an endpoint above the prefix, at the root or behind a wildcard is
+// reachable from every shard it may serve.
+func underPrefix(snt mkruleval.Sentinel, prefix []string) bool {
+	for i := 0; i < len(snt.Path) && i < len(prefix); i++ {
+		seg := mkruleval.ParseSegment(snt.Path[i])
+
+		switch seg.Kind {
+		case mkruleval.SEG_LITERAL:
+			if seg.Name != prefix[i] && !(snt.Flags&mkruleval.FLAG_CASE_INSENSITIVE != 0 && strings.EqualFold(seg.Name, prefix[i])) {
+				return false
+			}
+		case mkruleval.SEG_REGEXP:
+			if re, err := regexp.Compile("^(?:" + seg.Pattern + ")$"); err == nil && !re.MatchString(prefix[i]) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// splitSentinels returns the endpoints requests under each prefix can
+// reach, and the rest of them, reachable under none.
+func splitSentinels(snts []mkruleval.Sentinel, prefixes []string) ([][]mkruleval.Sentinel, []mkruleval.Sentinel) {
+	var rest []mkruleval.Sentinel
+
+	shards := make([][]mkruleval.Sentinel, len(prefixes))
+
+	for _, snt := range snts {
+		found := false
+
+		for i, prefix := range prefixes {
+			if underPrefix(snt, mkrul.SplitPrefix(prefix)) {
+				shards[i] = append(shards[i], snt)
+				found = true
+			}
+		}
+
+		if !found {
+			rest = append(rest, snt)
+		}
+	}
+
+	return shards, rest
+}
+
+func shardName(prefix string) string {
+	name := strings.Join(mkrul.SplitPrefix(prefix), "_")
+
+	if len(name) == 0 {
+		name = "root"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == '-' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+
+		return '_'
+	}, name) + ".bin"
+}
+
+func splitCmd(args []string) error {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	in := fs.String("i", "sentinels.bin", "compiled binary data or endpoints json")
+	out := fs.String("o", ".", "output directory")
+	by := fs.String("by-prefix", "", "comma-separated path prefixes, one shard per prefix")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	if len(*by) == 0 {
+		return fmt.Errorf("usage: mkrul split -i file -by-prefix /a,/b [-o dir]")
+	}
+
+	snts, tmpls, types, err := opts.Load(*in)
+
+	if err != nil {
+		return err
+	}
+
+	prefixes := strings.Split(*by, ",")
+	shards, rest := splitSentinels(snts, prefixes)
+
+	if i := slices.IndexFunc(prefixes, func(prefix string) bool { return shardName(prefix) == "rest.bin" }); i >= 0 && len(rest) != 0 {
+		return fmt.Errorf("the shard of %s is named as the one of the endpoints under no prefix, rest.bin", prefixes[i])
+	}
+
+	for i, shard := range shards {
+		name := filepath.Join(*out, shardName(prefixes[i]))
+
+		if err = opts.WriteSentinels(name, shard, tmpls, types); err != nil {
+			return err
+		}
+
+		slog.Info("shard written", "prefix", prefixes[i], "file", name, "sentinels", len(shard))
+	}
+
+	if len(rest) == 0 {
+		return nil
+	}
+
+	for _, snt := range rest {
+		slog.Warn("endpoint under no prefix", "endpoint", snt.Name())
+	}
+
+	name := filepath.Join(*out, "rest.bin")
+
+	if err = opts.WriteSentinels(name, rest, tmpls, types); err != nil {
+		return err
+	}
+
+	slog.Info("shard written", "file", name, "sentinels", len(rest))
+
+	return nil
+}
+
+func serveMetrics(addr string) {
+	if len(addr) == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", &mkrulhttp.DefaultMetrics)
+
+	go func() {
+		fatal(http.ListenAndServe(addr, mux))
+	}()
+}
+
+// serve runs the reverse proxy with the rules of path, reloaded on SIGHUP.
+func serve(addr string, upstream string, path string, snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes) error {
+	store := mkrul.Store{Compiler: opts}
+
+	target, err := url.Parse(upstream)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = store.Swap(snts, tmpls, types); err != nil {
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			start := time.Now()
+			set, err := store.Load(path)
+
+			if err != nil {
+				mkrulhttp.DefaultMetrics.Failed()
+				slog.Error("reload failed, keeping the current rules", "path", path, "error", err)
+				continue
+			}
+
+			mkrulhttp.DefaultMetrics.Compiled(time.Since(start), set.Sentinels)
+			slog.Info("rules reloaded", "path", path, "version", set.Version, "sentinels", len(set.Sentinels))
+		}
+	}()
+
+	return http.ListenAndServe(addr, mkrulhttp.StoreMiddleware(&store)(httputil.NewSingleHostReverseProxy(target)))
+}
+
+var envoyExtProc = template.Must(template.New("ext_proc").Parse(`http_filters:
+- name: envoy.filters.http.ext_proc
+  typed_config:
+    "@type": type.googleapis.com/envoy.extensions.filters.http.ext_proc.v3.ExternalProcessor
+    grpc_service:
+      envoy_grpc:
+        cluster_name: {{.Cluster}}
+    processing_mode:
+      request_header_mode: SEND
+      request_body_mode: BUFFERED
+      response_header_mode: SKIP
+      response_body_mode: NONE
+    message_timeout: 0.2s
+- name: envoy.filters.http.router
+  typed_config:
+    "@type": type.googleapis.com/envoy.extensions.filters.http.router.v3.Router
+`))
+
+var envoyWasm = template.Must(template.New("wasm").Parse(`http_filters:
+- name: envoy.filters.http.wasm
+  typed_config:
+    "@type": type.googleapis.com/envoy.extensions.filters.http.wasm.v3.Wasm
+    config:
+      name: mkrul
+      root_id: mkrul
+      configuration:
+        "@type": type.googleapis.com/google.protobuf.BytesValue
+        value: {{.Artifact}}
+      vm_config:
+        runtime: envoy.wasm.runtime.v8
+        code:
+          local:
+            filename: {{.Module}}
+- name: envoy.filters.http.router
+  typed_config:
+    "@type": type.googleapis.com/envoy.extensions.filters.http.router.v3.Router
+`))
+
+var openrestyModule = template.Must(template.New("lua").Parse(`-- generated by mkrul, do not edit
+local cjson = require "cjson.safe"
+
+local M = {}
+
+local CONTEXTS = { "http", "path", "urlenc", "headers", "json", "json_obj", "json_array", "cookie", "jwt" }
+
+local endpoints = {{.Endpoints}}
+
+local templates = {{.Templates}}
+
+local function split_path(path)
+    local segs = {}
+    for seg in string.gmatch(path, "[^/]+") do
+        segs[#segs + 1] = seg
+    end
+    return segs
+end
+
+local function find_endpoint(method, path)
+    local segs = split_path(path)
+    local found, best = nil, -1
+    for _, ep in ipairs(endpoints) do
+        local m = method
+        if ep.ci then
+            m = string.upper(method)
+        end
+        if (ep.method == "" or ep.method == "*" or ep.method == m) and #ep.path <= #segs and #ep.path > best then
+            local ok = true
+            for i, seg in ipairs(ep.path) do
+                if type(seg) == "table" then
+                    if not ngx.re.find(segs[i], seg.re, "jo") then
+                        ok = false
+                        break
+                    end
+                elseif seg ~= "*" and seg ~= segs[i] and not (ep.ci and string.lower(seg) == string.lower(segs[i])) then
+                    ok = false
+                    break
+                end
+            end
+            if ok then
+                found, best = ep, #ep.path
+            end
+        end
+    end
+    return found
+end
+
+local function cron_field(field, v)
+    for item in string.gmatch(field, "[^,]+") do
+        local rng, step = string.match(item, "^([^/]+)/?(%d*)$")
+        local a, b, n = 0, math.huge, tonumber(step) or 1
+        if rng ~= "*" then
+            local lo, hi = string.match(rng, "^(%d+)-?(%d*)$")
+            a = tonumber(lo)
+            b = tonumber(hi) or a
+        end
+        if v >= a and v <= b and (v - a) % n == 0 then
+            return true
+        end
+    end
+    return false
+end
+
+local function cron_match(expr, t)
+    local d = os.date("!*t", t)
+    local values = { d.min, d.hour, d.day, d.month, d.wday - 1 }
+    local i = 1
+    for field in string.gmatch(expr, "%S+") do
+        local v = values[i]
+        if not cron_field(field, v) and not (i == 5 and v == 0 and cron_field(field, 7)) then
+            return false
+        end
+        i = i + 1
+    end
+    return true
+end
+
+local function active(win, now)
+    if not win then
+        return true
+    end
+    if win.from and now < win.from then
+        return false
+    end
+    if win.to and now > win.to then
+        return false
+    end
+    return not win.cron or cron_match(win.cron, now)
+end
+
+local function body()
+    ngx.req.read_body()
+    return ngx.req.get_body_data() or ""
+end
+
+local function add(out, ctx, key, val, depth)
+    out[#out + 1] = { ctx = ctx, key = key, val = val, depth = depth or 0 }
+end
+
+local function add_args(out, ctx, args)
+    for k, v in pairs(args) do
+        if type(v) == "table" then
+            for _, x in ipairs(v) do
+                add(out, ctx, k, tostring(x))
+            end
+        else
+            add(out, ctx, k, tostring(v))
+        end
+    end
+end
+
+local function json_str(v)
+    if type(v) == "string" then
+        return v
+    end
+    return cjson.encode(v) or ""
+end
+
+local function flatten(v, depth, out)
+    if type(v) ~= "table" then
+        return out
+    end
+    if #v > 0 then
+        for i, x in ipairs(v) do
+            add(out, "json_array", tostring(i - 1), json_str(x), depth)
+            flatten(x, depth + 1, out)
+        end
+    else
+        for k, x in pairs(v) do
+            add(out, "json_obj", k, json_str(x), depth)
+            flatten(x, depth + 1, out)
+        end
+    end
+    return out
+end
+
+local function b64url(s)
+    s = string.gsub(string.gsub(s, "-", "+"), "_", "/")
+    return ngx.decode_base64(s .. string.rep("=", (4 - #s % 4) % 4))
+end
+
+local function items(ctx, input)
+    local out = {}
+    if ctx == "headers" then
+        if input.req then
+            add_args(out, ctx, ngx.req.get_headers(0, true))
+        end
+    elseif ctx == "cookie" then
+        local s = input.val
+        if input.req then
+            s = ngx.var.http_cookie or ""
+        end
+        for k, v in string.gmatch(s, "([^=;%s]+)=([^;]*)") do
+            add(out, ctx, k, v)
+        end
+    elseif ctx == "urlenc" then
+        if input.req then
+            add_args(out, ctx, ngx.req.get_uri_args(0))
+            if string.find(ngx.var.content_type or "", "application/x-www-form-urlencoded", 1, true) == 1 then
+                add_args(out, ctx, ngx.decode_args(body(), 0))
+            end
+        else
+            add_args(out, ctx, ngx.decode_args(input.val, 0))
+        end
+    elseif ctx == "path" then
+        local path = input.val
+        if input.req then
+            path = ngx.var.uri
+        end
+        for i, seg in ipairs(split_path(path)) do
+            add(out, ctx, tostring(i - 1), seg)
+        end
+    elseif ctx == "http" then
+        if input.req then
+            add(out, ctx, "method", ngx.req.get_method())
+            add(out, ctx, "scheme", ngx.var.scheme)
+            add(out, ctx, "uri", ngx.var.request_uri)
+            add(out, ctx, "path", ngx.var.uri)
+            add(out, ctx, "query", ngx.var.args or "")
+            add(out, ctx, "headers", ngx.req.raw_header(true))
+            add(out, ctx, "body", body())
+        end
+    elseif ctx == "json" or ctx == "json_obj" or ctx == "json_array" then
+        local s = input.val
+        if input.req then
+            s = body()
+        end
+        for _, item in ipairs(flatten(cjson.decode(s), 0, {})) do
+            if ctx == "json" or item.ctx == ctx then
+                out[#out + 1] = item
+            end
+        end
+    elseif ctx == "jwt" then
+        local token = input.val
+        if input.req then
+            token = string.match(ngx.var.http_authorization or "", "^[Bb]earer%s+(%S+)")
+        end
+        local h, p = string.match(token or "", "^([^.]+)%.([^.]+)%.")
+        h, p = h and b64url(h), p and b64url(p)
+        if h and p and cjson.decode(h) and cjson.decode(p) then
+            add(out, ctx, "header", h)
+            add(out, ctx, "payload", p)
+        end
+    end
+    return out
+end
+
+local TRANSFORMS = {
+    lower = string.lower,
+    upper = string.upper,
+    trim = function(v) return (string.gsub(v, "^%s*(.-)%s*$", "%1")) end,
+    url_decode = function(v) return ngx.unescape_uri(v) end,
+    base64_decode = function(v) return ngx.decode_base64(v) or v end,
+    compress_whitespace = function(v) return (string.gsub(v, "%s+", " ")) end,
+    remove_nulls = function(v) return (string.gsub(v, "%z", "")) end,
+}
+
+local function test(stmt, v, fold)
+    local ok
+    for _, tf in ipairs(stmt.tf or {}) do
+        v = TRANSFORMS[tf](v)
+    end
+    if stmt.re then
+        ok = ngx.re.find(v, stmt.re, stmt.flags) ~= nil
+    elseif fold and not stmt.bytes then
+        ok = string.lower(stmt.val) == string.lower(v)
+    else
+        ok = stmt.val == v
+    end
+    if stmt.op == "==" then
+        return ok
+    end
+    return not ok
+end
+
+local function match_group(stmts, input)
+    local out = {}
+    for _, ctx in ipairs(CONTEXTS) do
+        local allowed = true
+        for _, stmt in ipairs(stmts) do
+            if stmt.var == "ctx" and (stmt.op == "==") ~= (stmt.ctx[ctx] == true) then
+                allowed = false
+            end
+        end
+        if allowed then
+            for _, item in ipairs(items(ctx, input)) do
+                local ok = true
+                for _, stmt in ipairs(stmts) do
+                    if stmt.var == "key" then
+                        ok = test(stmt, item.key, item.ctx == "headers")
+                    elseif stmt.var == "val" then
+                        ok = test(stmt, item.val, false)
+                    elseif stmt.var == "depth" then
+                        ok = test(stmt, tostring(item.depth), false)
+                    end
+                    if not ok then
+                        break
+                    end
+                end
+                if ok then
+                    out[#out + 1] = item
+                end
+            end
+        end
+    end
+    return out
+end
+
+local function match_groups(groups, i, input)
+    if i > #groups then
+        return true
+    end
+    if #groups[i] == 0 then
+        return match_groups(groups, i + 1, input)
+    end
+    for _, item in ipairs(match_group(groups[i], input)) do
+        if match_groups(groups, i + 1, { val = item.val }) then
+            return true
+        end
+    end
+    return false
+end
+
+function M.access()
+    local ep = find_endpoint(ngx.req.get_method(), ngx.var.uri)
+    local now = ngx.time()
+    if not ep or not active(ep.active, now) then
+        return
+    end
+    local input = { req = true }
+    local score = 0
+    for _, rule in ipairs(ep.rules) do
+        if active(rule.active, now) and (not rule.expires or now < rule.expires) and (not rule.sample or math.random(10000) <= rule.sample) and match_groups(rule.groups, 1, input) then
+            local act = rule.action
+            if act.op == "score" then
+                score = score + act.num
+                if score >= ep.threshold then
+                    return ngx.exit(ngx.HTTP_FORBIDDEN)
+                end
+            elseif act.op == "block" then
+                return ngx.exit(ngx.HTTP_FORBIDDEN)
+            elseif act.op == "redirect" then
+                return ngx.redirect(act.val)
+            elseif act.op == "respond" then
+                local tmpl = templates[act.val]
+                ngx.status = act.num
+                if tmpl then
+                    ngx.header["Content-Type"] = tmpl.content_type
+                    ngx.print(tmpl.body)
+                end
+                return ngx.exit(ngx.HTTP_OK)
+            else
+                return
+            end
+        end
+    end
+end
+
+return M
+`))
+
+var openrestyConf = template.Must(template.New("conf").Parse(`lua_package_path "{{.Dir}}/?.lua;;";
+
+# put into the server or location block
+access_by_lua_block {
+    require("mkrul").access()
+}
+`))
+
+var luaVars = map[uint8]string{mkruleval.CTX: "ctx", mkruleval.KEY: "key", mkruleval.VAL: "val", mkruleval.DEPTH: "depth"}
+var luaOps = map[uint8]string{mkruleval.EQ: "==", mkruleval.NEQ: "!="}
+var luaContexts = map[string]bool{"http": true, "path": true, "urlenc": true, "headers": true, "json": true, "json_obj": true, "json_array": true, "cookie": true, "jwt": true}
+
+func luaStr(val string) string {
+	var sb strings.Builder
+
+	sb.WriteByte('"')
+
+	for i := 0; i < len(val); i++ {
+		c := val[i]
+
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	sb.WriteByte('"')
+
+	return sb.String()
+}
+
+func luaTable(fields []string) string {
+	if len(fields) == 0 {
+		return "{}"
+	}
+
+	return "{ " + strings.Join(fields, ", ") + " }"
+}
+
+func luaWindow(win mkruleval.Window) string {
+	var fields []string
+
+	if win.From != 0 {
+		fields = append(fields, fmt.Sprintf("from = %d", win.From))
+	}
+
+	if win.To != 0 {
+		fields = append(fields, fmt.Sprintf("to = %d", win.To))
+	}
+
+	if len(win.Cron) != 0 {
+		fields = append(fields, "cron = "+luaStr(win.Cron))
+	}
+
+	if len(fields) == 0 {
+		return "nil"
+	}
+
+	return luaTable(fields)
+}
+
+func luaTransforms(tfs []uint8) (string, error) {
+	var names []string
+
+	if len(tfs) == 0 {
+		return "", nil
+	}
+
+	for _, tf := range tfs {
+		if tf == mkruleval.TF_HTML_DECODE {
+			return "", fmt.Errorf("unsupported transform: %s", mkruleval.TransformNames[tf])
+		}
+
+		names = append(names, luaStr(mkruleval.TransformNames[tf]))
+	}
+
+	return ", tf = " + luaTable(names), nil
+}
+
+func luaRule(rule mkruleval.SentinelRule) (string, error) {
+	var groups []string
+
+	act, ok := mkruleval.Action(rule.Groups)
+
+	if !ok {
+		return "", fmt.Errorf("no action")
+	}
+
+	if len(rule.Experiment) != 0 {
+		return "", fmt.Errorf("unsupported experiment: %s", rule.Experiment)
+	}
+
+	for _, stmts := range rule.Groups {
+		var conds []string
+
+		for _, stmt := range stmts {
+			if stmt.Var == 0 {
+				continue
+			}
+
+			if _, ok := luaVars[stmt.Var]; !ok {
+				return "", fmt.Errorf("unsupported variable: %s", mkruleval.VarNames[stmt.Var])
+			}
+
+			if stmt.Mods&mkruleval.MOD_NFKC != 0 {
+				return "", fmt.Errorf("unsupported normalization: nfkc")
+			}
+
+			if stmt.Mods&mkruleval.MOD_EXCEPT != 0 {
+				return "", fmt.Errorf("unsupported exception")
+			}
+
+			if stmt.Mods&mkruleval.MOD_CAPTURE != 0 {
+				return "", fmt.Errorf("unsupported capture")
+			}
+
+			if stmt.Detector != 0 {
+				return "", fmt.Errorf("unsupported detector")
+			}
+
+			if stmt.Mods&mkruleval.MOD_LUHN != 0 {
+				return "", fmt.Errorf("unsupported luhn validation")
+			}
+
+			if stmt.Op == mkruleval.ENTROPY {
+				return "", fmt.Errorf("unsupported entropy")
+			}
+
+			if mkrul.PredicateOp(stmt.Op) {
+				return "", fmt.Errorf("unsupported predicate: %s", mkrul.CondOp(stmt.Op))
+			}
+
+			if stmt.Op == mkruleval.EQ_VAR || stmt.Op == mkruleval.NEQ_VAR {
+				return "", fmt.Errorf("unsupported comparison to %s", mkruleval.VarNames[stmt.Ref.Var])
+			}
+
+			op, ok := luaOps[stmt.Op]
+
+			if !ok {
+				return "", fmt.Errorf("unsupported operator: %s", mkrul.CondOp(stmt.Op))
+			}
+
+			tfs, err := luaTransforms(stmt.Transforms)
+
+			if err != nil {
+				return "", err
+			}
+
+			if stmt.Var == mkruleval.CTX {
+				var ctxs []string
+
+				for _, c := range strings.Split(stmt.Val, "|") {
+					c = strings.TrimSpace(c)
+
+					if !luaContexts[c] {
+						return "", fmt.Errorf("unsupported context: %s", c)
+					}
+
+					ctxs = append(ctxs, c+" = true")
+				}
+
+				conds = append(conds, fmt.Sprintf("{ var = \"ctx\", op = \"%s\", ctx = { %s } }", op, strings.Join(ctxs, ", ")))
+			} else if len(stmt.Regexp) != 0 {
+				conds = append(conds, fmt.Sprintf("{ var = \"%s\", op = \"%s\", re = %s, flags = \"jo%s\"%s }", luaVars[stmt.Var], op, luaStr(mkruleval.RegexpBody(stmt.Regexp)), mkruleval.RegexpFlagNames(stmt.Flags), tfs))
+			} else if len(stmt.Bytes) != 0 {
+				conds = append(conds, fmt.Sprintf("{ var = \"%s\", op = \"%s\", val = %s, bytes = true%s }", luaVars[stmt.Var], op, luaStr(string(stmt.Bytes)), tfs))
+			} else {
+				conds = append(conds, fmt.Sprintf("{ var = \"%s\", op = \"%s\", val = %s%s }", luaVars[stmt.Var], op, luaStr(stmt.Val), tfs))
+			}
+		}
+
+		groups = append(groups, luaTable(conds))
+	}
+
+	expires := "nil"
+
+	if rule.Expires != 0 {
+		expires = strconv.FormatUint(rule.Expires, 10)
+	}
+
+	sample := "nil"
+
+	if rule.Sample != 0 {
+		sample = strconv.Itoa(int(rule.Sample))
+	}
+
+	return fmt.Sprintf("{ active = %s, expires = %s, sample = %s, action = { op = \"%s\", num = %d, val = %s }, groups = %s }",
+		luaWindow(rule.Window), expires, sample, mkruleval.ActionNames[act.Op], act.Num, luaStr(act.Val), luaTable(groups)), nil
+}
+
+// luaEndpoints renders the endpoints as a Lua table. The rules and policies
+// the module cannot enforce fail the export, unless partial is set: then
+// they are left out with a warning.
+func luaEndpoints(snts []mkruleval.Sentinel, partial bool) (string, error) {
+	var sb strings.Builder
+
+	sb.WriteString("{\n")
+
+	for _, snt := range snts {
+		var path []string
+		var policies []string
+
+		for _, val := range snt.Path {
+			seg := mkruleval.ParseSegment(val)
+
+			switch seg.Kind {
+			case mkruleval.SEG_ANY:
+				path = append(path, luaStr("*"))
+			case mkruleval.SEG_REGEXP:
+				path = append(path, "{ re = "+luaStr("^(?:"+seg.Pattern+")$")+" }")
+			default:
+				path = append(path, luaStr(val))
+			}
+		}
+
+		if len(snt.Charsets) != 0 {
+			policies = append(policies, "charsets")
+		}
+
+		if snt.Flags&mkruleval.FLAG_FORBID_CONTROL != 0 {
+			policies = append(policies, "control characters policy")
+		}
+
+		if snt.Schema != nil {
+			policies = append(policies, "schema")
+		}
+
+		if len(snt.RequiredHeaders) != 0 || len(snt.AllowedHeaders) != 0 {
+			policies = append(policies, "headers policy")
+		}
+
+		if snt.Cookies.Flags != 0 {
+			policies = append(policies, "cookie policy")
+		}
+
+		if snt.CORS.Flags != 0 {
+			policies = append(policies, "cors policy")
+		}
+
+		if len(snt.AllowedStatus) != 0 {
+			policies = append(policies, "allowed status policy")
+		}
+
+		if snt.Bots.Flags != 0 {
+			policies = append(policies, "bot policy")
+		}
+
+		if len(snt.Sequences) != 0 {
+			policies = append(policies, "sequences")
+		}
+
+		for _, policy := range policies {
+			if !partial {
+				return "", fmt.Errorf("%s: unsupported %s, use -partial to export without it", snt.Name(), policy)
+			}
+
+			slog.Warn(policy+" skipped", "endpoint", snt.Name())
+		}
+
+		fmt.Fprintf(&sb, "    {\n        method = %s,\n        ci = %t,\n        path = %s,\n        threshold = %d,\n        active = %s,\n        rules = {\n",
+			luaStr(snt.Method), snt.Flags&mkruleval.FLAG_CASE_INSENSITIVE != 0, luaTable(path), snt.BlockThreshold, luaWindow(snt.Window))
+
+		for i, rule := range snt.Rules {
+			text, err := luaRule(rule)
+
+			if err != nil {
+				if !partial {
+					return "", fmt.Errorf("%s rule %d: %w, use -partial to export without it", snt.Name(), i, err)
+				}
+
+				slog.Warn("rule skipped", "endpoint", snt.Name(), "rule", i, "error", err)
+				continue
+			}
+
+			fmt.Fprintf(&sb, "            %s,\n", text)
+		}
+
+		sb.WriteString("        },\n    },\n")
+	}
+
+	sb.WriteString("}")
+
+	return sb.String(), nil
+}
+
+func luaTemplates(tmpls []mkruleval.Template) string {
+	var sb strings.Builder
+
+	sb.WriteString("{\n")
+
+	for _, tmpl := range tmpls {
+		fmt.Fprintf(&sb, "    [%s] = { content_type = %s, body = %s },\n", luaStr(tmpl.Name), luaStr(tmpl.ContentType), luaStr(tmpl.Body))
+	}
+
+	sb.WriteString("}")
+
+	return sb.String()
+}
+
+func exportOpenresty(args []string) error {
+	var module bytes.Buffer
+	var conf bytes.Buffer
+
+	fs := flag.NewFlagSet("export openresty", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration")
+	out := fs.String("o", ".", "output directory")
+	partial := fs.Bool("partial", false, "leave out the rules and policies the module cannot enforce instead of failing")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	snts, tmpls, _, err := opts.Compile(*in)
+
+	if err != nil {
+		return err
+	}
+
+	dir, err := filepath.Abs(*out)
+
+	if err != nil {
+		return err
+	}
+
+	endpoints, err := luaEndpoints(snts, *partial)
+
+	if err != nil {
+		return err
+	}
+
+	err = openrestyModule.Execute(&module, map[string]string{"Endpoints": endpoints, "Templates": luaTemplates(tmpls)})
+
+	if err != nil {
+		return err
+	}
+
+	if err = openrestyConf.Execute(&conf, map[string]string{"Dir": dir}); err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, "mkrul.lua"), module.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, "mkrul.conf"), conf.Bytes(), 0644)
+}
+
+type ReportRule struct {
+	Rule        string
+	Description string
+	Owner       string
+	Severity    string
+	Action      string
+	Active      string
+}
+
+type ReportEndpoint struct {
+	Anchor          string
+	Method          string
+	Path            string
+	Threshold       uint64
+	Active          string
+	CaseInsensitive bool
+	Description     string
+	Owner           string
+	Rules           []ReportRule
+}
+
+var reportHTML = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>WAF rules</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+code { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>WAF rules</h1>
+<ul>
+{{- range .}}
+<li><a href="#{{.Anchor}}">{{.Method}} {{.Path}}</a> ({{len .Rules}} rules)</li>
+{{- end}}
+</ul>
+{{- range .}}
+<h2 id="{{.Anchor}}">{{.Method}} {{.Path}}</h2>
+<p>
+{{- if .Description}}{{.Description}}<br>{{end}}
+{{- if .Owner}}Owner: {{.Owner}}<br>{{end}}
+{{- if .Threshold}}Block threshold: {{.Threshold}}<br>{{end}}
+{{- if .Active}}Active: {{.Active}}<br>{{end}}
+{{- if .CaseInsensitive}}Case-insensitive<br>{{end}}
+</p>
+<table>
+<tr><th>#</th><th>Rule</th><th>Description</th><th>Owner</th><th>Severity</th><th>Action</th><th>Active</th></tr>
+{{- range $i, $r := .Rules}}
+<tr><td>{{$i}}</td><td><code>{{$r.Rule}}</code></td><td>{{$r.Description}}</td><td>{{$r.Owner}}</td><td>{{$r.Severity}}</td><td>{{$r.Action}}</td><td>{{$r.Active}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
+
+var reportMarkdown = template.Must(template.New("md").Funcs(template.FuncMap{"md": mdEscape}).Parse(`# WAF rules
+{{range .}}
+- [{{.Method}} {{.Path}}](#{{.Anchor}}) ({{len .Rules}} rules)
+{{- end}}
+{{range .}}
+<a id="{{.Anchor}}"></a>
+## {{md .Method}} {{md .Path}}
+{{if .Description}}
+{{md .Description}}  
+{{- end}}
+{{- if .Owner}}
+Owner: {{md .Owner}}  
+{{- end}}
+{{- if .Threshold}}
+Block threshold: {{.Threshold}}  
+{{- end}}
+{{- if .Active}}
+Active: {{md .Active}}  
+{{- end}}
+{{- if .CaseInsensitive}}
+Case-insensitive  
+{{- end}}
+
+| # | Rule | Description | Owner | Severity | Action | Active |
+|---|------|-------------|-------|----------|--------|--------|
+{{- range $i, $r := .Rules}}
+| {{$i}} | ` + "`{{md $r.Rule}}`" + ` | {{md $r.Description}} | {{md $r.Owner}} | {{md $r.Severity}} | {{md $r.Action}} | {{md $r.Active}} |
+{{- end}}
+{{end}}`))
+
+func mdEscape(val string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ", "`", "'").Replace(val)
+}
+
+func describeActive(active *mkrul.Active, expires string) string {
+	var parts []string
+
+	if active != nil {
+		if len(active.From) != 0 {
+			parts = append(parts, "from "+active.From)
+		}
+
+		if len(active.To) != 0 {
+			parts = append(parts, "to "+active.To)
+		}
+
+		if len(active.Cron) != 0 {
+			parts = append(parts, "cron "+active.Cron)
+		}
+	}
+
+	if len(expires) != 0 {
+		parts = append(parts, "expires "+expires)
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func describeAction(rule string) string {
+	groups, err := mkrul.ParseRule(rule)
+
+	if err != nil {
+		return ""
+	}
+
+	act, ok := mkruleval.Action(groups)
+
+	if !ok {
+		return ""
+	}
+
+	switch act.Op {
+	case mkruleval.SCORE:
+		return fmt.Sprintf("score %d", act.Num)
+	case mkruleval.REDIRECT:
+		return "redirect " + act.Val
+	case mkruleval.RESPOND:
+		return fmt.Sprintf("respond %d %s", act.Num, act.Val)
+	}
+
+	return mkrul.OpName(act.Op)
+}
+
+func makeReport(endpoints []mkrul.Endpoint) []ReportEndpoint {
+	var result []ReportEndpoint
+
+	for i, endpoint := range endpoints {
+		method := strings.ToUpper(endpoint.Method)
+
+		if len(method) == 0 {
+			method = "*"
+		}
+
+		item := ReportEndpoint{
+			Anchor:          fmt.Sprintf("endpoint-%d", i),
+			Method:          method,
+			Path:            endpoint.Path,
+			Threshold:       endpoint.BlockThreshold,
+			Active:          describeActive(endpoint.Active, ""),
+			CaseInsensitive: endpoint.CaseInsensitive,
+			Description:     endpoint.Description,
+			Owner:           endpoint.Owner,
+		}
+
+		for _, rule := range endpoint.Rules {
+			item.Rules = append(item.Rules, ReportRule{
+				Rule:        rule.Rule,
+				Description: rule.Description,
+				Owner:       rule.Owner,
+				Severity:    rule.Severity,
+				Action:      describeAction(rule.Rule),
+				Active:      describeActive(rule.Active, rule.Expires),
+			})
+
+			if rule.Enabled != nil && !*rule.Enabled {
+				item.Rules[len(item.Rules)-1].Active = "disabled"
+			}
+		}
+
+		result = append(result, item)
+	}
+
+	return result
+}
+
+func reportCmd(args []string) error {
+	var buf bytes.Buffer
+
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration")
+	out := fs.String("o", "rules.html", "report file, .md for markdown")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	cfg, err := opts.ReadConfig(*in)
+
+	if err != nil {
+		return err
+	}
+
+	if _, _, _, err = opts.Build(cfg); err != nil {
+		return err
+	}
+
+	tmpl, ok := reportFormats[strings.ToLower(filepath.Ext(*out))]
+
+	if !ok {
+		tmpl = reportHTML
+	}
+
+	if err = tmpl.Execute(&buf, makeReport(cfg.Endpoints)); err != nil {
+		return err
+	}
+
+	return os.WriteFile(*out, buf.Bytes(), 0644)
+}
+
+// migrateRule rewrites a rule written for the v2 schema, where quoted
+// strings took every backslash-escaped character literally and stray
+// colons were ignored, into the current syntax.
+func migrateRule(rule string) string {
+	var sb strings.Builder
+
+	empty := true
+
+	for i := 0; i < len(rule); i++ {
+		c := rule[i]
+
+		switch {
+		case c == ':':
+			if !empty {
+				sb.WriteByte(c)
+			}
+
+			empty = true
+			continue
+		case c == '\'' || c == '/':
+			sb.WriteByte(c)
+
+			for i++; i < len(rule) && rule[i] != c; i++ {
+				if rule[i] == '\\' && i+1 < len(rule) {
+					if c == '\'' && strings.IndexByte("ntr0xu", rule[i+1]) >= 0 {
+						i++
+					} else {
+						sb.WriteByte(rule[i])
+						i++
+					}
+				}
+
+				sb.WriteByte(rule[i])
+			}
+
+			if i < len(rule) {
+				sb.WriteByte(c)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+
+		if !unicode.IsSpace(rune(c)) {
+			empty = false
+		}
+	}
+
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(sb.String()), ":"))
+}
+
+func migrateRules(rules []interface{}, where string, manual *[]string) {
+	for i, val := range rules {
+		text, ok := val.(string)
+		obj, isObj := val.(map[string]interface{})
+
+		if isObj {
+			text, ok = obj["rule"].(string)
+		}
+
+		if !ok {
+			*manual = append(*manual, fmt.Sprintf("%s rule %d: not a rule", where, i))
+			continue
+		}
+
+		migrated := strings.TrimSpace(migrateRule(text))
+
+		if groups, err := mkrul.ParseRule(migrated); err != nil {
+			*manual = append(*manual, fmt.Sprintf("%s rule %q: %v", where, text, err))
+		} else if !mkrul.Terminated(groups) {
+			*manual = append(*manual, fmt.Sprintf("%s rule %q: no terminal action", where, text))
+		}
+
+		if migrated != text {
+			slog.Info("rule migrated", "endpoint", where, "from", text, "to", migrated)
+		}
+
+		if isObj {
+			obj["rule"] = migrated
+		} else {
+			rules[i] = migrated
+		}
+	}
+}
+
+// readDocument reads an endpoints file as generic JSON for the commands
+// that rewrite it, so fields unknown to this version are kept.
+func readDocument(path string) (interface{}, []interface{}, error) {
+	var doc interface{}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	if err = dec.Decode(&doc); err != nil {
+		return nil, nil, err
+	}
+
+	endpoints, ok := doc.([]interface{})
+
+	if obj, isObj := doc.(map[string]interface{}); isObj {
+		endpoints, ok = obj["endpoints"].([]interface{})
+	}
+
+	if !ok {
+		return nil, nil, fmt.Errorf("no endpoints in %s", path)
+	}
+
+	return doc, endpoints, nil
+}
+
+// writeDocument writes the document to the given file, stdout if empty.
+func writeDocument(path string, doc interface{}) error {
+	var buf bytes.Buffer
+
+	// the rules are written as they are, without escaping their < > &
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+
+	if len(path) == 0 {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+
+	return mkrul.WriteFileAtomic(path, buf.Bytes())
+}
+
+func migrateCmd(args []string) error {
+	var manual []string
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration in the old schema")
+	out := fs.String("o", "", "migrated configuration, stdout if empty")
+	from := fs.String("from", "v2", "schema version of the input: v1 or v2")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	if *from != "v1" && *from != "v2" {
+		return fmt.Errorf("unknown schema version: %s", *from)
+	}
+
+	doc, endpoints, err := readDocument(*in)
+
+	if err != nil {
+		return err
+	}
+
+	for i, val := range endpoints {
+		endpoint, _ := val.(map[string]interface{})
+		where := fmt.Sprintf("#%d %v %v", i, endpoint["method"], endpoint["path"])
+
+		if rules, ok := endpoint["rules"].([]interface{}); ok {
+			migrateRules(rules, where, &manual)
+		}
+	}
+
+	if err = writeDocument(*out, doc); err != nil {
+		return err
+	}
+
+	for _, val := range manual {
+		slog.Warn("manual migration required", "rule", val)
+	}
+
+	if len(manual) != 0 {
+		return fmt.Errorf("%d rules need manual migration", len(manual))
+	}
+
+	return nil
+}
+
+// jsonMember is a member of a json object, as offsets into its document:
+// the start of its key and the end of its value.
+type jsonMember struct {
+	key        string
+	start, end int
+	value      json.RawMessage
+}
+
+// ruleObjects returns the byte spans of the object rules of an endpoints
+// file and their members, so that a command can edit one rule and leave
+// the rest of the file as it is.
+func ruleObjects(data []byte) ([][]jsonMember, error) {
+	var result [][]jsonMember
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	// next is the offset of the value or key after the last token read
+	next := func() int {
+		off := int(dec.InputOffset())
+
+		for off < len(data) && strings.IndexByte(" \t\r\n,:", data[off]) >= 0 {
+			off++
+		}
+
+		return off
+	}
+
+	peek := func() byte {
+		if off := next(); off < len(data) {
+			return data[off]
+		}
+
+		return 0
+	}
+
+	delim := func(want json.Delim) error {
+		if tok, err := dec.Token(); err != nil {
+			return err
+		} else if tok != want {
+			return fmt.Errorf("offset %d: expected %s", dec.InputOffset(), want)
+		}
+
+		return nil
+	}
+
+	// object reads the members of an object, the rules of the
+	// endpoints when rules is set
+	var object func(rules bool) ([]jsonMember, error)
+
+	object = func(rules bool) ([]jsonMember, error) {
+		var members []jsonMember
+
+		if err := delim('{'); err != nil {
+			return nil, err
+		}
+
+		for dec.More() {
+			member := jsonMember{start: next()}
+			key, err := dec.Token()
+
+			if err != nil {
+				return nil, err
+			}
+
+			member.key, _ = key.(string)
+
+			if rules && member.key == "rules" && peek() == '[' {
+				if err = delim('['); err != nil {
+					return nil, err
+				}
+
+				for dec.More() {
+					if peek() != '{' {
+						var raw json.RawMessage
+
+						if err = dec.Decode(&raw); err != nil {
+							return nil, err
+						}
+
+						continue
+					}
+
+					rule, err := object(false)
+
+					if err != nil {
+						return nil, err
+					}
+
+					result = append(result, rule)
+				}
+
+				if err = delim(']'); err != nil {
+					return nil, err
+				}
+			} else if err = dec.Decode(&member.value); err != nil {
+				return nil, err
+			}
+
+			member.end = int(dec.InputOffset())
+			members = append(members, member)
+		}
+
+		return members, delim('}')
+	}
+
+	endpoints := func() error {
+		if err := delim('['); err != nil {
+			return err
+		}
+
+		for dec.More() {
+			if _, err := object(true); err != nil {
+				return err
+			}
+		}
+
+		return delim(']')
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return result, endpoints()
+	}
+
+	if err := delim('{'); err != nil {
+		return nil, err
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if key == "endpoints" {
+			err = endpoints()
+		} else {
+			var raw json.RawMessage
+			err = dec.Decode(&raw)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// toggleRule enables the rule of the given id if it is disabled and
+// disables it otherwise, editing only its object in the document. It
+// returns the new document and whether the rule is now enabled.
+func toggleRule(data []byte, id string) ([]byte, bool, error) {
+	var found [][]jsonMember
+
+	rules, err := ruleObjects(data)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, members := range rules {
+		for _, member := range members {
+			var val string
+
+			if member.key == "id" && json.Unmarshal(member.value, &val) == nil && val == id {
+				found = append(found, members)
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, false, fmt.Errorf("rule %s not found", id)
+	case 1:
+	default:
+		return nil, false, fmt.Errorf("rule %s is defined %d times", id, len(found))
+	}
+
+	members := found[0]
+	i := slices.IndexFunc(members, func(member jsonMember) bool { return member.key == "enabled" })
+
+	switch {
+	case i >= 0 && string(members[i].value) == "false":
+		// the member goes with the comma before it, or after it for
+		// the first one
+		start, end := members[i].start, members[i].end
+
+		if i > 0 {
+			start = members[i-1].end
+		} else if len(members) > 1 {
+			end = members[1].start
+		}
+
+		return slices.Concat(data[:start], data[end:]), true, nil
+	case i >= 0:
+		start := members[i].end - len(members[i].value)
+		return slices.Concat(data[:start], []byte("false"), data[members[i].end:]), false, nil
+	}
+
+	// the new member follows the last one on a line of its own if the
+	// members are on lines of their own, with the same indentation
+	last := members[len(members)-1]
+	sep := ", "
+
+	if line := bytes.LastIndexByte(data[:last.start], '\n'); line >= 0 && len(bytes.TrimSpace(data[line:last.start])) == 0 {
+		sep = ",\n" + string(data[line+1:last.start])
+	}
+
+	return slices.Concat(data[:last.end], []byte(sep+`"enabled": false`), data[last.end:]), false, nil
+}
+
+func toggleCmd(args []string) error {
+	fs := flag.NewFlagSet("toggle", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration, edited in place")
+	id := fs.String("rule-id", "", "id of the rule to enable or disable")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	if len(*id) == 0 {
+		return fmt.Errorf("usage: mkrul toggle [-i file] -rule-id id")
+	}
+
+	data, err := os.ReadFile(*in)
+
+	if err != nil {
+		return err
+	}
+
+	data, enabled, err := toggleRule(data, *id)
+
+	if err != nil {
+		return fmt.Errorf("%s: %v", *in, err)
+	}
+
+	if enabled {
+		slog.Info("rule enabled", "id", *id)
+	} else {
+		slog.Info("rule disabled", "id", *id)
+	}
+
+	return mkrul.WriteFileAtomic(*in, data)
+}
+
+func lintPriorities(endpoint mkrul.Endpoint) []string {
+	var result []string
+
+	for i, a := range endpoint.Rules {
+		for _, b := range endpoint.Rules[i+1:] {
+			if a.Priority == 0 || a.Priority != b.Priority {
+				continue
+			}
+
+			if describeAction(a.Rule) != describeAction(b.Rule) {
+				result = append(result, fmt.Sprintf("rules %q and %q have the same priority %d and different actions, file order decides", a.Rule, b.Rule, a.Priority))
+			}
+		}
+	}
+
+	return result
+}
+
+// bodyless methods never carry a request body the runtime would decode.
+var bodyless = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true, "CONNECT": true}
+
+func lintContexts(endpoint mkrul.Endpoint) []string {
+	var result []string
+	var dead uint64
+
+	// trailers follow a body too
+	if bodyless[strings.ToUpper(endpoint.Method)] {
+		dead |= 1<<mkruleval.JSON | 1<<mkruleval.JSON_OBJ | 1<<mkruleval.JSON_ARRAY | 1<<mkruleval.TRAILERS
+	}
+
+	if len(endpoint.ContentTypes) != 0 {
+		hasJSON := false
+
+		for _, val := range endpoint.ContentTypes {
+			hasJSON = hasJSON || strings.Contains(strings.ToLower(val), "json")
+		}
+
+		if !hasJSON {
+			dead |= 1<<mkruleval.JSON | 1<<mkruleval.JSON_OBJ | 1<<mkruleval.JSON_ARRAY
+		}
+	}
+
+	if dead == 0 {
+		return nil
+	}
+
+	for _, rule := range endpoint.Rules {
+		groups, err := mkrul.ParseRule(rule.Rule)
+
+		if err != nil || len(groups) == 0 {
+			continue
+		}
+
+		for _, stmt := range groups[0] {
+			if stmt.Var != mkruleval.CTX || stmt.Op != mkruleval.EQ {
+				continue
+			}
+
+			if mask, err := mkruleval.ContextMask(stmt.Val); err == nil && mask&^dead == 0 {
+				result = append(result, fmt.Sprintf("rule %q uses context %s which the endpoint never receives", rule.Rule, stmt.Val))
+			}
+		}
+	}
+
+	return result
+}
+
+// traversalRegexp finds hand-written path traversal patterns, which miss
+// the encodings $path_traversal canonicalizes.
+var traversalRegexp = regexp.MustCompile(`(?i)\\\.\\\.|%2e%2e|\.\.[/\\]`)
+
+func lintTraversal(endpoint mkrul.Endpoint) []string {
+	var result []string
+
+	for _, rule := range endpoint.Rules {
+		groups, err := mkrul.ParseRule(rule.Rule)
+
+		if err != nil {
+			continue
+		}
+
+		for _, stmts := range groups {
+			if slices.ContainsFunc(stmts, func(stmt mkruleval.Stmt) bool {
+				return len(stmt.Regexp) != 0 && traversalRegexp.MatchString(stmt.Regexp)
+			}) {
+				result = append(result, fmt.Sprintf("rule %q matches path traversal with a regexp, which is deprecated: use $path_traversal == true", rule.Rule))
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// lints are checks of valid configurations that likely do not do what
+// the author meant, each returns its findings for a single endpoint.
+var lints = []func(mkrul.Endpoint) []string{
+	lintPriorities,
+	lintContexts,
+	lintTraversal,
+}
+
+func lintCmd(args []string) error {
+	var count int
+
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	cfg, err := opts.ReadConfig(*in)
+
+	if err != nil {
+		return err
+	}
+
+	// the checks of the compile warn too, about conflicting rules or
+	// regexps
+	start := diagnostics.warnings()
+
+	if _, _, _, err = opts.Build(cfg); err != nil {
+		return err
+	}
+
+	count = diagnostics.warnings() - start
+
+	for _, endpoint := range mkrul.InheritRules(cfg.Endpoints) {
+		for _, lint := range lints {
+			for _, msg := range lint(endpoint) {
+				slog.Warn("lint", "method", endpoint.Method, "path", endpoint.Path, "warning", msg)
+				count++
+			}
+		}
+	}
+
+	slog.Info("lint finished", "warnings", count)
+
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func signS3(req *http.Request, payload []byte, region string) error {
+	access := os.Getenv("AWS_ACCESS_KEY_ID")
+	secret := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	token := os.Getenv("AWS_SESSION_TOKEN")
+
+	if len(access) == 0 || len(secret) == 0 {
+		return fmt.Errorf("s3: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+
+	now := time.Now().UTC()
+	stamp := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	hash := mkrul.SHA256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", hash)
+
+	headers := []string{"host:" + req.URL.Host, "x-amz-content-sha256:" + hash, "x-amz-date:" + stamp}
+	signed := "host;x-amz-content-sha256;x-amz-date"
+
+	if len(token) != 0 {
+		req.Header.Set("X-Amz-Security-Token", token)
+		headers = append(headers, "x-amz-security-token:"+token)
+		signed += ";x-amz-security-token"
+	}
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, strings.Join(headers, "\n") + "\n", signed, hash}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	digest := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + mkrul.SHA256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		access, scope, signed, hex.EncodeToString(hmacSHA256(key, digest))))
+
+	return nil
+}
+
+func publish(target string, data []byte) (string, error) {
+	var req *http.Request
+
+	target = strings.ReplaceAll(target, "{hash}", mkrul.SHA256Hex(data))
+
+	dst, err := url.Parse(target)
+
+	if err != nil {
+		return "", err
+	}
+
+	key := strings.TrimPrefix(dst.Path, "/")
+
+	switch dst.Scheme {
+	case "s3":
+		region := os.Getenv("AWS_REGION")
+
+		if len(region) == 0 {
+			region = "us-east-1"
+		}
+
+		endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", dst.Host, region, key)
+
+		if base := os.Getenv("AWS_ENDPOINT_URL"); len(base) != 0 {
+			endpoint = strings.TrimSuffix(base, "/") + "/" + dst.Host + "/" + key
+		}
+
+		if req, err = http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(data)); err != nil {
+			return "", err
+		}
+
+		if err = signS3(req, data, region); err != nil {
+			return "", err
+		}
+	case "gs":
+		token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+
+		if len(token) == 0 {
+			return "", fmt.Errorf("gs: GOOGLE_OAUTH_ACCESS_TOKEN is required")
+		}
+
+		endpoint := fmt.Sprintf("https://storage.googleapis.com/%s/%s", dst.Host, key)
+
+		if req, err = http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(data)); err != nil {
+			return "", err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "http", "https":
+		if req, err = http.NewRequest(http.MethodPut, target, bytes.NewReader(data)); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported publish scheme: %s", dst.Scheme)
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("publish %s: %s: %s", target, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return target, nil
+}
+
+// cacheKey hashes the format version, the compile flags and the input,
+// with its rules files and overlay for an endpoints file. The input path,
+// the outputs and the flags that do not affect them are left out, so the
+// same rules compiled from another checkout hit the cache too.
+func cacheKey(path string) (string, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	if mkrul.IsConfig(path, data) {
+		cfg, err := opts.EffectiveConfig(path, data)
+
+		if err != nil {
+			return "", err
+		}
+
+		if data, err = json.Marshal(cfg); err != nil {
+			return "", err
+		}
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", mkrul.VERSION)
+
+	flag.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "cache-dir", "i", "o", "overlay", "d", "debug-format", "log-level", "log-format", "quiet", "summary", "progress", "metrics", "publish":
+			return
+		}
+
+		fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value)
+	})
+
+	h.Write(data)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func cachePath(dir, key, output string) string {
+	ext := filepath.Ext(output)
+
+	if _, ok := outputFormats[ext]; !ok && !isReport(output) {
+		ext = ".bin"
+	}
+
+	return filepath.Join(dir, key+ext)
+}
+
+// restoreCache copies the cached outputs into place, it reports false
+// unless every output was found.
+func restoreCache(dir, key string, paths []string) bool {
+	var entries [][]byte
+
+	for _, path := range paths {
+		data, err := os.ReadFile(cachePath(dir, key, path))
+
+		if err != nil {
+			return false
+		}
+
+		entries = append(entries, data)
+	}
+
+	for i, path := range paths {
+		if err := mkrul.WriteFileAtomic(path, entries[i]); err != nil {
+			slog.Warn("cache restore failed", "target", path, "error", err)
+			return false
+		}
+	}
+
+	return true
+}
+
+func storeCache(dir, key string, paths []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			return err
+		}
+
+		if err = mkrul.WriteFileAtomic(cachePath(dir, key, path), data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func exportEnvoy(args []string) error {
+	var buf bytes.Buffer
+	var conf bytes.Buffer
+
+	fs := flag.NewFlagSet("export envoy", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration")
+	out := fs.String("o", ".", "output directory")
+	mode := fs.String("mode", "ext_proc", "filter type: ext_proc or wasm")
+	cluster := fs.String("cluster", "tantal_wf", "ext_proc grpc cluster name")
+	module := fs.String("wasm", "/etc/envoy/tantal_wf.wasm", "wasm filter module path")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	snts, tmpls, types, err := opts.Compile(*in)
+
+	if err != nil {
+		return err
+	}
+
+	if err = opts.EncodeSentinels(&buf, snts, tmpls, types); err != nil {
+		return err
+	}
+
+	switch *mode {
+	case "ext_proc":
+		err = envoyExtProc.Execute(&conf, map[string]string{"Cluster": *cluster})
+	case "wasm":
+		err = envoyWasm.Execute(&conf, map[string]string{"Module": *module, "Artifact": base64.StdEncoding.EncodeToString(buf.Bytes())})
+	default:
+		return fmt.Errorf("unknown envoy mode: %s", *mode)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(filepath.Join(*out, "sentinels.bin"), buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(*out, "envoy.yaml"), conf.Bytes(), 0644)
+}
+
+// ruleString renders a compiled rule in the rule syntax, its exclusion
+// statements follow the first group after except.
+func ruleString(rule mkruleval.SentinelRule) string {
+	var groups []string
+
+	for _, stmts := range rule.Groups {
+		var conds, except []string
+
+		for _, stmt := range stmts {
+			if stmt.Mods&mkruleval.MOD_EXCEPT != 0 {
+				except = append(except, mkrul.StmtString(stmt))
+			} else {
+				conds = append(conds, mkrul.StmtString(stmt))
+			}
+		}
+
+		if len(except) != 0 {
+			conds = append(conds, "except", strings.Join(except, " "))
+		}
+
+		groups = append(groups, strings.Join(conds, " "))
+	}
+
+	return strings.Join(groups, " : ")
+}
+
+// modNames names the statement modifiers in the debug output.
+var modNames = map[uint8]string{
+	mkruleval.MOD_NFKC:    "nfkc",
+	mkruleval.MOD_EXCEPT:  "except",
+	mkruleval.MOD_CAPTURE: "capture",
+	mkruleval.MOD_LUHN:    "luhn",
+}
+
+func stmtMods(stmt mkruleval.Stmt) []string {
+	var mods []string
+
+	for _, mod := range []uint8{mkruleval.MOD_NFKC, mkruleval.MOD_EXCEPT, mkruleval.MOD_LUHN} {
+		if stmt.Mods&mod != 0 {
+			mods = append(mods, modNames[mod])
+		}
+	}
+
+	return mods
+}
+
+// treeNode writes a line of the tree with the branch of the last or any
+// other child.
+func treeNode(w io.Writer, prefix string, last bool, text string) string {
+	if last {
+		fmt.Fprintf(w, "%s└── %s\n", prefix, text)
+		return prefix + "    "
+	}
+
+	fmt.Fprintf(w, "%s├── %s\n", prefix, text)
+
+	return prefix + "│   "
+}
+
+// printTree writes the compiled rules as a tree of endpoints, rules,
+// groups and statements.
+func printTree(w io.Writer, snts []mkruleval.Sentinel) {
+	for _, snt := range snts {
+		var settings []string
+
+		if snt.BlockThreshold != 0 {
+			settings = append(settings, fmt.Sprintf("threshold %d", snt.BlockThreshold))
+		}
+
+		if snt.Flags&mkruleval.FLAG_CASE_INSENSITIVE != 0 {
+			settings = append(settings, "case insensitive")
+		}
+
+		if len(snt.Charsets) != 0 {
+			settings = append(settings, "charsets "+strings.Join(snt.Charsets, " "))
+		}
+
+		if snt.Flags&mkruleval.FLAG_FORBID_CONTROL != 0 {
+			settings = append(settings, "forbid control chars")
+		}
+
+		if snt.Schema != nil {
+			settings = append(settings, "schema")
+		}
+
+		if len(snt.RequiredHeaders) != 0 {
+			settings = append(settings, "required headers "+strings.Join(snt.RequiredHeaders, " "))
+		}
+
+		if len(snt.AllowedHeaders) != 0 {
+			settings = append(settings, "allowed headers "+strings.Join(snt.AllowedHeaders, " "))
+		}
+
+		if len(snt.AllowedStatus) != 0 {
+			settings = append(settings, "allowed status "+strings.Trim(fmt.Sprint(snt.AllowedStatus), "[]"))
+		}
+
+		if snt.Cookies.Flags != 0 {
+			settings = append(settings, "cookie policy "+strings.Join(cookieAttrNames(snt.Cookies), " "))
+		}
+
+		if snt.CORS.Flags != 0 {
+			settings = append(settings, "cors "+strings.Join(snt.CORS.Origins, " "))
+		}
+
+		if snt.Bots.Flags != 0 {
+			settings = append(settings, "bot policy "+strings.Join(botPolicyNames(snt.Bots), " "))
+		}
+
+		for _, seq := range snt.Sequences {
+			settings = append(settings, "sequence "+sequenceString(seq))
+		}
+
+		name := snt.Name()
+
+		if len(settings) != 0 {
+			name += " (" + strings.Join(settings, ", ") + ")"
+		}
+
+		fmt.Fprintln(w, name)
+
+		for i, rule := range snt.Rules {
+			label := fmt.Sprintf("rule %d", i)
+
+			if rule.Expires != 0 {
+				label += " (expires " + time.Unix(int64(rule.Expires), 0).UTC().Format(time.RFC3339) + ")"
+			}
+
+			if rule.Sample != 0 {
+				label += fmt.Sprintf(" (sample %g%%)", float64(rule.Sample)*100/mkruleval.SAMPLE_SCALE)
+			}
+
+			if len(rule.Experiment) != 0 {
+				label += fmt.Sprintf(" (experiment %s variant %d/%d)", rule.Experiment, rule.Variant, rule.Variants)
+			}
+
+			prefix := treeNode(w, "", i == len(snt.Rules)-1, label)
+
+			for j, stmts := range rule.Groups {
+				sub := treeNode(w, prefix, j == len(rule.Groups)-1, fmt.Sprintf("group %d", j))
+
+				for k, stmt := range stmts {
+					text := mkrul.StmtString(stmt)
+
+					if mods := stmtMods(stmt); len(mods) != 0 {
+						text += " [" + strings.Join(mods, ", ") + "]"
+					}
+
+					treeNode(w, sub, k == len(stmts)-1, text)
+				}
+			}
+		}
+	}
+}
+
+// botPolicyNames renders a bot policy as in the .mkr format.
+func botPolicyNames(bots mkruleval.BotChecks) []string {
+	var result []string
+
+	if bots.Flags&mkruleval.BOT_BROWSER_HEADERS != 0 {
+		result = append(result, "require_browser_headers")
+	}
+
+	if bots.Flags&mkruleval.BOT_AUTOMATION != 0 {
+		result = append(result, "deny_automation")
+	}
+
+	if len(bots.Allow) != 0 {
+		result = append(result, "allow="+strings.Join(bots.Allow, ","))
+	}
+
+	if len(bots.Deny) != 0 {
+		result = append(result, "deny="+strings.Join(bots.Deny, ","))
+	}
+
+	if bots.Flags&mkruleval.BOT_FLAG != 0 {
+		result = append(result, "action=flag")
+	}
+
+	return result
+}
+
+// sequenceString renders a sequence as in the .mkr format, with the
+// window in seconds.
+func sequenceString(seq mkruleval.SequenceRule) string {
+	key := "ip"
+
+	if seq.Key.Var != 0 {
+		key = mkruleval.VarNames[seq.Key.Var]
+
+		if mkrul.ArgVars[seq.Key.Var] {
+			key += "(" + mkrul.QuoteLiteral(seq.Key.Arg) + ")"
+		}
+	}
+
+	result := fmt.Sprintf("%s %d %ds", key, seq.Count, seq.Window)
+
+	if len(seq.Status) != 0 {
+		var codes []string
+
+		for _, code := range seq.Status {
+			codes = append(codes, strconv.Itoa(int(code)))
+		}
+
+		result += " status=" + strings.Join(codes, ",")
+	}
+
+	return result + " " + ruleString(mkruleval.SentinelRule{Groups: seq.Groups})
+}
+
+func cookieAttrNames(attrs mkruleval.CookieAttrs) []string {
+	var result []string
+
+	if attrs.Flags&mkruleval.COOKIE_SECURE != 0 {
+		result = append(result, "secure")
+	}
+
+	if attrs.Flags&mkruleval.COOKIE_HTTP_ONLY != 0 {
+		result = append(result, "http_only")
+	}
+
+	if attrs.Flags&mkruleval.COOKIE_SAME_SITE != 0 {
+		result = append(result, "same_site="+attrs.SameSite)
+	}
+
+	if attrs.Flags&mkruleval.COOKIE_FLAG != 0 {
+		result = append(result, "action=flag")
+	}
+
+	return result
+}
+
+type DebugStmt struct {
+	Stmt string   `json:"stmt"`
+	Var  string   `json:"var,omitempty"`
+	Op   string   `json:"op"`
+	Mods []string `json:"mods,omitempty"`
+}
+
+type DebugRule struct {
+	Rule    string        `json:"rule"`
+	Expires uint64        `json:"expires,omitempty"`
+	Sample  uint16        `json:"sample,omitempty"`
+	Groups  [][]DebugStmt `json:"groups"`
+
+	Experiment string `json:"experiment,omitempty"`
+	Variant    uint8  `json:"variant,omitempty"`
+}
+
+type DebugEndpoint struct {
+	Endpoint  string                `json:"endpoint"`
+	Threshold uint64                `json:"threshold,omitempty"`
+	Flags     uint8                 `json:"flags,omitempty"`
+	Charsets  []string              `json:"charsets,omitempty"`
+	Schema    *mkruleval.SchemaNode `json:"schema,omitempty"`
+	Required  []string              `json:"required_headers,omitempty"`
+	Allowed   []string              `json:"allowed_headers,omitempty"`
+	Status    []uint16              `json:"allowed_status,omitempty"`
+	Cookies   []string              `json:"cookie_policy,omitempty"`
+	CORS      *mkrul.CORS           `json:"cors,omitempty"`
+	Bots      []string              `json:"bot_policy,omitempty"`
+	Sequences []string              `json:"sequences,omitempty"`
+	Rules     []DebugRule           `json:"rules"`
+}
+
+func debugEndpoints(snts []mkruleval.Sentinel) []DebugEndpoint {
+	var result []DebugEndpoint
+
+	for _, snt := range snts {
+		endpoint := DebugEndpoint{Endpoint: snt.Name(), Threshold: snt.BlockThreshold, Flags: snt.Flags, Charsets: snt.Charsets, Schema: snt.Schema, Required: snt.RequiredHeaders, Allowed: snt.AllowedHeaders, Status: snt.AllowedStatus, Cookies: cookieAttrNames(snt.Cookies)}
+
+		if snt.CORS.Flags != 0 {
+			endpoint.CORS = &mkrul.CORS{Origins: snt.CORS.Origins, Methods: snt.CORS.Methods, Headers: snt.CORS.Headers, Credentials: snt.CORS.Flags&mkruleval.CORS_CREDENTIALS != 0}
+		}
+
+		if snt.Bots.Flags != 0 {
+			endpoint.Bots = botPolicyNames(snt.Bots)
+		}
+
+		for _, seq := range snt.Sequences {
+			endpoint.Sequences = append(endpoint.Sequences, sequenceString(seq))
+		}
+
+		for _, rule := range snt.Rules {
+			dr := DebugRule{Rule: ruleString(rule), Expires: rule.Expires, Sample: rule.Sample, Experiment: rule.Experiment, Variant: rule.Variant}
+
+			for _, stmts := range rule.Groups {
+				var group []DebugStmt
+
+				for _, stmt := range stmts {
+					group = append(group, DebugStmt{Stmt: mkrul.StmtString(stmt), Var: mkruleval.VarNames[stmt.Var], Op: mkrul.CondOp(stmt.Op), Mods: stmtMods(stmt)})
+				}
+
+				dr.Groups = append(dr.Groups, group)
+			}
+
+			endpoint.Rules = append(endpoint.Rules, dr)
+		}
+
+		result = append(result, endpoint)
+	}
+
+	return result
+}
+
+// writeDebug writes the compiled rules in the debug format.
+func writeDebug(w io.Writer, snts []mkruleval.Sentinel) error {
+	if *debugFormat == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(debugEndpoints(snts))
+	}
+
+	printTree(w, snts)
+
+	return nil
+}
+
+type OpenAPIRule struct {
+	Rule        string `json:"rule"`
+	Action      string `json:"action,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type OpenAPIPolicy struct {
+	Endpoint       string        `json:"endpoint"`
+	BlockThreshold uint64        `json:"block_threshold,omitempty"`
+	Owner          string        `json:"owner,omitempty"`
+	Description    string        `json:"description,omitempty"`
+	Rules          []OpenAPIRule `json:"rules"`
+}
+
+var openapiMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// specPathMatch matches a sentinel path against an OpenAPI path template
+// the way the runtime matches request paths; template parameters match
+// any sentinel segment. It returns the number of matched segments.
+func specPathMatch(pattern []string, path string, fold bool) (int, bool) {
+	var segs []string
+
+	for _, val := range strings.Split(path, "/") {
+		if len(val) != 0 {
+			segs = append(segs, val)
+		}
+	}
+
+	if len(pattern) > len(segs) {
+		return 0, false
+	}
+
+	for i, val := range pattern {
+		if strings.HasPrefix(segs[i], "{") && strings.HasSuffix(segs[i], "}") {
+			continue
+		}
+
+		switch seg := mkruleval.ParseSegment(val); seg.Kind {
+		case mkruleval.SEG_LITERAL:
+			if val != segs[i] && !(fold && strings.EqualFold(val, segs[i])) {
+				return 0, false
+			}
+		case mkruleval.SEG_REGEXP:
+			if re, err := regexp.Compile("^(?:" + seg.Pattern + ")$"); err != nil || !re.MatchString(segs[i]) {
+				return 0, false
+			}
+		}
+	}
+
+	return len(pattern), true
+}
+
+func openapiPolicy(snts []mkruleval.Sentinel, method string, path string) *OpenAPIPolicy {
+	found, best := -1, -1
+
+	for i, snt := range snts {
+		fold := snt.Flags&mkruleval.FLAG_CASE_INSENSITIVE != 0
+
+		if len(snt.Method) != 0 && snt.Method != "*" && !strings.EqualFold(snt.Method, method) {
+			continue
+		}
+
+		if n, ok := specPathMatch(snt.Path, path, fold); ok && n > best {
+			found, best = i, n
+		}
+	}
+
+	if found < 0 {
+		return nil
+	}
+
+	snt := snts[found]
+	policy := &OpenAPIPolicy{Endpoint: snt.Name(), BlockThreshold: snt.BlockThreshold, Owner: snt.Meta.Owner, Description: snt.Meta.Description, Rules: []OpenAPIRule{}}
+
+	for _, rule := range snt.Rules {
+		item := OpenAPIRule{Rule: ruleString(rule), Owner: rule.Meta.Owner, Description: rule.Meta.Description}
+
+		if act, ok := mkruleval.Action(rule.Groups); ok {
+			item.Action = mkrul.OpName(act.Op)
+		}
+
+		policy.Rules = append(policy.Rules, item)
+	}
+
+	return policy
+}
+
+func exportOpenAPI(args []string) error {
+	var doc map[string]interface{}
+
+	fs := flag.NewFlagSet("export openapi", flag.ExitOnError)
+	in := fs.String("i", "endpoints.json", "endpoints configuration")
+	spec := fs.String("spec", "", "OpenAPI specification in JSON")
+	out := fs.String("o", "", "output file, stdout if empty")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	if len(*spec) == 0 {
+		return fmt.Errorf("usage: mkrul export openapi [-i file] -spec api.json [-o file]")
+	}
+
+	data, err := os.ReadFile(*spec)
+
+	if err != nil {
+		return err
+	}
+
+	if !mkrul.IsJSON(data) {
+		return fmt.Errorf("%s: only JSON specifications are supported, convert YAML ones first", *spec)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	if err = dec.Decode(&doc); err != nil {
+		return &mkrul.CompileError{Code: mkrul.EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %v", *spec, err)}
+	}
+
+	paths, ok := doc["paths"].(map[string]interface{})
+
+	if !ok {
+		return fmt.Errorf("%s: no paths", *spec)
+	}
+
+	snts, _, _, err := opts.Compile(*in)
+
+	if err != nil {
+		return err
+	}
+
+	annotated := 0
+
+	for path, val := range paths {
+		item, _ := val.(map[string]interface{})
+
+		for _, method := range openapiMethods {
+			op, ok := item[method].(map[string]interface{})
+
+			if !ok {
+				continue
+			}
+
+			delete(op, "x-waf-rules")
+
+			if policy := openapiPolicy(snts, method, path); policy != nil {
+				op["x-waf-rules"] = policy
+				annotated++
+			}
+		}
+	}
+
+	slog.Info("operations annotated", "count", annotated)
+
+	if data, err = json.MarshalIndent(doc, "", "  "); err != nil {
+		return err
+	}
+
+	if len(*out) == 0 {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+
+	return mkrul.WriteFileAtomic(*out, append(data, '\n'))
+}
+
+func export(args []string) error {
+	if len(args) == 0 {
+		return mkrul.UsageError(fmt.Errorf("usage: mkrul export envoy|openresty|openapi [flags]"))
+	}
+
+	switch args[0] {
+	case "-h", "-help", "--help":
+		targetUsage("export")
+		return nil
+	case "envoy":
+		return exportEnvoy(args[1:])
+	case "openresty":
+		return exportOpenresty(args[1:])
+	case "openapi":
+		return exportOpenAPI(args[1:])
+	}
+
+	return mkrul.UsageError(fmt.Errorf("unknown export target: %s", args[0]))
+}
+
+// ImportedEndpoint is an endpoint created by import openapi, with only
+// the fields an operation gives.
+type ImportedEndpoint struct {
+	Path           string        `json:"path"`
+	Method         string        `json:"method"`
+	Rules          []interface{} `json:"rules"`
+	BlockThreshold uint64        `json:"block_threshold,omitempty"`
+	ContentTypes   []string      `json:"content_types,omitempty"`
+	Description    string        `json:"description,omitempty"`
+	Owner          string        `json:"owner,omitempty"`
+}
+
+// openapiParamTypes maps the schema types and formats of path parameters
+// to the typed segments matching them.
+var openapiParamTypes = map[string]string{"integer": "int", "uuid": "uuid"}
+
+// specPath turns an OpenAPI path template into an endpoint path, typing
+// the parameters whose schema has a matching segment type.
+func specPath(path string, params []interface{}) string {
+	types := map[string]string{}
+
+	for _, val := range params {
+		param, _ := val.(map[string]interface{})
+		schema, _ := param["schema"].(map[string]interface{})
+		name, _ := param["name"].(string)
+
+		if param["in"] != "path" || schema == nil {
+			continue
+		}
+
+		for _, key := range []string{"type", "format"} {
+			if typ, ok := openapiParamTypes[fmt.Sprint(schema[key])]; ok {
+				types[name] = typ
+			}
+		}
+	}
+
+	segs := strings.Split(path, "/")
+
+	for i, seg := range segs {
+		if !strings.HasPrefix(seg, "{") || !strings.HasSuffix(seg, "}") {
+			continue
+		}
+
+		if typ, ok := types[seg[1:len(seg)-1]]; ok {
+			segs[i] = seg[:len(seg)-1] + ":" + typ + "}"
+		}
+	}
+
+	return strings.Join(segs, "/")
+}
+
+// importOperation makes the endpoint of an operation, with the policy of
+// its x-waf-rules annotation if it has one.
+func importOperation(path string, method string, op map[string]interface{}) (ImportedEndpoint, error) {
+	var policy OpenAPIPolicy
+
+	endpoint := ImportedEndpoint{Path: path, Method: strings.ToUpper(method), Rules: []interface{}{}}
+	endpoint.Description, _ = op["summary"].(string)
+
+	if body, ok := op["requestBody"].(map[string]interface{}); ok {
+		content, _ := body["content"].(map[string]interface{})
+		endpoint.ContentTypes = slices.Sorted(maps.Keys(content))
+	}
+
+	val, ok := op["x-waf-rules"]
+
+	if !ok {
+		return endpoint, nil
+	}
+
+	data, err := json.Marshal(val)
+
+	if err != nil {
+		return endpoint, err
+	}
+
+	if err = json.Unmarshal(data, &policy); err != nil {
+		return endpoint, fmt.Errorf("%s %s: x-waf-rules: %v", endpoint.Method, path, err)
+	}
+
+	endpoint.BlockThreshold = policy.BlockThreshold
+	endpoint.Owner = policy.Owner
+
+	if len(policy.Description) != 0 {
+		endpoint.Description = policy.Description
+	}
+
+	for _, rule := range policy.Rules {
+		if len(rule.Owner) == 0 && len(rule.Description) == 0 {
+			endpoint.Rules = append(endpoint.Rules, rule.Rule)
+		} else {
+			endpoint.Rules = append(endpoint.Rules, mkrul.Rule{Rule: rule.Rule, Owner: rule.Owner, Description: rule.Description})
+		}
+	}
+
+	return endpoint, nil
+}
+
+func importOpenAPI(args []string) error {
+	var doc map[string]interface{}
+	var endpoints []ImportedEndpoint
+
+	fs := flag.NewFlagSet("import openapi", flag.ExitOnError)
+	spec := fs.String("spec", "", "OpenAPI specification in JSON")
+	out := fs.String("o", "", "output file, stdout if empty")
+
+	if _, err := parseCommand(fs, args); err != nil {
+		return err
+	}
+
+	if len(*spec) == 0 {
+		return mkrul.UsageError(fmt.Errorf("usage: mkrul import openapi -spec api.json [-o file]"))
+	}
+
+	data, err := os.ReadFile(*spec)
+
+	if err != nil {
+		return err
+	}
+
+	if !mkrul.IsJSON(data) {
+		return fmt.Errorf("%s: only JSON specifications are supported, convert YAML ones first", *spec)
+	}
+
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return &mkrul.CompileError{Code: mkrul.EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %v", *spec, err)}
+	}
+
+	paths, ok := doc["paths"].(map[string]interface{})
+
+	if !ok {
+		return fmt.Errorf("%s: no paths", *spec)
+	}
+
+	for _, path := range slices.Sorted(maps.Keys(paths)) {
+		item, _ := paths[path].(map[string]interface{})
+		common, _ := item["parameters"].([]interface{})
+
+		for _, method := range openapiMethods {
+			op, ok := item[method].(map[string]interface{})
+
+			if !ok {
+				continue
+			}
+
+			params, _ := op["parameters"].([]interface{})
+			endpoint, err := importOperation(specPath(path, append(slices.Clone(common), params...)), method, op)
+
+			if err != nil {
+				return &mkrul.CompileError{Code: mkrul.EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %v", *spec, err)}
+			}
+
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	slog.Info("operations imported", "count", len(endpoints))
+
+	if data, err = json.MarshalIndent(endpoints, "", "  "); err != nil {
+		return err
+	}
+
+	if len(*out) == 0 {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+
+	return mkrul.WriteFileAtomic(*out, append(data, '\n'))
+}
+
+func importCmd(args []string) error {
+	if len(args) == 0 {
+		return mkrul.UsageError(fmt.Errorf("usage: mkrul import openapi [flags]"))
+	}
+
+	switch args[0] {
+	case "-h", "-help", "--help":
+		targetUsage("import")
+		return nil
+	case "openapi":
+		return importOpenAPI(args[1:])
+	}
+
+	return mkrul.UsageError(fmt.Errorf("unknown import source: %s", args[0]))
+}
+
+type KV struct {
+	Key   string
+	Value []byte
+}
+
+func kvRequest(method string, endpoint string, body []byte) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); len(token) != 0 {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, resp.Header, nil
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, nil, fmt.Errorf("%s %s: %s", method, endpoint, resp.Status)
+	}
+
+	return data, resp.Header, nil
+}
+
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+
+	return "\x00"
+}
+
+func fetchKV(src *url.URL, index uint64) ([]KV, uint64, error) {
+	var result []KV
+
+	prefix := strings.TrimPrefix(src.Path, "/")
+
+	switch src.Scheme {
+	case "consul":
+		var list []struct {
+			Key   string
+			Value []byte
+		}
+
+		endpoint := fmt.Sprintf("http://%s/v1/kv/%s?recurse=true&index=%d&wait=5m", src.Host, prefix, index)
+		data, header, err := kvRequest(http.MethodGet, endpoint, nil)
+
+		if err != nil {
+			return nil, index, err
+		}
+
+		if data != nil {
+			if err = json.Unmarshal(data, &list); err != nil {
+				return nil, index, err
+			}
+		}
+
+		for _, kv := range list {
+			result = append(result, KV{kv.Key, kv.Value})
+		}
+
+		next, _ := strconv.ParseUint(header.Get("X-Consul-Index"), 10, 64)
+
+		return result, next, nil
+	case "etcd":
+		var resp struct {
+			Header struct {
+				Revision string `json:"revision"`
+			} `json:"header"`
+			Kvs []struct {
+				Key   []byte `json:"key"`
+				Value []byte `json:"value"`
+			} `json:"kvs"`
+		}
+
+		if index != 0 {
+			time.Sleep(*watchInterval)
+		}
+
+		body, _ := json.Marshal(map[string][]byte{"key": []byte(prefix), "range_end": []byte(prefixEnd(prefix))})
+		data, _, err := kvRequest(http.MethodPost, fmt.Sprintf("http://%s/v3/kv/range", src.Host), body)
+
+		if err != nil {
+			return nil, index, err
+		}
+
+		if err = json.Unmarshal(data, &resp); err != nil {
+			return nil, index, err
+		}
+
+		for _, kv := range resp.Kvs {
+			result = append(result, KV{string(kv.Key), kv.Value})
+		}
+
+		next, _ := strconv.ParseUint(resp.Header.Revision, 10, 64)
+
+		return result, next, nil
+	}
+
+	return nil, index, fmt.Errorf("unsupported watch scheme: %s", src.Scheme)
+}
+
+func storeKV(dst *url.URL, data []byte) error {
+	key := strings.TrimPrefix(dst.Path, "/")
+
+	switch dst.Scheme {
+	case "consul":
+		_, _, err := kvRequest(http.MethodPut, fmt.Sprintf("http://%s/v1/kv/%s", dst.Host, key), data)
+		return err
+	case "etcd":
+		body, _ := json.Marshal(map[string][]byte{"key": []byte(key), "value": data})
+		_, _, err := kvRequest(http.MethodPost, fmt.Sprintf("http://%s/v3/kv/put", dst.Host), body)
+		return err
+	}
+
+	return fmt.Errorf("unsupported store scheme: %s", dst.Scheme)
+}
+
+// BUILD_TYPE identifies the compiles of mkrul in provenance statements.
+const BUILD_TYPE = "https://github.com/tantalsec/Mkrul/attestation/compile/v1"
+
+// Statement is an in-toto statement about artifacts, here with a SLSA
+// provenance predicate.
+type Statement struct {
+	Type          string     `json:"_type"`
+	Subject       []Resource `json:"subject"`
+	PredicateType string     `json:"predicateType"`
+	Predicate     Provenance `json:"predicate"`
+}
+
+type Resource struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type Provenance struct {
+	BuildDefinition struct {
+		BuildType            string         `json:"buildType"`
+		ExternalParameters   map[string]any `json:"externalParameters"`
+		ResolvedDependencies []Resource     `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn  string `json:"startedOn"`
+			FinishedOn string `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// toolVersion is the module version and the commit mkrul was built from,
+// when the build recorded them.
+func toolVersion() string {
+	info, ok := runtimedebug.ReadBuildInfo()
+
+	if !ok {
+		return "unknown"
+	}
+
+	version := info.Main.Version
+
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			version += " " + setting.Value
+		}
+	}
+
+	return version
+}
+
+// attest writes the provenance of the binary output next to it, in
+// path.intoto.json.
+func attest(path string, start time.Time) error {
+	var stmt Statement
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	builder := *builderID
+
+	if len(builder) == 0 {
+		if builder, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	stmt.Type = "https://in-toto.io/Statement/v1"
+	stmt.PredicateType = "https://slsa.dev/provenance/v1"
+	stmt.Subject = []Resource{{Name: filepath.Base(path), Digest: map[string]string{"sha256": hex.EncodeToString(sum[:])}}}
+
+	build := &stmt.Predicate.BuildDefinition
+	build.BuildType = BUILD_TYPE
+	build.ExternalParameters = map[string]any{"input": *input, "args": os.Args[1:]}
+
+	for _, name := range slices.Sorted(maps.Keys(opts.Inputs)) {
+		build.ResolvedDependencies = append(build.ResolvedDependencies, Resource{Name: name, Digest: map[string]string{"sha256": opts.Inputs[name]}})
+	}
+
+	run := &stmt.Predicate.RunDetails
+	run.Builder.ID = builder
+	run.Builder.Version = map[string]string{"mkrul": toolVersion(), "format": strconv.Itoa(mkrul.VERSION)}
+	run.Metadata.StartedOn = start.UTC().Format(time.RFC3339)
+	run.Metadata.FinishedOn = time.Now().UTC().Format(time.RFC3339)
+
+	out, err := json.MarshalIndent(stmt, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return mkrul.WriteFileAtomic(path+".intoto.json", append(out, '\n'))
+}
+
+// verifyAttestation checks that a provenance statement is about the
+// artifact and that the inputs it lists, where they are still present,
+// have not changed since.
+func verifyAttestation(args []string) error {
+	var stmt Statement
+
+	fs := flag.NewFlagSet("verify-attestation", flag.ExitOnError)
+	statement := fs.String("attestation", "", "provenance statement (default: the artifact path with .intoto.json)")
+
+	files, err := parseCommand(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) != 1 {
+		return mkrul.UsageError(fmt.Errorf("usage: mkrul verify-attestation [-attestation file] artifact"))
+	}
+
+	if len(*statement) == 0 {
+		*statement = files[0] + ".intoto.json"
+	}
+
+	data, err := os.ReadFile(*statement)
+
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(data, &stmt); err != nil {
+		return fmt.Errorf("%s: %v", *statement, err)
+	}
+
+	if stmt.Type != "https://in-toto.io/Statement/v1" || stmt.PredicateType != "https://slsa.dev/provenance/v1" || stmt.Predicate.BuildDefinition.BuildType != BUILD_TYPE {
+		return fmt.Errorf("%s: not a provenance statement of mkrul", *statement)
+	}
+
+	if data, err = os.ReadFile(files[0]); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+
+	if !slices.ContainsFunc(stmt.Subject, func(res Resource) bool { return res.Digest["sha256"] == hex.EncodeToString(sum[:]) }) {
+		return fmt.Errorf("%s: the statement is not about this artifact", files[0])
+	}
+
+	for _, dep := range stmt.Predicate.BuildDefinition.ResolvedDependencies {
+		data, err := os.ReadFile(dep.Name)
+
+		if errors.Is(err, os.ErrNotExist) {
+			slog.Warn("input not found", "input", dep.Name)
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != dep.Digest["sha256"] {
+			return fmt.Errorf("input %s changed since the build", dep.Name)
+		}
+	}
+
+	slog.Info("attestation verified", "artifact", files[0], "builder", stmt.Predicate.RunDetails.Builder.ID, "inputs", len(stmt.Predicate.BuildDefinition.ResolvedDependencies))
+
+	return nil
+}
+
+func recompile(kvs []KV, skip string) ([]byte, error) {
+	var cfg mkrul.Config
+	var buf bytes.Buffer
+
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+
+	for _, kv := range kvs {
+		if kv.Key == skip || len(bytes.TrimSpace(kv.Value)) == 0 {
+			continue
+		}
+
+		doc, err := mkrul.DecodeConfig(bytes.NewReader(kv.Value))
+
+		if err != nil {
+			mkrulhttp.DefaultMetrics.Failed()
+			return nil, fmt.Errorf("%s: %v", kv.Key, err)
+		}
+
+		for name, resp := range doc.Responses {
+			if cfg.Responses == nil {
+				cfg.Responses = map[string]mkrul.Response{}
+			}
+
+			cfg.Responses[name] = resp
+		}
+
+		for contentType, ctx := range doc.ContentContexts {
+			if cfg.ContentContexts == nil {
+				cfg.ContentContexts = map[string]string{}
+			}
+
+			cfg.ContentContexts[contentType] = ctx
+		}
+
+		cfg.Endpoints = append(cfg.Endpoints, doc.Endpoints...)
+	}
+
+	start := time.Now()
+	snts, tmpls, types, err := opts.Build(cfg)
+
+	if err != nil {
+		mkrulhttp.DefaultMetrics.Failed()
+		return nil, err
+	}
+
+	mkrulhttp.DefaultMetrics.Compiled(time.Since(start), snts)
+
+	if err = opts.EncodeSentinels(&buf, snts, tmpls, types); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func watch(source string, target string) error {
+	var index uint64
+
+	src, err := url.Parse(source)
+
+	if err != nil {
+		return err
+	}
+
+	dst, err := url.Parse(target)
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		kvs, next, err := fetchKV(src, index)
+
+		if err != nil {
+			slog.Error("watch failed", "source", source, "error", err)
+			time.Sleep(*watchInterval)
+			continue
+		}
+
+		if next == index {
+			continue
+		}
+
+		index = next
+
+		data, err := recompile(kvs, strings.TrimPrefix(dst.Path, "/"))
+
+		if err != nil {
+			slog.Error("compile failed", "source", source, "error", err)
+			continue
+		}
+
+		if dst.Scheme == "consul" || dst.Scheme == "etcd" {
+			err = storeKV(dst, data)
+		} else {
+			err = mkrul.WriteFileAtomic(target, data)
+		}
+
+		if err != nil {
+			slog.Error("write failed", "target", target, "error", err)
+			continue
+		}
+
+		slog.Info("compiled", "target", target, "index", index, "size", len(data))
+	}
+}
+
+var input = flag.String("i", "endpoints.json", "endpoints configuration")
+var outputs Outputs
+var debug = flag.Bool("d", false, "debug mode")
+var quiet = flag.Bool("quiet", false, "log errors only")
+var summary = flag.Bool("summary", false, "print a one-line summary of the compile on stdout")
+var progressMode = flag.String("progress", "auto", "report the compile progress on stderr: auto (on a terminal), on or off")
+var debugFormat = flag.String("debug-format", "text", "debug output of the compiled rules: text (a tree) or json")
+var serveAddr = flag.String("serve", "", "serve a reverse proxy enforcing the rules on the given address")
+var upstream = flag.String("upstream", "", "upstream url for serve mode")
+var watchURL = flag.String("watch", "", "watch a consul:// or etcd:// key prefix and recompile on change")
+var watchInterval = flag.Duration("watch-interval", 5*time.Second, "poll interval for etcd and retry delay")
+var metricsAddr = flag.String("metrics", "", "serve prometheus metrics on the given address in serve and watch modes")
+var publishURL = flag.String("publish", "", "upload the artifact to s3://, gs:// or http(s):// url, {hash} is replaced with the content hash")
+
+var dryRun = flag.Bool("dry-run", false, "compile and encode without writing anything, print the artifact statistics")
+var selftest = flag.Bool("run-selftest", false, "round trip the compiled input through the encoder and decoder")
+var logLevel = flag.String("log-level", "info", "log level: debug, info, warn or error")
+var logFormat = flag.String("log-format", "text", "log format: text or json")
+var errorFormat = flag.String("error-format", "text", "diagnostics format: text, json or github")
+var strict = flag.Bool("strict", false, "fail if there were warnings")
+var cpuProfile = flag.String("cpuprofile", "", "write a cpu profile to the given file")
+var memProfile = flag.String("memprofile", "", "write a heap profile to the given file on exit")
+var changelogFile = flag.String("changelog", "", "embed the given changelog file in the binary data")
+var changelogBase = flag.String("changelog-base", "", "embed the differences with the given previous artifact in the changelog")
+var attestation = flag.Bool("attest", false, "write an in-toto provenance statement next to the binary output")
+var builderID = flag.String("builder-id", "", "builder id of the provenance statement (default: the host name)")
+
+// opts are the compile settings of the flags, the digests of the inputs
+// are the materials of the provenance.
+var opts = mkrul.Compiler{Inputs: map[string]string{}, Locate: diagnostics.locate}
+
+func commonFlags(fs *flag.FlagSet) {
+	fs.StringVar(logLevel, "log-level", "info", "log level: debug, info, warn or error")
+	fs.StringVar(logFormat, "log-format", "text", "log format: text or json")
+	fs.StringVar(errorFormat, "error-format", "text", "diagnostics format: text, json or github")
+	fs.BoolVar(strict, "strict", false, "fail if there were warnings")
+}
+
+// keyFlag adds -encrypt to the commands reading artifacts, for the key of
+// encrypted ones.
+func keyFlag(fs *flag.FlagSet) {
+	fs.StringVar(&opts.Encrypt, "encrypt", opts.Encrypt, "key of encrypted artifacts, aes:FILE with the key in hex, or MKRUL_KEY_FILE")
+}
+
+func parseCommand(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+
+	commonFlags(fs)
+
+	if describe != nil {
+		describe(fs)
+		return nil, errDescribed
+	}
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: mkrul %s [flags]\n", fs.Name())
+
+		if summary, ok := summaries[fs.Name()]; ok {
+			fmt.Fprintf(fs.Output(), "\n%s\n", summary)
+		}
+
+		fmt.Fprintf(fs.Output(), "\nflags:\n")
+		fs.PrintDefaults()
+	}
+
+	for {
+		_ = fs.Parse(args)
+
+		if fs.NArg() == 0 {
+			break
+		}
+
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	return rest, setupLogging()
+}
+
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Rule     *int   `json:"rule,omitempty"`
+	Message  string `json:"message"`
+	Position *int   `json:"position,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+}
+
+type Diagnostics struct {
+	sync.Mutex
+	list      []Diagnostic
+	positions map[string]mkrul.Position
+}
+
+func (d *Diagnostics) add(diag Diagnostic) {
+	d.Lock()
+	defer d.Unlock()
+	d.list = append(d.list, diag)
+}
+
+// warnings counts the warnings logged so far.
+func (d *Diagnostics) warnings() int {
+	d.Lock()
+	defer d.Unlock()
+
+	n := 0
+
+	for _, diag := range d.list {
+		if diag.Severity == "warning" {
+			n++
+		}
+	}
+
+	return n
+}
+
+func positionKey(endpoint string, rule int) string {
+	return endpoint + "#" + strconv.Itoa(rule)
+}
+
+// locate records where the endpoints and their rules are defined, so that
+// the diagnostics naming them can point at the input lines.
+func (d *Diagnostics) locate(endpoints []mkrul.Endpoint) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.positions = map[string]mkrul.Position{}
+
+	for _, endpoint := range endpoints {
+		name := mkrul.DiagEndpoint(endpoint.Method, endpoint.Path)
+
+		if pos := endpoint.Pos(); pos.Line != 0 {
+			d.positions[positionKey(name, -1)] = pos
+		}
+
+		for i, rule := range endpoint.Rules {
+			if pos := rule.Pos(); pos.Line != 0 {
+				d.positions[positionKey(name, i)] = pos
+			}
+		}
+	}
+}
+
+// resolve returns the diagnostics with the file and line of their rule,
+// or of their endpoint if the rule has none.
+func (d *Diagnostics) resolve() []Diagnostic {
+	d.Lock()
+	defer d.Unlock()
+
+	list := append([]Diagnostic{}, d.list...)
+
+	for i, diag := range list {
+		if len(diag.Endpoint) == 0 || len(diag.File) != 0 {
+			continue
+		}
+
+		pos, ok := mkrul.Position{}, false
+
+		if diag.Rule != nil {
+			pos, ok = d.positions[positionKey(diag.Endpoint, *diag.Rule)]
+		}
+
+		if !ok {
+			pos = d.positions[positionKey(diag.Endpoint, -1)]
+		}
+
+		list[i].File, list[i].Line, list[i].Column = pos.File, pos.Line, pos.Col
+	}
+
+	return list
+}
+
+// githubEscape escapes a GitHub workflow command message, or property
+// value with prop.
+func githubEscape(val string, prop bool) string {
+	val = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(val)
+
+	if prop {
+		val = strings.NewReplacer(":", "%3A", ",", "%2C").Replace(val)
+	}
+
+	return val
+}
+
+// writeGithub writes the diagnostics as GitHub Actions workflow commands,
+// which annotate the lines of the pull request they point at.
+func writeGithub(w io.Writer, list []Diagnostic) {
+	for _, diag := range list {
+		var props []string
+
+		if len(diag.File) != 0 {
+			props = append(props, "file="+githubEscape(diag.File, true), "line="+strconv.Itoa(diag.Line))
+
+			if diag.Column != 0 {
+				props = append(props, "col="+strconv.Itoa(diag.Column))
+			}
+		}
+
+		if title := diag.Endpoint; len(title) != 0 {
+			if diag.Rule != nil {
+				title += fmt.Sprintf(" rule %d", *diag.Rule)
+			}
+
+			props = append(props, "title="+githubEscape(title, true))
+		}
+
+		cmd := "::" + diag.Severity
+
+		if len(props) != 0 {
+			cmd += " " + strings.Join(props, ",")
+		}
+
+		fmt.Fprintf(w, "%s::%s\n", cmd, githubEscape(diag.Message, false))
+	}
+}
+
+var diagnostics Diagnostics
+
+func exitCode(err error) int {
+	var ce *mkrul.CompileError
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	var path *os.PathError
+	var link *os.LinkError
+	var req *url.Error
+
+	switch {
+	case errors.As(err, &ce):
+		return ce.Code
+	case errors.As(err, &syntax), errors.As(err, &typ):
+		return mkrul.EXIT_PARSE
+	case errors.As(err, &path), errors.As(err, &link), errors.As(err, &req):
+		return mkrul.EXIT_IO
+	}
+
+	return mkrul.EXIT_FAILURE
+}
+
+func errorDiagnostic(err error) Diagnostic {
+	var ce *mkrul.CompileError
+	var pe *mkrul.PositionError
+
+	diag := Diagnostic{Severity: "error", Message: err.Error()}
+
+	if errors.As(err, &ce) {
+		diag.Endpoint = ce.Endpoint
+		diag.File, diag.Line, diag.Column = ce.Pos.File, ce.Pos.Line, ce.Pos.Col
+
+		if rule := ce.Rule; rule >= 0 {
+			diag.Rule = &rule
+		}
+	}
+
+	if errors.As(err, &pe) {
+		pos := pe.Pos
+		diag.Position = &pos
+	}
+
+	return diag
+}
+
+// warningDiagnostic turns a warning log record into a diagnostic: the
+// method and path or endpoint attributes name the endpoint, an integer
+// rule attribute is the rule index and the rest is appended to the message.
+func warningDiagnostic(r slog.Record, attrs []slog.Attr) Diagnostic {
+	var method, path string
+	var details []string
+
+	diag := Diagnostic{Severity: "warning", Message: r.Message}
+
+	visit := func(attr slog.Attr) bool {
+		switch attr.Key {
+		case "method":
+			method = attr.Value.String()
+		case "path":
+			path = attr.Value.String()
+		case "endpoint":
+			diag.Endpoint = attr.Value.String()
+		case "error", "warning":
+			details = append(details, attr.Value.String())
+		default:
+			if attr.Key == "rule" && attr.Value.Kind() == slog.KindInt64 {
+				rule := int(attr.Value.Int64())
+				diag.Rule = &rule
+			} else {
+				details = append(details, attr.Key+"="+attr.Value.String())
+			}
+		}
+
+		return true
+	}
+
+	for _, attr := range attrs {
+		visit(attr)
+	}
+
+	r.Attrs(visit)
+
+	if len(diag.Endpoint) == 0 && len(method)+len(path) != 0 {
+		diag.Endpoint = mkrul.DiagEndpoint(method, path)
+	}
+
+	if len(details) != 0 {
+		diag.Message += ": " + strings.Join(details, ", ")
+	}
+
+	return diag
+}
+
+// DiagHandler records every warning as a diagnostic, whatever the log
+// level, and passes the records on to the log handler.
+type DiagHandler struct {
+	slog.Handler
+	attrs []slog.Attr
+}
+
+func (h *DiagHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level == slog.LevelWarn || h.Handler.Enabled(ctx, level)
+}
+
+func (h *DiagHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level == slog.LevelWarn {
+		diagnostics.add(warningDiagnostic(r, h.attrs))
+	}
+
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *DiagHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &DiagHandler{Handler: h.Handler.WithAttrs(attrs), attrs: append(slices.Clone(h.attrs), attrs...)}
+}
+
+func (h *DiagHandler) WithGroup(name string) slog.Handler {
+	return &DiagHandler{Handler: h.Handler.WithGroup(name), attrs: h.attrs}
+}
+
+func setupLogging() error {
+	var level slog.Level
+	var handler slog.Handler
+
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return mkrul.UsageError(err)
+	}
+
+	if *quiet {
+		level = slog.LevelError
+	}
+
+	if *debug {
+		level = slog.LevelDebug
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch *logFormat {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return mkrul.UsageError(fmt.Errorf("unknown log format: %s", *logFormat))
+	}
+
+	switch *errorFormat {
+	case "text", "json", "github":
+	default:
+		return mkrul.UsageError(fmt.Errorf("unknown error format: %s", *errorFormat))
+	}
+
+	switch *debugFormat {
+	case "text", "json":
+	default:
+		return mkrul.UsageError(fmt.Errorf("unknown debug format: %s", *debugFormat))
+	}
+
+	slog.SetDefault(slog.New(&DiagHandler{Handler: handler}))
+
+	return nil
+}
+
+func fatal(err error) {
+	exit(err)
+}
+
+// exit terminates with the exit code of err, or of the warnings in strict
+// mode, and writes the diagnostics in json if asked to.
+func exit(err error) {
+	code := mkrul.EXIT_OK
+
+	if n := len(diagnostics.list); err == nil && *strict && n != 0 {
+		err = &mkrul.CompileError{Code: mkrul.EXIT_WARNINGS, Rule: -1, Err: fmt.Errorf("strict mode: %d warnings", n)}
+	}
+
+	if err != nil {
+		slog.Error("fatal", "error", err)
+		code = exitCode(err)
+		diagnostics.add(errorDiagnostic(err))
+	}
+
+	switch *errorFormat {
+	case "json":
+		data, _ := json.Marshal(map[string]any{"exit_code": code, "diagnostics": diagnostics.resolve()})
+		fmt.Fprintf(os.Stderr, "%s\n", data)
+	case "github":
+		writeGithub(os.Stdout, diagnostics.resolve())
+	}
+
+	stopProfiling()
+	os.Exit(code)
+}
+
+var stopProfiling = func() {}
+
+func startProfiling() error {
+	var cpu *os.File
+
+	if len(*cpuProfile) != 0 {
+		f, err := os.Create(*cpuProfile)
+
+		if err != nil {
+			return err
+		}
+
+		if err = pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+
+		cpu = f
+	}
+
+	stopProfiling = func() {
+		stopProfiling = func() {}
+
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			cpu.Close()
+		}
+
+		if len(*memProfile) != 0 {
+			f, err := os.Create(*memProfile)
+
+			if err != nil {
+				slog.Error("memprofile", "error", err)
+				return
+			}
+
+			defer f.Close()
+			runtime.GC()
+
+			if err = pprof.WriteHeapProfile(f); err != nil {
+				slog.Error("memprofile", "error", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+var commands = map[string]func([]string) error{
+	"conformance": conformanceCmd,
+	"coverage":    coverageCmd,
+	"diff":        diffCmd,
+	"export":      export,
+	"gen-tests":   genTestsCmd,
+	"impact":      impactCmd,
+	"import":      importCmd,
+	"inspect":     inspectCmd,
+	"lint":        lintCmd,
+	"lock":        lockCmd,
+	"apply":       applyCmd,
+	"merge":       mergeCmd,
+	"plan":        planCmd,
+	"migrate":     migrateCmd,
+	"report":      reportCmd,
+	"split":       splitCmd,
+	"stats":       statsCmd,
+	"test":        testCmd,
+	"toggle":      toggleCmd,
+	"verify":      verifyCmd,
+
+	"verify-attestation": verifyAttestation,
+}
+
+// summaries describes the commands for the help and the completions,
+// compile and validate run on the global flags.
+var summaries = map[string]string{
+	"compile":     "compile endpoints into the binary artifact (the default command)",
+	"validate":    "compile and encode without writing anything",
+	"completion":  "print the bash, zsh or fish completion script",
+	"conformance": "compare the verdicts of a WAF with the local engine",
+	"coverage":    "list the rules no test case matches",
+	"diff":        "show the endpoints and rules changed between two inputs",
+	"export":      "generate envoy or openresty configuration or annotate an openapi spec",
+	"gen-tests":   "generate test cases from the rules",
+	"help":        "show the commands or the flags of a command",
+	"impact":      "list the test cases whose action changes between two inputs",
+	"import":      "create endpoints from the operations of an openapi spec",
+	"inspect":     "list endpoints and rules with their owners",
+	"lint":        "warn about suspicious endpoints and rules",
+	"lock":        "fetch the rule packs and pin them in mkrul.lock",
+	"merge":       "merge several inputs into one artifact",
+	"plan":        "show the changes between the input and the deployed artifact",
+	"apply":       "write and publish the artifact after showing the plan",
+	"migrate":     "rewrite endpoints written for an older schema",
+	"report":      "render the rules into an html or markdown report",
+	"split":       "split an input into artifacts per path prefix",
+	"stats":       "summarize an input or artifact",
+	"test":        "check the actions taken on sample requests",
+	"toggle":      "enable or disable a rule by id in place",
+	"verify":      "validate the structure of a compiled artifact in depth",
+
+	"verify-attestation": "check a provenance statement against the artifact and its inputs",
+}
+
+// targets are the positional arguments of the commands that take one.
+var targets = map[string][]string{
+	"completion": {"bash", "zsh", "fish"},
+	"export":     {"envoy", "openresty", "openapi"},
+	"import":     {"openapi"},
+	"help":       nil,
+}
+
+func usage() {
+	var names []string
+
+	for name := range summaries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: mkrul [command] [flags] [args]\n\ncommands:\n")
+
+	tw := tabwriter.NewWriter(flag.CommandLine.Output(), 0, 0, 2, ' ', 0)
+
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, summaries[name])
+	}
+
+	_ = tw.Flush()
+
+	fmt.Fprintf(flag.CommandLine.Output(), "\nflags of compile and validate:\n")
+	flag.PrintDefaults()
+}
+
+// targetUsage lists the targets of export or import, whose flags are
+// those of the target.
+func targetUsage(name string) {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: mkrul %s %s [flags]\n\n%s\n\nsee mkrul help %s TARGET for the flags of a target\n", name, strings.Join(targets[name], "|"), summaries[name], name)
+}
+
+func help(args []string) error {
+	if len(args) == 0 {
+		usage()
+		return nil
+	}
+
+	switch args[0] {
+	case "compile", "validate":
+		usage()
+		return nil
+	case "export", "import":
+		if len(args) > 1 {
+			return commands[args[0]]([]string{args[1], "-h"})
+		}
+	}
+
+	if cmd, ok := commands[args[0]]; ok {
+		return cmd([]string{"-h"})
+	}
+
+	if _, ok := summaries[args[0]]; ok {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s: %s\n", args[0], summaries[args[0]])
+		return nil
+	}
+
+	return mkrul.UsageError(fmt.Errorf("unknown command: %s", args[0]))
+}
+
+// describe, if set, receives the flag set of a command instead of parsing
+// it, so the completions can list the flags without running the command.
+var describe func(fs *flag.FlagSet)
+
+var errDescribed = errors.New("flags described")
+
+func commandFlags(name string) []string {
+	var result []string
+
+	seen := map[string]bool{}
+
+	describe = func(fs *flag.FlagSet) {
+		fs.VisitAll(func(f *flag.Flag) {
+			if !seen[f.Name] {
+				seen[f.Name] = true
+				result = append(result, "-"+f.Name)
+			}
+		})
+	}
+
+	defer func() {
+		describe = nil
+	}()
+
+	switch name {
+	case "compile", "validate":
+		describe(flag.CommandLine)
+	case "export", "import":
+		for _, target := range targets[name] {
+			_ = commands[name]([]string{target})
+		}
+	default:
+		if cmd, ok := commands[name]; ok {
+			_ = cmd(nil)
+		}
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+func completion(args []string) error {
+	var names []string
+	var sb strings.Builder
+
+	if len(args) != 1 {
+		return mkrul.UsageError(fmt.Errorf("usage: mkrul completion bash|zsh|fish"))
+	}
+
+	for name := range summaries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	targets["help"] = names
+
+	switch args[0] {
+	case "bash", "zsh":
+		if args[0] == "zsh" {
+			sb.WriteString("autoload -U +X bashcompinit && bashcompinit\n")
+		}
+
+		sb.WriteString("_mkrul() {\n")
+		sb.WriteString("\tlocal cur=${COMP_WORDS[COMP_CWORD]} cmd=${COMP_WORDS[1]} words\n")
+		fmt.Fprintf(&sb, "\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n\t\tCOMPREPLY=($(compgen -W \"%s %s\" -- \"$cur\"))\n\t\treturn\n\tfi\n", strings.Join(names, " "), strings.Join(commandFlags("compile"), " "))
+		sb.WriteString("\tcase \"$cmd\" in\n")
+
+		for _, name := range names {
+			fmt.Fprintf(&sb, "\t%s) words=\"%s\" ;;\n", name, strings.Join(append(commandFlags(name), targets[name]...), " "))
+		}
+
+		fmt.Fprintf(&sb, "\t*) words=\"%s\" ;;\n", strings.Join(commandFlags("compile"), " "))
+		sb.WriteString("\tesac\n")
+		sb.WriteString("\tif [[ \"$cur\" == -* || \"$cmd\" == completion || \"$cmd\" == help ]]; then\n")
+		sb.WriteString("\t\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+		sb.WriteString("\telse\n\t\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\") $(compgen -f -- \"$cur\"))\n\tfi\n")
+		sb.WriteString("}\n")
+		sb.WriteString("complete -o filenames -F _mkrul mkrul\n")
+	case "fish":
+		for _, name := range names {
+			fmt.Fprintf(&sb, "complete -c mkrul -n __fish_use_subcommand -a %s -d %q\n", name, summaries[name])
+		}
+
+		for _, f := range commandFlags("compile") {
+			fmt.Fprintf(&sb, "complete -c mkrul -n __fish_use_subcommand -o %s\n", f[1:])
+		}
+
+		for _, name := range names {
+			for _, f := range commandFlags(name) {
+				fmt.Fprintf(&sb, "complete -c mkrul -n '__fish_seen_subcommand_from %s' -o %s\n", name, f[1:])
+			}
+
+			for _, target := range targets[name] {
+				fmt.Fprintf(&sb, "complete -c mkrul -n '__fish_seen_subcommand_from %s' -a %s\n", name, target)
+			}
+		}
+	default:
+		return mkrul.UsageError(fmt.Errorf("unknown shell: %s", args[0]))
+	}
+
+	_, err := os.Stdout.WriteString(sb.String())
+
+	return err
+}
+
+func main() {
+	var err error
+	var snts []mkruleval.Sentinel
+	var tmpls []mkruleval.Template
+	var types mkruleval.ContentTypes
+
+	validate := false
+
+	flag.Var(&outputs, "o", "output file, repeatable: .json for the json ir, .html or .md for the report, anything else for the binary data (default sentinels.bin)")
+	flag.StringVar(&opts.Overlay, "overlay", "", "overlay file adding, replacing or disabling rules of the input endpoints")
+	flag.BoolVar(&opts.PruneExpired, "prune-expired", false, "drop expired rules")
+	flag.StringVar(&opts.Redos, "redos", "warn", "nested quantifier severity: off, warn or error")
+	flag.IntVar(&opts.MaxRegexLength, "max-regex-length", 0, "maximum regexp length, 0 for unlimited")
+	flag.BoolVar(&opts.ForbidBackrefs, "forbid-backreferences", false, "reject regexps with backreferences")
+	flag.StringVar(&opts.Conflicts, "conflicts", "warn", "severity of pass and block rules over the same conditions: off, warn or error")
+	flag.IntVar(&opts.MaxEndpoints, "max-endpoints", 0, "maximum number of endpoints, 0 for unlimited")
+	flag.IntVar(&opts.MaxRules, "max-rules-per-endpoint", 0, "maximum number of rules per endpoint, 0 for unlimited")
+	flag.IntVar(&opts.MaxDepth, "max-rule-depth", 0, "maximum number of groups per rule, 0 for unlimited")
+	flag.Uint64Var(&opts.MaxSize, "max-artifact-size", 0, "maximum artifact size in bytes, 0 for unlimited")
+	flag.BoolVar(&opts.AllowDangling, "allow-dangling", false, "allow rules without a terminal action")
+	flag.StringVar(&opts.Layout, "layout", "flat", "index layout of the binary data: flat or cdb")
+	flag.StringVar(&opts.ByteOrder, "byte-order", "le", "byte order of the binary data: le or be")
+	flag.BoolVar(&opts.StripMetadata, "strip-metadata", false, "leave the owners and descriptions out of the binary data")
+	flag.StringVar(&opts.Encrypt, "encrypt", "", "encrypt the binary output with AES-256-GCM, aes:FILE with the key in hex")
+	flag.StringVar(&opts.CacheDir, "cache-dir", "", "reuse the outputs of a previous compile of the same input and flags from the given directory")
+	flag.Var(&opts.Only, "only", "compile only the endpoints matching label=, method= or path=, repeatable")
+	flag.Var(&opts.Exclude, "exclude", "leave out the endpoints matching label=, method= or path=, repeatable")
+	flag.Var(&opts.Signers, "sign", "sign the binary output with ed25519, ID:FILE with the key id and the private key, repeatable")
+	flag.Usage = usage
+
+	if len(os.Args) > 1 {
+		switch name := os.Args[1]; name {
+		case "compile", "validate":
+			validate = name == "validate"
+			os.Args = append(os.Args[:1:1], os.Args[2:]...)
+		case "help":
+			exit(help(os.Args[2:]))
+		case "completion":
+			exit(completion(os.Args[2:]))
+		default:
+			if cmd, ok := commands[name]; ok {
+				exit(cmd(os.Args[2:]))
+			}
+
+			// a typo of a command must not compile over the default output
+			if !strings.HasPrefix(name, "-") {
+				fmt.Fprintf(flag.CommandLine.Output(), "unknown command: %s\n\n", name)
+				usage()
+				os.Exit(mkrul.EXIT_USAGE)
+			}
+		}
+	}
+
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "unexpected argument: %s\n\n", flag.Arg(0))
+		usage()
+		os.Exit(mkrul.EXIT_USAGE)
+	}
+
+	start := time.Now()
+
+	if err = setupLogging(); err != nil {
+		fatal(err)
+	}
+
+	if progress, err = newProgress(*progressMode); err != nil {
+		fatal(err)
+	}
+
+	opts.Progress = progress.Report
+
+	if err = startProfiling(); err != nil {
+		fatal(err)
+	}
+
+	if len(outputs) == 0 {
+		outputs = Outputs{"sentinels.bin"}
+	}
+
+	if len(*watchURL) != 0 {
+		if len(outputs.Binary()) == 0 {
+			fatal(fmt.Errorf("watch mode requires a binary output"))
+		}
+
+		serveMetrics(*metricsAddr)
+		fatal(watch(*watchURL, outputs.Binary()))
+	}
+
+	key := ""
+
+	// serve and selftest need the compiled rules, and pruning depends on
+	// the current time, so none of them can be served from the cache
+	if len(opts.CacheDir) != 0 && len(*serveAddr) == 0 && !*selftest && !opts.PruneExpired && !*dryRun && !validate && len(*changelogFile) == 0 && len(*changelogBase) == 0 && !*attestation && len(opts.Encrypt) == 0 && len(opts.Signers) == 0 {
+		if key, err = cacheKey(*input); err != nil {
+			fatal(err)
+		}
+	}
+
+	cached := len(key) != 0 && restoreCache(opts.CacheDir, key, outputs)
+
+	if cached {
+		slog.Info("cache hit", "key", key)
+	} else {
+		snts, tmpls, types, err = opts.Compile(*input)
+
+		if err != nil {
+			mkrulhttp.DefaultMetrics.Failed()
+			fatal(err)
+		}
+
+		mkrulhttp.DefaultMetrics.Compiled(time.Since(start), snts)
+
+		if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+			if err = writeDebug(os.Stderr, snts); err != nil {
+				fatal(err)
+			}
+		}
+
+		if opts.Changelog, err = makeChangelog(snts); err != nil {
+			fatal(err)
+		}
+
+		if *selftest {
+			if err = opts.RoundTrip(snts, tmpls, types); err != nil {
+				fatal(fmt.Errorf("selftest: %v", err))
+			}
+
+			slog.Info("selftest passed", "sentinels", len(snts), "templates", len(tmpls))
+		}
+
+		if validate {
+			var w mkrul.NopWriter
+
+			if err = opts.EncodeSentinels(&w, snts, tmpls, types); err != nil {
+				fatal(err)
+			}
+
+			slog.Info("valid", "sentinels", len(snts), "size", w.Offset())
+			exit(nil)
+		}
+
+		if len(*serveAddr) != 0 {
+			serveMetrics(*metricsAddr)
+			fatal(serve(*serveAddr, *upstream, *input, snts, tmpls, types))
+		}
+
+		if *dryRun {
+			stats, err := opts.Stats(snts, tmpls, types)
+
+			if err == nil {
+				err = printStats(os.Stdout, stats)
+			}
+
+			exit(err)
+		}
+
+		err = writeOutputs(outputs, snts, tmpls, types)
+
+		if err == nil {
+			err = writeReports(outputs, *input)
+		}
+
+		if err != nil {
+			fatal(err)
+		}
+
+		if *attestation {
+			if len(outputs.Binary()) == 0 {
+				fatal(fmt.Errorf("attest requires a binary output"))
+			}
+
+			if err = attest(outputs.Binary(), start); err != nil {
+				fatal(err)
+			}
+		}
+
+		if len(key) != 0 {
+			if err = storeCache(opts.CacheDir, key, outputs); err != nil {
+				slog.Warn("cache store failed", "error", err)
+			}
+		}
+	}
+
+	if len(*publishURL) != 0 {
+		if len(outputs.Binary()) == 0 {
+			fatal(fmt.Errorf("publish requires a binary output"))
+		}
+
+		data, err := os.ReadFile(outputs.Binary())
+
+		if err != nil {
+			fatal(err)
+		}
+
+		dst, err := publish(*publishURL, data)
+
+		if err != nil {
+			fatal(err)
+		}
+
+		slog.Info("published", "target", dst)
+	}
+
+	if *summary {
+		if err = printSummary(os.Stdout, snts, tmpls, types, outputs.Binary(), cached, time.Since(start)); err != nil {
+			fatal(err)
+		}
+	}
+
+	exit(nil)
+}
+
+// formatSize renders a byte count with a binary unit.
+func formatSize(n uint64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := uint64(unit), 0
+
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// printSummary prints the one-line summary of a compile, or of the
+// restore of its outputs from the cache.
+func printSummary(w io.Writer, snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes, binary string, cached bool, elapsed time.Duration) error {
+	var size uint64
+
+	if fi, err := os.Stat(binary); len(binary) != 0 && err == nil {
+		size = uint64(fi.Size())
+	} else {
+		var nw mkrul.NopWriter
+
+		if err := opts.EncodeSentinels(&nw, snts, tmpls, types); err != nil {
+			return err
+		}
+
+		size = nw.Offset()
+	}
+
+	if cached {
+		_, err := fmt.Fprintf(w, "restored %s from the cache, %dms\n", formatSize(size), elapsed.Milliseconds())
+		return err
+	}
+
+	rules := 0
+
+	for _, snt := range snts {
+		rules += len(snt.Rules)
+	}
+
+	_, err := fmt.Fprintf(w, "compiled %d endpoints, %d rules, %s, %dms\n", len(snts), rules, formatSize(size), elapsed.Milliseconds())
+
+	return err
+}
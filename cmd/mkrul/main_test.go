@@ -0,0 +1,1614 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tantalsec/Mkrul"
+	"github.com/tantalsec/Mkrul/mkruleval"
+)
+
+// TestMain runs the command instead of the tests in the processes that
+// runMain starts.
+func TestMain(m *testing.M) {
+	if os.Getenv("MKRUL_TEST_MAIN") == "1" {
+		main()
+	}
+
+	os.Exit(m.Run())
+}
+
+// runMain runs mkrul with the arguments in a process of its own and
+// returns what it printed on stdout and its exit code.
+func runMain(t *testing.T, args ...string) (string, int) {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "MKRUL_TEST_MAIN=1")
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+
+	if exit, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), exit.ExitCode()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stdout.String(), 0
+}
+
+func TestSpecPath(t *testing.T) {
+	for _, tc := range []struct {
+		path   string
+		params []interface{}
+		want   string
+	}{
+		{"/users", nil, "/users"},
+		{"/users/{id}", nil, "/users/{id}"},
+		{"/users/{id}", []interface{}{map[string]interface{}{"name": "id", "in": "path", "schema": map[string]interface{}{"type": "integer"}}}, "/users/{id:int}"},
+		{"/o/{oid}/i", []interface{}{map[string]interface{}{"name": "oid", "in": "path", "schema": map[string]interface{}{"type": "string", "format": "uuid"}}}, "/o/{oid:uuid}/i"},
+		{"/q/{id}", []interface{}{map[string]interface{}{"name": "id", "in": "query", "schema": map[string]interface{}{"type": "integer"}}}, "/q/{id}"},
+	} {
+		if got := specPath(tc.path, tc.params); got != tc.want {
+			t.Errorf("specPath(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestLuaEndpoints(t *testing.T) {
+	snts, _, _, err := opts.Compile("../../testdata/features.json")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		partial bool
+		want    string
+	}{
+		{false, "unsupported"},
+		{true, ""},
+	} {
+		_, err := luaEndpoints(snts, tc.partial)
+
+		switch {
+		case len(tc.want) == 0 && err != nil:
+			t.Errorf("luaEndpoints(partial=%t): %v", tc.partial, err)
+		case len(tc.want) != 0 && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("luaEndpoints(partial=%t) = %v, want %q", tc.partial, err, tc.want)
+		}
+	}
+}
+
+func TestLuaRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule string
+		want string
+	}{
+		{"$val == 'a' : block", ""},
+		{"$val is_sqli : block", "unsupported predicate: is_sqli"},
+		{"$val == $key : block", "unsupported comparison to $key"},
+		{"entropy > 4.5 : block", "unsupported entropy"},
+	} {
+		groups, err := mkrul.ParseRule(tc.rule)
+
+		if err != nil {
+			t.Fatalf("ParseRule(%q): %v", tc.rule, err)
+		}
+
+		_, err = luaRule(mkruleval.SentinelRule{Groups: groups})
+
+		switch {
+		case len(tc.want) == 0 && err != nil:
+			t.Errorf("luaRule(%q): %v", tc.rule, err)
+		case len(tc.want) != 0 && (err == nil || err.Error() != tc.want):
+			t.Errorf("luaRule(%q) = %v, want %q", tc.rule, err, tc.want)
+		}
+	}
+}
+
+func TestMergeSentinels(t *testing.T) {
+	block := mkruleval.SentinelRule{Groups: [][]mkruleval.Stmt{{{Var: mkruleval.VAL, Op: mkruleval.EQ, Val: "x"}, {Op: mkruleval.BLOCK}}}}
+	pass := mkruleval.SentinelRule{Groups: [][]mkruleval.Stmt{{{Op: mkruleval.PASS}}}}
+	base := mkruleval.Sentinel{Method: "GET", Path: []string{"api"}, Rules: []mkruleval.SentinelRule{block}}
+
+	for _, tc := range []struct {
+		name   string
+		policy string
+		dst    mkruleval.Sentinel
+		src    mkruleval.Sentinel
+		rules  int
+		err    string
+	}{
+		{"error", "error", base, base, 0, "endpoint GET /api is defined twice"},
+		{"first-wins", "first-wins", base, base, 1, ""},
+		{"concat", "concat-rules", base, base, 2, ""},
+		{"after a catch-all", "concat-rules", mkruleval.Sentinel{Method: "GET", Path: []string{"api"}, Rules: []mkruleval.SentinelRule{pass}}, base, 2, ""},
+		{"threshold taken", "concat-rules", base, mkruleval.Sentinel{Method: "GET", Path: []string{"api"}, BlockThreshold: 5}, 1, ""},
+		{"threshold differs", "concat-rules", mkruleval.Sentinel{Method: "GET", Path: []string{"api"}, BlockThreshold: 3}, mkruleval.Sentinel{Method: "GET", Path: []string{"api"}, BlockThreshold: 5}, 0, "endpoint GET /api: block_threshold differs"},
+		{"charsets differ", "concat-rules", mkruleval.Sentinel{Method: "GET", Path: []string{"api"}, Charsets: []string{"utf-8"}}, mkruleval.Sentinel{Method: "GET", Path: []string{"api"}, Charsets: []string{"latin1"}}, 0, "endpoint GET /api: charsets differs"},
+		{"other endpoint", "error", base, mkruleval.Sentinel{Method: "POST", Path: []string{"api"}}, 1, ""},
+		{"unknown policy", "last-wins", base, base, 0, "unknown conflict policy: last-wins"},
+	} {
+		got, err := mergeSentinels([]mkruleval.Sentinel{tc.dst}, []mkruleval.Sentinel{tc.src}, tc.policy)
+
+		switch {
+		case len(tc.err) != 0:
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: %v, want %q", tc.name, err, tc.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case len(got[0].Rules) != tc.rules:
+			t.Errorf("%s: %d rules, want %d", tc.name, len(got[0].Rules), tc.rules)
+		case tc.name == "threshold taken" && got[0].BlockThreshold != 5:
+			t.Errorf("%s: threshold %d, want 5", tc.name, got[0].BlockThreshold)
+		}
+	}
+}
+
+func TestToggleRule(t *testing.T) {
+	for _, tc := range []struct {
+		name, doc, want string
+		enabled         bool
+		err             string
+	}{
+		{
+			"disable inline",
+			`[{"path": "/", "method": "", "rules": [{"id": "a", "rule": "$val == '<b>' : block"}, "pass"]}]`,
+			`[{"path": "/", "method": "", "rules": [{"id": "a", "rule": "$val == '<b>' : block", "enabled": false}, "pass"]}]`,
+			false, "",
+		},
+		{
+			"enable inline",
+			`[{"path": "/", "method": "", "rules": [{"id": "a", "enabled": false, "rule": "block"}]}]`,
+			`[{"path": "/", "method": "", "rules": [{"id": "a", "rule": "block"}]}]`,
+			true, "",
+		},
+		{
+			"enable first member",
+			`[{"path": "/", "method": "", "rules": [{"enabled": false, "id": "a", "rule": "block"}]}]`,
+			`[{"path": "/", "method": "", "rules": [{"id": "a", "rule": "block"}]}]`,
+			true, "",
+		},
+		{
+			"disable enabled",
+			`[{"path": "/", "method": "", "rules": [{"id": "a", "enabled": true, "rule": "block"}]}]`,
+			`[{"path": "/", "method": "", "rules": [{"id": "a", "enabled": false, "rule": "block"}]}]`,
+			false, "",
+		},
+		{
+			"disable indented",
+			"{\n\t\"endpoints\": [\n\t\t{\n\t\t\t\"path\": \"/\",\n\t\t\t\"rules\": [\n\t\t\t\t{\n\t\t\t\t\t\"rule\": \"block\",\n\t\t\t\t\t\"id\": \"a\"\n\t\t\t\t}\n\t\t\t]\n\t\t}\n\t],\n\t\"zeta\": 1\n}\n",
+			"{\n\t\"endpoints\": [\n\t\t{\n\t\t\t\"path\": \"/\",\n\t\t\t\"rules\": [\n\t\t\t\t{\n\t\t\t\t\t\"rule\": \"block\",\n\t\t\t\t\t\"id\": \"a\",\n\t\t\t\t\t\"enabled\": false\n\t\t\t\t}\n\t\t\t]\n\t\t}\n\t],\n\t\"zeta\": 1\n}\n",
+			false, "",
+		},
+		{
+			"missing",
+			`[{"path": "/", "rules": [{"id": "a", "rule": "block"}]}]`,
+			"", false, "rule b not found",
+		},
+		{
+			"twice",
+			`[{"path": "/", "rules": [{"id": "b", "rule": "block"}]}, {"path": "/x", "rules": [{"id": "b", "rule": "pass"}]}]`,
+			"", false, "rule b is defined 2 times",
+		},
+	} {
+		id := "a"
+
+		if len(tc.err) != 0 {
+			id = "b"
+		}
+
+		got, enabled, err := toggleRule([]byte(tc.doc), id)
+
+		switch {
+		case len(tc.err) != 0:
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: %v, want %q", tc.name, err, tc.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case string(got) != tc.want || enabled != tc.enabled:
+			t.Errorf("%s: enabled %t\n%s\nwant enabled %t\n%s", tc.name, enabled, got, tc.enabled, tc.want)
+		}
+	}
+}
+
+func TestSplitSentinels(t *testing.T) {
+	endpoint := func(path string, flags uint8) mkruleval.Sentinel {
+		return mkruleval.Sentinel{Method: "GET", Path: mkrul.SplitPrefix(path), Flags: flags}
+	}
+
+	snts := []mkruleval.Sentinel{
+		endpoint("/", 0),
+		endpoint("/*", 0),
+		endpoint("/api", 0),
+		endpoint("/api/v1/users", 0),
+		endpoint("/API/V2", mkruleval.FLAG_CASE_INSENSITIVE),
+		endpoint("/api/{v:alnum}/docs", 0),
+		endpoint("/api/{n:int}/docs", 0),
+		endpoint("/health", 0),
+	}
+
+	shards, rest := splitSentinels(snts, []string{"/api/v1", "/api/v2"})
+
+	names := func(snts []mkruleval.Sentinel) string {
+		var result []string
+
+		for _, snt := range snts {
+			result = append(result, "/"+strings.Join(snt.Path, "/"))
+		}
+
+		return strings.Join(result, " ")
+	}
+
+	for _, tc := range []struct {
+		name string
+		got  []mkruleval.Sentinel
+		want string
+	}{
+		{"/api/v1", shards[0], "/ /* /api /api/v1/users /api/{v:alnum}/docs"},
+		{"/api/v2", shards[1], "/ /* /api /API/V2 /api/{v:alnum}/docs"},
+		{"rest", rest, "/api/{n:int}/docs /health"},
+	} {
+		if got := names(tc.got); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// run dispatches a command line the way main does, help included, and
+// returns its exit code and what it printed as usage.
+func run(t *testing.T, args ...string) (int, string) {
+	var buf bytes.Buffer
+
+	flag.CommandLine.SetOutput(&buf)
+	defer flag.CommandLine.SetOutput(nil)
+
+	var err error
+
+	if args[0] == "help" {
+		err = help(args[1:])
+	} else if cmd, ok := commands[args[0]]; ok {
+		err = cmd(args[1:])
+	} else {
+		t.Fatalf("unknown command: %s", args[0])
+	}
+
+	if err == nil {
+		return mkrul.EXIT_OK, buf.String()
+	}
+
+	return exitCode(err), buf.String() + err.Error()
+}
+
+func TestCommandDispatch(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		code int
+		want string
+	}{
+		{[]string{"help"}, mkrul.EXIT_OK, "commands:"},
+		{[]string{"help", "export"}, mkrul.EXIT_OK, "usage: mkrul export envoy|openresty|openapi [flags]"},
+		{[]string{"help", "import"}, mkrul.EXIT_OK, "usage: mkrul import openapi [flags]"},
+		{[]string{"help", "nope"}, mkrul.EXIT_USAGE, "unknown command: nope"},
+		{[]string{"export", "-h"}, mkrul.EXIT_OK, "see mkrul help export TARGET"},
+		{[]string{"export", "--help"}, mkrul.EXIT_OK, "see mkrul help export TARGET"},
+		{[]string{"import", "-h"}, mkrul.EXIT_OK, "see mkrul help import TARGET"},
+		{[]string{"export"}, mkrul.EXIT_USAGE, "usage: mkrul export"},
+		{[]string{"export", "nginx"}, mkrul.EXIT_USAGE, "unknown export target: nginx"},
+		{[]string{"import", "swagger"}, mkrul.EXIT_USAGE, "unknown import source: swagger"},
+		{[]string{"verify"}, mkrul.EXIT_USAGE, "usage: mkrul verify"},
+		{[]string{"inspect", "missing.bin"}, mkrul.EXIT_IO, "missing.bin"},
+	} {
+		code, out := run(t, tc.args...)
+
+		if code != tc.code || !strings.Contains(out, tc.want) {
+			t.Errorf("%v: exit %d %q, want %d and %q", tc.args, code, out, tc.code, tc.want)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	var syntax *json.SyntaxError
+
+	_, err := os.ReadFile(filepath.Join(t.TempDir(), "missing"))
+	jsonErr := json.Unmarshal([]byte("{"), &syntax)
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"plain", errors.New("failed"), mkrul.EXIT_FAILURE},
+		{"usage", mkrul.UsageError(errors.New("usage")), mkrul.EXIT_USAGE},
+		{"invalid", mkrul.Invalid(errors.New("invalid")), mkrul.EXIT_INVALID},
+		{"wrapped compile error", fmt.Errorf("a.json: %w", &mkrul.CompileError{Code: mkrul.EXIT_PARSE, Rule: -1, Err: errors.New("bad rule")}), mkrul.EXIT_PARSE},
+		{"json", fmt.Errorf("a.json: %w", jsonErr), mkrul.EXIT_PARSE},
+		{"io", err, mkrul.EXIT_IO},
+	} {
+		if got := exitCode(tc.err); got != tc.want {
+			t.Errorf("%s: exit %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMigrateRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule string
+		want string
+	}{
+		{`$path == 'a\nb' : block`, `$path == 'anb' : block`},
+		{`: $path == 'x' : block :`, `$path == 'x' : block`},
+		{`$path == 'x' :: block`, `$path == 'x' : block`},
+		{`$header['x'] == 'it\'s' : block`, `$header['x'] == 'it\'s' : block`},
+		{`$path ~ /a\.b/ : block`, `$path ~ /a\.b/ : block`},
+		{`block`, `block`},
+	} {
+		if got := migrateRule(tc.rule); got != tc.want {
+			t.Errorf("migrateRule(%q) = %q, want %q", tc.rule, got, tc.want)
+		}
+	}
+}
+
+func TestMigrateCmd(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  string
+		err   string
+	}{
+		{"rules", `[{"method": "GET", "path": "/a", "rules": [": $path == 'a\\nb' : block", {"rule": "pass", "owner": "web"}]}]`, `"$path == 'anb' : block"`, ""},
+		{"object", `{"endpoints": [{"method": "GET", "path": "/a", "rules": ["block :"]}]}`, `"block"`, ""},
+		{"manual", `[{"method": "GET", "path": "/a", "rules": ["$path == 'a'", 1]}]`, "", "2 rules need manual migration"},
+		{"no endpoints", `{"rules": []}`, "", "no endpoints in"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			in := filepath.Join(dir, tc.name+".json")
+			out := filepath.Join(dir, tc.name+".out.json")
+
+			if err := os.WriteFile(in, []byte(tc.input), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := migrateCmd([]string{"-i", in, "-o", out})
+
+			if len(tc.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want %q", err, tc.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(out)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Contains(data, []byte(tc.want)) {
+				t.Errorf("migrated to %s, want %s in it", data, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeSplitCmd(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		return path
+	}
+
+	a := write("a.json", `[{"method": "GET", "path": "/api/v1/users", "rules": ["$path == 'x' : block"]}, {"method": "GET", "path": "/health", "rules": ["pass"]}]`)
+	b := write("b.json", `[{"method": "GET", "path": "/api/v1/users", "rules": ["$path == 'y' : block"]}, {"method": "GET", "path": "/api/v2/users", "rules": ["block"]}]`)
+	merged := filepath.Join(dir, "merged.bin")
+
+	count := func(path string) int {
+		snts, _, _, err := opts.Load(path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(snts)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want int
+		err  string
+	}{
+		{[]string{"-o", merged, a, b}, 0, "endpoint GET /api/v1/users is defined twice"},
+		{[]string{"-o", merged, "-conflict", "first-wins", a, b}, 3, ""},
+		{[]string{"-o", merged, "-conflict", "concat-rules", a, b}, 3, ""},
+		{[]string{"-o", merged, "-conflict", "last-wins", a, b}, 0, "unknown conflict policy"},
+		{[]string{"-o", merged, a}, 0, "usage: mkrul merge"},
+	} {
+		err := mergeCmd(tc.args)
+
+		if len(tc.err) != 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("merge %v: error %v, want %q", tc.args, err, tc.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("merge %v: %v", tc.args, err)
+		} else if got := count(merged); got != tc.want {
+			t.Errorf("merge %v: %d endpoints, want %d", tc.args, got, tc.want)
+		}
+	}
+
+	shards := filepath.Join(dir, "shards")
+
+	if err := os.MkdirAll(shards, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := splitCmd([]string{"-i", merged, "-o", shards, "-by-prefix", "/api/v1,/api/v2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		file string
+		want int
+	}{
+		{"api_v1.bin", 1},
+		{"api_v2.bin", 1},
+		{"rest.bin", 1},
+	} {
+		if got := count(filepath.Join(shards, tc.file)); got != tc.want {
+			t.Errorf("%s: %d endpoints, want %d", tc.file, got, tc.want)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := filepath.Join(dir, "cache")
+
+	write := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := filepath.Join(dir, "a.json")
+	b := filepath.Join(dir, "b.json")
+	c := filepath.Join(dir, "c.json")
+	out := filepath.Join(dir, "sentinels.bin")
+
+	write(a, `[{"method": "GET", "path": "/a", "rules": ["block"]}]`)
+	write(b, `[{"method": "GET", "path": "/a", "rules": ["block"]}]`)
+	write(c, `[{"method": "GET", "path": "/a", "rules": ["pass"]}]`)
+	write(out, "artifact")
+
+	key := func(path string) string {
+		key, err := cacheKey(path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return key
+	}
+
+	for _, tc := range []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"same rules elsewhere", a, b, true},
+		{"other rules", a, c, false},
+	} {
+		if got := key(tc.a) == key(tc.b); got != tc.same {
+			t.Errorf("%s: same key %v, want %v", tc.name, got, tc.same)
+		}
+	}
+
+	if err := storeCache(cache, key(a), []string{out}); err != nil {
+		t.Fatal(err)
+	}
+
+	write(out, "stale")
+
+	for _, tc := range []struct {
+		name string
+		key  string
+		hit  bool
+		want string
+	}{
+		{"miss", key(c), false, "stale"},
+		{"hit", key(b), true, "artifact"},
+	} {
+		if hit := restoreCache(cache, tc.key, []string{out}); hit != tc.hit {
+			t.Errorf("%s: hit %v, want %v", tc.name, hit, tc.hit)
+		}
+
+		if data, _ := os.ReadFile(out); string(data) != tc.want {
+			t.Errorf("%s: output %q, want %q", tc.name, data, tc.want)
+		}
+	}
+}
+
+func TestExportEnvoy(t *testing.T) {
+	for _, tc := range []struct {
+		mode     string
+		want     []string
+		embedded bool
+		err      string
+	}{
+		{"ext_proc", []string{"envoy.filters.http.ext_proc", "cluster_name: waf"}, false, ""},
+		{"wasm", []string{"envoy.filters.http.wasm", "filename: /opt/waf.wasm"}, true, ""},
+		{"lua", nil, false, "unknown envoy mode: lua"},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			dir := t.TempDir()
+			err := exportEnvoy([]string{"-i", "../../testdata/endpoints.json", "-o", dir, "-mode", tc.mode, "-cluster", "waf", "-wasm", "/opt/waf.wasm"})
+
+			if len(tc.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want %q", err, tc.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conf, err := os.ReadFile(filepath.Join(dir, "envoy.yaml"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			artifact, err := os.ReadFile(filepath.Join(dir, "sentinels.bin"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, _, err = opts.Load(filepath.Join(dir, "sentinels.bin")); err != nil {
+				t.Fatal(err)
+			}
+
+			want := tc.want
+
+			if tc.embedded {
+				want = append(want, base64.StdEncoding.EncodeToString(artifact))
+			}
+
+			for _, w := range want {
+				if !bytes.Contains(conf, []byte(w)) {
+					t.Errorf("envoy.yaml without %q:\n%s", w, conf)
+				}
+			}
+		})
+	}
+}
+
+func TestPublish(t *testing.T) {
+	type upload struct {
+		method, path, auth, body string
+	}
+
+	var got upload
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = upload{r.Method, r.URL.Path, r.Header.Get("Authorization"), string(body)}
+
+		if strings.Contains(r.URL.Path, "denied") {
+			http.Error(w, "access denied", http.StatusForbidden)
+		}
+	}))
+
+	defer srv.Close()
+
+	data := []byte("artifact")
+	hash := mkrul.SHA256Hex(data)
+
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "")
+
+	for _, tc := range []struct {
+		name   string
+		target string
+		want   upload
+		auth   string
+		err    string
+	}{
+		{"http", srv.URL + "/rules/{hash}.bin", upload{http.MethodPut, "/rules/" + hash + ".bin", "", "artifact"}, "", ""},
+		{"s3", "s3://bucket/rules/sentinels.bin", upload{http.MethodPut, "/bucket/rules/sentinels.bin", "", "artifact"}, "AWS4-HMAC-SHA256 Credential=id/", ""},
+		{"rejected", srv.URL + "/denied.bin", upload{}, "", "403 Forbidden: access denied"},
+		{"gs without token", "gs://bucket/sentinels.bin", upload{}, "", "GOOGLE_OAUTH_ACCESS_TOKEN is required"},
+		{"scheme", "ftp://host/sentinels.bin", upload{}, "", "unsupported publish scheme: ftp"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got = upload{}
+
+			target, err := publish(tc.target, data)
+
+			if len(tc.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want %q", err, tc.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Contains(target, "{hash}") {
+				t.Errorf("target %s, want the hash in it", target)
+			}
+
+			if !strings.HasPrefix(got.auth, tc.auth) {
+				t.Errorf("authorization %q, want %q", got.auth, tc.auth)
+			}
+
+			got.auth = ""
+
+			if got != tc.want {
+				t.Errorf("upload %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFetchKV(t *testing.T) {
+	var etcdRange map[string][]byte
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/kv/rules":
+			if r.URL.Query().Get("recurse") != "true" || r.URL.Query().Get("index") != "3" {
+				http.Error(w, "bad query", http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("X-Consul-Index", "7")
+			_ = json.NewEncoder(w).Encode([]map[string]any{{"Key": "rules/a.json", "Value": []byte("a")}})
+		case "/v1/kv/missing":
+			http.NotFound(w, r)
+		case "/v3/kv/range":
+			_ = json.NewDecoder(r.Body).Decode(&etcdRange)
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"header": map[string]string{"revision": "9"},
+				"kvs":    []map[string][]byte{{"key": []byte("rules/b.json"), "value": []byte("b")}},
+			})
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	interval := *watchInterval
+	*watchInterval = 0
+
+	defer func() {
+		*watchInterval = interval
+	}()
+
+	for _, tc := range []struct {
+		source string
+		want   []KV
+		next   uint64
+		err    string
+	}{
+		{"consul://" + host + "/rules", []KV{{"rules/a.json", []byte("a")}}, 7, ""},
+		{"consul://" + host + "/missing", nil, 0, ""},
+		{"consul://" + host + "/down", nil, 3, "503 Service Unavailable"},
+		{"etcd://" + host + "/rules/", []KV{{"rules/b.json", []byte("b")}}, 9, ""},
+		{"zookeeper://" + host + "/rules", nil, 3, "unsupported watch scheme: zookeeper"},
+	} {
+		src, err := url.Parse(tc.source)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kvs, next, err := fetchKV(src, 3)
+
+		if len(tc.err) != 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error %v, want %q", tc.source, err, tc.err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tc.source, err)
+		} else if fmt.Sprint(kvs) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: %v, want %v", tc.source, kvs, tc.want)
+		}
+
+		if next != tc.next {
+			t.Errorf("%s: index %d, want %d", tc.source, next, tc.next)
+		}
+	}
+
+	// the range of a prefix ends at the prefix with its last byte bumped
+	if got := string(etcdRange["range_end"]); got != "rules0" {
+		t.Errorf("etcd range end %q, want rules0", got)
+	}
+}
+
+func TestRecompile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		kvs  []KV
+		skip string
+		want int
+		err  string
+	}{
+		{"merged", []KV{{"rules/b.json", []byte(`[{"method": "GET", "path": "/b", "rules": ["block"]}]`)}, {"rules/a.json", []byte(`{"endpoints": [{"method": "GET", "path": "/a", "rules": ["block"]}]}`)}}, "", 2, ""},
+		{"empty and output skipped", []KV{{"rules/a.json", []byte(`[{"method": "GET", "path": "/a", "rules": ["block"]}]`)}, {"rules/empty", []byte(" \n")}, {"rules/sentinels.bin", []byte("binary")}}, "rules/sentinels.bin", 1, ""},
+		{"invalid", []KV{{"rules/a.json", []byte(`[{"method": "GET"`)}}, "", 0, "rules/a.json"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := recompile(tc.kvs, tc.skip)
+
+			if len(tc.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want %q", err, tc.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			snts, _, _, err := opts.DecodeSentinels(bytes.NewReader(data))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(snts) != tc.want {
+				t.Errorf("%d endpoints, want %d", len(snts), tc.want)
+			}
+		})
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	stderr, level, format, quietMode, debugMode := os.Stderr, *logLevel, *logFormat, *quiet, *debug
+	logger := slog.Default()
+
+	defer func() {
+		os.Stderr, *logLevel, *logFormat, *quiet, *debug = stderr, level, format, quietMode, debugMode
+		slog.SetDefault(logger)
+	}()
+
+	for _, tc := range []struct {
+		name   string
+		level  string
+		format string
+		quiet  bool
+		debug  bool
+		want   []string
+		absent []string
+		code   int
+	}{
+		{"text", "info", "text", false, false, []string{"level=INFO msg=started file=a.json", "level=WARN msg=careful"}, []string{"details"}, mkrul.EXIT_OK},
+		{"json", "warn", "json", false, false, []string{`"level":"WARN","msg":"careful"`}, []string{"started", "details"}, mkrul.EXIT_OK},
+		{"quiet", "info", "text", true, false, nil, []string{"started", "careful"}, mkrul.EXIT_OK},
+		{"debug", "error", "text", false, true, []string{"level=DEBUG msg=details", "msg=started"}, nil, mkrul.EXIT_OK},
+		{"unknown level", "loud", "text", false, false, nil, nil, mkrul.EXIT_USAGE},
+		{"unknown format", "info", "xml", false, false, nil, nil, mkrul.EXIT_USAGE},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := os.CreateTemp(t.TempDir(), "stderr")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer f.Close()
+
+			os.Stderr, *logLevel, *logFormat, *quiet, *debug = f, tc.level, tc.format, tc.quiet, tc.debug
+
+			if err = setupLogging(); err != nil || tc.code != mkrul.EXIT_OK {
+				if code := exitCode(err); err == nil || code != tc.code {
+					t.Fatalf("error %v, exit %d, want %d", err, code, tc.code)
+				}
+
+				return
+			}
+
+			slog.Debug("details")
+			slog.Info("started", "file", "a.json")
+			slog.Warn("careful")
+
+			data, err := os.ReadFile(f.Name())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range tc.want {
+				if !strings.Contains(string(data), want) {
+					t.Errorf("log without %q:\n%s", want, data)
+				}
+			}
+
+			for _, absent := range tc.absent {
+				if strings.Contains(string(data), absent) {
+					t.Errorf("log with %q:\n%s", absent, data)
+				}
+			}
+		})
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	input := "../../testdata/endpoints.json"
+	snts, tmpls, types, err := opts.Compile(input)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		outputs Outputs
+		binary  string
+		formats map[string]string
+	}{
+		{"binary", Outputs{"a.bin"}, "a.bin", map[string]string{"a.bin": "binary"}},
+		{"any extension", Outputs{"rules.dat", "ir.json"}, "rules.dat", map[string]string{"rules.dat": "binary", "ir.json": "json"}},
+		{"first binary", Outputs{"ir.json", "x.bin", "y.bin"}, "x.bin", map[string]string{"ir.json": "json", "x.bin": "binary", "y.bin": "binary"}},
+		{"reports", Outputs{"report.html", "report.md", "ir.json"}, "", map[string]string{"report.html": "<html", "report.md": "#", "ir.json": "json"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			var paths []string
+
+			for _, path := range tc.outputs {
+				paths = append(paths, filepath.Join(dir, path))
+			}
+
+			if got := tc.outputs.Binary(); got != tc.binary {
+				t.Errorf("binary output %q, want %q", got, tc.binary)
+			}
+
+			if err := writeOutputs(paths, snts, tmpls, types); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := writeReports(paths, input); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, format := range tc.formats {
+				path := filepath.Join(dir, name)
+
+				switch format {
+				case "binary":
+					if loaded, _, _, err := opts.Load(path); err != nil || len(loaded) != len(snts) {
+						t.Errorf("%s: %d endpoints, %v", name, len(loaded), err)
+					}
+				case "json":
+					var ir IR
+
+					if data, err := os.ReadFile(path); err != nil || json.Unmarshal(data, &ir) != nil || ir.Version != mkrul.VERSION {
+						t.Errorf("%s: not the intermediate representation: %v", name, err)
+					}
+				default:
+					if data, err := os.ReadFile(path); err != nil || !bytes.Contains(data, []byte(format)) {
+						t.Errorf("%s: without %q: %v", name, format, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "endpoints.json")
+
+	err := os.WriteFile(in, []byte(`{
+		"responses": {"teapot": {"content_type": "text/plain", "body": "no"}},
+		"endpoints": [
+			{"method": "", "path": "/a", "owner": "web", "description": "login form", "rules": [
+				{"rule": "$val == '<script>' : block", "owner": "appsec", "severity": "high", "expires": "2030-01-01"},
+				{"rule": "$key == 'q' : score 5", "enabled": false},
+				"$key == 'r' : redirect '/login'",
+				"$key == 't' : respond 418 'teapot'",
+				"pass"
+			]}
+		]
+	}`), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		out    string
+		want   []string
+		absent []string
+	}{
+		{"rules.html", []string{`id="endpoint-0"`, "login form", "appsec", "high", "&lt;script&gt;", "expires 2030-01-01", "disabled", "score 5", "redirect /login", "respond 418 teapot"}, []string{"<script>"}},
+		{"rules.md", []string{"login form", "appsec", "expires 2030-01-01", "disabled", "score 5", "redirect /login", "respond 418 teapot", "pass"}, nil},
+	} {
+		t.Run(tc.out, func(t *testing.T) {
+			out := filepath.Join(dir, tc.out)
+
+			if err := reportCmd([]string{"-i", in, "-o", out}); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(out)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range tc.want {
+				if !bytes.Contains(data, []byte(want)) {
+					t.Errorf("report without %q:\n%s", want, data)
+				}
+			}
+
+			for _, absent := range tc.absent {
+				if bytes.Contains(data, []byte(absent)) {
+					t.Errorf("report with %q", absent)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateRules(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		rules  []interface{}
+		want   string
+		manual []string
+	}{
+		{"strings", []interface{}{"$val == 'a\\tb' : block", "pass"}, `["$val == 'atb' : block","pass"]`, nil},
+		{"objects", []interface{}{map[string]interface{}{"rule": "block :", "owner": "web"}}, `[{"owner":"web","rule":"block"}]`, nil},
+		{"not a rule", []interface{}{42.0, map[string]interface{}{"owner": "web"}}, `[42,{"owner":"web"}]`, []string{"GET /a rule 0: not a rule", "GET /a rule 1: not a rule"}},
+		{"no action", []interface{}{"$val == 'x'"}, `["$val == 'x'"]`, []string{`GET /a rule "$val == 'x'": no terminal action`}},
+		{"invalid", []interface{}{"$val ==="}, `["$val ==="]`, []string{`GET /a rule "$val ===": `}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var manual []string
+
+			migrateRules(tc.rules, "GET /a", &manual)
+
+			if data, _ := json.Marshal(tc.rules); string(data) != tc.want {
+				t.Errorf("migrated to %s, want %s", data, tc.want)
+			}
+
+			if len(manual) != len(tc.manual) {
+				t.Fatalf("manual %q, want %q", manual, tc.manual)
+			}
+
+			for i, want := range tc.manual {
+				if !strings.HasPrefix(manual[i], want) {
+					t.Errorf("manual %q, want %q", manual[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLintContexts(t *testing.T) {
+	rules := func(rules ...string) []mkrul.Rule {
+		var result []mkrul.Rule
+
+		for _, rule := range rules {
+			result = append(result, mkrul.Rule{Rule: rule})
+		}
+
+		return result
+	}
+
+	for _, tc := range []struct {
+		name     string
+		endpoint mkrul.Endpoint
+		want     []string
+	}{
+		{"json on get", mkrul.Endpoint{Method: "get", Rules: rules("$ctx == 'json' $key == 'id' : block", "pass")}, []string{"context json"}},
+		{"trailers on head", mkrul.Endpoint{Method: "HEAD", Rules: rules("$ctx == 'trailers' : block")}, []string{"context trailers"}},
+		{"some context alive", mkrul.Endpoint{Method: "GET", Rules: rules("$ctx == 'json|headers' : block")}, nil},
+		{"json on post", mkrul.Endpoint{Method: "POST", Rules: rules("$ctx == 'json' : block")}, nil},
+		{"json without a json type", mkrul.Endpoint{Method: "POST", ContentTypes: []string{"text/plain"}, Rules: rules("$ctx == 'json_obj|json_array' : block")}, []string{"context json_obj|json_array"}},
+		{"json type", mkrul.Endpoint{Method: "POST", ContentTypes: []string{"application/problem+JSON"}, Rules: rules("$ctx == 'json' : block")}, nil},
+		{"later groups", mkrul.Endpoint{Method: "GET", Rules: rules("$ctx == 'headers' : $ctx == 'json' : block")}, nil},
+	} {
+		got := lintContexts(tc.endpoint)
+
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+			continue
+		}
+
+		for i, want := range tc.want {
+			if !strings.Contains(got[i], want) {
+				t.Errorf("%s: %q, want %q", tc.name, got[i], want)
+			}
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+
+	if err := os.WriteFile(invalid, []byte(`[{"method": "GET", "path": "/a", "rules": ["$val === : block"]}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		code    int
+		written bool
+		stdout  string
+	}{
+		{"compile", []string{"-i", "../../testdata/endpoints.json"}, mkrul.EXIT_OK, true, ""},
+		{"dry run", []string{"-dry-run", "-i", "../../testdata/endpoints.json"}, mkrul.EXIT_OK, false, "sentinels"},
+		{"validate", []string{"validate", "-i", "../../testdata/endpoints.json"}, mkrul.EXIT_OK, false, ""},
+		{"dry run of invalid rules", []string{"-dry-run", "-i", invalid}, mkrul.EXIT_PARSE, false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "sentinels.bin")
+			stdout, code := runMain(t, append(tc.args, "-o", out)...)
+
+			if code != tc.code {
+				t.Errorf("exit %d, want %d", code, tc.code)
+			}
+
+			if _, err := os.Stat(out); (err == nil) != tc.written {
+				t.Errorf("output written %v, want %v", err == nil, tc.written)
+			}
+
+			if !strings.Contains(stdout, tc.stdout) {
+				t.Errorf("stdout %q, want %q", stdout, tc.stdout)
+			}
+		})
+	}
+}
+
+func TestExportOpenAPI(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "endpoints.json")
+	spec := filepath.Join(dir, "api.json")
+	out := filepath.Join(dir, "out.json")
+
+	endpoints := `[
+		{"path": "/api/users/{id:int}", "method": "GET", "owner": "team-a", "rules": ["$val == 'x' : block"]},
+		{"path": "/api", "method": "POST", "rules": ["pass"]}
+	]`
+	doc := `{"paths": {
+		"/api/users/{uid}": {"get": {}, "post": {}},
+		"/other": {"get": {"x-waf-rules": {"endpoint": "stale"}}}
+	}}`
+
+	if err := os.WriteFile(conf, []byte(endpoints), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(spec, []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exportOpenAPI([]string{"-i", conf, "-spec", spec, "-o", out}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		Paths map[string]map[string]struct {
+			Policy *OpenAPIPolicy `json:"x-waf-rules"`
+		} `json:"paths"`
+	}
+
+	data, err := os.ReadFile(out)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path, method string
+		endpoint     string
+		owner        string
+		rules        int
+	}{
+		{"/api/users/{uid}", "get", "GET /api/users/{id:int}", "team-a", 1},
+		{"/api/users/{uid}", "post", "POST /api", "", 1},
+		{"/other", "get", "", "", 0},
+	} {
+		policy := got.Paths[tc.path][tc.method].Policy
+
+		switch {
+		case len(tc.endpoint) == 0 && policy != nil:
+			t.Errorf("%s %s: annotated with %+v", tc.method, tc.path, policy)
+		case len(tc.endpoint) != 0 && policy == nil:
+			t.Errorf("%s %s: not annotated", tc.method, tc.path)
+		case policy != nil && (policy.Endpoint != tc.endpoint || policy.Owner != tc.owner || len(policy.Rules) != tc.rules):
+			t.Errorf("%s %s: %+v, want endpoint %q owner %q and %d rules", tc.method, tc.path, policy, tc.endpoint, tc.owner, tc.rules)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	users := `{"path": "/users", "method": "GET", "rules": ["$val == 'x' : block"]}`
+	admin := `{"path": "/admin", "method": "GET", "rules": ["block"]}`
+	changed := `{"path": "/users", "method": "GET", "rules": ["$val == 'y' : block"]}`
+
+	for _, tc := range []struct {
+		name, before, after  string
+		add, change, destroy int
+	}{
+		{"no state", "", "[" + users + "]", 1, 0, 0},
+		{"unchanged", "[" + users + "]", "[" + users + "]", 0, 0, 0},
+		{"added", "[" + users + "]", "[" + users + "," + admin + "]", 1, 0, 0},
+		{"destroyed", "[" + users + "," + admin + "]", "[" + users + "]", 0, 0, 1},
+		{"changed", "[" + users + "]", "[" + changed + "]", 0, 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			in := filepath.Join(dir, "endpoints.json")
+			state := filepath.Join(dir, "sentinels.bin")
+
+			if len(tc.before) != 0 {
+				if err := os.WriteFile(in, []byte(tc.before), 0644); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := applyCmd([]string{"-i", in, "-state", state, "-auto-approve"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := os.WriteFile(in, []byte(tc.after), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			plan, err := makePlan(in, state)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if plan.Add != tc.add || plan.Change != tc.change || plan.Destroy != tc.destroy {
+				t.Errorf("plan %+v, want %d to add, %d to change, %d to destroy", plan.Changes, tc.add, tc.change, tc.destroy)
+			}
+
+			if err = applyCmd([]string{"-i", in, "-state", state, "-auto-approve"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if plan, err = makePlan(in, state); err != nil || !plan.Empty() {
+				t.Errorf("plan after apply %+v, %v, want no changes", plan.Changes, err)
+			}
+		})
+	}
+}
+
+func TestWriteGithub(t *testing.T) {
+	rule := 2
+
+	for _, tc := range []struct {
+		diag Diagnostic
+		want string
+	}{
+		{Diagnostic{Severity: "error", Message: "bad"}, "::error::bad\n"},
+		{Diagnostic{Severity: "warning", File: "endpoints.json", Line: 4, Message: "slow"}, "::warning file=endpoints.json,line=4::slow\n"},
+		{Diagnostic{Severity: "error", File: "a.json", Line: 4, Column: 7, Endpoint: "GET /users", Rule: &rule, Message: "unexpected token"}, "::error file=a.json,line=4,col=7,title=GET /users rule 2::unexpected token\n"},
+		{Diagnostic{Severity: "error", File: "a,b:c.json", Line: 1, Message: "100%\nsure"}, "::error file=a%2Cb%3Ac.json,line=1::100%25%0Asure\n"},
+	} {
+		var buf bytes.Buffer
+
+		writeGithub(&buf, []Diagnostic{tc.diag})
+
+		if buf.String() != tc.want {
+			t.Errorf("writeGithub(%+v) = %q, want %q", tc.diag, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "endpoints.json")
+	endpoints := `[{"path": "/api", "method": "GET", "rules": [
+		"$ctx == 'headers' $key == 'x-attack' : block",
+		"$ctx == 'urlenc' $val == 'evil' : block"
+	]}]`
+
+	if err := os.WriteFile(conf, []byte(endpoints), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snts, tmpls, types, err := opts.Compile(conf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := mkruleval.NewGuard(snts, tmpls, types)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		waf  func(r *http.Request) int
+		err  string
+	}{
+		{"faithful", func(r *http.Request) int {
+			if v := g.Check(r, nil); v.Action != mkruleval.PASS {
+				return v.Status
+			}
+
+			return http.StatusOK
+		}, ""},
+		{"open", func(*http.Request) int { return http.StatusOK }, "diverge from the local engine"},
+		{"closed", func(*http.Request) int { return http.StatusForbidden }, "diverge from the local engine"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.waf(r))
+			}))
+			defer srv.Close()
+
+			err := conformanceCmd([]string{"-i", conf, "-target", srv.URL})
+
+			if len(tc.err) == 0 && err != nil || len(tc.err) != 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("conformance = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestSamples(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "endpoints.json")
+	endpoints := `[{"path": "/api", "method": "POST", "rules": [
+		"$ctx == 'headers' $key == 'x-attack' : block",
+		"$ctx == 'urlenc' $key == 'q' $val == /ev[i]l+/ : block",
+		"$ctx == 'cookie' $key == 'session' $val == 'bad' : block",
+		"$ctx == 'json' $key == 'role' $val == 'admin' : block",
+		"$val | lower == 'zz' : block",
+		"pass"
+	]}]`
+
+	if err := os.WriteFile(conf, []byte(endpoints), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snts, tmpls, types, err := opts.Compile(conf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := mkruleval.NewGuard(snts, tmpls, types)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := samples(g, snts, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]string{}
+
+	for _, sample := range list {
+		found[sample.Name] = sample.Expect
+	}
+
+	for _, tc := range []struct {
+		name   string
+		expect string
+	}{
+		{"POST /api baseline", "pass"},
+		{"POST /api rule 0", "block"},
+		{"POST /api rule 0 benign", "pass"},
+		{"POST /api rule 1", "block"},
+		{"POST /api rule 1 benign", "pass"},
+		{"POST /api rule 2", "block"},
+		{"POST /api rule 2 benign", "pass"},
+		{"POST /api rule 3", "block"},
+		{"POST /api rule 3 benign", "pass"},
+		{"POST /api rule 4", ""},
+	} {
+		if found[tc.name] != tc.expect {
+			t.Errorf("%s: expect %q, want %q", tc.name, found[tc.name], tc.expect)
+		}
+	}
+}
+
+func TestWriteDebug(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "endpoints.json")
+	endpoints := `[{"path": "/api", "method": "GET", "block_threshold": 10, "rules": [
+		"$ctx == 'headers' $key == 'x' : block",
+		"$val == 'a' : score 5"
+	]}]`
+
+	if err := os.WriteFile(conf, []byte(endpoints), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snts, _, _, err := opts.Compile(conf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(format string) { *debugFormat = format }(*debugFormat)
+
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{"text", `GET /api (threshold 10)
+├── rule 0
+│   ├── group 0
+│   │   ├── $ctx == 'headers'
+│   │   └── $key == 'x'
+│   └── group 1
+│       └── block
+└── rule 1
+    ├── group 0
+    │   └── $val == 'a'
+    └── group 1
+        └── score 5
+`},
+		{"json", `[{"endpoint":"GET /api","threshold":10,"rules":[` +
+			`{"rule":"$ctx == 'headers' $key == 'x' : block","groups":[[{"stmt":"$ctx == 'headers'","var":"$ctx","op":"=="},{"stmt":"$key == 'x'","var":"$key","op":"=="}],[{"stmt":"block","op":"block"}]]},` +
+			`{"rule":"$val == 'a' : score 5","groups":[[{"stmt":"$val == 'a'","var":"$val","op":"=="}],[{"stmt":"score 5","op":"score"}]]}]}]`},
+	} {
+		var buf bytes.Buffer
+
+		*debugFormat = tc.format
+
+		if err := writeDebug(&buf, snts); err != nil {
+			t.Fatal(err)
+		}
+
+		if tc.format == "json" {
+			var compact bytes.Buffer
+
+			if err := json.Compact(&compact, buf.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+
+			buf = compact
+		}
+
+		if buf.String() != tc.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tc.format, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestPrintSummary(t *testing.T) {
+	for _, tc := range []struct {
+		n    uint64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KB"},
+		{1536, "1.5KB"},
+		{5 << 20, "5.0MB"},
+		{3 << 30, "3.0GB"},
+	} {
+		if got := formatSize(tc.n); got != tc.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tc.n, got, tc.want)
+		}
+	}
+
+	binary := filepath.Join(t.TempDir(), "sentinels.bin")
+
+	if err := os.WriteFile(binary, make([]byte, 2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	block := mkruleval.SentinelRule{Groups: [][]mkruleval.Stmt{{{Op: mkruleval.BLOCK}}}}
+	snts := []mkruleval.Sentinel{{Method: "GET", Rules: []mkruleval.SentinelRule{block, block}}, {Rules: []mkruleval.SentinelRule{block}}}
+
+	for _, tc := range []struct {
+		cached bool
+		want   string
+	}{
+		{false, "compiled 2 endpoints, 3 rules, 2.0KB, 42ms\n"},
+		{true, "restored 2.0KB from the cache, 42ms\n"},
+	} {
+		var buf bytes.Buffer
+
+		if err := printSummary(&buf, snts, nil, nil, binary, tc.cached, 42*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.String() != tc.want {
+			t.Errorf("printSummary(cached=%t) = %q, want %q", tc.cached, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestChangelog(t *testing.T) {
+	dir := t.TempDir()
+	notes := filepath.Join(dir, "CHANGES")
+	base := filepath.Join(dir, "base.bin")
+	in := filepath.Join(dir, "endpoints.json")
+
+	if err := os.WriteFile(notes, []byte("Release 2\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(in, []byte(`[
+		{"path": "/a", "method": "GET", "rules": ["$val == 'x' : block", "pass"]},
+		{"path": "/b", "method": "GET", "rules": ["block"]}
+	]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyCmd([]string{"-i", in, "-state", base, "-auto-approve"}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(file, base string) { *changelogFile, *changelogBase = file, base }(*changelogFile, *changelogBase)
+
+	for _, tc := range []struct {
+		name      string
+		endpoints string
+		file      string
+		base      string
+		want      string
+	}{
+		{"nothing", `[]`, "", "", ""},
+		{"notes only", `[]`, notes, "", "Release 2"},
+		{"unchanged", `[
+			{"path": "/a", "method": "GET", "rules": ["$val == 'x' : block", "pass"]},
+			{"path": "/b", "method": "GET", "rules": ["block"]}
+		]`, "", base, "Changes from base.bin:\nno changes"},
+		{"changed", `[
+			{"path": "/a", "method": "GET", "block_threshold": 5, "rules": ["$val == 'y' : block", "pass"]},
+			{"path": "/c", "method": "GET", "rules": ["pass"]}
+		]`, notes, base, "Release 2\n\nChanges from base.bin:\n" +
+			"~ GET /a\n  ~ endpoint settings\n  + rule 0: block\n  - rule 0: block\n" +
+			"- GET /b (1 rules)\n+ GET /c (1 rules)"},
+		{"reordered", `[
+			{"path": "/a", "method": "GET", "rules": ["pass", "$val == 'x' : block"]},
+			{"path": "/b", "method": "GET", "rules": ["block"]}
+		]`, "", base, "Changes from base.bin:\n~ GET /a\n  ~ rules reordered"},
+	} {
+		if err := os.WriteFile(in, []byte(tc.endpoints), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		snts, _, _, err := opts.Compile(in)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		*changelogFile, *changelogBase = tc.file, tc.base
+		got, err := makeChangelog(snts)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tc.want {
+			t.Errorf("%s: changelog\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAttestation(t *testing.T) {
+	defer func(inputs map[string]string) { opts.Inputs = inputs }(opts.Inputs)
+
+	for _, tc := range []struct {
+		name   string
+		change func(in, artifact string) error
+		err    string
+	}{
+		{"untouched", func(in, artifact string) error { return nil }, ""},
+		{"input removed", func(in, artifact string) error { return os.Remove(in) }, ""},
+		{"input changed", func(in, artifact string) error {
+			return os.WriteFile(in, []byte(`[{"path": "/", "method": "", "rules": ["pass"]}]`), 0644)
+		}, "changed since the build"},
+		{"artifact changed", func(in, artifact string) error {
+			return os.WriteFile(artifact, []byte("other"), 0644)
+		}, "the statement is not about this artifact"},
+		{"not a provenance", func(in, artifact string) error {
+			data, err := os.ReadFile(artifact + ".intoto.json")
+
+			if err != nil {
+				return err
+			}
+
+			return os.WriteFile(artifact+".intoto.json", bytes.Replace(data, []byte("slsa.dev"), []byte("example.com"), 1), 0644)
+		}, "not a provenance statement of mkrul"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			in := filepath.Join(dir, "endpoints.json")
+			artifact := filepath.Join(dir, "sentinels.bin")
+			opts.Inputs = map[string]string{}
+
+			if err := os.WriteFile(in, []byte(`[{"path": "/", "method": "", "rules": ["block"]}]`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := applyCmd([]string{"-i", in, "-state", artifact, "-auto-approve"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := attest(artifact, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tc.change(in, artifact); err != nil {
+				t.Fatal(err)
+			}
+
+			err := verifyAttestation([]string{artifact})
+
+			if len(tc.err) == 0 && err != nil || len(tc.err) != 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("verify = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
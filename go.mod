@@ -0,0 +1,5 @@
+module github.com/tantalsec/Mkrul
+
+go 1.23
+
+require golang.org/x/text v0.21.0
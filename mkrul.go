@@ -1,76 +1,263 @@
-package main
+// Package mkrul compiles endpoint rules into sentinel artifacts, reads
+// them back, and keeps the current ones of a process in a Store.
+package mkrul
 
 import (
 	"bytes"
+	"cmp"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
-	"flag"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
-)
+	"unicode/utf8"
 
-const (
-	VERSION = 4
+	"github.com/tantalsec/Mkrul/mkruleval"
+	"golang.org/x/text/unicode/norm"
 )
 
 const (
-	CTX = 1
-	KEY = 2
-	VAL = 3
-	DEPTH = 4
+	VERSION    = 5
+	V4_VERSION = 4
 )
 
-const (
-	NUMERIC = 1
-	STRING  = 2
-	REGEXP  = 3
-)
+// ArgVars are the variables taking a name operand, e.g. $cookie('session'),
+// kept in the Arg field of the statement.
+var ArgVars = map[uint8]bool{mkruleval.COOKIE_VAL: true, mkruleval.HEADER_VAL: true, mkruleval.CAPTURE: true, mkruleval.PSEUDO: true}
 
-const (
-	BLOCK = 1
-	PASS  = 2
-	EQ    = 3
-	NEQ   = 4
-)
+// pseudoHeaders are the names $pseudo takes, the request pseudo-headers of
+// HTTP/2 and HTTP/3.
+var pseudoHeaders = []string{":method", ":scheme", ":authority", ":path"}
+
+// protoVersions are the values of $proto.
+var protoVersions = []string{"1.0", "1.1", "2", "3"}
 
 const (
-	AUTH_HEADER= 11
-	HEADERS    = 4
-	URLENC     = 3
-	BASE64     = 9
-	BASE64_URL = 10
-	COOKIE     = 8
-	JSON       = 5
-	JSON_OBJ   = 6
-	JSON_ARRAY = 7
-	PATH       = 2
-	HTTP       = 1
-	JWT        = 12
+	NUMERIC  = 1
+	STRING   = 2
+	REGEXP   = 3
+	RESPONSE = 4
+	BYTES    = 5
+	VARIABLE = 6
+	DETECTOR = 7
 )
 
+type Active struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Cron string `json:"cron"`
+}
+
+type Rule struct {
+	Rule        string   `json:"rule"`
+	ID          string   `json:"id"`
+	Enabled     *bool    `json:"enabled"`
+	Active      *Active  `json:"active"`
+	Expires     string   `json:"expires"`
+	Sample      *float64 `json:"sample"`
+	Normalize   string   `json:"normalize"`
+	Description string   `json:"description"`
+	Owner       string   `json:"owner"`
+	Severity    string   `json:"severity"`
+	Priority    int      `json:"priority"`
+	Use         string   `json:"use"`
+	Except      string   `json:"except"`
+
+	// Variants are formulations of the rule compared in the Experiment,
+	// given instead of Rule
+	Experiment string   `json:"experiment"`
+	Variants   []string `json:"variants"`
+
+	index  int
+	source string
+	pos    Position
+
+	// variant is the number of the variant of an experiment, from 1
+	variant int
+}
+
+// Position is where an endpoint or a rule is defined in the input, for
+// the diagnostics. Col is the byte column, 0 for line-based formats.
+type Position struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Position) String() string {
+	if p.Col == 0 {
+		return fmt.Sprintf("%s:%d", p.File, p.Line)
+	}
+
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// Pos returns where the rule is defined, the zero Position if unknown.
+func (r Rule) Pos() Position {
+	return r.pos
+}
+
+// lineStarts returns the offsets of the lines of data.
+func lineStarts(data []byte) []int {
+	starts := []int{0}
+
+	for i, c := range data {
+		if c == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+
+	return starts
+}
+
+// offsetPosition turns a byte offset into a line and column.
+func offsetPosition(path string, starts []int, off int) Position {
+	line, found := slices.BinarySearch(starts, off)
+
+	if found {
+		line++
+	}
+
+	return Position{path, line, off - starts[line-1] + 1}
+}
+
+func (r *Rule) UnmarshalJSON(data []byte) error {
+	type rule Rule
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("\"")) {
+		return json.Unmarshal(data, &r.Rule)
+	}
+
+	return json.Unmarshal(data, (*rule)(r))
+}
+
 type Endpoint struct {
-	Method string `json:"method"`
-	Path  string   `json:"path"`
-	Rules []string `json:"rules"`
+	Method          string   `json:"method"`
+	Path            string   `json:"path"`
+	Rules           []Rule   `json:"rules"`
+	BlockThreshold  uint64   `json:"block_threshold"`
+	Active          *Active  `json:"active"`
+	CaseInsensitive bool     `json:"case_insensitive"`
+	Inherit         bool     `json:"inherit"`
+	Priority        int      `json:"priority"`
+	ContentTypes    []string `json:"content_types"`
+	Description     string   `json:"description"`
+	Owner           string   `json:"owner"`
+	RulesFile       string   `json:"rules_file"`
+	Charsets        []string `json:"charsets"`
+	Labels          []string `json:"labels"`
+
+	ForbidControlChars bool     `json:"forbid_control_chars"`
+	AllowControlChars  []string `json:"allow_control_chars"`
+	RequiredHeaders    []string `json:"required_headers"`
+	AllowedHeaders     []string `json:"allowed_headers"`
+	AllowedStatus      []int    `json:"allowed_status"`
+
+	CookiePolicy *CookiePolicy `json:"cookie_policy,omitempty"`
+	CORS         *CORS         `json:"cors,omitempty"`
+	BotPolicy    *BotPolicy    `json:"bot_policy,omitempty"`
+	Sequences    []Sequence    `json:"sequences,omitempty"`
+
+	// Schema is an inline JSON schema or the name of a schema file
+	Schema json.RawMessage `json:"schema,omitempty"`
+
+	pos Position
+}
+
+// Pos returns where the endpoint is defined, the zero Position if unknown.
+func (e Endpoint) Pos() Position {
+	return e.pos
+}
+
+// CookiePolicy lists the attributes the cookies set by the responses of an
+// endpoint must have; SameSite is the least strict accepted level.
+type CookiePolicy struct {
+	Secure   bool   `json:"secure"`
+	HttpOnly bool   `json:"http_only"`
+	SameSite string `json:"same_site"`
+	Action   string `json:"action"`
+}
+
+// CORS lists the origins allowed to call an endpoint from a browser, with
+// the methods and request headers of their preflight requests.
+type CORS struct {
+	Origins     []string `json:"origins"`
+	Methods     []string `json:"methods"`
+	Headers     []string `json:"headers"`
+	Credentials bool     `json:"credentials"`
 }
 
-type Stmt struct {
-	Var    uint8
-	Op     uint8
-	Val    string
-	Regexp string
+// BotPolicy turns away the clients not behaving like browsers: requests
+// missing the headers browsers send, User-Agents of HTTP libraries and
+// automated browsers, and denied header fingerprints. An allowed
+// fingerprint skips the other checks.
+type BotPolicy struct {
+	RequireBrowserHeaders bool     `json:"require_browser_headers"`
+	DenyAutomation        bool     `json:"deny_automation"`
+	AllowFingerprints     []string `json:"allow_fingerprints"`
+	DenyFingerprints      []string `json:"deny_fingerprints"`
+	Action                string   `json:"action"`
 }
 
-type Sentinel struct {
-	Method string
-	Path  []string
-	Rules [][][]Stmt
+// Sequence counts the requests of a key matching the conditions of its
+// rule, e.g. the failed logins of a client address, and takes the action
+// of the rule on the requests of the key once count of them were made
+// within the window. With statuses, a request counts once its response
+// has one of them.
+type Sequence struct {
+	Key    string `json:"key"`
+	Rule   string `json:"rule"`
+	Count  uint32 `json:"count"`
+	Window string `json:"window"`
+	Status []int  `json:"status,omitempty"`
 }
 
+type Response struct {
+	ContentType string `json:"content_type"`
+	Body        string `json:"body"`
+}
+
+type Config struct {
+	Responses       map[string]Response `json:"responses"`
+	Endpoints       []Endpoint          `json:"endpoints"`
+	CaseInsensitive bool                `json:"case_insensitive"`
+	Normalize       string              `json:"normalize"`
+	Use             []string            `json:"use"`
+	ContentContexts map[string]string   `json:"content_contexts"`
+}
+
+// crossVars are the variables a cross-value comparison takes on either
+// side: those of the item, $key and $val, and the request values.
+var crossVars = map[uint8]bool{mkruleval.KEY: true, mkruleval.VAL: true, mkruleval.COOKIE_VAL: true, mkruleval.HEADER_VAL: true, mkruleval.SCHEME: true, mkruleval.CHARSET: true, mkruleval.FILE_EXT: true, mkruleval.PATH_VAR: true, mkruleval.FINGERPRINT: true, mkruleval.TLS_VERSION: true, mkruleval.SNI: true, mkruleval.CLIENT_CERT_CN: true, mkruleval.PROTO: true, mkruleval.PSEUDO: true, mkruleval.CAPTURE: true}
+
 type NopWriter uint64
 
 func (w *NopWriter) Write(data []byte) (int, error) {
@@ -78,488 +265,7046 @@ func (w *NopWriter) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// Ordered is implemented by the writers and readers of artifacts with a
+// byte order other than the default little-endian.
+type Ordered interface {
+	ByteOrder() binary.ByteOrder
+}
+
+func orderOf(v any) binary.ByteOrder {
+	if o, ok := v.(Ordered); ok {
+		return o.ByteOrder()
+	}
+
+	return binary.LittleEndian
+}
+
+// CountingWriter tracks the absolute offset of the data written to w.
+type CountingWriter struct {
+	w     io.Writer
+	n     uint64
+	order binary.ByteOrder
+}
+
+func (w *CountingWriter) ByteOrder() binary.ByteOrder {
+	return w.order
+}
+
+func (w *CountingWriter) Write(data []byte) (int, error) {
+	n, err := w.w.Write(data)
+	w.n += uint64(n)
+	return n, err
+}
+
+func (w *CountingWriter) Offset() uint64 {
+	return w.n
+}
+
 func (w *NopWriter) Offset() uint64 {
 	return uint64(*w)
 }
 
-func parseVar(val string) (uint8, error) {
-	switch val {
-	case "$ctx":
-		return CTX, nil
-	case "$key":
-		return KEY, nil
-	case "$val":
-		return VAL, nil
-	case "$depth":
-		return DEPTH, nil
+var customOps = map[string]uint8{}
+
+func makeContentTypes(mapping map[string]string) (mkruleval.ContentTypes, error) {
+	types := mkruleval.ContentTypes{}
+
+	for contentType, ctx := range mapping {
+		if err := types.Register(contentType, ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return types, nil
+}
+
+// RegisterContext declares a custom context for the compiler and the
+// engine alike, with a code in the custom range.
+func RegisterContext(name string, code uint8) error {
+	return mkruleval.RegisterContext(name, code)
+}
+
+func RegisterOp(name string, code uint8) error {
+	if code < mkruleval.CUSTOM_OP_MIN {
+		return fmt.Errorf("operator code %d is out of custom range %d-%d", code, mkruleval.CUSTOM_OP_MIN, mkruleval.CUSTOM_OP_MAX)
+	}
+
+	if _, err := parseOp(name); err == nil {
+		return fmt.Errorf("operator already defined: %s", name)
+	}
+
+	for other, n := range customOps {
+		if n == code {
+			return fmt.Errorf("operator code %d already used by %s", code, other)
+		}
+	}
+
+	customOps[name] = code
+
+	return nil
+}
+
+func parseVar(val string) (uint8, string, error) {
+	if len(val) == 2 && val[1] >= '1' && val[1] <= '9' {
+		return mkruleval.CAPTURE, val[1:], nil
+	}
+
+	for code, name := range mkruleval.VarNames {
+		if !ArgVars[code] && val == name {
+			return code, "", nil
+		}
+	}
+
+	for code := range ArgVars {
+		name := mkruleval.VarNames[code]
+
+		if arg, ok := strings.CutPrefix(val, name+"('"); ok {
+			if arg, ok = strings.CutSuffix(arg, "')"); !ok || len(arg) == 0 || strings.Contains(arg, "'") {
+				return 0, "", fmt.Errorf("invalid %s name: %s", name, val)
+			}
+
+			if code == mkruleval.PSEUDO && !slices.Contains(pseudoHeaders, arg) {
+				return 0, "", fmt.Errorf("unknown pseudo-header: %s, expected one of %s", arg, strings.Join(pseudoHeaders, " "))
+			}
+
+			return code, arg, nil
+		}
 	}
-	return 0, fmt.Errorf("unknown variable: %s", val)
+
+	return 0, "", fmt.Errorf("unknown variable: %s", val)
 }
 
 func parseOp(val string) (uint8, error) {
 	switch val {
 	case "block":
-		return BLOCK, nil
+		return mkruleval.BLOCK, nil
 	case "pass":
-		return PASS, nil
+		return mkruleval.PASS, nil
 	case "==":
-		return EQ, nil
+		return mkruleval.EQ, nil
 	case "!=":
-		return NEQ, nil
+		return mkruleval.NEQ, nil
+	case "score":
+		return mkruleval.SCORE, nil
+	case "redirect":
+		return mkruleval.REDIRECT, nil
+	case "respond":
+		return mkruleval.RESPOND, nil
+	case "is_sqli":
+		return mkruleval.IS_SQLI, nil
+	case "is_xss":
+		return mkruleval.IS_XSS, nil
+	}
+
+	if n, ok := customOps[val]; ok {
+		return n, nil
 	}
+
 	return 0, fmt.Errorf("unknown operator: %s", val)
 }
 
-func parseRule(rule string) ([][]Stmt, error) {
-	var result [][]Stmt
+func ParseRule(rule string) ([][]mkruleval.Stmt, error) {
+	var result [][]mkruleval.Stmt
+
+	groups, err := scanGroups(rule)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, group := range groups {
+		stmts, err := parseGroup(group)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// only the last group may be a bare action: a group without
+		// conditions before it would match every request
+		switch {
+		case len(stmts) == 0:
+			return nil, fmt.Errorf("empty group: %s", strings.Join(group, " "))
+		case i < len(groups)-1 && !slices.ContainsFunc(stmts, func(stmt mkruleval.Stmt) bool { return stmt.Var != 0 }):
+			return nil, fmt.Errorf("group without conditions: %s", strings.Join(group, " "))
+		}
+
+		result = append(result, stmts)
+	}
+
+	if err = assignSlots(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// The scanner works on byte offsets into the rule text: tokens are slices
+// of it and only quoted tokens with escapes are copied, into a builder
+// shared by the whole rule.
+
+func scanWord(text string, i int) int {
+	for i < len(text) {
+		r, size := utf8.DecodeRuneInString(text[i:])
+
+		if unicode.IsSpace(r) {
+			return i
+		}
+
+		i += size
+	}
+
+	return i
+}
+
+// scanDelim returns the delimited token starting at text[i] and the offset
+// after it. Tokens without backslashes are returned as is, the others are
+// unescaped into sb.
+func scanDelim(sb *strings.Builder, text string, i int, delim byte) (string, int, error) {
+	start := i
+
+	for i++; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			sb.Reset()
+			sb.WriteString(text[start:i])
+			end, err := scanEscaped(sb, text, i, rune(delim))
+			return sb.String(), end, err
+		case delim:
+			return text[start : i+1], i + 1, nil
+		}
+	}
+
+	return "", i, fmt.Errorf("invalid string: %s", text[start:])
+}
+
+func scanEscaped(dst *strings.Builder, text string, i int, delim rune) (int, error) {
+	escape := false
+
+	for i < len(text) {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+
+		if escape && delim == '\'' {
+			n, err := scanEscape(dst, text[i:], r)
+
+			if err != nil {
+				return i, err
+			}
+			i += n
+			escape = false
+		} else if escape {
+			dst.WriteRune(r)
+			escape = false
+		} else if r == '\\' {
+			escape = true
+		} else if r == delim {
+			dst.WriteRune(r)
+			return i, nil
+		} else {
+			dst.WriteRune(r)
+		}
+	}
+
+	return i, fmt.Errorf("invalid string: %s", dst.String())
+}
+
+// scanEscape writes the escaped rune r, reading the hex digits of \x and \u
+// from src, and returns the number of bytes it consumed.
+func scanEscape(dst *strings.Builder, src string, r rune) (int, error) {
+	var size int
+
+	switch r {
+	case 'n':
+		dst.WriteByte('\n')
+	case 't':
+		dst.WriteByte('\t')
+	case 'r':
+		dst.WriteByte('\r')
+	case '0':
+		dst.WriteByte(0)
+	case 'x':
+		size = 2
+	case 'u':
+		size = 4
+	default:
+		dst.WriteRune(r)
+	}
+
+	if size == 0 {
+		return 0, nil
+	}
+
+	digits := src[:min(size, len(src))]
+	n, err := strconv.ParseUint(digits, 16, 32)
+
+	if err != nil || len(digits) != size {
+		return len(digits), fmt.Errorf("invalid escape: \\%c%s", r, digits)
+	}
+
+	if r == 'x' {
+		dst.WriteByte(byte(n))
+	} else {
+		dst.WriteRune(rune(n))
+	}
+
+	return size, nil
+}
+
+func scanFlags(text string, i int) int {
+	for i < len(text) {
+		r, size := utf8.DecodeRuneInString(text[i:])
+
+		if !unicode.IsLetter(r) {
+			return i
+		}
+
+		i += size
+	}
+
+	return i
+}
+
+// validText replaces every invalid byte of text with U+FFFD, so that the
+// tokens sliced out of it are valid UTF-8.
+func validText(text string) string {
+	if utf8.ValidString(text) {
+		return text
+	}
+
+	var sb strings.Builder
+
+	// ranging over a string yields U+FFFD for each invalid byte
+	for _, r := range text {
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+func scanGroups(text string) ([][]string, error) {
+	var result [][]string
+	var group []string
+	var sb strings.Builder
+
+	colon := -1
+	text = validText(text)
+
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+
+		if unicode.IsSpace(r) {
+			i += size
+			continue
+		}
+
+		switch r {
+		case ':':
+			colon = i
+			if len(group) == 0 {
+				return nil, &PositionError{Pos: colon, Err: fmt.Errorf("rule %s: empty group at position %d", text, colon)}
+			}
+			result = append(result, group)
+			group = nil
+			i += size
+		case '\'':
+			token, end, err := scanDelim(&sb, text, i, '\'')
+			if err != nil {
+				return nil, &PositionError{Pos: i, Err: err}
+			}
+			group = append(group, token)
+			i = end
+		case '/':
+			token, end, err := scanDelim(&sb, text, i, '/')
+			if err != nil {
+				return nil, &PositionError{Pos: i, Err: err}
+			}
+			flags := scanFlags(text, end)
+			if strings.IndexByte(text[i:end], '\\') < 0 {
+				token = text[i:flags]
+			} else {
+				token += text[end:flags]
+			}
+			group = append(group, token)
+			i = flags
+		default:
+			end := scanWord(text, i)
+			group = append(group, text[i:end])
+			i = end
+		}
+	}
+
+	if len(group) == 0 && colon >= 0 {
+		return nil, &PositionError{Pos: colon, Err: fmt.Errorf("rule %s: empty group after position %d", text, colon)}
+	}
+
+	if len(group) != 0 {
+		result = append(result, group)
+	}
+
+	return result, nil
+}
+
+func parseGroup(tokens []string) ([]mkruleval.Stmt, error) {
+	var result []mkruleval.Stmt
+	var curr mkruleval.Stmt
+	var err error
+
+	pipe, above := false, false
+	start := 0
+
+	for i, token := range tokens {
+		// a cross-value comparison is complete once no transform of its
+		// right side follows
+		if curr.Ref.Var != 0 && !pipe && token != "|" {
+			result = append(result, curr)
+			curr = mkruleval.Stmt{}
+		}
+
+		// start is the first token of the statement being built
+		if !begun(curr) {
+			start = i
+		}
+
+		if curr.Op == 0 && !pipe && (strings.HasPrefix(token, "'") || strings.HasPrefix(token, "/") || strings.HasPrefix(token, "0x")) {
+			return nil, fmt.Errorf("operand without an operator: %s", strings.Join(tokens[start:i+1], " "))
+		}
+
+		if pipe {
+			if curr.Ref.Var != 0 {
+				err = curr.Ref.Pipe(token)
+			} else {
+				err = curr.Pipe(token)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			pipe = false
+		} else if token == "|" {
+			if curr.Var == 0 || curr.Op != 0 && curr.Ref.Var == 0 {
+				return nil, fmt.Errorf("transform without a variable: %s", token)
+			}
+
+			pipe = true
+		} else if strings.HasPrefix(token, "'") {
+			curr.Val = token[1 : len(token)-1]
+		} else if strings.HasPrefix(token, "/") {
+			n := strings.LastIndex(token, "/")
+			curr.Regexp = token[:n+1]
+			flags := token[n+1:]
+
+			// c is not a regexp flag, the statement keeps the groups
+			if strings.Contains(flags, "c") {
+				curr.Mods |= mkruleval.MOD_CAPTURE
+				flags = strings.ReplaceAll(flags, "c", "")
+			}
+
+			if curr.Flags, err = parseRegexpFlags(flags); err != nil {
+				return nil, err
+			}
+		} else if strings.HasPrefix(token, "$") && curr.Var != 0 && (curr.Op == mkruleval.EQ || curr.Op == mkruleval.NEQ) {
+			names := strings.Split(token, "|")
+
+			if curr.Ref.Var, curr.Ref.Arg, err = parseVar(names[0]); err != nil {
+				return nil, err
+			}
+
+			if !crossVars[curr.Var] || !crossVars[curr.Ref.Var] {
+				return nil, fmt.Errorf("cross-value comparisons take $key, $val and request values: %s %s", mkruleval.VarNames[curr.Var], names[0])
+			}
+
+			for _, name := range names[1:] {
+				if err = curr.Ref.Pipe(name); err != nil {
+					return nil, err
+				}
+			}
+
+			if curr.Op == mkruleval.EQ {
+				curr.Op = mkruleval.EQ_VAR
+			} else {
+				curr.Op = mkruleval.NEQ_VAR
+			}
+		} else if strings.HasPrefix(token, "$") {
+			names := strings.Split(token, "|")
+			curr.Var, curr.Arg, err = parseVar(names[0])
+
+			if err != nil {
+				return nil, err
+			}
+
+			if curr.Var == mkruleval.CAPTURE {
+				return nil, fmt.Errorf("captures are compared to, not compared: %s", token)
+			}
+
+			for _, name := range names[1:] {
+				if err = curr.Pipe(name); err != nil {
+					return nil, err
+				}
+			}
+		} else if curr.Op == mkruleval.SCORE && curr.Num == 0 {
+			if curr.Num, err = strconv.ParseUint(token, 10, 32); err != nil || curr.Num == 0 {
+				return nil, fmt.Errorf("invalid score: %s", token)
+			}
+		} else if curr.Op == mkruleval.RESPOND && curr.Num == 0 {
+			if curr.Num, err = strconv.ParseUint(token, 10, 16); err != nil || curr.Num < 100 || curr.Num > 599 {
+				return nil, fmt.Errorf("invalid status: %s", token)
+			}
+		} else if mkruleval.BoolVars[curr.Var] && curr.Op != 0 && (token == "true" || token == "false") {
+			curr.Val = token
+		} else if name, ok := strings.CutPrefix(token, "@detector('"); ok {
+			name, _ = strings.CutSuffix(name, "')")
+
+			if curr.Detector, ok = detectorCodes[name]; !ok {
+				return nil, fmt.Errorf("unknown detector: %s", token)
+			}
+
+			if curr.Var != mkruleval.KEY && curr.Var != mkruleval.VAL || curr.Op != mkruleval.EQ && curr.Op != mkruleval.NEQ {
+				return nil, fmt.Errorf("detectors are matched by $key == or $val ==: %s", token)
+			}
+		} else if token == "entropy" && curr.Var == 0 && curr.Op == 0 {
+			// entropy > N is a condition on $val, the threshold is kept in
+			// hundredths of a bit per byte
+			curr.Var, curr.Op = mkruleval.VAL, mkruleval.ENTROPY
+		} else if curr.Op == mkruleval.ENTROPY && !above {
+			if token != ">" {
+				return nil, fmt.Errorf("entropy is compared with >: %s", token)
+			}
+
+			above = true
+		} else if curr.Op == mkruleval.ENTROPY {
+			bits, err := strconv.ParseFloat(token, 64)
+
+			if err != nil || bits < 0 || bits >= 8 {
+				return nil, fmt.Errorf("invalid entropy, from 0 to 8 bits per byte: %s", token)
+			}
+
+			curr.Num = uint64(math.Round(bits * 100))
+			result = append(result, curr)
+			curr, above = mkruleval.Stmt{}, false
+
+			continue
+		} else if token == "luhn" && curr.Var == 0 && curr.Op == 0 {
+			// luhn validates the matches of the regexp before it
+			if len(result) == 0 || len(result[len(result)-1].Regexp) == 0 {
+				return nil, fmt.Errorf("luhn without a regexp: %s", token)
+			}
+
+			if last := &result[len(result)-1]; last.Mods&mkruleval.MOD_CAPTURE != 0 {
+				return nil, fmt.Errorf("luhn cannot validate a capturing regexp: %s", last.Regexp)
+			} else {
+				last.Mods |= mkruleval.MOD_LUHN
+			}
+		} else if strings.HasPrefix(token, "0x") {
+			if curr.Bytes, err = hex.DecodeString(token[2:]); err != nil || len(curr.Bytes) == 0 {
+				return nil, fmt.Errorf("invalid bytes literal: %s", token)
+			}
+
+			if curr.Var == mkruleval.CTX {
+				return nil, fmt.Errorf("bytes literal is not allowed for $ctx: %s", token)
+			}
+		} else {
+			op := curr.Op
+
+			if curr.Op, err = parseOp(token); err != nil {
+				return nil, err
+			}
+
+			if PredicateOp(curr.Op) && op != 0 {
+				return nil, fmt.Errorf("%s takes a variable and no operator: %s", token, CondOp(op))
+			}
+
+			if PredicateOp(curr.Op) && curr.Var == 0 {
+				return nil, fmt.Errorf("%s takes a variable: none given", token)
+			}
+		}
+
+		if curr.Var == mkruleval.FILE_EXT && strings.HasPrefix(curr.Val, ".") {
+			return nil, fmt.Errorf("$file_ext is compared without the dot: %s", token)
+		}
+
+		if curr.Var == mkruleval.PROTO && len(curr.Val) != 0 && !slices.Contains(protoVersions, curr.Val) {
+			return nil, fmt.Errorf("$proto compares to %s: %s", strings.Join(protoVersions, ", "), token)
+		}
+
+		if curr.Var == mkruleval.TLS_VERSION && len(curr.Val) != 0 && !slices.Contains(slices.Collect(maps.Values(mkruleval.TLSVersions)), curr.Val) {
+			return nil, fmt.Errorf("$tls_version compares to 1.0, 1.1, 1.2 or 1.3: %s", token)
+		}
+
+		if mkruleval.BoolVars[curr.Var] && (len(curr.Regexp) != 0 || len(curr.Bytes) != 0 || curr.Detector != 0 || len(curr.Val) != 0 && curr.Val != "true" && curr.Val != "false") {
+			return nil, fmt.Errorf("%s compares to true or false: %s", mkruleval.VarNames[curr.Var], token)
+		}
+
+		if (curr.Var != 0 && curr.Op != 0 && (len(curr.Val) != 0 || len(curr.Regexp) != 0 || len(curr.Bytes) != 0 || curr.Detector != 0)) || (curr.Var != 0 && PredicateOp(curr.Op)) || (curr.Op == mkruleval.BLOCK || curr.Op == mkruleval.PASS) || (curr.Op == mkruleval.SCORE && curr.Num != 0) || (curr.Op == mkruleval.REDIRECT && len(curr.Val) != 0) || (curr.Op == mkruleval.RESPOND && curr.Num != 0 && len(curr.Val) != 0) {
+			result = append(result, curr)
+			curr = mkruleval.Stmt{}
+		}
+	}
+
+	if pipe {
+		return nil, fmt.Errorf("missing transform after |")
+	}
+
+	if curr.Op == mkruleval.ENTROPY {
+		return nil, fmt.Errorf("missing entropy threshold")
+	}
+
+	if curr.Ref.Var != 0 {
+		result = append(result, curr)
+	} else if begun(curr) {
+		return nil, fmt.Errorf("incomplete statement: %s", strings.Join(tokens[start:], " "))
+	}
+
+	return result, nil
+}
+
+// checkContexts checks that the contexts a rule compares $ctx to are known,
+// built in or registered.
+func checkContexts(groups [][]mkruleval.Stmt) error {
+	for _, stmts := range groups {
+		for _, stmt := range stmts {
+			if stmt.Var != mkruleval.CTX || len(stmt.Val) == 0 {
+				continue
+			}
+
+			if _, err := mkruleval.ContextMask(stmt.Val); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// begun tells whether the parser has started a statement: a variable,
+// operator or operand was read but it was not complete yet.
+func begun(stmt mkruleval.Stmt) bool {
+	return stmt.Var != 0 || stmt.Op != 0 || len(stmt.Val) != 0 || len(stmt.Regexp) != 0 || len(stmt.Bytes) != 0 || stmt.Detector != 0
+}
+
+// assignSlots numbers the groups of the capturing regexps of a rule from
+// $1 on, in order, and checks that the references come after their
+// capture, in the same group or a later one.
+func assignSlots(groups [][]mkruleval.Stmt) error {
+	next := 1
+
+	for _, stmts := range groups {
+		for i := range stmts {
+			stmt := &stmts[i]
+
+			if stmt.Ref.Var == mkruleval.CAPTURE {
+				if n, _ := strconv.Atoi(stmt.Ref.Arg); n >= next {
+					return fmt.Errorf("$%s refers to no earlier capture", stmt.Ref.Arg)
+				}
+			}
+
+			if stmt.Mods&mkruleval.MOD_CAPTURE == 0 {
+				continue
+			}
+
+			if len(stmt.Regexp) == 0 || stmt.Op != mkruleval.EQ {
+				return fmt.Errorf("captures need a regexp compared with ==: %s", StmtString(*stmt))
+			}
+
+			re, err := syntax.Parse(mkruleval.RegexpBody(stmt.Regexp), syntax.Perl)
+
+			if err != nil {
+				return fmt.Errorf("invalid regexp: %s: %v", stmt.Regexp, err)
+			}
+
+			if re.MaxCap() == 0 {
+				return fmt.Errorf("capturing regexp without groups: %s", stmt.Regexp)
+			}
+
+			stmt.Slot = uint8(next)
+
+			if next += re.MaxCap(); next > mkruleval.MAX_CAPTURES+1 {
+				return fmt.Errorf("more than %d captures in a rule", mkruleval.MAX_CAPTURES)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Compiler) ReadConfig(path string) (Config, error) {
+	data, err := c.ReadInput(path)
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	return c.decodeConfigFile(path, data)
+}
+
+func isMkr(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".mkr")
+}
+
+// IsConfig tells endpoint files, json or .mkr, from compiled artifacts.
+func IsConfig(path string, data []byte) bool {
+	return isMkr(path) || IsJSON(data)
+}
+
+// decodeConfigFile decodes an endpoints file in the format selected by
+// its extension and loads its rules files.
+func (c *Compiler) decodeConfigFile(path string, data []byte) (Config, error) {
+	cfg, err := ParseConfig(path, data)
+
+	if err != nil {
+		return cfg, err
+	}
+
+	if err = c.readRulesFiles(&cfg, filepath.Dir(path)); err != nil {
+		return cfg, err
+	}
+
+	if len(cfg.Use) == 0 {
+		return cfg, nil
+	}
+
+	lock, err := c.ReadLock(LockPath(path))
+
+	if err != nil {
+		return cfg, err
+	}
+
+	_, err = c.ImportPacks(&cfg, lock, false)
+
+	return cfg, err
+}
+
+func ParseConfig(path string, data []byte) (Config, error) {
+	if isMkr(path) {
+		return parseMkr(path, data)
+	}
+
+	cfg, err := DecodeConfig(bytes.NewReader(data))
+
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+
+	switch {
+	case err == nil:
+		jsonPositions(&cfg, path, data)
+	case errors.As(err, &syntax):
+		// the offset of a syntax error is past the offending byte
+		err = jsonError(err, path, data, max(syntax.Offset-1, 0))
+	case errors.As(err, &typ):
+		err = jsonError(err, path, data, typ.Offset)
+	}
+
+	return cfg, err
+}
+
+// jsonError adds the position of the offset to a json decoding error.
+func jsonError(err error, path string, data []byte, offset int64) error {
+	pos := offsetPosition(path, lineStarts(data), int(min(offset, int64(len(data)))))
+
+	return &CompileError{Code: EXIT_PARSE, Rule: -1, Pos: pos, Err: fmt.Errorf("%s: %w", pos, err)}
+}
+
+// jsonPositions sets the positions of the endpoints and rules of a json
+// endpoints file to the lines their values start on. The data is already
+// decoded, so the walk just stops at anything unexpected.
+func jsonPositions(cfg *Config, path string, data []byte) {
+	starts := lineStarts(data)
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	// next is the position of the value after the last token read.
+	next := func() Position {
+		off := int(dec.InputOffset())
+
+		for off < len(data) && strings.IndexByte(" \t\r\n,:", data[off]) >= 0 {
+			off++
+		}
+
+		return offsetPosition(path, starts, off)
+	}
+
+	skip := func() bool {
+		var raw json.RawMessage
+		return dec.Decode(&raw) == nil
+	}
+
+	delim := func(want json.Delim) bool {
+		tok, err := dec.Token()
+		return err == nil && tok == want
+	}
+
+	endpoints := func() bool {
+		if !delim('[') {
+			return false
+		}
+
+		for i := 0; dec.More(); i++ {
+			if i < len(cfg.Endpoints) {
+				cfg.Endpoints[i].pos = next()
+			}
+
+			if !delim('{') {
+				return false
+			}
+
+			for dec.More() {
+				key, err := dec.Token()
+
+				if err != nil {
+					return false
+				}
+
+				if key != "rules" || i >= len(cfg.Endpoints) {
+					if !skip() {
+						return false
+					}
+
+					continue
+				}
+
+				if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+					if err == nil && tok == nil {
+						continue
+					}
+
+					return false
+				}
+
+				for j := 0; dec.More(); j++ {
+					if j < len(cfg.Endpoints[i].Rules) {
+						cfg.Endpoints[i].Rules[j].pos = next()
+					}
+
+					if !skip() {
+						return false
+					}
+				}
+
+				if !delim(']') {
+					return false
+				}
+			}
+
+			if !delim('}') {
+				return false
+			}
+		}
+
+		return delim(']')
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		endpoints()
+		return
+	}
+
+	if !delim('{') {
+		return
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+
+		if err != nil {
+			return
+		}
+
+		if key == "endpoints" {
+			if !endpoints() {
+				return
+			}
+		} else if !skip() {
+			return
+		}
+	}
+}
+
+func unquote(val string) (string, error) {
+	if strings.HasPrefix(val, "\"") {
+		return strconv.Unquote(val)
+	}
+
+	return val, nil
+}
+
+// parseMkr parses the .mkr format: line-based top-level statements and
+// endpoint and ruleset blocks, with @ annotations applying to the next
+// rule.
+//
+//	response denied text/html "<h1>denied</h1>"
+//
+//	ruleset debug {
+//	    rule $ctx == 'headers' $key == 'X-Debug' : block
+//	}
+//
+//	endpoint POST /api/login {
+//	    threshold 10
+//	    use debug
+//	    @id login-sqli
+//	    rule $ctx == 'json' $val == /union.+select/i : block
+//	}
+func parseMkr(name string, data []byte) (Config, error) {
+	var cfg Config
+	var endpoint *Endpoint
+	var ruleset string
+	var next Rule
+
+	rulesets := map[string][]Rule{}
+	annotated := false
+
+	for i, line := range strings.Split(string(data), "\n") {
+		errorf := func(format string, args ...any) error {
+			return &CompileError{Code: EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s:%d: %s", name, i+1, fmt.Sprintf(format, args...))}
+		}
+
+		line = strings.TrimSpace(line)
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyword, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+		inBlock := endpoint != nil || len(ruleset) != 0
+
+		if keyword == "}" {
+			if !inBlock {
+				return cfg, errorf("unexpected }")
+			}
+
+			if annotated {
+				return cfg, errorf("annotations without a rule")
+			}
+
+			if endpoint != nil {
+				cfg.Endpoints = append(cfg.Endpoints, *endpoint)
+			}
+
+			endpoint, ruleset = nil, ""
+			continue
+		}
+
+		if strings.HasPrefix(keyword, "@") {
+			if !inBlock {
+				return cfg, errorf("annotation outside of a block")
+			}
+
+			val, err := unquote(rest)
+
+			if err != nil {
+				return cfg, errorf("%s: %v", keyword, err)
+			}
+
+			switch keyword {
+			case "@id":
+				next.ID = val
+			case "@owner":
+				next.Owner = val
+			case "@description":
+				next.Description = val
+			case "@severity":
+				next.Severity = val
+			case "@expires":
+				next.Expires = val
+			case "@normalize":
+				next.Normalize = val
+			case "@sample":
+				sample, err := strconv.ParseFloat(val, 64)
+
+				if err != nil {
+					return cfg, errorf("invalid sample: %s", val)
+				}
+
+				next.Sample = &sample
+			case "@except":
+				next.Except = val
+			case "@priority":
+				if next.Priority, err = strconv.Atoi(val); err != nil {
+					return cfg, errorf("invalid priority: %s", val)
+				}
+			case "@disabled":
+				disabled := false
+				next.Enabled = &disabled
+			case "@from", "@to", "@cron":
+				if next.Active == nil {
+					next.Active = &Active{}
+				}
+
+				switch keyword {
+				case "@from":
+					next.Active.From = val
+				case "@to":
+					next.Active.To = val
+				default:
+					next.Active.Cron = val
+				}
+			default:
+				return cfg, errorf("unknown annotation: %s", keyword)
+			}
+
+			annotated = true
+			continue
+		}
+
+		if annotated && keyword != "rule" && keyword != "variant" {
+			return cfg, errorf("annotations must be followed by a rule")
+		}
+
+		if !inBlock {
+			switch keyword {
+			case "endpoint", "ruleset":
+				fields := strings.Fields(rest)
+
+				if len(fields) == 0 || fields[len(fields)-1] != "{" {
+					return cfg, errorf("%s: missing {", keyword)
+				}
+
+				fields = fields[:len(fields)-1]
+
+				if keyword == "ruleset" {
+					if len(fields) != 1 {
+						return cfg, errorf("usage: ruleset name {")
+					}
+
+					if _, ok := rulesets[fields[0]]; ok {
+						return cfg, errorf("ruleset %s is defined twice", fields[0])
+					}
+
+					ruleset = fields[0]
+					rulesets[ruleset] = nil
+				} else {
+					if len(fields) != 2 {
+						return cfg, errorf("usage: endpoint method path {")
+					}
+
+					endpoint = &Endpoint{Method: fields[0], Path: fields[1], pos: Position{name, i + 1, 0}}
+				}
+			case "response":
+				fields := strings.SplitN(rest, " ", 3)
+
+				if len(fields) != 3 {
+					return cfg, errorf("usage: response name content-type body")
+				}
+
+				body, err := unquote(strings.TrimSpace(fields[2]))
+
+				if err != nil {
+					return cfg, errorf("response %s: %v", fields[0], err)
+				}
+
+				if cfg.Responses == nil {
+					cfg.Responses = map[string]Response{}
+				}
+
+				cfg.Responses[fields[0]] = Response{ContentType: fields[1], Body: body}
+			case "case_insensitive":
+				cfg.CaseInsensitive = true
+			case "normalize":
+				cfg.Normalize = rest
+			case "use":
+				cfg.Use = append(cfg.Use, rest)
+			case "content_context":
+				fields := strings.Fields(rest)
+
+				if len(fields) != 2 {
+					return cfg, errorf("usage: content_context content-type context")
+				}
+
+				if cfg.ContentContexts == nil {
+					cfg.ContentContexts = map[string]string{}
+				}
+
+				cfg.ContentContexts[fields[0]] = fields[1]
+			default:
+				return cfg, errorf("unknown statement: %s", keyword)
+			}
+
+			continue
+		}
+
+		switch keyword {
+		case "rule":
+			next.Rule = rest
+			next.source = fmt.Sprintf("%s:%d", name, i+1)
+			next.pos = Position{name, i + 1, 0}
+
+			if endpoint != nil {
+				endpoint.Rules = append(endpoint.Rules, next)
+			} else {
+				rulesets[ruleset] = append(rulesets[ruleset], next)
+			}
+
+			next, annotated = Rule{}, false
+			continue
+		case "variant":
+			// the variants of an experiment follow each other, the
+			// annotations go before the first one
+			id, text, _ := strings.Cut(rest, " ")
+
+			if len(id) == 0 || len(strings.TrimSpace(text)) == 0 {
+				return cfg, errorf("usage: variant experiment rule")
+			}
+
+			rules := rulesets[ruleset]
+
+			if endpoint != nil {
+				rules = endpoint.Rules
+			}
+
+			if n := len(rules); n != 0 && rules[n-1].Experiment == id && !annotated {
+				rules[n-1].Variants = append(rules[n-1].Variants, strings.TrimSpace(text))
+			} else {
+				next.Experiment, next.Variants = id, []string{strings.TrimSpace(text)}
+				next.source = fmt.Sprintf("%s:%d", name, i+1)
+				next.pos = Position{name, i + 1, 0}
+				rules = append(rules, next)
+			}
+
+			if endpoint != nil {
+				endpoint.Rules = rules
+			} else {
+				rulesets[ruleset] = rules
+			}
+
+			next, annotated = Rule{}, false
+			continue
+		case "use":
+			name, except, _ := strings.Cut(rest, " except ")
+			rules, ok := rulesets[name]
+
+			if !ok || name == ruleset {
+				return cfg, errorf("unknown ruleset: %s", name)
+			}
+
+			if len(except) != 0 {
+				rules = slices.Clone(rules)
+
+				for j := range rules {
+					if len(rules[j].Except) != 0 {
+						return cfg, errorf("rule %s of ruleset %s already has an exception", rules[j].Rule, name)
+					}
+
+					rules[j].Except = strings.TrimSpace(except)
+				}
+			}
+
+			if endpoint != nil {
+				endpoint.Rules = append(endpoint.Rules, rules...)
+			} else {
+				rulesets[ruleset] = append(rulesets[ruleset], rules...)
+			}
+
+			continue
+		}
+
+		if endpoint == nil {
+			return cfg, errorf("unknown ruleset statement: %s", keyword)
+		}
+
+		if keyword == "except" {
+			id, except, _ := strings.Cut(rest, " ")
+
+			if len(strings.TrimSpace(except)) == 0 {
+				return cfg, errorf("usage: except id conditions")
+			}
+
+			endpoint.Rules = append(endpoint.Rules, Rule{Use: id, Except: strings.TrimSpace(except), source: fmt.Sprintf("%s:%d", name, i+1), pos: Position{name, i + 1, 0}})
+			continue
+		}
+
+		val, err := unquote(rest)
+
+		if err != nil {
+			return cfg, errorf("%s: %v", keyword, err)
+		}
+
+		switch keyword {
+		case "threshold":
+			if endpoint.BlockThreshold, err = strconv.ParseUint(val, 10, 64); err != nil {
+				return cfg, errorf("invalid threshold: %s", val)
+			}
+		case "priority":
+			if endpoint.Priority, err = strconv.Atoi(val); err != nil {
+				return cfg, errorf("invalid priority: %s", val)
+			}
+		case "owner":
+			endpoint.Owner = val
+		case "description":
+			endpoint.Description = val
+		case "case_insensitive":
+			endpoint.CaseInsensitive = true
+		case "inherit":
+			endpoint.Inherit = true
+		case "content_types":
+			endpoint.ContentTypes = strings.Fields(val)
+		case "charsets":
+			endpoint.Charsets = strings.Fields(val)
+		case "labels":
+			endpoint.Labels = strings.Fields(val)
+		case "forbid_control_chars":
+			endpoint.ForbidControlChars = true
+		case "allow_control_chars":
+			endpoint.AllowControlChars = strings.Fields(val)
+		case "required_headers":
+			endpoint.RequiredHeaders = strings.Fields(val)
+		case "allowed_headers":
+			endpoint.AllowedHeaders = strings.Fields(val)
+		case "allowed_status":
+			for _, field := range strings.Fields(val) {
+				code, err := strconv.Atoi(field)
+
+				if err != nil {
+					return cfg, errorf("invalid status: %s", field)
+				}
+
+				endpoint.AllowedStatus = append(endpoint.AllowedStatus, code)
+			}
+		case "cookie_policy":
+			endpoint.CookiePolicy = &CookiePolicy{}
+
+			for _, field := range strings.Fields(val) {
+				name, arg, _ := strings.Cut(field, "=")
+
+				switch name {
+				case "secure":
+					endpoint.CookiePolicy.Secure = true
+				case "http_only":
+					endpoint.CookiePolicy.HttpOnly = true
+				case "same_site":
+					endpoint.CookiePolicy.SameSite = arg
+				case "action":
+					endpoint.CookiePolicy.Action = arg
+				default:
+					return cfg, errorf("unknown cookie policy attribute: %s", field)
+				}
+			}
+		case "bot_policy":
+			endpoint.BotPolicy = &BotPolicy{}
+
+			for _, field := range strings.Fields(val) {
+				name, arg, _ := strings.Cut(field, "=")
+
+				switch name {
+				case "require_browser_headers":
+					endpoint.BotPolicy.RequireBrowserHeaders = true
+				case "deny_automation":
+					endpoint.BotPolicy.DenyAutomation = true
+				case "allow":
+					endpoint.BotPolicy.AllowFingerprints = strings.Split(arg, ",")
+				case "deny":
+					endpoint.BotPolicy.DenyFingerprints = strings.Split(arg, ",")
+				case "action":
+					endpoint.BotPolicy.Action = arg
+				default:
+					return cfg, errorf("unknown bot policy attribute: %s", field)
+				}
+			}
+		case "cors_origins", "cors_methods", "cors_headers", "cors_credentials":
+			if endpoint.CORS == nil {
+				endpoint.CORS = &CORS{}
+			}
+
+			switch keyword {
+			case "cors_origins":
+				endpoint.CORS.Origins = strings.Fields(val)
+			case "cors_methods":
+				endpoint.CORS.Methods = strings.Fields(val)
+			case "cors_headers":
+				endpoint.CORS.Headers = strings.Fields(val)
+			default:
+				endpoint.CORS.Credentials = true
+			}
+		case "sequence":
+			fields := strings.SplitN(val, " ", 4)
+
+			if len(fields) != 4 {
+				return cfg, errorf("usage: sequence key count window [status=code,...] rule")
+			}
+
+			count, err := strconv.ParseUint(fields[1], 10, 32)
+
+			if err != nil {
+				return cfg, errorf("invalid sequence count: %s", fields[1])
+			}
+
+			seq := Sequence{Key: fields[0], Count: uint32(count), Window: fields[2], Rule: fields[3]}
+
+			if codes, ok := strings.CutPrefix(fields[3], "status="); ok {
+				codes, seq.Rule, _ = strings.Cut(codes, " ")
+
+				for _, code := range strings.Split(codes, ",") {
+					n, err := strconv.Atoi(code)
+
+					if err != nil {
+						return cfg, errorf("invalid sequence status: %s", code)
+					}
+
+					seq.Status = append(seq.Status, n)
+				}
+			}
+
+			endpoint.Sequences = append(endpoint.Sequences, seq)
+		case "rules_file":
+			endpoint.RulesFile = val
+		case "schema":
+			if strings.HasPrefix(val, "{") {
+				endpoint.Schema = json.RawMessage(val)
+			} else {
+				endpoint.Schema, _ = json.Marshal(val)
+			}
+		case "from", "to", "cron":
+			if endpoint.Active == nil {
+				endpoint.Active = &Active{}
+			}
+
+			switch keyword {
+			case "from":
+				endpoint.Active.From = val
+			case "to":
+				endpoint.Active.To = val
+			default:
+				endpoint.Active.Cron = val
+			}
+		default:
+			return cfg, errorf("unknown endpoint statement: %s", keyword)
+		}
+	}
+
+	if endpoint != nil || len(ruleset) != 0 {
+		return cfg, &CompileError{Code: EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: unterminated block", name)}
+	}
+
+	applyDefaults(&cfg)
+
+	return cfg, nil
+}
+
+// readRulesFile appends the rules of the endpoint's rules file, one rule
+// per line with blank lines and lines starting with # skipped. The path is
+// relative to the directory of the endpoints file.
+func (c *Compiler) readRulesFile(endpoint *Endpoint, dir string, normalize string) error {
+	if len(endpoint.RulesFile) == 0 {
+		return nil
+	}
+
+	path := endpoint.RulesFile
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	data, err := c.ReadInput(path)
+
+	if err != nil {
+		return err
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		endpoint.Rules = append(endpoint.Rules, Rule{Rule: line, Normalize: normalize, source: fmt.Sprintf("%s:%d", endpoint.RulesFile, i+1), pos: Position{path, i + 1, 0}})
+	}
+
+	endpoint.RulesFile = ""
+
+	return nil
+}
+
+func (c *Compiler) readRulesFiles(cfg *Config, dir string) error {
+	for i := range cfg.Endpoints {
+		if err := c.readRulesFile(&cfg.Endpoints[i], dir, cfg.Normalize); err != nil {
+			return err
+		}
+
+		if err := c.readSchemaFile(&cfg.Endpoints[i], dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSchemaFile replaces a schema given as a file name with the content
+// of the file, relative to the directory of the endpoints file.
+func (c *Compiler) readSchemaFile(endpoint *Endpoint, dir string) error {
+	var name string
+
+	if json.Unmarshal(endpoint.Schema, &name) != nil {
+		return nil
+	}
+
+	path := name
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	data, err := c.ReadInput(path)
+
+	if err != nil {
+		return err
+	}
+
+	if !json.Valid(data) {
+		return fmt.Errorf("schema %s: invalid JSON", name)
+	}
+
+	endpoint.Schema = data
+
+	return nil
+}
+
+func DecodeConfig(r io.Reader) (Config, error) {
+	var err error
+	var raw json.RawMessage
+	var result Config
+
+	dec := json.NewDecoder(r)
+	err = dec.Decode(&raw)
+
+	if err == io.EOF {
+		return result, nil
+	}
+
+	if err != nil {
+		return result, &CompileError{Code: EXIT_PARSE, Rule: -1, Err: err}
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		err = json.Unmarshal(raw, &result.Endpoints)
+	} else {
+		err = json.Unmarshal(raw, &result)
+	}
+
+	if err != nil {
+		return result, &CompileError{Code: EXIT_PARSE, Rule: -1, Err: err}
+	}
+
+	applyDefaults(&result)
+
+	return result, nil
+}
+
+// applyDefaults propagates the top-level settings to the endpoints and
+// rules.
+func applyDefaults(cfg *Config) {
+	if cfg.CaseInsensitive {
+		for i := range cfg.Endpoints {
+			cfg.Endpoints[i].CaseInsensitive = true
+		}
+	}
+
+	for i := range cfg.Endpoints {
+		for j := range cfg.Endpoints[i].Rules {
+			if rule := &cfg.Endpoints[i].Rules[j]; len(rule.Normalize) == 0 {
+				rule.Normalize = cfg.Normalize
+			}
+		}
+	}
+}
+
+// OverlayEndpoint overrides the base endpoint with the same method and
+// path: its rules are appended, or replace the base rules with replace,
+// and the base rules listed in disable are dropped.
+type OverlayEndpoint struct {
+	Endpoint
+	Replace bool     `json:"replace"`
+	Disable []string `json:"disable"`
+}
+
+type Overlay struct {
+	Responses map[string]Response `json:"responses"`
+	Endpoints []OverlayEndpoint   `json:"endpoints"`
+}
+
+func (c *Compiler) readOverlay(path string) (Overlay, error) {
+	var result Overlay
+
+	data, err := c.ReadInput(path)
+
+	if err != nil {
+		return result, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &result.Endpoints)
+	} else {
+		err = json.Unmarshal(data, &result)
+	}
+
+	if err != nil {
+		return result, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return result, nil
+}
+
+func endpointKey(endpoint Endpoint) string {
+	method := strings.ToUpper(endpoint.Method)
+
+	if method == "*" {
+		method = ""
+	}
+
+	return method + " " + endpoint.Path
+}
+
+// applyOverlay merges an overlay into the configuration. Overlay responses
+// and endpoint settings win over the base ones, while rules never replace
+// each other silently: adding a rule that is already defined or disabling
+// one that is not is an error.
+func applyOverlay(cfg Config, overlay Overlay) (Config, error) {
+	index := map[string]int{}
+	seen := map[string]bool{}
+
+	for name, resp := range overlay.Responses {
+		if cfg.Responses == nil {
+			cfg.Responses = map[string]Response{}
+		}
+
+		cfg.Responses[name] = resp
+	}
+
+	for i, endpoint := range cfg.Endpoints {
+		index[endpointKey(endpoint)] = i
+	}
+
+	for _, ovl := range overlay.Endpoints {
+		key := endpointKey(ovl.Endpoint)
+
+		if seen[key] {
+			return cfg, fmt.Errorf("overlay: endpoint %s is defined twice", key)
+		}
+
+		seen[key] = true
+
+		for j := range ovl.Rules {
+			if rule := &ovl.Rules[j]; len(rule.Normalize) == 0 {
+				rule.Normalize = cfg.Normalize
+			}
+		}
+
+		i, ok := index[key]
+
+		if !ok {
+			if ovl.Replace || len(ovl.Disable) != 0 {
+				return cfg, fmt.Errorf("overlay: endpoint %s is not in the base", key)
+			}
+
+			ovl.CaseInsensitive = ovl.CaseInsensitive || cfg.CaseInsensitive
+			cfg.Endpoints = append(cfg.Endpoints, ovl.Endpoint)
+			continue
+		}
+
+		base := &cfg.Endpoints[i]
+
+		if ovl.Replace {
+			base.Rules = nil
+		}
+
+		for _, text := range ovl.Disable {
+			j := slices.IndexFunc(base.Rules, func(rule Rule) bool { return rule.Rule == text })
+
+			if j < 0 {
+				return cfg, fmt.Errorf("overlay: endpoint %s: disabled rule %s is not in the base", key, text)
+			}
+
+			base.Rules = slices.Delete(base.Rules, j, j+1)
+		}
+
+		for _, rule := range ovl.Rules {
+			if slices.ContainsFunc(base.Rules, func(prev Rule) bool { return prev.Rule == rule.Rule && prev.Use == rule.Use }) {
+				return cfg, fmt.Errorf("overlay: endpoint %s: rule %s is already defined, disable or replace it", key, rule.Rule+rule.Use)
+			}
+
+			base.Rules = append(base.Rules, rule)
+		}
+
+		if ovl.BlockThreshold != 0 {
+			base.BlockThreshold = ovl.BlockThreshold
+		}
+
+		if ovl.Active != nil {
+			base.Active = ovl.Active
+		}
+
+		if ovl.Priority != 0 {
+			base.Priority = ovl.Priority
+		}
+
+		if ovl.ContentTypes != nil {
+			base.ContentTypes = ovl.ContentTypes
+		}
+
+		if ovl.Charsets != nil {
+			base.Charsets = ovl.Charsets
+		}
+
+		if ovl.Labels != nil {
+			base.Labels = ovl.Labels
+		}
+
+		if ovl.AllowControlChars != nil {
+			base.AllowControlChars = ovl.AllowControlChars
+		}
+
+		if ovl.Schema != nil {
+			base.Schema = ovl.Schema
+		}
+
+		if ovl.RequiredHeaders != nil {
+			base.RequiredHeaders = ovl.RequiredHeaders
+		}
+
+		if ovl.AllowedHeaders != nil {
+			base.AllowedHeaders = ovl.AllowedHeaders
+		}
+
+		if ovl.AllowedStatus != nil {
+			base.AllowedStatus = ovl.AllowedStatus
+		}
+
+		if ovl.CookiePolicy != nil {
+			base.CookiePolicy = ovl.CookiePolicy
+		}
+
+		if ovl.CORS != nil {
+			base.CORS = ovl.CORS
+		}
+
+		if ovl.BotPolicy != nil {
+			base.BotPolicy = ovl.BotPolicy
+		}
+
+		if ovl.Sequences != nil {
+			base.Sequences = ovl.Sequences
+		}
+
+		if len(ovl.Description) != 0 {
+			base.Description = ovl.Description
+		}
+
+		if len(ovl.Owner) != 0 {
+			base.Owner = ovl.Owner
+		}
+
+		base.CaseInsensitive = base.CaseInsensitive || ovl.CaseInsensitive
+		base.ForbidControlChars = base.ForbidControlChars || ovl.ForbidControlChars
+		base.Inherit = base.Inherit || ovl.Inherit
+	}
+
+	return cfg, nil
+}
+
+// Lock pins the rule packs of an endpoints file to the contents they had
+// when they were locked.
+type Lock struct {
+	Packs map[string]LockedPack `json:"packs"`
+}
+
+type LockedPack struct {
+	Commit string `json:"commit,omitempty"`
+	SHA256 string `json:"sha256"`
+}
+
+func LockPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "mkrul.lock")
+}
+
+func (c *Compiler) ReadLock(path string) (Lock, error) {
+	var lock Lock
+
+	data, err := c.ReadInput(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return Lock{Packs: map[string]LockedPack{}}, nil
+	}
+
+	if err != nil {
+		return lock, err
+	}
+
+	if err = json.Unmarshal(data, &lock); err != nil {
+		return lock, &CompileError{Code: EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %v", path, err)}
+	}
+
+	if lock.Packs == nil {
+		lock.Packs = map[string]LockedPack{}
+	}
+
+	return lock, nil
+}
+
+// splitPackRef splits git+URL@REF#FILE into the repository, the ref and
+// the pack file, which defaults to pack.mkr or pack.json.
+func splitPackRef(ref string) (string, string, string, error) {
+	repo, file, _ := strings.Cut(strings.TrimPrefix(ref, "git+"), "#")
+	i := strings.LastIndex(repo, "@")
+
+	if i < 0 || i == len(repo)-1 || strings.ContainsAny(repo[i:], "/:") {
+		return "", "", "", fmt.Errorf("pack %s: missing @version", ref)
+	}
+
+	if len(file) != 0 && !filepath.IsLocal(filepath.FromSlash(file)) {
+		return "", "", "", fmt.Errorf("pack %s: %s is outside the repository", ref, file)
+	}
+
+	return repo[:i], repo[i+1:], file, nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	out, err := cmd.Output()
+
+	if exit, ok := err.(*exec.ExitError); ok {
+		return "", fmt.Errorf("git %s: %s", args[0], bytes.TrimSpace(exit.Stderr))
+	}
+
+	return strings.TrimSpace(string(out)), err
+}
+
+// fetchPack downloads a rule pack, it returns the pack file name, its
+// contents and, for git packs, the commit.
+func fetchPack(ref string) (string, []byte, string, error) {
+	if !strings.HasPrefix(ref, "git+") {
+		resp, err := http.Get(ref)
+
+		if err != nil {
+			return "", nil, "", err
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return "", nil, "", fmt.Errorf("pack %s: %s", ref, resp.Status)
+		}
+
+		data, err := io.ReadAll(resp.Body)
+
+		return resp.Request.URL.Path, data, "", err
+	}
+
+	repo, version, file, err := splitPackRef(ref)
+
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	dir, err := os.MkdirTemp("", "mkrul-pack")
+
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	defer os.RemoveAll(dir)
+
+	if _, err = git("", "clone", "--quiet", "--depth", "1", "--branch", version, "--", repo, dir); err != nil {
+		return "", nil, "", fmt.Errorf("pack %s: %v", ref, err)
+	}
+
+	commit, err := git(dir, "rev-parse", "HEAD")
+
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	names := []string{file}
+
+	if len(file) == 0 {
+		names = []string{"pack.mkr", "pack.json"}
+	}
+
+	// the pack file must not be a link out of the clone either
+	root, err := filepath.EvalSymlinks(dir)
+
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	for _, name := range names {
+		path, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return "", nil, "", err
+		}
+
+		if rel, err := filepath.Rel(root, path); err != nil || !filepath.IsLocal(rel) {
+			return "", nil, "", fmt.Errorf("pack %s: %s is outside the repository", ref, name)
+		}
+
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			return "", nil, "", err
+		}
+
+		return name, data, commit, nil
+	}
+
+	return "", nil, "", fmt.Errorf("pack %s: %s not found", ref, strings.Join(names, " or "))
+}
+
+// packCache is where the packs are kept by checksum so that locked packs
+// are fetched once.
+func (c *Compiler) packCache(sum string) string {
+	if len(c.CacheDir) == 0 {
+		return ""
+	}
+
+	return filepath.Join(c.CacheDir, "packs", sum)
+}
+
+// ImportPacks merges the rule packs used by the endpoints into them, the
+// packs must match the lock unless pin is set, in which case the packs
+// missing from the lock are fetched and added to the returned lock.
+func (c *Compiler) ImportPacks(cfg *Config, lock Lock, pin bool) (Lock, error) {
+	used := Lock{Packs: map[string]LockedPack{}}
+
+	for _, ref := range cfg.Use {
+		var name, commit string
+		var data []byte
+		var err error
+
+		locked, ok := lock.Packs[ref]
+
+		if !ok && !pin {
+			return used, Invalid(fmt.Errorf("pack %s is not locked, run mkrul lock", ref))
+		}
+
+		if cached := c.packCache(locked.SHA256); ok && len(cached) != 0 {
+			stored, _ := os.ReadFile(filepath.Join(cached, "name"))
+			data, _ = os.ReadFile(filepath.Join(cached, "pack"))
+			name = string(stored)
+		}
+
+		if data == nil || SHA256Hex(data) != locked.SHA256 {
+			if name, data, commit, err = fetchPack(ref); err != nil {
+				return used, &CompileError{Code: EXIT_IO, Rule: -1, Err: err}
+			}
+
+			if ok && (SHA256Hex(data) != locked.SHA256 || commit != locked.Commit) {
+				return used, Invalid(fmt.Errorf("pack %s does not match mkrul.lock", ref))
+			}
+
+			locked = LockedPack{Commit: commit, SHA256: SHA256Hex(data)}
+
+			if cached := c.packCache(locked.SHA256); len(cached) != 0 {
+				if err = storePack(cached, name, data); err != nil {
+					slog.Warn("pack cache store failed", "pack", ref, "error", err)
+				}
+			}
+		}
+
+		used.Packs[ref] = locked
+
+		pack, err := ParseConfig(name, data)
+
+		if err != nil {
+			return used, fmt.Errorf("pack %s: %w", ref, err)
+		}
+
+		if err = mergePack(cfg, pack, ref); err != nil {
+			return used, Invalid(err)
+		}
+	}
+
+	cfg.Use = nil
+
+	return used, nil
+}
+
+func storePack(dir, name string, data []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := WriteFileAtomic(filepath.Join(dir, "name"), []byte(name)); err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(filepath.Join(dir, "pack"), data)
+}
+
+// mergePack adds the pack responses and endpoints, the rules of endpoints
+// also defined by the importing file are appended to its own.
+func mergePack(cfg *Config, pack Config, ref string) error {
+	if len(pack.Use) != 0 {
+		return fmt.Errorf("pack %s: packs cannot use other packs", ref)
+	}
+
+	for name, resp := range pack.Responses {
+		if old, ok := cfg.Responses[name]; ok && old != resp {
+			return fmt.Errorf("pack %s: response %s conflicts with an existing one", ref, name)
+		}
+
+		if cfg.Responses == nil {
+			cfg.Responses = map[string]Response{}
+		}
+
+		cfg.Responses[name] = resp
+	}
+
+	for contentType, ctx := range pack.ContentContexts {
+		if old, ok := cfg.ContentContexts[contentType]; ok && old != ctx {
+			return fmt.Errorf("pack %s: content type %s conflicts with an existing one", ref, contentType)
+		}
+
+		if cfg.ContentContexts == nil {
+			cfg.ContentContexts = map[string]string{}
+		}
+
+		cfg.ContentContexts[contentType] = ctx
+	}
+
+	index := map[string]int{}
+
+	for i, endpoint := range cfg.Endpoints {
+		index[endpointKey(endpoint)] = i
+	}
+
+	for _, endpoint := range pack.Endpoints {
+		if len(endpoint.RulesFile) != 0 {
+			return fmt.Errorf("pack %s: rules files are not supported in packs", ref)
+		}
+
+		endpoint.pos = Position{}
+
+		for i := range endpoint.Rules {
+			if len(endpoint.Rules[i].source) == 0 {
+				endpoint.Rules[i].source = ref
+			}
+
+			endpoint.Rules[i].pos = Position{}
+		}
+
+		if i, ok := index[endpointKey(endpoint)]; ok {
+			cfg.Endpoints[i].Rules = append(cfg.Endpoints[i].Rules, endpoint.Rules...)
+			continue
+		}
+
+		index[endpointKey(endpoint)] = len(cfg.Endpoints)
+		cfg.Endpoints = append(cfg.Endpoints, endpoint)
+	}
+
+	return nil
+}
+
+func parseTime(val string) (uint64, error) {
+	if len(val) == 0 {
+		return 0, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, val); err == nil {
+			return uint64(t.Unix()), nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid time: %s", val)
+}
+
+// parseEnd parses the end of a period, a date alone standing for the whole
+// day: the result is the first second after it, the next midnight for a
+// date.
+func parseEnd(val string) (uint64, error) {
+	t, err := parseTime(val)
+
+	if _, date := time.Parse(time.DateOnly, val); err == nil && date == nil {
+		t += 24 * 60 * 60
+	}
+
+	return t, err
+}
+
+func checkCronField(field string, min, max int) error {
+	for _, item := range strings.Split(field, ",") {
+		rng, step, found := strings.Cut(item, "/")
+
+		if found {
+			if n, err := strconv.Atoi(step); err != nil || n <= 0 {
+				return fmt.Errorf("invalid cron step: %s", item)
+			}
+		}
+
+		if rng == "*" {
+			continue
+		}
+
+		lo, hi, found := strings.Cut(rng, "-")
+
+		if !found {
+			hi = lo
+		}
+
+		a, err := strconv.Atoi(lo)
+
+		if err != nil || a < min || a > max {
+			return fmt.Errorf("invalid cron value: %s", item)
+		}
+
+		b, err := strconv.Atoi(hi)
+
+		if err != nil || b < a || b > max {
+			return fmt.Errorf("invalid cron value: %s", item)
+		}
+	}
+
+	return nil
+}
+
+func checkCron(expr string) error {
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	fields := strings.Fields(expr)
+
+	if len(fields) != len(bounds) {
+		return fmt.Errorf("invalid cron expression: %s", expr)
+	}
+
+	for i, field := range fields {
+		if err := checkCronField(field, bounds[i][0], bounds[i][1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func makeWindow(active *Active) (mkruleval.Window, error) {
+	var err error
+	var result mkruleval.Window
+
+	if active == nil {
+		return result, nil
+	}
+
+	if result.From, err = parseTime(active.From); err != nil {
+		return result, err
+	}
+
+	if result.To, err = parseTime(active.To); err != nil {
+		return result, err
+	}
+
+	// a window to a date contains the whole day, up to its last second
+	if _, date := time.Parse(time.DateOnly, active.To); date == nil {
+		result.To += 24*60*60 - 1
+	}
+
+	if result.To != 0 && result.From > result.To {
+		return result, fmt.Errorf("invalid window: %s is after %s", active.From, active.To)
+	}
+
+	if len(active.Cron) != 0 {
+		if err = checkCron(active.Cron); err != nil {
+			return result, err
+		}
+	}
+
+	result.Cron = active.Cron
+
+	return result, nil
+}
+
+// InheritRules prepends to every endpoint with inherit set the rules of its
+// ancestors, the endpoints of the same method (or any method) whose path is
+// a prefix of its own, so that the broadest rules come first and a terminal
+// rule of the child does not shadow them. The catch-all rules of a parent,
+// an action alone, are its default and not inherited: ahead of the child's
+// rules they would shadow all of them.
+func InheritRules(endpoints []Endpoint) []Endpoint {
+	result := make([]Endpoint, len(endpoints))
+	copy(result, endpoints)
+
+	for i, child := range endpoints {
+		var parents []Endpoint
+
+		if !child.Inherit {
+			continue
+		}
+
+		path := SplitPrefix(child.Path)
+
+		for j, parent := range endpoints {
+			method := strings.ToUpper(parent.Method)
+
+			if i == j || (method != strings.ToUpper(child.Method) && method != "*" && method != "") {
+				continue
+			}
+
+			if prefix := SplitPrefix(parent.Path); len(prefix) < len(path) && HasPrefix(path, prefix) {
+				parents = append(parents, parent)
+			}
+		}
+
+		sort.SliceStable(parents, func(a, b int) bool {
+			return len(SplitPrefix(parents[a].Path)) > len(SplitPrefix(parents[b].Path))
+		})
+
+		result[i].Rules = append([]Rule(nil), child.Rules...)
+
+		for _, parent := range parents {
+			rules := slices.DeleteFunc(append([]Rule(nil), parent.Rules...), catchAll)
+			result[i].Rules = append(rules, result[i].Rules...)
+
+			if result[i].BlockThreshold == 0 {
+				result[i].BlockThreshold = parent.BlockThreshold
+			}
+
+			slog.Debug("rules inherited", "endpoint", child.Method+" "+child.Path, "parent", parent.Method+" "+parent.Path, "rules", len(parent.Rules))
+		}
+	}
+
+	return result
+}
+
+// catchAll tells whether a rule applies to every request: a terminal
+// action without conditions, window, sampling or exceptions.
+func catchAll(rule Rule) bool {
+	if rule.Active != nil || rule.Sample != nil || len(rule.Except) != 0 || len(rule.Use) != 0 || len(rule.Variants) != 0 {
+		return false
+	}
+
+	groups, err := ParseRule(rule.Rule)
+
+	if err != nil || len(groups) != 1 {
+		return false
+	}
+
+	for _, stmt := range groups[0] {
+		if stmt.Var != 0 || stmt.Op == mkruleval.SCORE {
+			return false
+		}
+	}
+
+	return len(groups[0]) != 0
+}
+
+// byPriority orders endpoints and their rules by descending priority,
+// keeping the file order among equal priorities.
+func byPriority(endpoints []Endpoint) []Endpoint {
+	result := make([]Endpoint, len(endpoints))
+	copy(result, endpoints)
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Priority > result[j].Priority
+	})
+
+	for i := range result {
+		rules := append([]Rule(nil), result[i].Rules...)
+
+		sort.SliceStable(rules, func(a, b int) bool {
+			return rules[a].Priority > rules[b].Priority
+		})
+
+		result[i].Rules = rules
+	}
+
+	return result
+}
+
+// source is the endpoint a sentinel is compiled from and the rule of each
+// of its rules, for the diagnostics of the checks after the compile.
+type source struct {
+	endpoint Endpoint
+	rules    []Rule
+}
+
+func (c *Compiler) makeSentinels(endpoints []Endpoint) ([]mkruleval.Sentinel, []source, error) {
+	var err error
+	var result []mkruleval.Sentinel
+	var sources []source
+
+	disabled := 0
+	endpoints = byPriority(endpoints)
+
+	report := c.Progress
+
+	if report == nil {
+		report = func(string, int, int) {}
+	}
+
+	// clears the progress line however the compile ends
+	defer report("compiling endpoints", len(endpoints), len(endpoints))
+
+	for i, endpoint := range endpoints {
+		var sentinel mkruleval.Sentinel
+		var compiled []Rule
+
+		report("compiling endpoints", i, len(endpoints))
+
+		if len(endpoint.RulesFile) != 0 {
+			return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: rules_file %s is only supported in endpoint files", endpoint.Method, endpoint.Path, endpoint.RulesFile))
+		}
+
+		sentinel.Method = strings.ToUpper(endpoint.Method)
+
+		// any method is written as the empty string rather than a
+		// literal, so runtimes need a single test for it
+		if sentinel.Method == "*" {
+			sentinel.Method = ""
+		}
+
+		if endpoint.CaseInsensitive {
+			sentinel.Flags |= mkruleval.FLAG_CASE_INSENSITIVE
+		}
+
+		if endpoint.ForbidControlChars {
+			sentinel.Flags |= mkruleval.FLAG_FORBID_CONTROL
+			sentinel.AllowControl = endpoint.AllowControlChars
+		} else if len(endpoint.AllowControlChars) != 0 {
+			return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: allow_control_chars requires forbid_control_chars", endpoint.Method, endpoint.Path))
+		}
+		sentinel.BlockThreshold = endpoint.BlockThreshold
+		sentinel.Meta = mkruleval.Metadata{Owner: endpoint.Owner, Description: endpoint.Description}
+
+		for _, charset := range endpoint.Charsets {
+			if !validCharset(charset) {
+				return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: invalid charset: %q", endpoint.Method, endpoint.Path, charset))
+			}
+
+			sentinel.Charsets = append(sentinel.Charsets, strings.ToLower(charset))
+		}
+
+		if sentinel.Schema, err = makeSchema(endpoint.Schema); err != nil {
+			return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: %v", endpoint.Method, endpoint.Path, err))
+		}
+
+		for _, name := range slices.Concat(endpoint.RequiredHeaders, endpoint.AllowedHeaders) {
+			if !validHeaderName(name) {
+				return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: invalid header name: %q", endpoint.Method, endpoint.Path, name))
+			}
+		}
+
+		for _, name := range endpoint.RequiredHeaders {
+			sentinel.RequiredHeaders = append(sentinel.RequiredHeaders, strings.ToLower(name))
+		}
+
+		// required headers are allowed too, runtimes check a single list
+		if len(endpoint.AllowedHeaders) != 0 {
+			for _, name := range slices.Concat(endpoint.AllowedHeaders, endpoint.RequiredHeaders) {
+				if name = strings.ToLower(name); !slices.Contains(sentinel.AllowedHeaders, name) {
+					sentinel.AllowedHeaders = append(sentinel.AllowedHeaders, name)
+				}
+			}
+		}
+
+		for _, code := range endpoint.AllowedStatus {
+			// informational responses precede the final one and are
+			// not checked
+			if code < 200 || code > 599 {
+				return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: invalid allowed status: %d", endpoint.Method, endpoint.Path, code))
+			}
+
+			sentinel.AllowedStatus = append(sentinel.AllowedStatus, uint16(code))
+		}
+
+		if sentinel.Cookies, err = makeCookieAttrs(endpoint.CookiePolicy); err != nil {
+			return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: cookie_policy: %v", endpoint.Method, endpoint.Path, err))
+		}
+
+		if sentinel.CORS, err = makeCORSPolicy(endpoint.CORS); err != nil {
+			return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: cors: %v", endpoint.Method, endpoint.Path, err))
+		}
+
+		if sentinel.Bots, err = makeBotChecks(endpoint.BotPolicy); err != nil {
+			return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: bot_policy: %v", endpoint.Method, endpoint.Path, err))
+		}
+
+		if sentinel.Window, err = makeWindow(endpoint.Active); err != nil {
+			return nil, nil, endpointError(EXIT_PARSE, endpoint, fmt.Errorf("endpoint %s %s: %v", endpoint.Method, endpoint.Path, err))
+		}
+
+		for _, val := range endpoint.Sequences {
+			seq, err := makeSequence(val)
+
+			if err != nil {
+				return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: sequence %s: %v", endpoint.Method, endpoint.Path, val.Rule, err))
+			}
+
+			sentinel.Sequences = append(sentinel.Sequences, seq)
+		}
+
+		for _, val := range strings.Split(endpoint.Path, "/") {
+			if len(val) == 0 {
+				continue
+			}
+
+			seg := mkruleval.ParseSegment(val)
+
+			// endpoints are matched on the path only, a query string
+			// would silently become part of a segment
+			if _, query, found := strings.Cut(val, "?"); found && seg.Kind != mkruleval.SEG_REGEXP {
+				hint := "match it with $ctx == 'urlenc' rules"
+
+				if key, _, _ := strings.Cut(query, "="); len(key) != 0 {
+					hint = fmt.Sprintf("match it with a rule such as $ctx == 'urlenc' $key == '%s'", key)
+				}
+
+				return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: the path cannot have a query string (?%s), %s", endpoint.Method, endpoint.Path, query, hint))
+			}
+
+			if seg.Kind == mkruleval.SEG_REGEXP {
+				if _, err = regexp.Compile(seg.Pattern); err != nil {
+					return nil, nil, endpointError(EXIT_PARSE, endpoint, fmt.Errorf("endpoint %s %s: invalid path parameter %s: %v", endpoint.Method, endpoint.Path, val, err))
+				}
+			}
+
+			sentinel.Path = append(sentinel.Path, val)
+		}
+
+		rules, err := applyExceptions(endpoint)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if rules, err = expandVariants(endpoint, rules); err != nil {
+			return nil, nil, err
+		}
+
+		for _, val := range rules {
+			if val.Enabled != nil && !*val.Enabled {
+				disabled++
+				continue
+			}
+
+			rule := mkruleval.SentinelRule{Meta: mkruleval.Metadata{Owner: val.Owner, Description: val.Description}}
+
+			if val.variant != 0 {
+				rule.Experiment, rule.Variant, rule.Variants = val.Experiment, uint8(val.variant), uint8(len(val.Variants))
+			}
+
+			if rule.Groups, err = ParseRule(val.Rule); err != nil {
+				return nil, nil, ruleError(EXIT_PARSE, endpoint, val, err)
+			}
+
+			if err = exceptRule(rule.Groups, val.Except); err != nil {
+				return nil, nil, ruleError(EXIT_INVALID, endpoint, val, fmt.Errorf("rule %s: %v", val.Rule, err))
+			}
+
+			if err = checkContexts(rule.Groups); err != nil {
+				return nil, nil, ruleError(EXIT_INVALID, endpoint, val, fmt.Errorf("rule %s: %v", val.Rule, err))
+			}
+
+			if err = normalizeRule(rule.Groups, val.Normalize); err != nil {
+				return nil, nil, ruleError(EXIT_INVALID, endpoint, val, fmt.Errorf("rule %s: %v", val.Rule, err))
+			}
+
+			if !c.AllowDangling && !Terminated(rule.Groups) {
+				return nil, nil, ruleError(EXIT_INVALID, endpoint, val, fmt.Errorf("rule %s: no terminal action in the last group", val.Rule))
+			}
+
+			if rule.Window, err = makeWindow(val.Active); err != nil {
+				return nil, nil, ruleError(EXIT_PARSE, endpoint, val, fmt.Errorf("rule %s: %v", val.Rule, err))
+			}
+
+			if rule.Expires, err = parseEnd(val.Expires); err != nil {
+				return nil, nil, ruleError(EXIT_PARSE, endpoint, val, fmt.Errorf("rule %s: %v", val.Rule, err))
+			}
+
+			// 0 is encoded as all requests, a rule for none is disabled
+			// instead
+			if val.Sample != nil && (*val.Sample <= 0 || *val.Sample > 1) {
+				return nil, nil, ruleError(EXIT_INVALID, endpoint, val, fmt.Errorf("rule %s: sample %v is not above 0 and at most 1 (disable the rule instead of a sample of 0)", val.Rule, *val.Sample))
+			}
+
+			// a sample too small to encode still applies to some requests
+			if val.Sample != nil && *val.Sample != 1 {
+				rule.Sample = uint16(max(1, math.Round(*val.Sample*mkruleval.SAMPLE_SCALE)))
+			}
+
+			if rule.Expires != 0 && rule.Expires <= uint64(time.Now().Unix()) {
+				if c.PruneExpired {
+					continue
+				}
+
+				slog.Warn("rule expired", "method", endpoint.Method, "path", endpoint.Path, "rule", val.Rule, "expires", val.Expires)
+			}
+
+			sentinel.Rules = append(sentinel.Rules, rule)
+			compiled = append(compiled, val)
+		}
+
+		if sentinel.BlockThreshold == 0 && hasScore(sentinel.AllRules()) {
+			return nil, nil, endpointError(EXIT_INVALID, endpoint, fmt.Errorf("endpoint %s %s: score action requires block_threshold", endpoint.Method, endpoint.Path))
+		}
+
+		result = append(result, sentinel)
+		sources = append(sources, source{endpoint: endpoint, rules: compiled})
+	}
+
+	if disabled != 0 {
+		slog.Info("disabled rules skipped", "count", disabled)
+	}
+
+	return result, sources, nil
+}
+
+// applyExceptions attaches the except conditions of the endpoint's
+// exception entries, the rules with only use and except, to the rules
+// whose id is use or starts with use/.
+func applyExceptions(endpoint Endpoint) ([]Rule, error) {
+	var result []Rule
+	var entries []Rule
+
+	for _, rule := range endpoint.Rules {
+		if len(rule.Use) == 0 {
+			result = append(result, rule)
+		} else {
+			entries = append(entries, rule)
+		}
+	}
+
+	for _, entry := range entries {
+		if len(entry.Rule) != 0 || len(entry.Except) == 0 {
+			return nil, ruleError(EXIT_INVALID, endpoint, entry, fmt.Errorf("exception %s: use requires except and no rule", entry.Use))
+		}
+
+		found := false
+
+		for i := range result {
+			if id := result[i].ID; id != entry.Use && !strings.HasPrefix(id, entry.Use+"/") {
+				continue
+			}
+
+			if len(result[i].Except) != 0 {
+				return nil, ruleError(EXIT_INVALID, endpoint, entry, fmt.Errorf("exception %s: rule %s already has an exception", entry.Use, result[i].ID))
+			}
+
+			result[i].Except = entry.Except
+			found = true
+		}
+
+		if !found {
+			return nil, ruleError(EXIT_INVALID, endpoint, entry, fmt.Errorf("exception %s: no rule with this id", entry.Use))
+		}
+	}
+
+	return result, nil
+}
+
+// expandVariants replaces the rules of experiments by one rule for each
+// of their variants.
+func expandVariants(endpoint Endpoint, rules []Rule) ([]Rule, error) {
+	var result []Rule
+
+	for _, rule := range rules {
+		if len(rule.Experiment) == 0 && len(rule.Variants) == 0 {
+			result = append(result, rule)
+			continue
+		}
+
+		if len(rule.Experiment) == 0 || len(rule.Rule) != 0 || len(rule.Variants) < 2 || len(rule.Variants) > math.MaxUint8 {
+			return nil, ruleError(EXIT_INVALID, endpoint, rule, fmt.Errorf("experiment %s: expected an experiment and 2 to %d variants instead of a rule", rule.Experiment, math.MaxUint8))
+		}
+
+		for i, text := range rule.Variants {
+			variant := rule
+			variant.Rule, variant.variant = text, i+1
+			result = append(result, variant)
+		}
+	}
+
+	return result, nil
+}
+
+// exceptRule appends the except conditions to the first group of the
+// rule as exclusion statements: the items matching all of them are
+// skipped.
+func exceptRule(groups [][]mkruleval.Stmt, except string) error {
+	if len(except) == 0 {
+		return nil
+	}
+
+	if len(groups) == 0 || !slices.ContainsFunc(groups[0], func(stmt mkruleval.Stmt) bool { return stmt.Var != 0 }) {
+		return fmt.Errorf("except requires conditions in the first group")
+	}
+
+	conds, err := ParseRule(except)
+
+	if err != nil {
+		return fmt.Errorf("except: %v", err)
+	}
+
+	if len(conds) != 1 || slices.ContainsFunc(conds[0], func(stmt mkruleval.Stmt) bool { return stmt.Var == 0 }) {
+		return fmt.Errorf("except: %s is not a single group of conditions", except)
+	}
+
+	for _, stmt := range conds[0] {
+		if mkruleval.RequestWide(stmt) {
+			return fmt.Errorf("except: %s applies to the whole request", StmtString(stmt))
+		}
+
+		if stmt.Mods&mkruleval.MOD_CAPTURE != 0 {
+			return fmt.Errorf("except: %s captures", StmtString(stmt))
+		}
+
+		stmt.Mods |= mkruleval.MOD_EXCEPT
+		groups[0] = append(groups[0], stmt)
+	}
+
+	return nil
+}
+
+// makeSequence compiles a sequence: its rule is the conditions making an
+// event, none for every request, and an action other than pass in a group
+// of its own.
+func makeSequence(seq Sequence) (mkruleval.SequenceRule, error) {
+	var result mkruleval.SequenceRule
+	var err error
+
+	if seq.Key != "ip" {
+		if result.Key.Var, result.Key.Arg, err = parseVar(seq.Key); err != nil {
+			return result, fmt.Errorf("key: %v", err)
+		}
+
+		if !crossVars[result.Key.Var] || mkruleval.ItemVar(result.Key.Var) {
+			return result, fmt.Errorf("key: %s is not a request value", seq.Key)
+		}
+	}
+
+	if seq.Count == 0 {
+		return result, fmt.Errorf("count must be positive")
+	}
+
+	window, err := time.ParseDuration(seq.Window)
+
+	if err != nil || window < time.Second || window%time.Second != 0 || window/time.Second > math.MaxUint32 {
+		return result, fmt.Errorf("invalid window: %q, whole seconds expected", seq.Window)
+	}
+
+	result.Count = seq.Count
+	result.Window = uint32(window / time.Second)
+
+	for _, code := range seq.Status {
+		if code < 100 || code > 599 {
+			return result, fmt.Errorf("invalid status: %d", code)
+		}
+
+		result.Status = append(result.Status, uint16(code))
+	}
+
+	if result.Groups, err = ParseRule(seq.Rule); err != nil {
+		return result, err
+	}
+
+	if err = checkContexts(result.Groups); err != nil {
+		return result, err
+	}
+
+	if len(result.Groups) == 0 {
+		return result, fmt.Errorf("no action")
+	}
+
+	last := result.Groups[len(result.Groups)-1]
+
+	if len(last) != 1 || last[0].Var != 0 || last[0].Op == mkruleval.PASS {
+		return result, fmt.Errorf("the last group must be an action other than pass")
+	}
+
+	for _, stmts := range result.Groups[:len(result.Groups)-1] {
+		if slices.ContainsFunc(stmts, func(stmt mkruleval.Stmt) bool { return stmt.Var == 0 }) {
+			return result, fmt.Errorf("the action must be the last group")
+		}
+	}
+
+	return result, nil
+}
+
+var schemaTypes = map[string]uint8{
+	"null":    mkruleval.TYPE_NULL,
+	"boolean": mkruleval.TYPE_BOOLEAN,
+	"integer": mkruleval.TYPE_INTEGER,
+	"number":  mkruleval.TYPE_NUMBER,
+	"string":  mkruleval.TYPE_STRING,
+	"array":   mkruleval.TYPE_ARRAY,
+	"object":  mkruleval.TYPE_OBJECT,
+}
+
+// makeSchema compiles the subset of JSON Schema the runtime enforces:
+// type, properties, required, additionalProperties, items and maxLength.
+// Other validation keywords are rejected rather than silently ignored.
+func makeSchema(raw json.RawMessage) (*mkruleval.SchemaNode, error) {
+	var v any
+
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("schema: %v", err)
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return nil, fmt.Errorf("schema file %s is only supported in endpoint files", v)
+	}
+
+	node, err := schemaNode("schema", v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &node, nil
+}
+
+func schemaNode(at string, v any) (mkruleval.SchemaNode, error) {
+	var node mkruleval.SchemaNode
+	var required []string
+
+	obj, ok := v.(map[string]any)
+
+	if !ok {
+		if v == true {
+			return node, nil
+		}
+
+		return node, fmt.Errorf("%s: expected an object", at)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(obj)) {
+		val := obj[key]
+
+		switch key {
+		case "$schema", "$id", "$comment", "title", "description", "default", "examples":
+		case "type":
+			names, ok := val.([]any)
+
+			if !ok {
+				names = []any{val}
+			}
+
+			for _, name := range names {
+				name, _ := name.(string)
+				typ, ok := schemaTypes[name]
+
+				if !ok {
+					return node, fmt.Errorf("%s: invalid type: %v", at, name)
+				}
+
+				node.Types |= typ
+			}
+		case "maxLength":
+			n, ok := val.(float64)
+
+			if !ok || n < 0 || n != math.Trunc(n) {
+				return node, fmt.Errorf("%s: maxLength must be a non-negative integer", at)
+			}
+
+			node.Flags |= mkruleval.SCHEMA_MAX_LENGTH
+			node.MaxLength = uint64(n)
+		case "properties":
+			props, ok := val.(map[string]any)
+
+			if !ok {
+				return node, fmt.Errorf("%s: properties must be an object", at)
+			}
+
+			for _, name := range slices.Sorted(maps.Keys(props)) {
+				child, err := schemaNode(at+"/properties/"+name, props[name])
+
+				if err != nil {
+					return node, err
+				}
+
+				child.Key = name
+				node.Children = append(node.Children, child)
+			}
+		case "required":
+			list, _ := val.([]any)
+
+			for _, name := range list {
+				name, ok := name.(string)
+
+				if !ok {
+					return node, fmt.Errorf("%s: required must list property names", at)
+				}
+
+				required = append(required, name)
+			}
+		case "additionalProperties":
+			allow, ok := val.(bool)
+
+			if !ok {
+				return node, fmt.Errorf("%s: additionalProperties must be true or false", at)
+			}
+
+			if !allow {
+				node.Flags |= mkruleval.SCHEMA_CLOSED
+			}
+		case "items":
+			child, err := schemaNode(at+"/items", val)
+
+			if err != nil {
+				return node, err
+			}
+
+			child.Flags |= mkruleval.SCHEMA_ITEMS
+			node.Children = append(node.Children, child)
+		default:
+			return node, fmt.Errorf("%s: unsupported keyword: %s", at, key)
+		}
+	}
+
+	for _, name := range required {
+		i := slices.IndexFunc(node.Children, func(child mkruleval.SchemaNode) bool {
+			return child.Flags&mkruleval.SCHEMA_ITEMS == 0 && child.Key == name
+		})
+
+		if i < 0 {
+			i = len(node.Children)
+			node.Children = append(node.Children, mkruleval.SchemaNode{Key: name})
+		}
+
+		node.Children[i].Flags |= mkruleval.SCHEMA_REQUIRED
+	}
+
+	return node, nil
+}
+
+func makeCookieAttrs(policy *CookiePolicy) (mkruleval.CookieAttrs, error) {
+	var attrs mkruleval.CookieAttrs
+
+	if policy == nil {
+		return attrs, nil
+	}
+
+	if policy.Secure {
+		attrs.Flags |= mkruleval.COOKIE_SECURE
+	}
+
+	if policy.HttpOnly {
+		attrs.Flags |= mkruleval.COOKIE_HTTP_ONLY
+	}
+
+	if len(policy.SameSite) != 0 {
+		attrs.SameSite = strings.ToLower(policy.SameSite)
+
+		if _, ok := mkruleval.SameSiteLevels[attrs.SameSite]; !ok {
+			return attrs, fmt.Errorf("invalid same_site: %s", policy.SameSite)
+		}
+
+		attrs.Flags |= mkruleval.COOKIE_SAME_SITE
+	}
+
+	if attrs.Flags == 0 {
+		return attrs, errors.New("no required attribute")
+	}
+
+	switch policy.Action {
+	case "", "strip":
+	case "flag":
+		attrs.Flags |= mkruleval.COOKIE_FLAG
+	default:
+		return attrs, fmt.Errorf("invalid action: %s", policy.Action)
+	}
+
+	return attrs, nil
+}
+
+func makeCORSPolicy(cors *CORS) (mkruleval.CORSPolicy, error) {
+	var policy mkruleval.CORSPolicy
+
+	if cors == nil {
+		return policy, nil
+	}
+
+	if len(cors.Origins) == 0 {
+		return policy, errors.New("no origins")
+	}
+
+	policy.Flags = mkruleval.CORS_ENABLED
+
+	for _, origin := range cors.Origins {
+		if err := validOrigin(origin); err != nil {
+			return policy, fmt.Errorf("origin %s: %v", origin, err)
+		}
+
+		if origin == "*" && cors.Credentials {
+			return policy, errors.New("credentials cannot be allowed to any origin")
+		}
+
+		policy.Origins = append(policy.Origins, strings.ToLower(origin))
+	}
+
+	for _, method := range cors.Methods {
+		if !validHeaderName(method) {
+			return policy, fmt.Errorf("invalid method: %q", method)
+		}
+
+		policy.Methods = append(policy.Methods, strings.ToUpper(method))
+	}
+
+	for _, name := range cors.Headers {
+		if !validHeaderName(name) {
+			return policy, fmt.Errorf("invalid header name: %q", name)
+		}
+
+		policy.Headers = append(policy.Headers, strings.ToLower(name))
+	}
+
+	if cors.Credentials {
+		policy.Flags |= mkruleval.CORS_CREDENTIALS
+	}
+
+	return policy, nil
+}
+
+// validOrigin accepts *, or a scheme and host with an optional port and a
+// *. prefix for the subdomains, as browsers send them in the Origin header.
+func validOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+
+	scheme, host, ok := strings.Cut(origin, "://")
+
+	if !ok || scheme != "http" && scheme != "https" {
+		return errors.New("expected an http or https scheme")
+	}
+
+	if strings.ContainsAny(host, "/?#@") {
+		return errors.New("an origin has no path, query or user")
+	}
+
+	hostname, port, err := net.SplitHostPort(host)
+
+	if err != nil {
+		hostname, port = host, ""
+	} else if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > math.MaxUint16 {
+		return fmt.Errorf("invalid port: %s", port)
+	}
+
+	hostname = strings.TrimPrefix(hostname, "*.")
+
+	if len(hostname) == 0 || strings.ContainsFunc(hostname, func(r rune) bool {
+		return r > unicode.MaxASCII || !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-.[]:", r)
+	}) {
+		return fmt.Errorf("invalid host: %s", host)
+	}
+
+	return nil
+}
+
+// browserHeaders are the request headers every browser sends, required
+// with a Mozilla/ User-Agent by require_browser_headers.
+var browserHeaders = []string{"user-agent", "accept", "accept-language", "accept-encoding"}
+
+// automationAgents are the User-Agent substrings of HTTP libraries and
+// automated browsers denied by deny_automation, with the empty one.
+var automationAgents = []string{"curl/", "wget/", "python-requests", "python-urllib", "aiohttp", "go-http-client", "java/", "okhttp", "apache-httpclient", "libwww-perl", "scrapy", "headlesschrome", "phantomjs", "selenium", "puppeteer", "playwright"}
+
+func makeBotChecks(policy *BotPolicy) (mkruleval.BotChecks, error) {
+	var bots mkruleval.BotChecks
+
+	if policy == nil {
+		return bots, nil
+	}
+
+	bots.Flags = mkruleval.BOT_ENABLED
+
+	if policy.RequireBrowserHeaders {
+		bots.Flags |= mkruleval.BOT_BROWSER_HEADERS
+		bots.Headers = browserHeaders
+	}
+
+	if policy.DenyAutomation {
+		bots.Flags |= mkruleval.BOT_AUTOMATION
+		bots.Agents = automationAgents
+	}
+
+	for _, fp := range slices.Concat(policy.AllowFingerprints, policy.DenyFingerprints) {
+		if _, err := hex.DecodeString(fp); err != nil || len(fp) != 16 || strings.ToLower(fp) != fp {
+			return bots, fmt.Errorf("invalid fingerprint: %q, 16 lowercase hex digits expected", fp)
+		}
+
+		if slices.Contains(policy.AllowFingerprints, fp) && slices.Contains(policy.DenyFingerprints, fp) {
+			return bots, fmt.Errorf("fingerprint %s is both allowed and denied", fp)
+		}
+	}
+
+	bots.Allow = policy.AllowFingerprints
+	bots.Deny = policy.DenyFingerprints
+
+	if bots.Flags == mkruleval.BOT_ENABLED && len(bots.Deny) == 0 {
+		return bots, errors.New("no check")
+	}
+
+	switch policy.Action {
+	case "", "block":
+	case "flag":
+		bots.Flags |= mkruleval.BOT_FLAG
+	default:
+		return bots, fmt.Errorf("invalid action: %s", policy.Action)
+	}
+
+	return bots, nil
+}
+
+func validHeaderName(name string) bool {
+	return len(name) != 0 && !strings.ContainsFunc(name, func(r rune) bool {
+		return r > unicode.MaxASCII || !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+	})
+}
+
+func validCharset(charset string) bool {
+	return len(charset) != 0 && !strings.ContainsFunc(charset, func(r rune) bool {
+		return r > unicode.MaxASCII || !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-_.:+", r)
+	})
+}
+
+func normalizeRule(groups [][]mkruleval.Stmt, form string) error {
+	switch form {
+	case "", "none":
+		return nil
+	case "nfkc":
+	default:
+		return fmt.Errorf("unknown normalization: %s", form)
+	}
+
+	for _, stmts := range groups {
+		for i := range stmts {
+			if stmts[i].Var == mkruleval.KEY || stmts[i].Var == mkruleval.VAL || stmts[i].Var == mkruleval.COOKIE_VAL {
+				stmts[i].Mods |= mkruleval.MOD_NFKC
+				stmts[i].Val = norm.NFKC.String(stmts[i].Val)
+			}
+		}
+	}
+
+	return nil
+}
+
+func Terminated(groups [][]mkruleval.Stmt) bool {
+	if len(groups) == 0 {
+		return false
+	}
+
+	for _, stmt := range groups[len(groups)-1] {
+		if stmt.Var == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasScore(rules []mkruleval.SentinelRule) bool {
+	for _, rule := range rules {
+		for _, stmts := range rule.Groups {
+			for _, stmt := range stmts {
+				if stmt.Op == mkruleval.SCORE {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func parseRegexpFlags(val string) (uint8, error) {
+	var flags uint8
+
+next:
+	for i := 0; i < len(val); i++ {
+		for _, f := range mkruleval.RegexpFlags {
+			if f.Name == val[i] {
+				flags |= f.Flag
+				continue next
+			}
+		}
+
+		return 0, fmt.Errorf("unknown regexp flag: %c", val[i])
+	}
+
+	return flags, nil
+}
+
+func hasBackref(pattern string) bool {
+	for i := 0; i < len(pattern)-1; i++ {
+		if pattern[i] != '\\' {
+			continue
+		}
+
+		if pattern[i+1] >= '1' && pattern[i+1] <= '9' {
+			return true
+		}
+
+		i++
+	}
+
+	return false
+}
+
+func unbounded(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus:
+		return true
+	case syntax.OpRepeat:
+		return re.Max == -1 || re.Max > 1
+	}
+
+	return false
+}
+
+func nestedQuantifier(re *syntax.Regexp, inside bool) bool {
+	if unbounded(re) {
+		if inside {
+			return true
+		}
+
+		inside = true
+	}
+
+	for _, sub := range re.Sub {
+		if nestedQuantifier(sub, inside) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Compiler) checkRegexp(pattern string) error {
+	if c.MaxRegexLength > 0 && len(pattern) > c.MaxRegexLength {
+		return fmt.Errorf("regexp /%s/ is longer than %d", pattern, c.MaxRegexLength)
+	}
+
+	if c.ForbidBackrefs && hasBackref(pattern) {
+		return fmt.Errorf("regexp /%s/ uses backreferences", pattern)
+	}
+
+	if c.Redos == "off" {
+		return nil
+	}
+
+	re, err := syntax.Parse(pattern, syntax.Perl)
+
+	if err != nil {
+		slog.Warn("regexp is not analyzed", "regexp", pattern, "error", err)
+		return nil
+	}
+
+	if !nestedQuantifier(re, false) {
+		return nil
+	}
+
+	if c.Redos == "error" {
+		return fmt.Errorf("regexp /%s/ has nested quantifiers", pattern)
+	}
+
+	slog.Warn("regexp has nested quantifiers", "regexp", pattern)
+
+	return nil
+}
+
+func (c *Compiler) checkRegexps(snts []mkruleval.Sentinel) error {
+	if c.Redos != "" && c.Redos != "off" && c.Redos != "warn" && c.Redos != "error" {
+		return fmt.Errorf("unknown redos severity: %s", c.Redos)
+	}
+
+	for _, snt := range snts {
+		for _, rule := range snt.AllRules() {
+			for _, stmts := range rule.Groups {
+				for _, stmt := range stmts {
+					if len(stmt.Regexp) == 0 {
+						continue
+					}
+
+					if err := c.checkRegexp(mkruleval.RegexpBody(stmt.Regexp)); err != nil {
+						return fmt.Errorf("endpoint %s: %v", snt.Name(), err)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func predicate(rule mkruleval.SentinelRule) string {
+	var groups [][]mkruleval.Stmt
+
+	for _, stmts := range rule.Groups {
+		var conds []mkruleval.Stmt
+
+		for _, stmt := range stmts {
+			if stmt.Var != 0 {
+				conds = append(conds, stmt)
+			}
+		}
+
+		groups = append(groups, conds)
+	}
+
+	return fmt.Sprintf("%+v %+v %d", groups, rule.Window, rule.Expires)
+}
+
+// checkConflicts finds the rules of an endpoint that another one before
+// it shadows with the opposite action. The sources, when known, locate the
+// conflicts in the endpoint files.
+func (c *Compiler) checkConflicts(snts []mkruleval.Sentinel, sources []source) error {
+	if c.Conflicts != "" && c.Conflicts != "off" && c.Conflicts != "warn" && c.Conflicts != "error" {
+		return fmt.Errorf("unknown conflicts severity: %s", c.Conflicts)
+	}
+
+	if c.Conflicts == "off" {
+		return nil
+	}
+
+	for k, snt := range snts {
+		seen := map[string]int{}
+
+		for i, rule := range snt.Rules {
+			act, ok := mkruleval.Action(rule.Groups)
+
+			if !ok {
+				continue
+			}
+
+			key := predicate(rule)
+			j, dup := seen[key]
+
+			if !dup {
+				if act.Op != mkruleval.SCORE {
+					seen[key] = i
+				}
+				continue
+			}
+
+			prev, _ := mkruleval.Action(snt.Rules[j].Groups)
+
+			if (prev.Op == mkruleval.PASS) == (act.Op == mkruleval.PASS) {
+				continue
+			}
+
+			err := fmt.Errorf("endpoint %s: rule %d (%s) contradicts rule %d (%s) over the same conditions and is never reached", snt.Name(), i, OpName(act.Op), j, OpName(prev.Op))
+			endpoint, rule := snt.Name(), i
+
+			if sources != nil {
+				src := sources[k]
+				endpoint, rule = DiagEndpoint(src.endpoint.Method, src.endpoint.Path), src.rules[i].index
+
+				if c.Conflicts == "error" {
+					return ruleError(EXIT_INVALID, src.endpoint, src.rules[i], err)
+				}
+			}
+
+			if c.Conflicts == "error" {
+				return err
+			}
+
+			slog.Warn("conflicting rules", "endpoint", endpoint, "rule", rule, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// CheckSentinels runs the checks of the compile on compiled endpoints,
+// for the tools that combine artifacts: rules end with an action, score
+// rules have a threshold, the regexps and the conflicts between rules.
+func (c *Compiler) CheckSentinels(snts []mkruleval.Sentinel) error {
+	seen := map[string]bool{}
+
+	for _, snt := range snts {
+		if seen[snt.Name()] {
+			return fmt.Errorf("endpoint %s is defined twice", snt.Name())
+		}
+
+		seen[snt.Name()] = true
+
+		for i, rule := range snt.Rules {
+			if !c.AllowDangling && !Terminated(rule.Groups) {
+				return fmt.Errorf("endpoint %s: rule %d: no terminal action in the last group", snt.Name(), i)
+			}
+		}
+
+		if snt.BlockThreshold == 0 && hasScore(snt.AllRules()) {
+			return fmt.Errorf("endpoint %s: score action requires block_threshold", snt.Name())
+		}
+	}
+
+	if err := c.checkRegexps(snts); err != nil {
+		return err
+	}
+
+	return c.checkConflicts(snts, nil)
+}
+
+// MatchesAll tells whether a compiled rule takes its action on every
+// request: a single group with a terminal action and no conditions,
+// window, expiry, sampling or experiment.
+func MatchesAll(rule mkruleval.SentinelRule) bool {
+	if rule.Window != (mkruleval.Window{}) || rule.Expires != 0 || rule.Sample != 0 || len(rule.Experiment) != 0 || len(rule.Groups) != 1 {
+		return false
+	}
+
+	for _, stmt := range rule.Groups[0] {
+		if stmt.Var != 0 || stmt.Op == mkruleval.SCORE {
+			return false
+		}
+	}
+
+	return len(rule.Groups[0]) != 0
+}
+
+func (c *Compiler) CheckLimits(snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes) error {
+	var w NopWriter
+
+	if c.MaxEndpoints > 0 && len(snts) > c.MaxEndpoints {
+		return fmt.Errorf("%d endpoints exceed -max-endpoints %d", len(snts), c.MaxEndpoints)
+	}
+
+	for _, snt := range snts {
+		name := snt.Name()
+
+		if c.MaxRules > 0 && len(snt.Rules) > c.MaxRules {
+			return fmt.Errorf("endpoint %s: %d rules exceed -max-rules-per-endpoint %d", name, len(snt.Rules), c.MaxRules)
+		}
+
+		for i, rule := range snt.Rules {
+			if c.MaxDepth > 0 && len(rule.Groups) > c.MaxDepth {
+				return fmt.Errorf("endpoint %s: rule %d: %d groups exceed -max-rule-depth %d", name, i, len(rule.Groups), c.MaxDepth)
+			}
+		}
+	}
+
+	if c.MaxSize > 0 {
+		if err := c.EncodeSentinels(&w, snts, tmpls, types); err != nil {
+			return err
+		}
+
+		if w.Offset() > c.MaxSize {
+			return fmt.Errorf("artifact size %d exceeds -max-artifact-size %d", w.Offset(), c.MaxSize)
+		}
+	}
+
+	return nil
+}
+
+func makeTemplates(responses map[string]Response, snts []mkruleval.Sentinel) ([]mkruleval.Template, error) {
+	var result []mkruleval.Template
+
+	for name, resp := range responses {
+		result = append(result, mkruleval.Template{Name: name, ContentType: resp.ContentType, Body: resp.Body})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	for _, snt := range snts {
+		for _, rule := range snt.AllRules() {
+			for _, stmts := range rule.Groups {
+				for _, stmt := range stmts {
+					if _, ok := responses[stmt.Val]; stmt.Op == mkruleval.RESPOND && !ok {
+						return nil, fmt.Errorf("unknown response: %s", stmt.Val)
+					}
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// ALIGN is the alignment of the sentinels and the index section, so that
+// the runtime can mmap the artifact and read them in place.
+const ALIGN = 8
+
+const (
+	HDR_BIG_ENDIAN = 1 << 0
+	HDR_CDB        = 1 << 1
+	HDR_ENCRYPTED  = 1 << 2
+	HDR_SIGNED     = 1 << 3
+)
+
+// PRELUDE is the size of the version and the header flags, which stay in
+// the clear in encrypted artifacts.
+const PRELUDE = 8
+
+// encryptionKey reads the AES-256 key of -encrypt aes:FILE, or of the
+// MKRUL_KEY_FILE environment variable when decrypting without the flag.
+// The file holds the 32-byte key in hex.
+func (c *Compiler) encryptionKey() ([]byte, error) {
+	path := os.Getenv("MKRUL_KEY_FILE")
+
+	if len(c.Encrypt) != 0 {
+		scheme, file, _ := strings.Cut(c.Encrypt, ":")
+
+		if scheme != "aes" {
+			return nil, fmt.Errorf("unsupported encryption: %s (only aes:FILE is)", scheme)
+		}
+
+		path = file
+	}
+
+	if len(path) == 0 {
+		return nil, fmt.Errorf("encrypted artifact: no key, use -encrypt aes:FILE or MKRUL_KEY_FILE")
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s: the key must be 32 bytes in hex", path)
+	}
+
+	return key, nil
+}
+
+func (c *Compiler) artifactCipher() (cipher.AEAD, error) {
+	key, err := c.encryptionKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealArtifact sets the encrypted flag of an encoded artifact and replaces
+// everything after the prelude with a random nonce and the AES-GCM sealed
+// rest, authenticated together with the prelude.
+func (c *Compiler) sealArtifact(data []byte) ([]byte, error) {
+	aead, err := c.artifactCipher()
+
+	if err != nil {
+		return nil, err
+	}
+
+	prelude := slices.Clone(data[:PRELUDE])
+	prelude[4] |= HDR_ENCRYPTED
+
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, err = crand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(append(prelude, nonce...), nonce, data[PRELUDE:], prelude), nil
+}
+
+// openArtifact returns the rest of an encrypted artifact after the
+// prelude, decrypted.
+func (c *Compiler) openArtifact(prelude []byte, r io.Reader) ([]byte, error) {
+	aead, err := c.artifactCipher()
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted artifact: truncated")
+	}
+
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], prelude)
+
+	if err != nil {
+		return nil, fmt.Errorf("encrypted artifact: wrong key or corrupted")
+	}
+
+	return plain, nil
+}
+
+// Signature is one (key id, signature) pair of the signature trailer.
+type Signature struct {
+	KeyID string
+	Sig   []byte
+}
+
+// Signers are the ID:FILE keys of -sign.
+type Signers []string
+
+func (s *Signers) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *Signers) Set(val string) error {
+	if id, file, _ := strings.Cut(val, ":"); len(id) == 0 || len(file) == 0 {
+		return fmt.Errorf("%s: the key must be given as ID:FILE", val)
+	}
+
+	*s = append(*s, val)
+	return nil
+}
+
+// signingKey reads an ed25519 private key, PKCS#8 PEM as written by
+// openssl genpkey -algorithm ed25519, or the 32-byte seed in hex.
+func signingKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		if key, ok := key.(ed25519.PrivateKey); ok {
+			return key, nil
+		}
+
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: the key must be PKCS#8 PEM or a 32-byte seed in hex", path)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signArtifact appends the signature trailer to an artifact whose signed
+// flag is set: u16 count, the str key id and str signature of every key,
+// then the u32 length of the trailer before it. The signatures cover the
+// artifact up to the trailer, encrypted or not.
+func signArtifact(data []byte, signers []string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := &CountingWriter{w: &buf, order: binary.LittleEndian}
+
+	if data[4]&HDR_BIG_ENDIAN != 0 {
+		w.order = binary.BigEndian
+	}
+
+	if len(signers) > math.MaxUint16 {
+		return nil, fmt.Errorf("%d signing keys exceed the %d keys limit", len(signers), math.MaxUint16)
+	}
+
+	if err := writeUint16(w, uint16(len(signers))); err != nil {
+		return nil, err
+	}
+
+	for _, signer := range signers {
+		id, file, _ := strings.Cut(signer, ":")
+		key, err := signingKey(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err = writeStr(w, id); err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+
+		if err = writeStr(w, string(ed25519.Sign(key, data))); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeUint32(w, uint32(buf.Len())); err != nil {
+		return nil, err
+	}
+
+	return append(data, buf.Bytes()...), nil
+}
+
+// SplitSignatures returns a signed artifact without its trailer, and the
+// signatures of the trailer. Other artifacts are returned as is.
+func SplitSignatures(data []byte) ([]byte, []Signature, error) {
+	var result []Signature
+
+	if len(data) < PRELUDE || data[4]&HDR_SIGNED == 0 {
+		return data, nil, nil
+	}
+
+	r := &CountingReader{order: binary.LittleEndian}
+
+	if data[4]&HDR_BIG_ENDIAN != 0 {
+		r.order = binary.BigEndian
+	}
+
+	if len(data) < PRELUDE+4 {
+		return nil, nil, fmt.Errorf("signature trailer: truncated")
+	}
+
+	end := len(data) - 4
+	n := uint64(r.order.Uint32(data[end:]))
+
+	if n < 2 || n > uint64(end-PRELUDE) {
+		return nil, nil, fmt.Errorf("signature trailer: length %d does not fit", n)
+	}
+
+	trailer := bytes.NewReader(data[end-int(n) : end])
+	r.r = trailer
+	count, err := readUint16(r)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("signature trailer: %v", err)
+	}
+
+	for i := 0; i < int(count); i++ {
+		var sig Signature
+
+		if sig.KeyID, err = readStr(r); err != nil {
+			return nil, nil, fmt.Errorf("signature trailer: signature %d: %v", i, err)
+		}
+
+		key, err := readStr(r)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("signature trailer: signature %d: %v", i, err)
+		}
+
+		sig.Sig = []byte(key)
+		result = append(result, sig)
+	}
+
+	if count == 0 || trailer.Len() != 0 {
+		return nil, nil, fmt.Errorf("signature trailer: %d signatures in %d bytes", count, n)
+	}
+
+	return data[:end-int(n)], result, nil
+}
+
+type OffsetWriter interface {
+	io.Writer
+	Offset() uint64
+}
+
+func align(w OffsetWriter) error {
+	_, err := w.Write(make([]byte, (ALIGN-w.Offset()%ALIGN)%ALIGN))
+	return err
+}
+
+// offsetTable returns the offsets of the sentinels and of the index section.
+func (c *Compiler) offsetTable(snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes, table *RuleTable) ([]uint64, uint64, error) {
+	var err error
+	var w NopWriter
+	var result []uint64
+
+	if uint64(len(snts)) > math.MaxUint32 {
+		return nil, 0, fmt.Errorf("too many sentinels: %d", len(snts))
+	}
+
+	_ = writeHeader(&w, 0, 0, make([]uint64, len(snts)))
+
+	if err = table.write(&w); err != nil {
+		return nil, 0, err
+	}
+
+	_ = writeUint32(&w, uint32(len(snts)))
+
+	for _, snt := range snts {
+		_ = align(&w)
+		result = append(result, w.Offset())
+		if err = writeSentinel(&w, snt, table); err != nil {
+			return nil, 0, fmt.Errorf("endpoint %s: %v", snt.Name(), err)
+		}
+	}
+
+	if err = writeTemplates(&w, tmpls); err != nil {
+		return nil, 0, err
+	}
+
+	if err = c.writeMetadata(&w, snts); err != nil {
+		return nil, 0, err
+	}
+
+	if err = writeContentContexts(&w, types); err != nil {
+		return nil, 0, err
+	}
+
+	if err = c.writeChangelog(&w); err != nil {
+		return nil, 0, err
+	}
+
+	_ = align(&w)
+
+	return result, w.Offset(), nil
+}
+
+// indexKey hashes the lookup key of the index section: the method and
+// the first path segment, "*" for any method or a non-literal segment and
+// "" for the root path.
+func indexKey(method string, seg string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write([]byte(seg))
+	return h.Sum64()
+}
+
+func sentinelKey(snt mkruleval.Sentinel) uint64 {
+	var seg string
+
+	method := snt.Method
+
+	if len(method) == 0 {
+		method = "*"
+	}
+
+	if len(snt.Path) != 0 {
+		seg = snt.Path[0]
+
+		if mkruleval.ParseSegment(seg).Kind != mkruleval.SEG_LITERAL {
+			seg = "*"
+		} else if snt.Flags&mkruleval.FLAG_CASE_INSENSITIVE != 0 {
+			seg = strings.ToLower(seg)
+		}
+	}
+
+	return indexKey(method, seg)
+}
+
+// CDBHash hashes a lookup key of the cdb layout: the method and the path
+// segments joined by a zero byte.
+func CDBHash(method string, segs []string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write([]byte("/" + strings.Join(segs, "/")))
+	return h.Sum64()
+}
+
+// cdbKey is the key of an endpoint in the cdb layout, the method ("*" for
+// any method) and the path with "*" for the segments that are not literal,
+// lowercased for case-insensitive endpoints. A runtime has only the request
+// path, so this is the key it can rebuild from the shape of the endpoint.
+func cdbKey(snt mkruleval.Sentinel) uint64 {
+	method := snt.Method
+
+	if len(method) == 0 {
+		method = "*"
+	}
+
+	segs := make([]string, len(snt.Path))
+
+	for i, seg := range snt.Path {
+		if mkruleval.ParseSegment(seg).Kind != mkruleval.SEG_LITERAL {
+			seg = "*"
+		}
+
+		segs[i] = seg
+	}
+
+	if snt.Flags&mkruleval.FLAG_CASE_INSENSITIVE != 0 {
+		method = strings.ToLower(method)
+
+		for i := range segs {
+			segs[i] = strings.ToLower(segs[i])
+		}
+	}
+
+	return CDBHash(method, segs)
+}
+
+// MAX_CDB_WILDCARD is the number of leading segments of the cdb layout that
+// may be wildcards, the bits of a shape mask.
+const MAX_CDB_WILDCARD = 64
+
+// CDBShape is the length of endpoint paths and the mask of their non-literal
+// segments. The lookup of a request probes one key per shape.
+type CDBShape struct {
+	Length uint32
+	Mask   uint64
+}
+
+func cdbShape(snt mkruleval.Sentinel) (CDBShape, error) {
+	shape := CDBShape{Length: uint32(len(snt.Path))}
+
+	for i, seg := range snt.Path {
+		if mkruleval.ParseSegment(seg).Kind == mkruleval.SEG_LITERAL {
+			continue
+		}
+
+		if i >= MAX_CDB_WILDCARD {
+			return shape, fmt.Errorf("endpoint %s: the cdb layout allows wildcards in the first %d segments only", snt.Name(), MAX_CDB_WILDCARD)
+		}
+
+		shape.Mask |= 1 << i
+	}
+
+	return shape, nil
+}
+
+// cdbShapes lists the distinct shapes of the endpoints, longest first, the
+// order in which a runtime probes them.
+func cdbShapes(snts []mkruleval.Sentinel) ([]CDBShape, error) {
+	var shapes []CDBShape
+
+	for _, snt := range snts {
+		shape, err := cdbShape(snt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !slices.Contains(shapes, shape) {
+			shapes = append(shapes, shape)
+		}
+	}
+
+	slices.SortFunc(shapes, func(a, b CDBShape) int {
+		if a.Length != b.Length {
+			return cmp.Compare(b.Length, a.Length)
+		}
+
+		return cmp.Compare(a.Mask, b.Mask)
+	})
+
+	return shapes, nil
+}
+
+// writeCDB writes the index section of the cdb layout: the shapes of the
+// endpoints, a power of two number of buckets holding the offset of the
+// first entry of their chain, followed by the entries (hash, sentinel
+// offset, next entry offset).
+func writeCDB(w OffsetWriter, snts []mkruleval.Sentinel, offs []uint64) error {
+	var err error
+
+	shapes, err := cdbShapes(snts)
+
+	if err != nil {
+		return err
+	}
+
+	size := 1
+
+	for size < len(snts) {
+		size <<= 1
+	}
+
+	chains := make([][]int, size)
+
+	for i, snt := range snts {
+		b := cdbKey(snt) & uint64(size-1)
+		chains[b] = append(chains[b], i)
+	}
+
+	if err = writeUint32(w, uint32(size)); err != nil {
+		return err
+	}
+
+	if err = writeUint32(w, uint32(len(shapes))); err != nil {
+		return err
+	}
+
+	for _, shape := range shapes {
+		if err = writeUint32(w, shape.Length); err != nil {
+			return err
+		}
+
+		if err = writeUint32(w, 0); err != nil {
+			return err
+		}
+
+		if err = writeUint64(w, shape.Mask); err != nil {
+			return err
+		}
+	}
+
+	next := w.Offset() + 8*uint64(size)
+
+	for _, chain := range chains {
+		head := uint64(0)
+
+		if len(chain) != 0 {
+			head = next
+			next += 24 * uint64(len(chain))
+		}
+
+		if err = writeUint64(w, head); err != nil {
+			return err
+		}
+	}
+
+	for _, chain := range chains {
+		for j, i := range chain {
+			link := uint64(0)
+
+			if j+1 < len(chain) {
+				link = w.Offset() + 24
+			}
+
+			for _, val := range []uint64{cdbKey(snts[i]), offs[i], link} {
+				if err = writeUint64(w, val); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// CDBIndex reads the cdb index section of an artifact in place.
+type CDBIndex struct {
+	data    []byte
+	order   binary.ByteOrder
+	size    uint64
+	shapes  []CDBShape
+	buckets uint64
+}
+
+func readCDB(data []byte, order binary.ByteOrder, index uint64) (*CDBIndex, error) {
+	if index+8 > uint64(len(data)) {
+		return nil, fmt.Errorf("cdb index: truncated")
+	}
+
+	c := &CDBIndex{data: data, order: order, size: uint64(order.Uint32(data[index:]))}
+	n := uint64(order.Uint32(data[index+4:]))
+	c.buckets = index + 8 + 16*n
+
+	if c.size == 0 || c.size&(c.size-1) != 0 || c.buckets+8*c.size > uint64(len(data)) {
+		return nil, fmt.Errorf("cdb index: %d buckets and %d shapes do not fit", c.size, n)
+	}
+
+	for i := uint64(0); i < n; i++ {
+		at := index + 8 + 16*i
+		c.shapes = append(c.shapes, CDBShape{order.Uint32(data[at:]), order.Uint64(data[at+8:])})
+	}
+
+	return c, nil
+}
+
+// probe returns the sentinel offsets of the chain entries with the hash.
+// Links only go forward, so a corrupt chain cannot loop.
+func (c *CDBIndex) probe(hash uint64) []uint64 {
+	var result []uint64
+
+	at := c.order.Uint64(c.data[c.buckets+8*(hash&(c.size-1)):])
+
+	for at != 0 && at+24 <= uint64(len(c.data)) {
+		if c.order.Uint64(c.data[at:]) == hash {
+			result = append(result, c.order.Uint64(c.data[at+8:]))
+		}
+
+		next := c.order.Uint64(c.data[at+16:])
+
+		if next <= at {
+			break
+		}
+
+		at = next
+	}
+
+	return result
+}
+
+// Lookup returns the offsets of the sentinels whose key matches the request,
+// longest paths first. For every shape no longer than the path it probes
+// the path prefix with "*" in the wildcard segments, with the request
+// method and with "*", as is and lowercased for case-insensitive endpoints.
+// The candidates are then matched in full, segment patterns included, and
+// the longest one wins, the first one among equally long.
+func (c *CDBIndex) Lookup(method string, path string) []uint64 {
+	var result []uint64
+
+	var segs []string
+
+	for _, seg := range strings.Split(path, "/") {
+		if len(seg) != 0 {
+			segs = append(segs, seg)
+		}
+	}
+
+	for _, shape := range c.shapes {
+		if int(shape.Length) > len(segs) {
+			continue
+		}
+
+		key := slices.Clone(segs[:shape.Length])
+
+		for i := range key {
+			if i < MAX_CDB_WILDCARD && shape.Mask&(1<<i) != 0 {
+				key[i] = "*"
+			}
+		}
+
+		lower := make([]string, len(key))
+
+		for i, seg := range key {
+			lower[i] = strings.ToLower(seg)
+		}
+
+		for _, probe := range []struct {
+			method string
+			segs   []string
+		}{{method, key}, {"*", key}, {strings.ToLower(method), lower}, {"*", lower}} {
+			for _, off := range c.probe(CDBHash(probe.method, probe.segs)) {
+				if !slices.Contains(result, off) {
+					result = append(result, off)
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+func writeIndex(w io.Writer, snts []mkruleval.Sentinel, offs []uint64) error {
+	var err error
+	var keys []uint64
+	var start uint32
+
+	buckets := map[uint64][]uint64{}
+
+	for i, snt := range snts {
+		key := sentinelKey(snt)
+
+		if _, ok := buckets[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		buckets[key] = append(buckets[key], offs[i])
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	if err = writeUint32(w, uint32(len(keys))); err != nil {
+		return err
+	}
+
+	if err = writeUint32(w, 0); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err = writeUint64(w, key); err != nil {
+			return err
+		}
+
+		if err = writeUint32(w, start); err != nil {
+			return err
+		}
+
+		if err = writeUint32(w, uint32(len(buckets[key]))); err != nil {
+			return err
+		}
+
+		start += uint32(len(buckets[key]))
+	}
+
+	for _, key := range keys {
+		for _, off := range buckets[key] {
+			if err = writeUint64(w, off); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Compiler) WriteSentinels(path string, snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes) error {
+	var err error
+	var w *os.File
+
+	if len(c.Encrypt) != 0 || len(c.Signers) != 0 {
+		var buf bytes.Buffer
+
+		if err = c.EncodeSentinels(&buf, snts, tmpls, types); err != nil {
+			return err
+		}
+
+		data := buf.Bytes()
+
+		// the flag is set first, the encryption authenticates it
+		if len(c.Signers) != 0 {
+			data[4] |= HDR_SIGNED
+		}
+
+		if len(c.Encrypt) != 0 {
+			if data, err = c.sealArtifact(data); err != nil {
+				return err
+			}
+		}
+
+		if len(c.Signers) != 0 {
+			if data, err = signArtifact(data, c.Signers); err != nil {
+				return err
+			}
+		}
+
+		mode := os.FileMode(0644)
+
+		// the key stays with the reader, the artifact with its owner
+		if len(c.Encrypt) != 0 {
+			mode = 0600
+		}
+
+		return os.WriteFile(path, data, mode)
+	}
+
+	w, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer w.Close()
+
+	return c.EncodeSentinels(w, snts, tmpls, types)
+}
+
+// writeHeader writes the version, the header flags, the sentinel count,
+// the index offset and the sentinel offsets, all 8-byte aligned.
+func writeHeader(w io.Writer, flags uint8, index uint64, offs []uint64) error {
+	var err error
+
+	if err = writeUint32(w, VERSION); err != nil {
+		return err
+	}
+
+	if _, err = w.Write([]byte{flags, 0, 0, 0}); err != nil {
+		return err
+	}
+
+	if err = writeUint32(w, uint32(len(offs))); err != nil {
+		return err
+	}
+
+	if err = writeUint32(w, 0); err != nil {
+		return err
+	}
+
+	if err = writeUint64(w, index); err != nil {
+		return err
+	}
+
+	for _, off := range offs {
+		if err = writeUint64(w, off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Compiler) EncodeSentinels(w io.Writer, snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes) error {
+	var err error
+	var offs []uint64
+
+	table, err := internRules(snts)
+
+	if err != nil {
+		return err
+	}
+
+	offs, index, err := c.offsetTable(snts, tmpls, types, table)
+
+	if err != nil {
+		return err
+	}
+
+	var flags uint8
+
+	cw := &CountingWriter{w: w, order: binary.LittleEndian}
+
+	switch c.ByteOrder {
+	case "", "le":
+	case "be":
+		flags |= HDR_BIG_ENDIAN
+		cw.order = binary.BigEndian
+	default:
+		return fmt.Errorf("unknown byte order: %s", c.ByteOrder)
+	}
+
+	switch c.Layout {
+	case "", "flat":
+	case "cdb":
+		flags |= HDR_CDB
+	default:
+		return fmt.Errorf("unknown layout: %s", c.Layout)
+	}
+
+	if err = writeHeader(cw, flags, index, offs); err != nil {
+		return err
+	}
+
+	if err = table.write(cw); err != nil {
+		return err
+	}
+
+	if err = writeUint32(cw, uint32(len(snts))); err != nil {
+		return err
+	}
+
+	for i, snt := range snts {
+		if err = align(cw); err != nil {
+			return err
+		}
+
+		if cw.Offset() != offs[i] {
+			return fmt.Errorf("sentinel %d: offset %d does not match the offset table (%d)", i, cw.Offset(), offs[i])
+		}
+
+		if err = writeSentinel(cw, snt, table); err != nil {
+			return fmt.Errorf("endpoint %s: %v", snt.Name(), err)
+		}
+	}
+
+	if err = writeTemplates(cw, tmpls); err != nil {
+		return err
+	}
+
+	if err = c.writeMetadata(cw, snts); err != nil {
+		return err
+	}
+
+	if err = writeContentContexts(cw, types); err != nil {
+		return err
+	}
+
+	if err = c.writeChangelog(cw); err != nil {
+		return err
+	}
+
+	if err = align(cw); err != nil {
+		return err
+	}
+
+	if cw.Offset() != index {
+		return fmt.Errorf("index offset %d does not match the header (%d)", cw.Offset(), index)
+	}
+
+	if flags&HDR_CDB != 0 {
+		return writeCDB(cw, snts, offs)
+	}
+
+	return writeIndex(cw, snts, offs)
+}
+
+func hasMetadata(snts []mkruleval.Sentinel) bool {
+	for _, snt := range snts {
+		if snt.Meta != (mkruleval.Metadata{}) {
+			return true
+		}
+
+		for _, rule := range snt.Rules {
+			if rule.Meta != (mkruleval.Metadata{}) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func writeMeta(w io.Writer, meta mkruleval.Metadata) error {
+	if err := writeStr(w, meta.Owner); err != nil {
+		return err
+	}
+
+	return writeStr(w, meta.Description)
+}
+
+// writeMetadata writes the owners and descriptions of the sentinels and
+// their rules in sentinel order, or just a zero count if there are none
+// or they are stripped.
+func (c *Compiler) writeMetadata(w io.Writer, snts []mkruleval.Sentinel) error {
+	if c.StripMetadata || !hasMetadata(snts) {
+		return writeUint32(w, 0)
+	}
+
+	if err := writeUint32(w, uint32(len(snts))); err != nil {
+		return err
+	}
+
+	for _, snt := range snts {
+		if err := writeMeta(w, snt.Meta); err != nil {
+			return fmt.Errorf("endpoint %s: %v", snt.Name(), err)
+		}
+
+		if err := writeCount(w, len(snt.Rules)); err != nil {
+			return err
+		}
+
+		for _, rule := range snt.Rules {
+			if err := writeMeta(w, rule.Meta); err != nil {
+				return fmt.Errorf("endpoint %s: %v", snt.Name(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeChangelog writes the changelog text, which unlike other strings
+// may be longer than 64 KiB.
+func (c *Compiler) writeChangelog(w io.Writer) error {
+	if uint64(len(c.Changelog)) > math.MaxUint32 {
+		return fmt.Errorf("changelog of %d bytes is too long", len(c.Changelog))
+	}
+
+	if err := writeUint32(w, uint32(len(c.Changelog))); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, c.Changelog)
+
+	return err
+}
+
+func writeContentContexts(w io.Writer, types mkruleval.ContentTypes) error {
+	keys := slices.Sorted(maps.Keys(types))
+
+	if err := writeUint32(w, uint32(len(keys))); err != nil {
+		return err
+	}
+
+	for _, contentType := range keys {
+		if err := writeStr(w, contentType); err != nil {
+			return err
+		}
+
+		code, err := mkruleval.ContextCode(types[contentType])
+
+		if err != nil {
+			return fmt.Errorf("content type %s: %v", contentType, err)
+		}
+
+		if err = writeUint8(w, code); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeTemplates(w io.Writer, tmpls []mkruleval.Template) error {
+	var err error
+
+	if err = writeCount(w, len(tmpls)); err != nil {
+		return err
+	}
+
+	for _, tmpl := range tmpls {
+		if err = writeStr(w, tmpl.Name); err != nil {
+			return err
+		}
+
+		if err = writeStr(w, tmpl.ContentType); err != nil {
+			return err
+		}
+
+		if err = writeStr(w, tmpl.Body); err != nil {
+			return fmt.Errorf("response %s: %v", tmpl.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func writeStr(w io.Writer, val string) error {
+	var err error
+
+	if len(val) > math.MaxUint16 {
+		return fmt.Errorf("string of %d bytes exceeds the %d bytes limit", len(val), math.MaxUint16)
+	}
+
+	err = writeUint16(w, uint16(len(val)))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte(val))
+
+	return err
+}
+
+func writeUint64(w io.Writer, val uint64) error {
+	return binary.Write(w, orderOf(w), val)
+}
+
+func writeUint32(w io.Writer, val uint32) error {
+	return binary.Write(w, orderOf(w), val)
+}
+
+// writeCount writes the uint16 element count of a list, failing instead of
+// wrapping around for lists the format cannot hold.
+func writeCount(w io.Writer, n int) error {
+	if n > math.MaxUint16 {
+		return fmt.Errorf("%d elements exceed the %d elements limit", n, math.MaxUint16)
+	}
+
+	return writeUint16(w, uint16(n))
+}
+
+func writeUint16(w io.Writer, val uint16) error {
+	return binary.Write(w, orderOf(w), val)
+}
+
+func writeUint8(w io.Writer, val uint8) error {
+	return binary.Write(w, orderOf(w), val)
+}
+
+func ctxNames(mask uint64) (string, error) {
+	var names []string
+
+	for n := uint8(0); n < 64; n++ {
+		if mask&(1<<n) == 0 {
+			continue
+		}
+
+		name, err := mkruleval.ContextName(n)
+
+		if err != nil {
+			return "", err
+		}
+
+		names = append(names, name)
+	}
+
+	return strings.Join(names, "|"), nil
+}
+
+func writeCtx(w io.Writer, val string) error {
+	r, err := mkruleval.ContextMask(val)
+
+	if err != nil {
+		return err
+	}
+
+	return writeUint64(w, r)
+}
+
+func writeWindow(w io.Writer, win mkruleval.Window) error {
+	var err error
+
+	if err = writeUint64(w, win.From); err != nil {
+		return err
+	}
+
+	if err = writeUint64(w, win.To); err != nil {
+		return err
+	}
+
+	return writeStr(w, win.Cron)
+}
+
+func writeSentinelRecord(w io.Writer, snt mkruleval.Sentinel, table *RuleTable) error {
+	var err error
+
+	if err = writeStr(w, snt.Method); err != nil {
+		return err
+	}
+
+	if err = writeUint8(w, snt.Flags); err != nil {
+		return err
+	}
+
+	if err = writeCount(w, len(snt.Path)); err != nil {
+		return err
+	}
+
+	for _, val := range snt.Path {
+		seg := mkruleval.ParseSegment(val)
+
+		if err = writeUint8(w, seg.Kind); err != nil {
+			return err
+		}
+
+		if err = writeStr(w, seg.Name); err != nil {
+			return err
+		}
+
+		if err = writeStr(w, seg.Pattern); err != nil {
+			return err
+		}
+	}
+
+	if err = writeUint64(w, snt.BlockThreshold); err != nil {
+		return err
+	}
+
+	if err = writeWindow(w, snt.Window); err != nil {
+		return err
+	}
+
+	if err = writeCount(w, len(snt.Rules)); err != nil {
+		return err
+	}
+
+	for _, rule := range snt.Rules {
+		ref, err := table.ref(rule)
+
+		if err != nil {
+			return err
+		}
+
+		if err = writeUint32(w, ref); err != nil {
+			return err
+		}
+	}
+
+	if err = writeCount(w, len(snt.Charsets)); err != nil {
+		return err
+	}
+
+	for _, charset := range snt.Charsets {
+		if err = writeStr(w, charset); err != nil {
+			return err
+		}
+	}
+
+	if err = writeCount(w, len(snt.AllowControl)); err != nil {
+		return err
+	}
+
+	for _, key := range snt.AllowControl {
+		if err = writeStr(w, key); err != nil {
+			return err
+		}
+	}
+
+	if snt.Schema == nil {
+		err = writeUint8(w, 0)
+	} else if err = writeUint8(w, 1); err == nil {
+		err = writeSchema(w, *snt.Schema)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, list := range [][]string{snt.RequiredHeaders, snt.AllowedHeaders} {
+		if err = writeCount(w, len(list)); err != nil {
+			return err
+		}
+
+		for _, name := range list {
+			if err = writeStr(w, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = writeUint8(w, snt.Cookies.Flags); err != nil {
+		return err
+	}
+
+	if err = writeStr(w, snt.Cookies.SameSite); err != nil {
+		return err
+	}
+
+	if err = writeUint8(w, snt.CORS.Flags); err != nil {
+		return err
+	}
+
+	for _, list := range [][]string{snt.CORS.Origins, snt.CORS.Methods, snt.CORS.Headers} {
+		if err = writeCount(w, len(list)); err != nil {
+			return err
+		}
+
+		for _, val := range list {
+			if err = writeStr(w, val); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = writeUint8(w, snt.Bots.Flags); err != nil {
+		return err
+	}
+
+	for _, list := range [][]string{snt.Bots.Headers, snt.Bots.Agents, snt.Bots.Allow, snt.Bots.Deny} {
+		if err = writeCount(w, len(list)); err != nil {
+			return err
+		}
+
+		for _, val := range list {
+			if err = writeStr(w, val); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = writeCount(w, len(snt.Sequences)); err != nil {
+		return err
+	}
+
+	for _, seq := range snt.Sequences {
+		if err = writeSequence(w, seq); err != nil {
+			return err
+		}
+	}
+
+	if err = writeCount(w, len(snt.AllowedStatus)); err != nil {
+		return err
+	}
+
+	for _, code := range snt.AllowedStatus {
+		if err = writeUint16(w, code); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeSequence(w io.Writer, seq mkruleval.SequenceRule) error {
+	var err error
+
+	if err = writeUint8(w, seq.Key.Var); err != nil {
+		return err
+	}
+
+	if ArgVars[seq.Key.Var] {
+		if err = writeStr(w, seq.Key.Arg); err != nil {
+			return err
+		}
+	}
+
+	if err = writeUint32(w, seq.Count); err != nil {
+		return err
+	}
+
+	if err = writeUint32(w, seq.Window); err != nil {
+		return err
+	}
+
+	if err = writeCount(w, len(seq.Status)); err != nil {
+		return err
+	}
+
+	for _, code := range seq.Status {
+		if err = writeUint16(w, code); err != nil {
+			return err
+		}
+	}
+
+	return writeGroups(w, seq.Groups)
+}
+
+func writeSchema(w io.Writer, node mkruleval.SchemaNode) error {
+	var err error
+
+	if err = writeStr(w, node.Key); err != nil {
+		return err
+	}
+
+	if err = writeUint8(w, node.Types); err != nil {
+		return err
+	}
+
+	if err = writeUint8(w, node.Flags); err != nil {
+		return err
+	}
+
+	if err = writeUint64(w, node.MaxLength); err != nil {
+		return err
+	}
+
+	if err = writeCount(w, len(node.Children)); err != nil {
+		return err
+	}
+
+	for _, child := range node.Children {
+		if err = writeSchema(w, child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RuleTable is the shared rules section: every distinct rule is written
+// once and the sentinels refer to it by index.
+type RuleTable struct {
+	rules []mkruleval.SentinelRule
+	index map[string]uint32
+}
+
+func RuleKey(rule mkruleval.SentinelRule) (string, error) {
+	var buf bytes.Buffer
+
+	if err := writeRule(&buf, rule); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func internRules(snts []mkruleval.Sentinel) (*RuleTable, error) {
+	table := &RuleTable{index: map[string]uint32{}}
+
+	for _, snt := range snts {
+		for _, rule := range snt.Rules {
+			key, err := RuleKey(rule)
+
+			if err != nil {
+				return nil, fmt.Errorf("endpoint %s: %v", snt.Name(), err)
+			}
+
+			if _, ok := table.index[key]; !ok {
+				table.index[key] = uint32(len(table.rules))
+				table.rules = append(table.rules, rule)
+			}
+		}
+	}
+
+	return table, nil
+}
+
+func (t *RuleTable) ref(rule mkruleval.SentinelRule) (uint32, error) {
+	key, err := RuleKey(rule)
+
+	if err != nil {
+		return 0, err
+	}
+
+	ref, ok := t.index[key]
+
+	if !ok {
+		return 0, fmt.Errorf("rule is missing from the shared rules")
+	}
+
+	return ref, nil
+}
+
+func (t *RuleTable) write(w io.Writer) error {
+	if err := writeUint32(w, uint32(len(t.rules))); err != nil {
+		return err
+	}
+
+	for _, rule := range t.rules {
+		var buf bytes.Buffer
+
+		if err := writeRule(&CountingWriter{w: &buf, order: orderOf(w)}, rule); err != nil {
+			return err
+		}
+
+		if err := writeRecord(w, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeRule(w io.Writer, rule mkruleval.SentinelRule) error {
+	var err error
+
+	if err = writeWindow(w, rule.Window); err != nil {
+		return err
+	}
+
+	if err = writeUint64(w, rule.Expires); err != nil {
+		return err
+	}
+
+	if err = writeUint16(w, rule.Sample); err != nil {
+		return err
+	}
+
+	if err = writeStr(w, rule.Experiment); err != nil {
+		return err
+	}
+
+	if len(rule.Experiment) != 0 {
+		if err = writeUint8(w, rule.Variant); err != nil {
+			return err
+		}
+
+		if err = writeUint8(w, rule.Variants); err != nil {
+			return err
+		}
+	}
+
+	return writeGroups(w, rule.Groups)
+}
+
+// stmtCost estimates the CPU cost of testing a statement on one value, in
+// units of a plain comparison: transforms, regexp programs and the
+// detectors add to it. Runtimes under load may skip or defer the rules
+// costing the most.
+func stmtCost(stmt mkruleval.Stmt) uint16 {
+	cost := 1 + 2*len(stmt.Transforms) + 2*len(stmt.Ref.Transforms)
+
+	if len(stmt.Regexp) != 0 {
+		if re, err := syntax.Parse(mkruleval.RegexpSource(stmt), syntax.Perl); err == nil {
+			if prog, err := syntax.Compile(re.Simplify()); err == nil {
+				cost += len(prog.Inst)
+			}
+		}
+	}
+
+	if stmt.Mods&mkruleval.MOD_NFKC != 0 {
+		cost += 4
+	}
+
+	if stmt.Mods&mkruleval.MOD_LUHN != 0 {
+		cost += 8
+	}
+
+	switch {
+	case stmt.Detector != 0, PredicateOp(stmt.Op):
+		cost += 32
+	case stmt.Op == mkruleval.ENTROPY, stmt.Var == mkruleval.PATH_TRAVERSAL, stmt.Var == mkruleval.DOUBLE_ENCODED:
+		cost += 8
+	}
+
+	return uint16(min(cost, math.MaxUint16))
+}
+
+// operandType returns the type of the operand a statement is written
+// with.
+func operandType(stmt mkruleval.Stmt) uint8 {
+	switch {
+	case stmt.Var == mkruleval.CTX, stmt.Op == mkruleval.SCORE, stmt.Op == mkruleval.ENTROPY:
+		return NUMERIC
+	case stmt.Ref.Var != 0:
+		return VARIABLE
+	case stmt.Op == mkruleval.RESPOND:
+		return RESPONSE
+	case stmt.Detector != 0:
+		return DETECTOR
+	case len(stmt.Regexp) != 0:
+		return REGEXP
+	case len(stmt.Bytes) != 0:
+		return BYTES
+	}
+
+	return STRING
+}
+
+// operandTypes returns the operand types the compiler gives a statement
+// with the variable and operator of stmt.
+func operandTypes(stmt mkruleval.Stmt) []uint8 {
+	switch {
+	case stmt.Var == mkruleval.CTX, stmt.Op == mkruleval.SCORE, stmt.Op == mkruleval.ENTROPY:
+		return []uint8{NUMERIC}
+	case stmt.Op == mkruleval.EQ_VAR, stmt.Op == mkruleval.NEQ_VAR:
+		return []uint8{VARIABLE}
+	case stmt.Op == mkruleval.RESPOND:
+		return []uint8{RESPONSE}
+	case stmt.Op == mkruleval.BLOCK, stmt.Op == mkruleval.PASS, stmt.Op == mkruleval.REDIRECT, PredicateOp(stmt.Op), mkruleval.BoolVars[stmt.Var]:
+		return []uint8{STRING}
+	case (stmt.Var == mkruleval.KEY || stmt.Var == mkruleval.VAL) && (stmt.Op == mkruleval.EQ || stmt.Op == mkruleval.NEQ):
+		return []uint8{STRING, REGEXP, BYTES, DETECTOR}
+	}
+
+	return []uint8{STRING, REGEXP, BYTES}
+}
+
+// checkOperand checks that a decoded statement has an operand of a type
+// and value the compiler gives its variable and operator, so that it is
+// written back the way it was read.
+func checkOperand(stmt mkruleval.Stmt, typ uint8) error {
+	if !slices.Contains(operandTypes(stmt), typ) {
+		return fmt.Errorf("operand type %d does not fit %s", typ, strings.TrimSpace(mkruleval.VarNames[stmt.Var]+" "+CondOp(stmt.Op)))
+	}
+
+	switch typ {
+	case NUMERIC:
+		if stmt.Var == mkruleval.CTX && len(stmt.Val) == 0 {
+			return fmt.Errorf("$ctx compared to no context")
+		}
+
+		if stmt.Op == mkruleval.ENTROPY && (stmt.Var != mkruleval.VAL || stmt.Num >= 800) {
+			return fmt.Errorf("entropy of %s over %d hundredths of a bit", mkruleval.VarNames[stmt.Var], stmt.Num)
+		}
+
+		if stmt.Op == mkruleval.SCORE && (stmt.Num == 0 || stmt.Num > math.MaxUint32) {
+			return fmt.Errorf("invalid score: %d", stmt.Num)
+		}
+	case STRING:
+		if (stmt.Op == mkruleval.BLOCK || stmt.Op == mkruleval.PASS || PredicateOp(stmt.Op)) && len(stmt.Val) != 0 {
+			return fmt.Errorf("%s takes no value: %s", CondOp(stmt.Op), stmt.Val)
+		}
+
+		if mkruleval.BoolVars[stmt.Var] && stmt.Val != "true" && stmt.Val != "false" {
+			return fmt.Errorf("%s compares to true or false: %s", mkruleval.VarNames[stmt.Var], stmt.Val)
+		}
+	case REGEXP:
+		if len(stmt.Regexp) == 0 {
+			return fmt.Errorf("empty regexp")
+		}
+	case BYTES:
+		if len(stmt.Bytes) == 0 {
+			return fmt.Errorf("empty bytes literal")
+		}
+	case VARIABLE:
+		if !crossVars[stmt.Var] || !crossVars[stmt.Ref.Var] {
+			return fmt.Errorf("cross-value comparison of variables %d and %d", stmt.Var, stmt.Ref.Var)
+		}
+	case RESPONSE:
+		if stmt.Num < 100 || stmt.Num > 599 {
+			return fmt.Errorf("invalid status: %d", stmt.Num)
+		}
+	}
+
+	return nil
+}
+
+func writeGroups(w io.Writer, groups [][]mkruleval.Stmt) error {
+	var err error
+
+	if err = writeCount(w, len(groups)); err != nil {
+		return err
+	}
+
+	for _, stmts := range groups {
+		if err = writeCount(w, len(stmts)); err != nil {
+			return err
+		}
+
+		for _, stmt := range stmts {
+			if err = writeUint8(w, stmt.Var); err != nil {
+				return err
+			}
+
+			if err = writeUint8(w, stmt.Op); err != nil {
+				return err
+			}
+
+			if err = writeUint8(w, stmt.Mods); err != nil {
+				return err
+			}
+
+			if err = writeUint16(w, stmtCost(stmt)); err != nil {
+				return err
+			}
+
+			if err = writeUint8(w, uint8(len(stmt.Transforms))); err != nil {
+				return err
+			}
+
+			for _, tf := range stmt.Transforms {
+				if err = writeUint8(w, tf); err != nil {
+					return err
+				}
+			}
+
+			if ArgVars[stmt.Var] {
+				if err = writeStr(w, stmt.Arg); err != nil {
+					return err
+				}
+			}
+
+			typ := operandType(stmt)
+
+			if err = writeUint8(w, typ); err != nil {
+				return err
+			}
+
+			switch typ {
+			case NUMERIC:
+				if stmt.Var == mkruleval.CTX {
+					err = writeCtx(w, stmt.Val)
+				} else {
+					err = writeUint64(w, stmt.Num)
+				}
+
+				if err != nil {
+					return err
+				}
+			case VARIABLE:
+				if err = writeUint8(w, stmt.Ref.Var); err != nil {
+					return err
+				}
+
+				if err = writeUint8(w, uint8(len(stmt.Ref.Transforms))); err != nil {
+					return err
+				}
+
+				for _, tf := range stmt.Ref.Transforms {
+					if err = writeUint8(w, tf); err != nil {
+						return err
+					}
+				}
+
+				if ArgVars[stmt.Ref.Var] {
+					if err = writeStr(w, stmt.Ref.Arg); err != nil {
+						return err
+					}
+				}
+			case RESPONSE:
+				if err = writeUint16(w, uint16(stmt.Num)); err != nil {
+					return err
+				}
+
+				if err = writeStr(w, stmt.Val); err != nil {
+					return err
+				}
+			case DETECTOR:
+				if err = writeUint8(w, stmt.Detector); err != nil {
+					return err
+				}
+			case REGEXP:
+				if err = writeStr(w, stmt.Regexp); err != nil {
+					return err
+				}
+
+				if err = writeUint8(w, stmt.Flags); err != nil {
+					return err
+				}
+
+				if stmt.Mods&mkruleval.MOD_CAPTURE != 0 {
+					if err = writeUint8(w, stmt.Slot); err != nil {
+						return err
+					}
+				}
+			case BYTES:
+				if err = writeStr(w, string(stmt.Bytes)); err != nil {
+					return err
+				}
+			default:
+				if err = writeStr(w, stmt.Val); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeSentinel writes a sentinel record prefixed with its length, as are
+// the rules inside it, so that readers can skip what they do not need.
+func writeSentinel(w io.Writer, snt mkruleval.Sentinel, table *RuleTable) error {
+	var buf bytes.Buffer
+
+	if err := writeSentinelRecord(&CountingWriter{w: &buf, order: orderOf(w)}, snt, table); err != nil {
+		return err
+	}
+
+	return writeRecord(w, buf.Bytes())
+}
+
+func writeRecord(w io.Writer, data []byte) error {
+	if uint64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("record of %d bytes exceeds the %d bytes limit", len(data), uint64(math.MaxUint32))
+	}
+
+	if err := writeUint32(w, uint32(len(data))); err != nil {
+		return err
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func readUint64(r io.Reader) (uint64, error) {
+	var val uint64
+	err := binary.Read(r, orderOf(r), &val)
+	return val, err
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var val uint32
+	err := binary.Read(r, orderOf(r), &val)
+	return val, err
+}
+
+func readUint16(r io.Reader) (uint16, error) {
+	var val uint16
+	err := binary.Read(r, orderOf(r), &val)
+	return val, err
+}
+
+func readUint8(r io.Reader) (uint8, error) {
+	var val uint8
+	err := binary.Read(r, orderOf(r), &val)
+	return val, err
+}
+
+func readStr(r io.Reader) (string, error) {
+	n, err := readUint16(r)
+
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, n)
+
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+func readWindow(r io.Reader) (mkruleval.Window, error) {
+	var err error
+	var win mkruleval.Window
+
+	if win.From, err = readUint64(r); err != nil {
+		return win, err
+	}
+
+	if win.To, err = readUint64(r); err != nil {
+		return win, err
+	}
+
+	win.Cron, err = readStr(r)
+
+	return win, err
+}
+
+// readStmt reads a statement and rejects the operands the compiler does
+// not write for its variable and operator.
+func readStmt(r io.Reader, version uint32) (mkruleval.Stmt, error) {
+	stmt, typ, err := readOperand(r, version)
+
+	if err != nil {
+		return stmt, err
+	}
+
+	return stmt, checkOperand(stmt, typ)
+}
+
+func readOperand(r io.Reader, version uint32) (mkruleval.Stmt, uint8, error) {
+	var err error
+	var typ uint8
+	var stmt mkruleval.Stmt
+
+	if stmt.Var, err = readUint8(r); err != nil {
+		return stmt, typ, err
+	}
+
+	if stmt.Op, err = readUint8(r); err != nil {
+		return stmt, typ, err
+	}
+
+	// the original layout has no modifiers, cost nor transforms; the cost
+	// is derived from the statement, stmtCost gives it again
+	if version != V4_VERSION {
+		if stmt.Mods, err = readUint8(r); err != nil {
+			return stmt, typ, err
+		}
+
+		if _, err = readUint16(r); err != nil {
+			return stmt, typ, err
+		}
+
+		if typ, err = readUint8(r); err != nil {
+			return stmt, typ, err
+		}
+	}
+
+	for i := 0; i < int(typ); i++ {
+		tf, err := readUint8(r)
+
+		if err != nil {
+			return stmt, typ, err
+		}
+
+		if _, ok := mkruleval.TransformNames[tf]; !ok {
+			return stmt, typ, fmt.Errorf("unknown transform: %d", tf)
+		}
+
+		stmt.Transforms = append(stmt.Transforms, tf)
+	}
+
+	if ArgVars[stmt.Var] && version != V4_VERSION {
+		if stmt.Arg, err = readStr(r); err != nil {
+			return stmt, typ, err
+		}
+	}
+
+	if typ, err = readUint8(r); err != nil {
+		return stmt, typ, err
+	}
+
+	switch typ {
+	case NUMERIC:
+		n, err := readUint64(r)
+
+		if err != nil {
+			return stmt, typ, err
+		}
+
+		if stmt.Var == mkruleval.CTX {
+			stmt.Val, err = ctxNames(n)
+		} else {
+			stmt.Num = n
+		}
+
+		return stmt, typ, err
+	case STRING:
+		stmt.Val, err = readStr(r)
+	case REGEXP:
+		if stmt.Regexp, err = readStr(r); err != nil || version == V4_VERSION {
+			return stmt, typ, err
+		}
+
+		if stmt.Flags, err = readUint8(r); err != nil || stmt.Mods&mkruleval.MOD_CAPTURE == 0 {
+			return stmt, typ, err
+		}
+
+		stmt.Slot, err = readUint8(r)
+	case BYTES:
+		val, err := readStr(r)
+		stmt.Bytes = []byte(val)
+		return stmt, typ, err
+	case DETECTOR:
+		if stmt.Detector, err = readUint8(r); err == nil && detectorNames[stmt.Detector] == "" {
+			err = fmt.Errorf("unknown detector: %d", stmt.Detector)
+		}
+	case VARIABLE:
+		if stmt.Ref.Var, err = readUint8(r); err != nil {
+			return stmt, typ, err
+		}
+
+		if version != V4_VERSION {
+			n, err := readUint8(r)
+
+			if err != nil {
+				return stmt, typ, err
+			}
+
+			for i := 0; i < int(n); i++ {
+				tf, err := readUint8(r)
+
+				if err != nil {
+					return stmt, typ, err
+				}
+
+				if _, ok := mkruleval.TransformNames[tf]; !ok {
+					return stmt, typ, fmt.Errorf("unknown transform: %d", tf)
+				}
+
+				stmt.Ref.Transforms = append(stmt.Ref.Transforms, tf)
+			}
+		}
+
+		if ArgVars[stmt.Ref.Var] {
+			stmt.Ref.Arg, err = readStr(r)
+		}
+	case RESPONSE:
+		n, err := readUint16(r)
+
+		if err != nil {
+			return stmt, typ, err
+		}
+
+		stmt.Num = uint64(n)
+		stmt.Val, err = readStr(r)
+
+		return stmt, typ, err
+	default:
+		return stmt, typ, fmt.Errorf("unknown operand type: %d", typ)
+	}
+
+	return stmt, typ, err
+}
+
+func readSentinel(r io.Reader, shared []mkruleval.SentinelRule) (mkruleval.Sentinel, error) {
+	var err error
+	var n uint16
+	var snt mkruleval.Sentinel
+
+	if r, err = readRecord(r); err != nil {
+		return snt, err
+	}
+
+	if snt.Method, err = readStr(r); err != nil {
+		return snt, err
+	}
+
+	if snt.Flags, err = readUint8(r); err != nil {
+		return snt, err
+	}
+
+	if n, err = readUint16(r); err != nil {
+		return snt, err
+	}
+
+	for i := 0; i < int(n); i++ {
+		var seg mkruleval.Segment
+
+		if seg.Kind, err = readUint8(r); err != nil {
+			return snt, err
+		}
+
+		if seg.Name, err = readStr(r); err != nil {
+			return snt, err
+		}
+
+		if seg.Pattern, err = readStr(r); err != nil {
+			return snt, err
+		}
+
+		snt.Path = append(snt.Path, seg.String())
+	}
+
+	if snt.BlockThreshold, err = readUint64(r); err != nil {
+		return snt, err
+	}
+
+	if snt.Window, err = readWindow(r); err != nil {
+		return snt, err
+	}
+
+	if n, err = readUint16(r); err != nil {
+		return snt, err
+	}
+
+	for i := 0; i < int(n); i++ {
+		ref, err := readUint32(r)
+
+		if err != nil {
+			return snt, err
+		}
+
+		if int(ref) >= len(shared) {
+			return snt, fmt.Errorf("rule %d: unknown shared rule %d", i, ref)
+		}
+
+		snt.Rules = append(snt.Rules, shared[ref])
+	}
+
+	if n, err = readUint16(r); err != nil {
+		return snt, err
+	}
+
+	for i := 0; i < int(n); i++ {
+		charset, err := readStr(r)
+
+		if err != nil {
+			return snt, err
+		}
+
+		snt.Charsets = append(snt.Charsets, charset)
+	}
+
+	if n, err = readUint16(r); err != nil {
+		return snt, err
+	}
+
+	for i := 0; i < int(n); i++ {
+		key, err := readStr(r)
+
+		if err != nil {
+			return snt, err
+		}
+
+		snt.AllowControl = append(snt.AllowControl, key)
+	}
+
+	var present uint8
+
+	if present, err = readUint8(r); err != nil {
+		return snt, err
+	}
+
+	if present != 0 {
+		node, err := readSchema(r)
+
+		if err != nil {
+			return snt, err
+		}
+
+		snt.Schema = &node
+	}
+
+	for _, list := range []*[]string{&snt.RequiredHeaders, &snt.AllowedHeaders} {
+		if n, err = readUint16(r); err != nil {
+			return snt, err
+		}
+
+		for i := 0; i < int(n); i++ {
+			name, err := readStr(r)
+
+			if err != nil {
+				return snt, err
+			}
+
+			*list = append(*list, name)
+		}
+	}
+
+	if snt.Cookies.Flags, err = readUint8(r); err != nil {
+		return snt, err
+	}
+
+	if snt.Cookies.SameSite, err = readStr(r); err != nil {
+		return snt, err
+	}
+
+	if snt.CORS.Flags, err = readUint8(r); err != nil {
+		return snt, err
+	}
+
+	for _, list := range []*[]string{&snt.CORS.Origins, &snt.CORS.Methods, &snt.CORS.Headers} {
+		if n, err = readUint16(r); err != nil {
+			return snt, err
+		}
+
+		for i := 0; i < int(n); i++ {
+			val, err := readStr(r)
+
+			if err != nil {
+				return snt, err
+			}
+
+			*list = append(*list, val)
+		}
+	}
+
+	if snt.Bots.Flags, err = readUint8(r); err != nil {
+		return snt, err
+	}
+
+	for _, list := range []*[]string{&snt.Bots.Headers, &snt.Bots.Agents, &snt.Bots.Allow, &snt.Bots.Deny} {
+		if n, err = readUint16(r); err != nil {
+			return snt, err
+		}
+
+		for i := 0; i < int(n); i++ {
+			val, err := readStr(r)
+
+			if err != nil {
+				return snt, err
+			}
+
+			*list = append(*list, val)
+		}
+	}
+
+	if n, err = readUint16(r); err != nil {
+		return snt, err
+	}
+
+	for i := 0; i < int(n); i++ {
+		seq, err := readSequence(r)
+
+		if err != nil {
+			return snt, err
+		}
+
+		snt.Sequences = append(snt.Sequences, seq)
+	}
+
+	if n, err = readUint16(r); err != nil {
+		return snt, err
+	}
+
+	for i := 0; i < int(n); i++ {
+		code, err := readUint16(r)
+
+		if err != nil {
+			return snt, err
+		}
+
+		snt.AllowedStatus = append(snt.AllowedStatus, code)
+	}
+
+	return snt, checkRecord(r)
+}
+
+func readSchema(r io.Reader) (mkruleval.SchemaNode, error) {
+	var err error
+	var n uint16
+	var node mkruleval.SchemaNode
+
+	if node.Key, err = readStr(r); err != nil {
+		return node, err
+	}
+
+	if node.Types, err = readUint8(r); err != nil {
+		return node, err
+	}
+
+	if node.Flags, err = readUint8(r); err != nil {
+		return node, err
+	}
+
+	if node.MaxLength, err = readUint64(r); err != nil {
+		return node, err
+	}
+
+	if n, err = readUint16(r); err != nil {
+		return node, err
+	}
+
+	for i := 0; i < int(n); i++ {
+		child, err := readSchema(r)
+
+		if err != nil {
+			return node, err
+		}
+
+		node.Children = append(node.Children, child)
+	}
+
+	return node, nil
+}
+
+func readRule(r io.Reader) (mkruleval.SentinelRule, error) {
+	var err error
+	var rule mkruleval.SentinelRule
+
+	if r, err = readRecord(r); err != nil {
+		return rule, err
+	}
+
+	if rule.Window, err = readWindow(r); err != nil {
+		return rule, err
+	}
+
+	if rule.Expires, err = readUint64(r); err != nil {
+		return rule, err
+	}
+
+	if rule.Sample, err = readUint16(r); err != nil {
+		return rule, err
+	}
+
+	if rule.Sample > mkruleval.SAMPLE_SCALE {
+		return rule, fmt.Errorf("invalid sample: %d", rule.Sample)
+	}
+
+	if rule.Experiment, err = readStr(r); err != nil {
+		return rule, err
+	}
+
+	if len(rule.Experiment) != 0 {
+		if rule.Variant, err = readUint8(r); err != nil {
+			return rule, err
+		}
+
+		if rule.Variants, err = readUint8(r); err != nil {
+			return rule, err
+		}
+
+		if rule.Variant == 0 || rule.Variant > rule.Variants {
+			return rule, fmt.Errorf("experiment %s: invalid variant %d of %d", rule.Experiment, rule.Variant, rule.Variants)
+		}
+	}
+
+	if rule.Groups, err = readGroups(r, VERSION); err != nil {
+		return rule, err
+	}
+
+	return rule, checkRecord(r)
+}
+
+func readGroups(r io.Reader, version uint32) ([][]mkruleval.Stmt, error) {
+	var result [][]mkruleval.Stmt
+
+	groups, err := readUint16(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for j := 0; j < int(groups); j++ {
+		var stmts []mkruleval.Stmt
+
+		count, err := readUint16(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for k := 0; k < int(count); k++ {
+			stmt, err := readStmt(r, version)
+
+			if err != nil {
+				return nil, err
+			}
+
+			stmts = append(stmts, stmt)
+		}
+
+		result = append(result, stmts)
+	}
+
+	return result, nil
+}
+
+func readSequence(r io.Reader) (mkruleval.SequenceRule, error) {
+	var err error
+	var n uint16
+	var seq mkruleval.SequenceRule
+
+	if seq.Key.Var, err = readUint8(r); err != nil {
+		return seq, err
+	}
+
+	if ArgVars[seq.Key.Var] {
+		if seq.Key.Arg, err = readStr(r); err != nil {
+			return seq, err
+		}
+	}
+
+	if seq.Count, err = readUint32(r); err != nil {
+		return seq, err
+	}
+
+	if seq.Count == 0 {
+		return seq, fmt.Errorf("sequence count must be positive")
+	}
+
+	if seq.Window, err = readUint32(r); err != nil {
+		return seq, err
+	}
+
+	if n, err = readUint16(r); err != nil {
+		return seq, err
+	}
+
+	for i := 0; i < int(n); i++ {
+		code, err := readUint16(r)
+
+		if err != nil {
+			return seq, err
+		}
+
+		seq.Status = append(seq.Status, code)
+	}
+
+	seq.Groups, err = readGroups(r, VERSION)
+
+	return seq, err
+}
+
+func readRecord(r io.Reader) (io.Reader, error) {
+	n, err := readUint32(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, int64(n)))
+
+	if err == nil && len(data) != int(n) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return &CountingReader{r: bytes.NewReader(data), order: orderOf(r)}, err
+}
+
+// checkRecord fails if a length-prefixed record was not read to its end.
+func checkRecord(r io.Reader) error {
+	if cr, ok := r.(*CountingReader); ok {
+		if rec, ok := cr.r.(*bytes.Reader); ok && rec.Len() != 0 {
+			return fmt.Errorf("%d trailing bytes in record", rec.Len())
+		}
+	}
+
+	return nil
+}
+
+type CountingReader struct {
+	r     io.Reader
+	n     uint64
+	order binary.ByteOrder
+}
+
+func (r *CountingReader) ByteOrder() binary.ByteOrder {
+	return r.order
+}
+
+func (r *CountingReader) Read(data []byte) (int, error) {
+	n, err := r.r.Read(data)
+	r.n += uint64(n)
+	return n, err
+}
+
+// RoundTrip encodes the sentinels, decodes them back and checks that
+// encoding the result gives the same bytes.
+func (c *Compiler) RoundTrip(snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes) error {
+	var a, b bytes.Buffer
+
+	if err := c.EncodeSentinels(&a, snts, tmpls, types); err != nil {
+		return err
+	}
+
+	s, t, ct, err := c.DecodeSentinels(bytes.NewReader(a.Bytes()))
+
+	if err != nil {
+		return fmt.Errorf("decode: %v", err)
+	}
+
+	if err = c.EncodeSentinels(&b, s, t, ct); err != nil {
+		return fmt.Errorf("re-encode: %v", err)
+	}
+
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		for i := range a.Bytes() {
+			if i >= b.Len() || a.Bytes()[i] != b.Bytes()[i] {
+				return fmt.Errorf("round trip mismatch at offset %d", i)
+			}
+		}
+
+		return fmt.Errorf("round trip mismatch at offset %d", a.Len())
+	}
+
+	return nil
+}
+
+func (c *Compiler) DecodeSentinels(src io.Reader) ([]mkruleval.Sentinel, []mkruleval.Template, mkruleval.ContentTypes, error) {
+	var snts []mkruleval.Sentinel
+	var tmpls []mkruleval.Template
+	var offs []uint64
+	var shared []mkruleval.SentinelRule
+	var types mkruleval.ContentTypes
+
+	var head [4]byte
+
+	r := &CountingReader{r: src, order: binary.LittleEndian}
+
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, nil, nil, err
+	}
+
+	version := binary.LittleEndian.Uint32(head[:])
+
+	if version == V4_VERSION {
+		return c.decodeV4(r)
+	}
+
+	var hdr [4]byte
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if hdr[0]&HDR_BIG_ENDIAN != 0 {
+		r.order = binary.BigEndian
+	}
+
+	if version = r.order.Uint32(head[:]); version != VERSION {
+		return nil, nil, nil, fmt.Errorf("unsupported version: %d", version)
+	}
+
+	if hdr[0]&HDR_ENCRYPTED != 0 {
+		prelude := append(head[:], hdr[:]...)
+		rest, err := io.ReadAll(r.r)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// the signature trailer follows the sealed data
+		if hdr[0]&HDR_SIGNED != 0 {
+			if rest, _, err = SplitSignatures(append(slices.Clone(prelude), rest...)); err != nil {
+				return nil, nil, nil, err
+			}
+
+			rest = rest[PRELUDE:]
+		}
+
+		plain, err := c.openArtifact(prelude, bytes.NewReader(rest))
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		r.r = bytes.NewReader(plain)
+	}
+
+	n, err := readUint32(r)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if _, err = readUint32(r); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if _, err = readUint64(r); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var prev uint64
+
+	for i := 0; i < int(n); i++ {
+		off, err := readUint64(r)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if off <= prev {
+			return nil, nil, nil, fmt.Errorf("offset table: offset %d of sentinel %d is out of order", off, i)
+		}
+
+		prev = off
+		offs = append(offs, off)
+	}
+
+	nrules, err := readUint32(r)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for i := 0; i < int(nrules); i++ {
+		rule, err := readRule(r)
+
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("shared rule %d: %v", i, err)
+		}
+
+		shared = append(shared, rule)
+	}
+
+	count, err := readUint32(r)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if count != n {
+		return nil, nil, nil, fmt.Errorf("offset table has %d entries for %d sentinels", n, count)
+	}
+
+	for i := 0; i < int(count); i++ {
+		if offs[i] < r.n {
+			return nil, nil, nil, fmt.Errorf("sentinel %d: offset %d is inside the previous sentinel", i, offs[i])
+		}
+
+		if _, err = io.CopyN(io.Discard, r, int64(offs[i]-r.n)); err != nil {
+			return nil, nil, nil, err
+		}
+
+		snt, err := readSentinel(r, shared)
+
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("sentinel %d: %v", i, err)
+		}
+
+		snts = append(snts, snt)
+	}
+
+	ntmpls, err := readUint16(r)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for i := 0; i < int(ntmpls); i++ {
+		var tmpl mkruleval.Template
+
+		if tmpl.Name, err = readStr(r); err != nil {
+			return nil, nil, nil, err
+		}
+
+		if tmpl.ContentType, err = readStr(r); err != nil {
+			return nil, nil, nil, err
+		}
+
+		if tmpl.Body, err = readStr(r); err != nil {
+			return nil, nil, nil, err
+		}
+
+		tmpls = append(tmpls, tmpl)
+	}
+
+	if err = readMetadata(r, snts); err != nil {
+		return nil, nil, nil, fmt.Errorf("metadata: %v", err)
+	}
+
+	if types, err = readContentContexts(r); err != nil {
+		return nil, nil, nil, fmt.Errorf("content types: %v", err)
+	}
+
+	size, err := readUint32(r)
+
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("changelog: %v", err)
+	}
+
+	var sb strings.Builder
+
+	if _, err = io.CopyN(&sb, r, int64(size)); err != nil {
+		return nil, nil, nil, fmt.Errorf("changelog: %v", err)
+	}
+
+	c.LoadedChangelog = sb.String()
+
+	return snts, tmpls, types, nil
+}
+
+// decodeV4 reads the original layout: the sentinel count and offsets, the
+// count again and the sentinels, each a method, the path segments and the
+// rules as bare groups, with nothing after them.
+func (c *Compiler) decodeV4(r *CountingReader) ([]mkruleval.Sentinel, []mkruleval.Template, mkruleval.ContentTypes, error) {
+	var snts []mkruleval.Sentinel
+	var offs []uint64
+
+	c.LoadedChangelog = ""
+
+	n, err := readUint16(r)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for i := 0; i < int(n); i++ {
+		off, err := readUint64(r)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		offs = append(offs, off)
+	}
+
+	count, err := readUint16(r)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if count != n {
+		return nil, nil, nil, fmt.Errorf("offset table has %d entries for %d sentinels", n, count)
+	}
+
+	for i := 0; i < int(count); i++ {
+		var snt mkruleval.Sentinel
+
+		if r.n != offs[i] {
+			return nil, nil, nil, fmt.Errorf("sentinel %d: offset %d does not match the offset table (%d)", i, r.n, offs[i])
+		}
+
+		if snt.Method, err = readStr(r); err != nil {
+			return nil, nil, nil, err
+		}
+
+		if snt.Method == "*" {
+			snt.Method = ""
+		}
+
+		segs, err := readUint16(r)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		for j := 0; j < int(segs); j++ {
+			seg, err := readStr(r)
+
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			snt.Path = append(snt.Path, seg)
+		}
+
+		rules, err := readUint16(r)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		for j := 0; j < int(rules); j++ {
+			groups, err := readGroups(r, V4_VERSION)
+
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("sentinel %d: rule %d: %v", i, j, err)
+			}
+
+			snt.Rules = append(snt.Rules, mkruleval.SentinelRule{Groups: groups})
+		}
+
+		snts = append(snts, snt)
+	}
+
+	if _, err = r.Read(make([]byte, 1)); err != io.EOF {
+		return nil, nil, nil, fmt.Errorf("trailing data after the sentinels")
+	}
+
+	return snts, nil, nil, nil
+}
+
+func readMeta(r io.Reader) (mkruleval.Metadata, error) {
+	var meta mkruleval.Metadata
+	var err error
+
+	if meta.Owner, err = readStr(r); err != nil {
+		return meta, err
+	}
+
+	meta.Description, err = readStr(r)
+
+	return meta, err
+}
+
+func readMetadata(r io.Reader, snts []mkruleval.Sentinel) error {
+	n, err := readUint32(r)
+
+	if err != nil || n == 0 {
+		return err
+	}
+
+	if int(n) != len(snts) {
+		return fmt.Errorf("%d entries for %d sentinels", n, len(snts))
+	}
+
+	for i := range snts {
+		if snts[i].Meta, err = readMeta(r); err != nil {
+			return err
+		}
+
+		nrules, err := readUint16(r)
+
+		if err != nil {
+			return err
+		}
+
+		if int(nrules) != len(snts[i].Rules) {
+			return fmt.Errorf("sentinel %d: %d entries for %d rules", i, nrules, len(snts[i].Rules))
+		}
+
+		for j := range snts[i].Rules {
+			if snts[i].Rules[j].Meta, err = readMeta(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func readContentContexts(r io.Reader) (mkruleval.ContentTypes, error) {
+	types := mkruleval.ContentTypes{}
+
+	n, err := readUint32(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < int(n); i++ {
+		contentType, err := readStr(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		code, err := readUint8(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, err := mkruleval.ContextName(code)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err = types.Register(contentType, ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return types, nil
+}
+
+func IsJSON(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) != 0 && (data[0] == '[' || data[0] == '{')
+}
+
+// Load compiles an endpoints file or decodes an artifact as compile does,
+// without the overlay and the filters of the command line.
+func (c *Compiler) Load(path string) ([]mkruleval.Sentinel, []mkruleval.Template, mkruleval.ContentTypes, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if IsConfig(path, data) {
+		cfg, err := c.decodeConfigFile(path, data)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		return c.Build(cfg)
+	}
+
+	return c.decodeArtifact(path, data)
+}
+
+// decodeArtifact decodes the artifact read from path and checks it like a
+// compile's own output, the errors name the file.
+func (c *Compiler) decodeArtifact(path string, data []byte) ([]mkruleval.Sentinel, []mkruleval.Template, mkruleval.ContentTypes, error) {
+	snts, tmpls, types, err := c.DecodeSentinels(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, nil, nil, &CompileError{Code: EXIT_PARSE, Rule: -1, Err: fmt.Errorf("%s: %v", path, err)}
+	}
+
+	if err = c.checkRegexps(snts); err != nil {
+		return nil, nil, nil, Invalid(fmt.Errorf("%s: %v", path, err))
+	}
+
+	if err = c.CheckLimits(snts, tmpls, types); err != nil {
+		return nil, nil, nil, Invalid(fmt.Errorf("%s: %v", path, err))
+	}
+
+	return snts, tmpls, types, nil
+}
+
+type Stats struct {
+	Sentinels   int            `json:"sentinels"`
+	Rules       int            `json:"rules"`
+	SharedRules int            `json:"shared_rules"`
+	Groups      int            `json:"groups"`
+	Statements  int            `json:"statements"`
+	Regexps     int            `json:"unique_regexps"`
+	StringBytes int            `json:"string_bytes"`
+	Size        uint64         `json:"size"`
+	Largest     string         `json:"largest_endpoint"`
+	LargestSize uint64         `json:"largest_endpoint_size"`
+	Contexts    map[string]int `json:"contexts"`
+
+	// Cost sums the statement costs of all rules, see stmtCost
+	Cost          uint64 `json:"cost"`
+	Costliest     string `json:"costliest_rule"`
+	CostliestCost uint64 `json:"costliest_rule_cost"`
+}
+
+func (c *Compiler) Stats(snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes) (Stats, error) {
+	var w NopWriter
+
+	stats := Stats{Sentinels: len(snts), Contexts: map[string]int{}}
+	regexps := map[string]bool{}
+
+	if err := c.EncodeSentinels(&w, snts, tmpls, types); err != nil {
+		return stats, err
+	}
+
+	stats.Size = w.Offset()
+
+	table, err := internRules(snts)
+
+	if err != nil {
+		return stats, err
+	}
+
+	stats.SharedRules = len(table.rules)
+
+	for _, tmpl := range tmpls {
+		stats.StringBytes += len(tmpl.Name) + len(tmpl.ContentType) + len(tmpl.Body)
+	}
+
+	for _, snt := range snts {
+		var size NopWriter
+
+		if err := writeSentinel(&size, snt, table); err != nil {
+			return stats, err
+		}
+
+		if size.Offset() > stats.LargestSize {
+			stats.Largest = snt.Name()
+			stats.LargestSize = size.Offset()
+		}
+
+		stats.Rules += len(snt.Rules)
+		stats.StringBytes += len(snt.Method) + len(snt.Window.Cron)
+
+		for _, val := range snt.Path {
+			stats.StringBytes += len(val)
+		}
+
+		for i, rule := range snt.Rules {
+			var cost uint64
+
+			stats.Groups += len(rule.Groups)
+			stats.StringBytes += len(rule.Window.Cron)
+
+			for _, stmts := range rule.Groups {
+				stats.Statements += len(stmts)
+
+				for _, stmt := range stmts {
+					cost += uint64(stmtCost(stmt))
+
+					if len(stmt.Regexp) != 0 {
+						regexps[mkruleval.RegexpSource(stmt)] = true
+					}
+
+					if stmt.Var == mkruleval.CTX {
+						for _, c := range strings.Split(stmt.Val, "|") {
+							stats.Contexts[strings.TrimSpace(c)]++
+						}
+					} else {
+						stats.StringBytes += len(stmt.Arg) + len(stmt.Val) + len(stmt.Regexp) + len(stmt.Bytes)
+					}
+				}
+			}
+
+			if stats.Cost += cost; cost > stats.CostliestCost {
+				stats.Costliest = fmt.Sprintf("%s rule %d", snt.Name(), i)
+				stats.CostliestCost = cost
+			}
+		}
+	}
+
+	stats.Regexps = len(regexps)
+
+	return stats, nil
+}
+
+// DecryptArtifact returns an encrypted artifact as it was before
+// sealArtifact, and any other artifact as is.
+func (c *Compiler) DecryptArtifact(data []byte) ([]byte, error) {
+	if len(data) < PRELUDE || data[4]&HDR_ENCRYPTED == 0 {
+		return data, nil
+	}
+
+	plain, err := c.openArtifact(data[:PRELUDE], bytes.NewReader(data[PRELUDE:]))
+
+	if err != nil {
+		return nil, err
+	}
+
+	prelude := slices.Clone(data[:PRELUDE])
+	prelude[4] &^= HDR_ENCRYPTED
+
+	return append(prelude, plain...), nil
+}
+
+// verifyLayout checks the header, the offset table and the position of
+// every sentinel record against the raw artifact.
+func verifyLayout(data []byte) (binary.ByteOrder, uint64, []uint64, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+
+	if len(data) < 24 {
+		return nil, 0, nil, fmt.Errorf("header: truncated")
+	}
+
+	if binary.LittleEndian.Uint32(data) == V4_VERSION {
+		return nil, 0, nil, fmt.Errorf("header: version %d is not verified, re-encode it with -i", V4_VERSION)
+	}
+
+	if data[4]&HDR_BIG_ENDIAN != 0 {
+		order = binary.BigEndian
+	}
+
+	if version := order.Uint32(data); version != VERSION {
+		return nil, 0, nil, fmt.Errorf("header: unsupported version %d", version)
+	}
+
+	if flags := data[4] &^ (HDR_BIG_ENDIAN | HDR_CDB | HDR_ENCRYPTED | HDR_SIGNED); flags != 0 {
+		return nil, 0, nil, fmt.Errorf("header: unknown flags %#x", flags)
+	}
+
+	if data[5] != 0 || data[6] != 0 || data[7] != 0 || order.Uint32(data[12:]) != 0 {
+		return nil, 0, nil, fmt.Errorf("header: reserved fields are not zero")
+	}
+
+	count := uint64(order.Uint32(data[8:]))
+	index := order.Uint64(data[16:])
+	table := 24 + 8*count
+
+	if table > uint64(len(data)) {
+		return nil, 0, nil, fmt.Errorf("offset table: %d entries do not fit in %d bytes", count, len(data))
+	}
+
+	if index%ALIGN != 0 || index < table || index > uint64(len(data)) {
+		return nil, 0, nil, fmt.Errorf("header: index offset %d is out of bounds or unaligned", index)
+	}
+
+	offs := make([]uint64, count)
+
+	// every offset is checked before any record is read, the records are
+	// sliced up to the next offset
+	for i := range offs {
+		offs[i] = order.Uint64(data[24+8*i:])
+
+		if offs[i]%ALIGN != 0 || offs[i] < table || offs[i] >= index || (i > 0 && offs[i] <= offs[i-1]) {
+			return nil, 0, nil, fmt.Errorf("offset table: offset %d of sentinel %d is out of bounds, unaligned or out of order", offs[i], i)
+		}
+	}
+
+	for i, off := range offs {
+		next := index
+
+		if i+1 < len(offs) {
+			next = offs[i+1]
+		}
+
+		if next-off < 4 {
+			return nil, 0, nil, fmt.Errorf("sentinel %d: no room for the record at offset %d", i, off)
+		}
+
+		end := off + 4 + uint64(order.Uint32(data[off:]))
+
+		if end > next {
+			return nil, 0, nil, fmt.Errorf("sentinel %d: record of %d bytes overlaps the next section", i, end-off)
+		}
+
+		if i+1 < len(offs) && (next-end >= ALIGN || slices.ContainsFunc(data[end:next], func(b byte) bool { return b != 0 })) {
+			return nil, 0, nil, fmt.Errorf("sentinel %d: %d unaccounted bytes after the record", i, next-end)
+		}
+	}
+
+	return order, index, offs, nil
+}
+
+// verifyStmt checks that the codes of a decoded statement are ones the
+// runtime knows.
+func verifyStmt(stmt mkruleval.Stmt) error {
+	if _, ok := mkruleval.ActionNames[stmt.Op]; ok {
+		if stmt.Var != 0 {
+			return fmt.Errorf("action %s has variable %d", OpName(stmt.Op), stmt.Var)
+		}
+
+		return nil
+	}
+
+	if _, ok := mkruleval.VarNames[stmt.Var]; !ok {
+		return fmt.Errorf("unknown variable: %d", stmt.Var)
+	}
+
+	switch {
+	case stmt.Op == mkruleval.EQ || stmt.Op == mkruleval.NEQ || stmt.Op == mkruleval.ENTROPY || PredicateOp(stmt.Op):
+	case stmt.Op == mkruleval.EQ_VAR || stmt.Op == mkruleval.NEQ_VAR:
+		if _, ok := mkruleval.VarNames[stmt.Ref.Var]; !ok {
+			return fmt.Errorf("unknown variable: %d", stmt.Ref.Var)
+		}
+	case stmt.Op >= mkruleval.CUSTOM_OP_MIN:
+	default:
+		return fmt.Errorf("unknown operator: %d", stmt.Op)
+	}
+
+	if mods := stmt.Mods &^ (mkruleval.MOD_NFKC | mkruleval.MOD_EXCEPT | mkruleval.MOD_CAPTURE | mkruleval.MOD_LUHN); mods != 0 {
+		return fmt.Errorf("unknown modifiers: %#x", mods)
+	}
+
+	if flags := stmt.Flags &^ (mkruleval.RE_CASE_INSENSITIVE | mkruleval.RE_DOTALL | mkruleval.RE_MULTILINE); flags != 0 {
+		return fmt.Errorf("unknown regexp flags: %#x", flags)
+	}
+
+	if err := checkOperand(stmt, operandType(stmt)); err != nil {
+		return err
+	}
+
+	if len(stmt.Regexp) != 0 {
+		if _, err := regexp.Compile(mkruleval.RegexpSource(stmt)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifyArtifact checks a decrypted artifact beyond what decoding does:
+// its layout, the statements, and the index against the one the decoded
+// sentinels make. It returns the sentinels and the problems found.
+func (c *Compiler) VerifyArtifact(data []byte) ([]mkruleval.Sentinel, []string, error) {
+	var problems []string
+
+	order, index, offs, err := verifyLayout(data)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := bytes.NewReader(data)
+	snts, _, _, err := c.DecodeSentinels(r)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the sections end at the last record before the index, padded to
+	// its alignment
+	if end := uint64(len(data) - r.Len()); end > index || index-end >= ALIGN || slices.ContainsFunc(data[end:index], func(b byte) bool { return b != 0 }) {
+		problems = append(problems, fmt.Sprintf("the sections end at %d, not at the index (%d)", end, index))
+	}
+
+	for _, snt := range snts {
+		for j, seq := range snt.Sequences {
+			if seq.Count == 0 {
+				problems = append(problems, fmt.Sprintf("%s sequence %d: count is zero", snt.Name(), j))
+			}
+		}
+
+		for j, rule := range snt.AllRules() {
+			if rule.Sample > mkruleval.SAMPLE_SCALE {
+				problems = append(problems, fmt.Sprintf("%s rule %d: sample %d is over %d", snt.Name(), j, rule.Sample, mkruleval.SAMPLE_SCALE))
+			}
+
+			if len(rule.Experiment) != 0 && (rule.Variant == 0 || rule.Variant > rule.Variants) {
+				problems = append(problems, fmt.Sprintf("%s rule %d: variant %d of %d", snt.Name(), j, rule.Variant, rule.Variants))
+			}
+
+			for k, group := range rule.Groups {
+				for l, stmt := range group {
+					if err = verifyStmt(stmt); err != nil {
+						problems = append(problems, fmt.Sprintf("%s rule %d group %d statement %d: %v", snt.Name(), j, k, l, err))
+					}
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+
+	cw := &CountingWriter{w: &buf, n: index, order: order}
+
+	if data[4]&HDR_CDB != 0 {
+		err = writeCDB(cw, snts, offs)
+	} else {
+		err = writeIndex(cw, snts, offs)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !bytes.Equal(buf.Bytes(), data[index:]) {
+		problems = append(problems, "index section does not match the sentinels")
+	} else if data[4]&HDR_CDB != 0 {
+		cdb, err := readCDB(data, order, index)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i, snt := range snts {
+			method := snt.Method
+
+			if len(method) == 0 || method == "*" {
+				method = http.MethodGet
+			}
+
+			if !slices.Contains(cdb.Lookup(method, SamplePath(snt.Path)), offs[i]) {
+				problems = append(problems, fmt.Sprintf("%s is not reachable through the cdb index", snt.Name()))
+			}
+		}
+	}
+
+	return snts, problems, nil
+}
+
+// SamplePath returns a request path matching the path of an endpoint.
+func SamplePath(path []string) string {
+	var segs []string
+
+	for _, val := range path {
+		seg := mkruleval.ParseSegment(val)
+
+		switch seg.Kind {
+		case mkruleval.SEG_LITERAL:
+			segs = append(segs, seg.Name)
+		case mkruleval.SEG_REGEXP:
+			sample := "x"
+
+			for _, candidate := range []string{"1", "x", "a1", "00000000-0000-0000-0000-000000000000"} {
+				if ok, _ := regexp.MatchString("^(?:"+seg.Pattern+")$", candidate); ok {
+					sample = candidate
+					break
+				}
+			}
+
+			segs = append(segs, sample)
+		default:
+			segs = append(segs, "x")
+		}
+	}
+
+	return "/" + strings.Join(segs, "/")
+}
+
+func HasPrefix(path []string, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+
+	for i, val := range prefix {
+		if path[i] != val {
+			return false
+		}
+	}
+
+	return true
+}
+
+func SplitPrefix(prefix string) []string {
+	var segs []string
+
+	for _, val := range strings.Split(prefix, "/") {
+		if len(val) != 0 {
+			segs = append(segs, val)
+		}
+	}
+
+	return segs
+}
+
+var detectorCodes = map[string]uint8{
+	"cc":      mkruleval.DETECT_CC,
+	"ssn":     mkruleval.DETECT_SSN,
+	"aws_key": mkruleval.DETECT_AWS_KEY,
+	"jwt":     mkruleval.DETECT_JWT,
+}
+
+var detectorNames = map[uint8]string{
+	mkruleval.DETECT_CC:      "cc",
+	mkruleval.DETECT_SSN:     "ssn",
+	mkruleval.DETECT_AWS_KEY: "aws_key",
+	mkruleval.DETECT_JWT:     "jwt",
+}
+
+// PredicateOp tells the operators that test a value by themselves, without
+// an operand.
+func PredicateOp(op uint8) bool {
+	return op == mkruleval.IS_SQLI || op == mkruleval.IS_XSS
+}
+
+// RuleSet is one version of the rules held by a Store.
+type RuleSet struct {
+	Version      uint64
+	Sentinels    []mkruleval.Sentinel
+	Templates    []mkruleval.Template
+	ContentTypes mkruleval.ContentTypes
+	Guard        *mkruleval.Guard
+	Loaded       time.Time
+}
+
+// Store holds the current rules of a process. Swaps are atomic: a request
+// is checked against the rule set it started with, and the subscribers
+// are notified of every new one.
+type Store struct {
+	// Compiler compiles the files of Load.
+	Compiler Compiler
+
+	current atomic.Pointer[RuleSet]
+
+	mu   sync.Mutex
+	subs []chan *RuleSet
+}
+
+// Current returns the current rule set, nil before the first swap.
+func (s *Store) Current() *RuleSet {
+	return s.current.Load()
+}
+
+// Swap makes the rules current and returns their rule set.
+func (s *Store) Swap(snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes) (*RuleSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.swap(snts, tmpls, types)
+}
+
+func (s *Store) swap(snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes) (*RuleSet, error) {
+	g, err := mkruleval.NewGuard(snts, tmpls, types)
+
+	if err != nil {
+		return nil, err
+	}
+
+	set := &RuleSet{Sentinels: snts, Templates: tmpls, ContentTypes: types, Guard: g, Loaded: time.Now()}
+
+	// the sequence counts survive the swap
+	if prev := s.current.Load(); prev != nil {
+		set.Version = prev.Version + 1
+		g.Tracker = prev.Guard.Tracker
+	} else {
+		set.Version = 1
+	}
+
+	s.current.Store(set)
+
+	// the channels hold the latest rule set only, so that a slow
+	// subscriber does not block the swaps
+	for _, ch := range s.subs {
+		select {
+		case <-ch:
+		default:
+		}
+
+		ch <- set
+	}
 
-	groups := scanGroups(rule)
+	return set, nil
+}
 
-	for _, group := range groups {
-		stmt, err := parseGroup(group)
+// Load compiles an endpoints file, or decodes an artifact, and swaps it
+// in. The current rules are kept if it fails.
+func (s *Store) Load(path string) (*RuleSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		if err != nil {
-			return nil, err
-		}
+	snts, tmpls, types, err := s.Compiler.Compile(path)
 
-		result = append(result, stmt)
+	if err != nil {
+		return nil, err
 	}
 
-	return result, nil
+	return s.swap(snts, tmpls, types)
 }
 
-func scanWord(dst *strings.Builder, src *bytes.Buffer) {
-	for {
-		r, _, err := src.ReadRune()
+// Subscribe returns a channel receiving the rule sets swapped in from now
+// on; a pending one is replaced by a newer one.
+func (s *Store) Subscribe() <-chan *RuleSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		if err != nil { // EOF
-			return
-		}
-
-		if unicode.IsSpace(r) {
-			return
-		}
+	ch := make(chan *RuleSet, 1)
+	s.subs = append(s.subs, ch)
 
-		dst.WriteRune(r)
-	}
+	return ch
 }
 
-func scanDelim(dst *strings.Builder, src *bytes.Buffer, delim rune) {
-	escape := false
+// Unsubscribe stops the notifications of a channel from Subscribe.
+func (s *Store) Unsubscribe(ch <-chan *RuleSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	for {
-		r, _, err := src.ReadRune()
+	s.subs = slices.DeleteFunc(s.subs, func(sub chan *RuleSet) bool {
+		return sub == ch
+	})
+}
 
-		if err != nil {
-			log.Fatalln("invalid string")
-		}
+func OpName(op uint8) string {
+	if name, ok := mkruleval.ActionNames[op]; ok {
+		return name
+	}
 
-		if escape {
-			dst.WriteRune(r)
-			escape = false
-		} else if r == '\\' {
-			escape = true
-		} else if r == delim {
-			dst.WriteRune(r)
-			return
-		} else {
-			dst.WriteRune(r)
+	for name, code := range customOps {
+		if code == op {
+			return name
 		}
 	}
+
+	return strconv.Itoa(int(op))
 }
 
-func scanGroups(text string) [][]string {
-	var result [][]string
-	var group []string
-	var sb strings.Builder
+func SHA256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
 
-	buf := bytes.NewBufferString(text)
+// EffectiveConfig decodes the endpoints file and applies its rules files
+// and the overlay.
+func (c *Compiler) EffectiveConfig(path string, data []byte) (Config, error) {
+	cfg, err := c.decodeConfigFile(path, data)
 
-	for {
-		r, _, err := buf.ReadRune()
+	if err != nil {
+		return cfg, err
+	}
 
-		if err != nil { // EOF
-			break
-		}
+	if len(c.Overlay) == 0 {
+		return c.filterEndpoints(cfg), nil
+	}
 
-		if unicode.IsSpace(r) {
-			continue
+	ovl, err := c.readOverlay(c.Overlay)
+
+	if err != nil {
+		return cfg, err
+	}
+
+	for i := range ovl.Endpoints {
+		if err = c.readRulesFile(&ovl.Endpoints[i].Endpoint, filepath.Dir(c.Overlay), cfg.Normalize); err != nil {
+			return cfg, err
 		}
 
-		switch r {
-		case ':':
-			result = append(result, group)
-			group = nil
-		case '\'':
-			sb.WriteRune(r)
-			scanDelim(&sb, buf, '\'')
-			group = append(group, sb.String())
-			sb.Reset()
-		case '/':
-			sb.WriteRune(r)
-			scanDelim(&sb, buf, '/')
-			group = append(group, sb.String())
-			sb.Reset()
-		default:
-			sb.WriteRune(r)
-			scanWord(&sb, buf)
-			group = append(group, sb.String())
-			sb.Reset()
+		if err = c.readSchemaFile(&ovl.Endpoints[i].Endpoint, filepath.Dir(c.Overlay)); err != nil {
+			return cfg, err
 		}
 	}
 
-	if len(group) != 0 {
-		result = append(result, group)
+	if cfg, err = applyOverlay(cfg, ovl); err != nil {
+		return cfg, Invalid(err)
 	}
 
-	return result
+	return c.filterEndpoints(cfg), nil
 }
 
-func parseGroup(tokens []string) ([]Stmt, error) {
-	var result []Stmt
-	var curr Stmt
-	var err error
-
-	for _, token := range tokens {
-		if strings.HasPrefix(token, "'") {
-			curr.Val = strings.Trim(token, "'")
-		} else if strings.HasPrefix(token, "/") {
-			curr.Regexp = token
-		} else if strings.HasPrefix(token, "$") {
-			curr.Var, err = parseVar(token)
+// Filter selects endpoints by label, method or path for -only and
+// -exclude. Path patterns are matched as by path.Match, and a trailing /*
+// matches any subpath.
+type Filter struct {
+	Key string
+	Val string
+}
 
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			curr.Op, err = parseOp(token)
+type Filters []Filter
 
-			if err != nil {
-				return nil, err
-			}
-		}
+func (f *Filters) String() string {
+	var vals []string
 
-		if (curr.Var != 0 && curr.Op != 0 && (len(curr.Val) != 0 || len(curr.Regexp) != 0)) || (curr.Op == BLOCK || curr.Op == PASS) {
-			result = append(result, curr)
-			curr = Stmt{}
-		}
+	for _, filter := range *f {
+		vals = append(vals, filter.Key+"="+filter.Val)
 	}
 
-	return result, nil
+	return strings.Join(vals, ",")
 }
 
-func readEndpoints(path string) ([]Endpoint, error) {
-	var err error
-	var file *os.File
-	var result []Endpoint
+func (f *Filters) Set(val string) error {
+	key, val, found := strings.Cut(val, "=")
 
-	if file, err = os.Open(path); err != nil {
-		return nil, err
+	if !found || len(val) == 0 {
+		return fmt.Errorf("expected label=, method= or path= and a value")
 	}
 
-	defer file.Close()
+	switch key {
+	case "label", "method":
+	case "path":
+		if _, err := path.Match(val, ""); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown filter: %s", key)
+	}
 
-	dec := json.NewDecoder(file)
-	err = dec.Decode(&result)
+	*f = append(*f, Filter{key, val})
 
-	if err != nil && err != io.EOF {
-		return nil, err
+	return nil
+}
+
+func (f Filter) Match(endpoint Endpoint) bool {
+	switch f.Key {
+	case "label":
+		return slices.Contains(endpoint.Labels, f.Val)
+	case "method":
+		return strings.EqualFold(endpoint.Method, f.Val)
 	}
 
-	return result, nil
+	if prefix, ok := strings.CutSuffix(f.Val, "/*"); ok && strings.HasPrefix(endpoint.Path, prefix+"/") {
+		return true
+	}
+
+	ok, _ := path.Match(f.Val, endpoint.Path)
+
+	return ok
 }
 
-func makeSentinels(endpoints []Endpoint) ([]Sentinel, error) {
-	var result []Sentinel
+func (f Filters) Match(endpoint Endpoint) bool {
+	return slices.ContainsFunc(f, func(filter Filter) bool {
+		return filter.Match(endpoint)
+	})
+}
 
-	for _, endpoint := range endpoints {
-		var sentinel Sentinel
+// Compiler holds the settings of the compiles and of the artifacts they
+// write, the flags of the command line; the zero value uses the defaults.
+// Decoding reads its key from it too.
+type Compiler struct {
+	// Overlay is the overlay file applied to the endpoint files, and Only
+	// and Exclude the filters of their endpoints.
+	Overlay string
+	Only    Filters
+	Exclude Filters
 
-		sentinel.Method = endpoint.Method
+	AllowDangling bool
+	PruneExpired  bool
 
-		for _, val := range strings.Split(endpoint.Path, "/") {
-			if len(val) == 0 {
-				continue
-			}
+	// Redos and Conflicts are the severities of the nested quantifiers and
+	// of the conflicting rules: off, warn (the default) or error.
+	Redos          string
+	Conflicts      string
+	MaxRegexLength int
+	ForbidBackrefs bool
 
-			sentinel.Path = append(sentinel.Path, val)
-		}
+	// The limits, 0 for unlimited.
+	MaxEndpoints int
+	MaxRules     int
+	MaxDepth     int
+	MaxSize      uint64
 
-		for _, val := range endpoint.Rules {
-			rule, err := parseRule(val)
+	// Layout is flat (the default) or cdb, ByteOrder le (the default) or be.
+	Layout        string
+	ByteOrder     string
+	StripMetadata bool
 
-			if err != nil {
-				return nil, err
-			}
+	// Changelog is embedded in the artifacts written, LoadedChangelog is
+	// set to the one of the last artifact read.
+	Changelog       string
+	LoadedChangelog string
 
-			sentinel.Rules = append(sentinel.Rules, rule)
-		}
+	// Encrypt is the aes:FILE key of the artifacts written, decoding falls
+	// back to MKRUL_KEY_FILE without it. Signers are the ID:FILE keys
+	// signing them.
+	Encrypt string
+	Signers Signers
 
-		result = append(result, sentinel)
-	}
+	// CacheDir keeps the fetched packs.
+	CacheDir string
 
-	return result, nil
+	// Inputs, when not nil, receives the sha256 digests of the files read
+	// by path.
+	Inputs map[string]string
+
+	// Progress, when set, is called as the endpoints are compiled, and
+	// Locate with the endpoints of every build before they are compiled.
+	Progress func(stage string, done, total int)
+	Locate   func(endpoints []Endpoint)
 }
 
-func offsetTable(snts []Sentinel) ([]uint64, error) {
-	var err error
-	var w NopWriter
-	var result []uint64
+// filterEndpoints keeps the endpoints matching one of the -only filters,
+// if any, and none of the -exclude ones.
+func (c *Compiler) filterEndpoints(cfg Config) Config {
+	if len(c.Only) == 0 && len(c.Exclude) == 0 {
+		return cfg
+	}
+
+	total := len(cfg.Endpoints)
+
+	cfg.Endpoints = slices.DeleteFunc(cfg.Endpoints, func(endpoint Endpoint) bool {
+		return len(c.Only) != 0 && !c.Only.Match(endpoint) || c.Exclude.Match(endpoint)
+	})
+
+	slog.Info("endpoints filtered", "kept", len(cfg.Endpoints), "total", total)
 
-	_ = binary.Write(&w, binary.LittleEndian, uint32(0))
-	_ = binary.Write(&w, binary.LittleEndian, uint16(len(snts)))
+	return cfg
+}
+
+func (c *Compiler) Compile(path string) ([]mkruleval.Sentinel, []mkruleval.Template, mkruleval.ContentTypes, error) {
+	data, err := c.ReadInput(path)
 
-	for i := 0; i < len(snts); i++ {
-		_ = binary.Write(&w, binary.LittleEndian, uint64(0))
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	_ = binary.Write(&w, binary.LittleEndian, uint16(len(snts)))
+	if IsConfig(path, data) {
+		cfg, err := c.EffectiveConfig(path, data)
 
-	for _, snt := range snts {
-		result = append(result, w.Offset())
-		if err = writeSentinel(&w, snt); err != nil {
-			return nil, err
+		if err != nil {
+			return nil, nil, nil, err
 		}
+
+		return c.Build(cfg)
 	}
 
-	return result, nil
+	if len(c.Overlay) != 0 {
+		return nil, nil, nil, fmt.Errorf("%s: overlays apply to endpoint files only", path)
+	}
+
+	if len(c.Only) != 0 || len(c.Exclude) != 0 {
+		return nil, nil, nil, UsageError(fmt.Errorf("%s: -only and -exclude apply to endpoint files only", path))
+	}
+
+	return c.decodeArtifact(path, data)
 }
 
-func writeSentinels(path string, snts []Sentinel) error {
+func (c *Compiler) Build(cfg Config) ([]mkruleval.Sentinel, []mkruleval.Template, mkruleval.ContentTypes, error) {
 	var err error
-	var w *os.File
-	var offs []uint64
+	var snts []mkruleval.Sentinel
+	var tmpls []mkruleval.Template
 
-	w, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0655)
+	slog.Debug("endpoints", "count", len(cfg.Endpoints))
 
-	if err != nil {
-		return err
+	for i := range cfg.Endpoints {
+		for j := range cfg.Endpoints[i].Rules {
+			cfg.Endpoints[i].Rules[j].index = j
+		}
 	}
 
-	defer w.Close()
+	if c.Locate != nil {
+		c.Locate(cfg.Endpoints)
+	}
 
-	err = binary.Write(w, binary.LittleEndian, uint32(VERSION)) // version
+	snts, sources, err := c.makeSentinels(InheritRules(cfg.Endpoints))
 
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
-	offs, err = offsetTable(snts)
+	slog.Debug("sentinels", "count", len(snts))
 
-	if err != nil {
-		return err
+	if err = c.checkRegexps(snts); err != nil {
+		return nil, nil, nil, Invalid(err)
 	}
 
-	err = writeUint16(w, uint16(len(offs)))
-
-	if err != nil {
-		return err
+	if err = c.checkConflicts(snts, sources); err != nil {
+		return nil, nil, nil, Invalid(err)
 	}
 
-	for _, off := range offs {
-		if err = writeUint64(w, off); err != nil {
-			return err
-		}
+	tmpls, err = makeTemplates(cfg.Responses, snts)
+
+	if err != nil {
+		return nil, nil, nil, Invalid(err)
 	}
 
-	err = writeUint16(w, uint16(len(snts)))
+	types, err := makeContentTypes(cfg.ContentContexts)
 
 	if err != nil {
-		return err
+		return nil, nil, nil, Invalid(err)
 	}
 
-	for _, snt := range snts {
-		if err = writeSentinel(w, snt); err != nil {
-			return err
-		}
+	if err = c.CheckLimits(snts, tmpls, types); err != nil {
+		return nil, nil, nil, Invalid(err)
 	}
 
-	return nil
+	return snts, tmpls, types, nil
 }
 
-func writeStr(w io.Writer, val string) error {
-	var err error
+// QuoteLiteral quotes a string for the rule syntax.
+func QuoteLiteral(val string) string {
+	var sb strings.Builder
 
-	err = binary.Write(w, binary.LittleEndian, uint16(len(val)))
+	sb.WriteByte('\'')
 
-	if err != nil {
-		return err
-	}
+	for i := 0; i < len(val); {
+		r, size := utf8.DecodeRuneInString(val[i:])
 
-	_, err = w.Write([]byte(val))
+		switch {
+		case r == '\'' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r == '\n':
+			sb.WriteString("\\n")
+		case r == '\t':
+			sb.WriteString("\\t")
+		case r == '\r':
+			sb.WriteString("\\r")
+		case r == utf8.RuneError && size == 1 || r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, "\\x%02x", val[i])
+		default:
+			sb.WriteString(val[i : i+size])
+		}
 
-	return err
-}
+		i += size
+	}
 
-func writeUint64(w io.Writer, val uint64) error {
-	return binary.Write(w, binary.LittleEndian, val)
-}
+	sb.WriteByte('\'')
 
-func writeUint16(w io.Writer, val uint16) error {
-	return binary.Write(w, binary.LittleEndian, val)
+	return sb.String()
 }
 
-func writeUint8(w io.Writer, val uint8) error {
-	return binary.Write(w, binary.LittleEndian, val)
-}
+// CondOp names the operator of a condition as written in the rules.
+func CondOp(op uint8) string {
+	switch op {
+	case mkruleval.EQ, mkruleval.EQ_VAR:
+		return "=="
+	case mkruleval.NEQ, mkruleval.NEQ_VAR:
+		return "!="
+	case mkruleval.ENTROPY:
+		return "entropy >"
+	case mkruleval.IS_SQLI:
+		return "is_sqli"
+	case mkruleval.IS_XSS:
+		return "is_xss"
+	}
 
-func getCtxCode(val string) (uint8, error) {
-	var n uint8
+	return OpName(op)
+}
 
-	switch val {
-	case "headers":
-		n = HEADERS
-	case "urlenc":
-		n = URLENC
-	case "base64":
-		n = BASE64
-	case "cookie":
-		n = COOKIE
-	case "json":
-		n = JSON
-	case "json_obj":
-		n = JSON_OBJ
-	case "json_array":
-		n = JSON_ARRAY
-	case "path":
-		n = PATH
-	case "http":
-		n = HTTP
-	case "auth_header":
-		n = AUTH_HEADER
-	case "base64_url":
-		n = BASE64_URL
-	case "jwt":
-		n = JWT
-	default:
-		return 0, fmt.Errorf("unknown context: %s", val)
+// StmtString renders a compiled statement in the rule syntax.
+func StmtString(stmt mkruleval.Stmt) string {
+	if stmt.Op == mkruleval.ENTROPY {
+		return "entropy > " + strconv.FormatFloat(float64(stmt.Num)/100, 'f', -1, 64)
 	}
-	return n, nil
-}
 
-func writeCtx(w io.Writer, val string) error {
-	var r uint64 = 0
+	if PredicateOp(stmt.Op) {
+		name := mkruleval.VarNames[stmt.Var]
 
-	contexts := strings.Split(val, "|")
+		if ArgVars[stmt.Var] {
+			name += "(" + QuoteLiteral(stmt.Arg) + ")"
+		}
 
-	for _, c := range contexts {
-		ctx := strings.TrimSpace(c)
-		n, err := getCtxCode(ctx)
-		if err != nil {
-			return err
+		for _, tf := range stmt.Transforms {
+			name += " | " + mkruleval.TransformNames[tf]
 		}
-		r |= (1 << n)
+
+		return name + " " + CondOp(stmt.Op)
 	}
 
-	return writeUint64(w, r)
-}
+	if stmt.Var == 0 {
+		switch stmt.Op {
+		case mkruleval.SCORE:
+			return fmt.Sprintf("score %d", stmt.Num)
+		case mkruleval.REDIRECT:
+			return "redirect " + QuoteLiteral(stmt.Val)
+		case mkruleval.RESPOND:
+			return fmt.Sprintf("respond %d %s", stmt.Num, QuoteLiteral(stmt.Val))
+		}
 
-func writeSentinel(w io.Writer, snt Sentinel) error {
-	var err error
+		return OpName(stmt.Op)
+	}
 
-	if err = writeStr(w, snt.Method); err != nil {
-		return err
+	name := mkruleval.VarNames[stmt.Var]
+
+	if ArgVars[stmt.Var] {
+		name += "(" + QuoteLiteral(stmt.Arg) + ")"
 	}
 
-	if err = writeUint16(w, uint16(len(snt.Path))); err != nil {
-		return err
+	for _, tf := range stmt.Transforms {
+		name += " | " + mkruleval.TransformNames[tf]
 	}
 
-	for _, val := range snt.Path {
-		if err = writeStr(w, val); err != nil {
-			return err
+	op := CondOp(stmt.Op)
+	val := QuoteLiteral(stmt.Val)
+
+	switch {
+	case len(stmt.Regexp) != 0:
+		body := strings.NewReplacer("\\", "\\\\", "/", "\\/").Replace(mkruleval.RegexpBody(stmt.Regexp))
+		val = "/" + body + "/" + mkruleval.RegexpFlagNames(stmt.Flags)
+
+		if stmt.Mods&mkruleval.MOD_CAPTURE != 0 {
+			val += "c"
 		}
-	}
 
-	if err = writeUint16(w, uint16(len(snt.Rules))); err != nil {
-		return err
-	}
+		if stmt.Mods&mkruleval.MOD_LUHN != 0 {
+			val += " luhn"
+		}
+	case len(stmt.Bytes) != 0:
+		val = "0x" + hex.EncodeToString(stmt.Bytes)
+	case stmt.Detector != 0:
+		val = "@detector('" + detectorNames[stmt.Detector] + "')"
+	case mkruleval.BoolVars[stmt.Var]:
+		val = stmt.Val
+	case stmt.Ref.Var == mkruleval.CAPTURE:
+		val = "$" + stmt.Ref.Arg
+	case stmt.Ref.Var != 0:
+		val = mkruleval.VarNames[stmt.Ref.Var]
 
-	for _, groups := range snt.Rules {
-		if err = writeUint16(w, uint16(len(groups))); err != nil {
-			return err
+		if ArgVars[stmt.Ref.Var] {
+			val += "(" + QuoteLiteral(stmt.Ref.Arg) + ")"
 		}
 
-		for _, stmts := range groups {
-			if err = writeUint16(w, uint16(len(stmts))); err != nil {
-				return err
-			}
+		for _, tf := range stmt.Ref.Transforms {
+			val += " | " + mkruleval.TransformNames[tf]
+		}
+	}
 
-			for _, stmt := range stmts {
-				if err = writeUint8(w, stmt.Var); err != nil {
-					return err
-				}
+	return name + " " + op + " " + val
+}
 
-				if err = writeUint8(w, stmt.Op); err != nil {
-					return err
-				}
+func (c *Compiler) ReadInput(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
 
-				if stmt.Var == CTX {
-					if err = writeUint8(w, NUMERIC); err != nil {
-						return err
-					}
+	if err == nil {
+		sum := sha256.Sum256(data)
+		if c.Inputs != nil {
+			c.Inputs[path] = hex.EncodeToString(sum[:])
+		}
+	}
 
-					if err = writeCtx(w, stmt.Val); err != nil {
-						return err
-					}
-				} else if len(stmt.Regexp) != 0 {
-					if err = writeUint8(w, REGEXP); err != nil {
-						return err
-					}
+	return data, err
+}
 
-					if err = writeStr(w, stmt.Regexp); err != nil {
-						return err
-					}
-				} else {
-					if err = writeUint8(w, STRING); err != nil {
-						return err
-					}
+func WriteFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
 
-					if err = writeStr(w, stmt.Val); err != nil {
-						return err
-					}
-				}
-			}
-		}
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
 	}
 
-	return nil
+	return os.Rename(tmp, path)
 }
 
-var input = flag.String("i", "endpoints.json", "endpoints configuration")
-var output = flag.String("o", "sentinels.bin", "waf sentinels binary data")
-var debug = flag.Bool("d", false, "debug mode")
+// Exit codes, so that automation can tell the failures apart.
+const (
+	EXIT_OK       = 0
+	EXIT_FAILURE  = 1
+	EXIT_USAGE    = 2
+	EXIT_PARSE    = 3
+	EXIT_INVALID  = 4
+	EXIT_IO       = 5
+	EXIT_WARNINGS = 6
+)
 
-func main() {
-	var err error
-	var epts []Endpoint
-	var snts []Sentinel
+// CompileError carries the exit code of a failure and, when known, the
+// endpoint and the index of the rule it comes from.
+type CompileError struct {
+	Code     int
+	Endpoint string
+	Rule     int
+	Pos      Position
+	Err      error
+}
 
-	flag.Parse()
+func (e *CompileError) Error() string {
+	return e.Err.Error()
+}
 
-	epts, err = readEndpoints(*input)
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
 
-	if err != nil {
-		log.Fatalln(err)
-	}
+// PositionError is a rule syntax error at a byte offset of the rule text.
+type PositionError struct {
+	Pos int
+	Err error
+}
 
-	if *debug {
-		fmt.Printf("endpoints: %+v\n", epts)
+func (e *PositionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PositionError) Unwrap() error {
+	return e.Err
+}
+
+func DiagEndpoint(method, path string) string {
+	return strings.TrimSpace(strings.ToUpper(method) + " " + path)
+}
+
+func endpointError(code int, endpoint Endpoint, err error) error {
+	if endpoint.pos.Line != 0 {
+		err = fmt.Errorf("%s: %w", endpoint.pos, err)
 	}
 
-	snts, err = makeSentinels(epts)
+	return &CompileError{Code: code, Endpoint: DiagEndpoint(endpoint.Method, endpoint.Path), Rule: -1, Pos: endpoint.pos, Err: err}
+}
 
-	if err != nil {
-		log.Fatalln(err)
+// ruleError prefixes err with where the rule comes from: its file and line,
+// or the pack it was imported from.
+func ruleError(code int, endpoint Endpoint, rule Rule, err error) error {
+	pos := rule.pos
+
+	switch {
+	case len(rule.source) != 0:
+		err = fmt.Errorf("%s: %w", rule.source, err)
+	case pos.Line != 0:
+		err = fmt.Errorf("%s: %w", pos, err)
 	}
 
-	if *debug {
-		fmt.Printf("sentinels: %+v\n", snts)
+	if pos.Line == 0 {
+		pos = endpoint.pos
 	}
 
-	err = writeSentinels(*output, snts)
+	return &CompileError{Code: code, Endpoint: DiagEndpoint(endpoint.Method, endpoint.Path), Rule: rule.index, Pos: pos, Err: err}
+}
+
+func Invalid(err error) error {
+	var ce *CompileError
 
-	if err != nil {
-		log.Fatalln(err)
+	if errors.As(err, &ce) {
+		return err
 	}
+
+	return &CompileError{Code: EXIT_INVALID, Rule: -1, Err: err}
+}
+
+func UsageError(err error) error {
+	return &CompileError{Code: EXIT_USAGE, Rule: -1, Err: err}
 }
@@ -0,0 +1,2029 @@
+package mkrul
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tantalsec/Mkrul/mkruleval"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden artifacts of the current VERSION")
+
+// goldens returns the artifacts in testdata, one per layout version the
+// decoder reads, all compiled from testdata/endpoints.json.
+func goldens(t testing.TB) []string {
+	files, err := filepath.Glob(filepath.Join("testdata", "v*.bin"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) == 0 {
+		t.Fatal("no golden artifacts in testdata")
+	}
+
+	return files
+}
+
+// artifacts returns every golden artifact in testdata, the fuzz seeds.
+func artifacts(t testing.TB) []string {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.bin"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+// layouts are the encodings of the feature goldens, by the suffix of their
+// file.
+var layouts = []struct {
+	name string
+	c    Compiler
+}{
+	{"le", Compiler{}},
+	{"be", Compiler{ByteOrder: "be"}},
+	{"cdb-le", Compiler{Layout: "cdb"}},
+	{"cdb-be", Compiler{Layout: "cdb", ByteOrder: "be"}},
+}
+
+func compileGolden(t testing.TB) []byte {
+	var c Compiler
+	var buf bytes.Buffer
+
+	snts, tmpls, types, err := c.Compile(filepath.Join("testdata", "endpoints.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.EncodeSentinels(&buf, snts, tmpls, types); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestGoldenCompile(t *testing.T) {
+	got := compileGolden(t)
+	path := filepath.Join("testdata", fmt.Sprintf("v%d.bin", VERSION))
+
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatalf("%v, run the test with -update after bumping VERSION", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("compiled artifact differs from %s, bump VERSION if the layout changed", path)
+	}
+}
+
+func TestGoldenDecode(t *testing.T) {
+	want := compileGolden(t)
+
+	for _, path := range goldens(t) {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			var c Compiler
+			var buf bytes.Buffer
+
+			snts, tmpls, types, err := c.Load(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = c.EncodeSentinels(&buf, snts, tmpls, types); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("re-encoded %s differs from the compiled endpoints", path)
+			}
+
+			if err = c.RoundTrip(snts, tmpls, types); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// TestGoldenFeatures compiles testdata/features.json, which uses the
+// endpoint fields, operators and rule objects testdata/endpoints.json has
+// not, in every layout and byte order, and checks each against its golden
+// artifact and that it decodes back to the same bytes.
+func TestGoldenFeatures(t *testing.T) {
+	for _, l := range layouts {
+		t.Run(l.name, func(t *testing.T) {
+			c := l.c
+			var buf, again bytes.Buffer
+
+			snts, tmpls, types, err := c.Compile(filepath.Join("testdata", "features.json"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = c.EncodeSentinels(&buf, snts, tmpls, types); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join("testdata", fmt.Sprintf("features-%s.bin", l.name))
+
+			if *update {
+				if err = os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(path)
+
+			if err != nil {
+				t.Fatalf("%v, run the test with -update after bumping VERSION", err)
+			}
+
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("compiled artifact differs from %s, bump VERSION if the layout changed", path)
+			}
+
+			decoded, tmpls, types, err := c.DecodeSentinels(bytes.NewReader(buf.Bytes()))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(decoded) != len(snts) {
+				t.Fatalf("compiled %d sentinels, decoded %d", len(snts), len(decoded))
+			}
+
+			if err = c.EncodeSentinels(&again, decoded, tmpls, types); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(again.Bytes(), buf.Bytes()) {
+				t.Error("decoded artifact re-encodes differently")
+			}
+		})
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, tc := range []struct {
+		rule, err string
+	}{
+		{"$val == is_sqli : block", "is_sqli takes a variable and no operator: =="},
+		{"$val != is_xss : block", "is_xss takes a variable and no operator: !="},
+		{"is_sqli : block", "is_sqli takes a variable: none given"},
+		{"$val is_sqli : block", ""},
+		{"$val == : block", "incomplete statement: $val =="},
+		{"$val : block", "incomplete statement: $val"},
+		{"respond 403 : block", "incomplete statement: respond 403"},
+		{"score : block", "incomplete statement: score"},
+		{"$val == 'a' 'b'", "operand without an operator: 'b'"},
+		{"$val == 'a' $key == : block", "incomplete statement: $key =="},
+		{"$val 'a' == : block", "operand without an operator: $val 'a'"},
+		{"block : block", "group without conditions: block"},
+		{"$val == 'a' : $key == 'b' : block", ""},
+		{"pass", ""},
+	} {
+		_, err := ParseRule(tc.rule)
+
+		switch {
+		case err == nil && len(tc.err) != 0:
+			t.Errorf("%q: no error, want %q", tc.rule, tc.err)
+		case err != nil && err.Error() != tc.err:
+			t.Errorf("%q: %v, want %q", tc.rule, err, tc.err)
+		}
+	}
+}
+
+func TestInheritRules(t *testing.T) {
+	var c Compiler
+
+	cfg, err := ParseConfig("endpoints.json", []byte(`[
+		{"path": "/api", "method": "", "rules": ["$ctx == 'headers' $key == 'x-bad' : block", "pass"]},
+		{"path": "/api/admin", "method": "", "inherit": true, "rules": ["$ctx == 'headers' $key == 'x-admin' : block", "pass"]}
+	]`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snts, tmpls, types, err := c.Build(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := mkruleval.NewGuard(snts, tmpls, types)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path, header string
+		want         uint8
+	}{
+		{"/api/admin", "x-admin", mkruleval.BLOCK},
+		{"/api/admin", "x-bad", mkruleval.BLOCK},
+		{"/api/admin", "x-other", mkruleval.PASS},
+		{"/api", "x-admin", mkruleval.PASS},
+		{"/api", "x-bad", mkruleval.BLOCK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		r.Header.Set(tc.header, "1")
+
+		if got := g.Check(r, nil); got.Action != tc.want {
+			t.Errorf("%s with %s: action %d, want %d", tc.path, tc.header, got.Action, tc.want)
+		}
+	}
+}
+
+// newGuard compiles the endpoints given in JSON into a guard.
+func newGuard(t *testing.T, endpoints string) *mkruleval.Guard {
+	var c Compiler
+
+	cfg, err := ParseConfig("endpoints.json", []byte(endpoints))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snts, tmpls, types, err := c.Build(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := mkruleval.NewGuard(snts, tmpls, types)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return g
+}
+
+func TestGuardBase64(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/std", "method": "", "rules": ["$ctx == 'urlenc' $key == 'd' : $ctx == 'base64' $val == /^<?evil>?$/ : block", "pass"]},
+		{"path": "/url", "method": "", "rules": ["$ctx == 'urlenc' $key == 'd' : $ctx == 'base64_url' $val == /^<?evil>?$/ : block", "pass"]}
+	]`)
+
+	for _, tc := range []struct {
+		uri  string
+		want uint8
+	}{
+		{"/std?d=ZXZpbA%3D%3D", mkruleval.BLOCK},
+		{"/std?d=ZXZpbA", mkruleval.BLOCK},
+		{"/std?d=PGV2aWw%2B", mkruleval.BLOCK},
+		{"/std?d=PGV2aWw-", mkruleval.PASS},
+		{"/std?d=Z29vZA%3D%3D", mkruleval.PASS},
+		{"/url?d=ZXZpbA%3D%3D", mkruleval.BLOCK},
+		{"/url?d=ZXZpbA", mkruleval.BLOCK},
+		{"/url?d=PGV2aWw-", mkruleval.BLOCK},
+		{"/url?d=PGV2aWw%2B", mkruleval.PASS},
+		{"/url?d=Z29vZA", mkruleval.PASS},
+	} {
+		if got := g.Check(httptest.NewRequest(http.MethodGet, tc.uri, nil), nil); got.Action != tc.want {
+			t.Errorf("%s: action %d, want %d", tc.uri, got.Action, tc.want)
+		}
+	}
+}
+
+func TestGuardLaterGroups(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/capture", "method": "", "rules": ["$ctx == 'urlenc' $key == 'user' $val == /^u-([0-9]+)$/c : $header('x-user') != $1 : block", "pass"]},
+		{"path": "/request", "method": "", "rules": ["$ctx == 'urlenc' $key == 'id' $val == /^([0-9]+)$/c : $header('x-tenant') == 'acme' $path == '/request' : block", "pass"]},
+		{"path": "/mixed", "method": "", "rules": ["$ctx == 'urlenc' $key == 'd' : $ctx == 'json' $key == 'role' $header('x-admin') == '1' : block", "pass"]},
+		{"path": "/cookie", "method": "", "rules": ["$ctx == 'urlenc' $key == 'c' : $cookie('sid') == 'x' : block", "pass"]}
+	]`)
+
+	for _, tc := range []struct {
+		uri, header, val string
+		want             uint8
+	}{
+		{"/capture?user=u-42", "X-User", "42", mkruleval.PASS},
+		{"/capture?user=u-42", "X-User", "7", mkruleval.BLOCK},
+		{"/capture?user=u-42", "X-Other", "42", mkruleval.BLOCK},
+		{"/capture?user=guest", "X-User", "7", mkruleval.PASS},
+		{"/request?id=1", "X-Tenant", "acme", mkruleval.BLOCK},
+		{"/request?id=1", "X-Tenant", "other", mkruleval.PASS},
+		{"/request?id=x", "X-Tenant", "acme", mkruleval.PASS},
+		{"/mixed?d=%7B%22role%22%3A1%7D", "X-Admin", "1", mkruleval.BLOCK},
+		{"/mixed?d=%7B%22role%22%3A1%7D", "X-Admin", "0", mkruleval.PASS},
+		{"/mixed?d=%7B%22name%22%3A1%7D", "X-Admin", "1", mkruleval.PASS},
+		{"/cookie?c=sid%3Dx", "Cookie", "sid=y", mkruleval.PASS},
+		{"/cookie?c=sid%3Dy", "Cookie", "sid=x", mkruleval.BLOCK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.uri, nil)
+		r.Header.Set(tc.header, tc.val)
+
+		if got := g.Check(r, nil); got.Action != tc.want {
+			t.Errorf("%s with %s: %s: action %d, want %d", tc.uri, tc.header, tc.val, got.Action, tc.want)
+		}
+	}
+}
+
+func TestGuardResponseDraws(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/sample", "method": "", "rules": [{"rule": "$ctx == 'response' $val == /secret/ : block", "sample": 0.5}, "pass"]},
+		{"path": "/experiment", "method": "", "rules": [{"experiment": "e", "variants": ["$ctx == 'headers' $key == 'x-never' : block", "$ctx == 'response' $val == /secret/ : block"]}, "pass"]}
+	]`)
+
+	for _, tc := range []struct {
+		uri     string
+		draw    bool
+		variant uint8
+		want    uint8
+	}{
+		{"/sample", true, 1, mkruleval.BLOCK},
+		{"/sample", false, 1, mkruleval.PASS},
+		{"/experiment", true, 2, mkruleval.BLOCK},
+		{"/experiment", true, 1, mkruleval.PASS},
+	} {
+		// the response phase would be given the other draw
+		draw, variant := tc.draw, tc.variant
+
+		g.Sampled = func(uint16) bool {
+			draw = !draw
+			return !draw
+		}
+
+		g.Variant = func(string, uint8) uint8 {
+			variant = 3 - variant
+			return 3 - variant
+		}
+
+		r := httptest.NewRequest(http.MethodGet, tc.uri, nil)
+		eval := g.Evaluate(r, nil, time.Now())
+		got := g.CheckResponse(&eval, r, nil, []byte("a secret"))
+
+		switch {
+		case got.Action != tc.want:
+			t.Errorf("%s drawn %t, variant %d: action %d, want %d", tc.uri, tc.draw, tc.variant, got.Action, tc.want)
+		case tc.uri == "/experiment" && got.Action == mkruleval.BLOCK && (got.Experiment != "e" || got.Variant != 2):
+			t.Errorf("%s: experiment %q variant %d, want e variant 2", tc.uri, got.Experiment, got.Variant)
+		}
+	}
+}
+
+func TestDecodeZeroCount(t *testing.T) {
+	var c Compiler
+	var buf bytes.Buffer
+
+	cfg, err := ParseConfig("endpoints.json", []byte(`[
+		{"path": "/login", "method": "POST", "rules": ["pass"], "sequences": [{"key": "ip", "count": 5, "window": "10m", "rule": "block"}]}
+	]`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snts, tmpls, types, err := c.Build(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snts[0].Sequences[0].Count = 0
+
+	if err = c.EncodeSentinels(&buf, snts, tmpls, types); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err = c.DecodeSentinels(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("sequence of count 0 decoded")
+	}
+
+	if _, _, err = c.VerifyArtifact(buf.Bytes()); err == nil {
+		t.Error("sequence of count 0 verified")
+	}
+}
+
+// syntheticRule returns a rule of n conditions over the usual contexts,
+// variables, pipes and regexps, ending with a block.
+func syntheticRule(n int) string {
+	var sb strings.Builder
+
+	for i := 0; i < n; i++ {
+		switch i % 4 {
+		case 0:
+			fmt.Fprintf(&sb, "$ctx == 'headers' $key == 'x-h%d' $val == /^(jndi|ldap|rmi|dns)%d:/ : ", i, i)
+		case 1:
+			fmt.Fprintf(&sb, "$ctx == 'urlenc' $key == 'q%d' $val | lower | url_decode == 'union select %d' : ", i, i)
+		case 2:
+			fmt.Fprintf(&sb, "$header('x-k%d') != 'v\\'%d' : ", i, i)
+		default:
+			fmt.Fprintf(&sb, "$ctx == 'json' $val == /(a|b)%d+$/i : ", i)
+		}
+	}
+
+	sb.WriteString("block")
+
+	return sb.String()
+}
+
+// syntheticConfig returns n endpoints under distinct paths with rules of
+// a few conditions each.
+func syntheticConfig(b *testing.B, n int) Config {
+	var sb strings.Builder
+
+	sb.WriteString("[")
+
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+
+		rule, err := json.Marshal(syntheticRule(i%8 + 1))
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		fmt.Fprintf(&sb, `{"path": "/api/v%d/items/{id}/part%d", "method": "POST", "rules": [%s, "pass"]}`, i%10, i, rule)
+	}
+
+	sb.WriteString("]")
+
+	cfg, err := ParseConfig("endpoints.json", []byte(sb.String()))
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return cfg
+}
+
+func BenchmarkScanGroups(b *testing.B) {
+	rule := syntheticRule(2000)
+
+	b.SetBytes(int64(len(rule)))
+
+	for i := 0; i < b.N; i++ {
+		if _, err := scanGroups(rule); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseRule(b *testing.B) {
+	rule := syntheticRule(2000)
+
+	b.SetBytes(int64(len(rule)))
+
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseRule(rule); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteSentinels(b *testing.B) {
+	var c Compiler
+
+	snts, tmpls, types, err := c.Build(syntheticConfig(b, 5000))
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	path := filepath.Join(b.TempDir(), "sentinels.bin")
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err = c.WriteSentinels(path, snts, tmpls, types); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func FuzzParseRule(f *testing.F) {
+	for _, rule := range []string{
+		"block",
+		"pass",
+		"$ctx == 'headers' $val == /\\$\\{.*(jndi|ldap|rmi|dns):/ : block",
+		"$ctx == 'urlenc' $key == 'id' $val | lower | url_decode == 'union' : block",
+		"$header('content-type') != 'application/json' : block",
+		"$val == /(a+)+$/i : pass",
+	} {
+		f.Add(rule)
+	}
+
+	f.Fuzz(func(t *testing.T, rule string) {
+		ParseRule(rule)
+	})
+}
+
+// FuzzDecode checks that the decoder never panics and that every artifact
+// it accepts survives an encode/decode round trip.
+func FuzzDecode(f *testing.F) {
+	for _, path := range artifacts(f) {
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var c Compiler
+
+		snts, tmpls, types, err := c.DecodeSentinels(bytes.NewReader(data))
+
+		if err != nil {
+			return
+		}
+
+		if err = c.RoundTrip(snts, tmpls, types); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// FuzzVerify runs the checks of the verify command, which must reject a
+// malformed artifact with an error instead of panicking, and checks that
+// the artifacts passing them decode to the same sentinels.
+func FuzzVerify(f *testing.F) {
+	for _, path := range artifacts(f) {
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var c Compiler
+
+		data, _, err := SplitSignatures(data)
+
+		if err != nil {
+			return
+		}
+
+		if data, err = c.DecryptArtifact(data); err != nil {
+			return
+		}
+
+		snts, problems, err := c.VerifyArtifact(data)
+
+		if err != nil || len(problems) != 0 {
+			return
+		}
+
+		decoded, tmpls, types, err := c.DecodeSentinels(bytes.NewReader(data))
+
+		if err != nil {
+			t.Fatalf("verified artifact does not decode: %v", err)
+		}
+
+		if len(decoded) != len(snts) {
+			t.Fatalf("verified %d sentinels, decoded %d", len(snts), len(decoded))
+		}
+
+		if err = c.RoundTrip(decoded, tmpls, types); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCheckSentinels(t *testing.T) {
+	cond := mkruleval.Stmt{Var: mkruleval.VAL, Op: mkruleval.EQ, Val: "x"}
+	score := mkruleval.SentinelRule{Groups: [][]mkruleval.Stmt{{cond, {Op: mkruleval.SCORE, Num: 2}}}}
+	dangling := mkruleval.SentinelRule{Groups: [][]mkruleval.Stmt{{cond}}}
+
+	for _, tc := range []struct {
+		name string
+		snts []mkruleval.Sentinel
+		err  string
+	}{
+		{"valid", []mkruleval.Sentinel{{Method: "GET", BlockThreshold: 4, Rules: []mkruleval.SentinelRule{score}}}, ""},
+		{"twice", []mkruleval.Sentinel{{Method: "GET"}, {Method: "GET"}}, "endpoint GET / is defined twice"},
+		{"no threshold", []mkruleval.Sentinel{{Method: "GET", Rules: []mkruleval.SentinelRule{score}}}, "endpoint GET /: score action requires block_threshold"},
+		{"dangling", []mkruleval.Sentinel{{Method: "GET", Rules: []mkruleval.SentinelRule{dangling}}}, "endpoint GET /: rule 0: no terminal action in the last group"},
+	} {
+		var c Compiler
+
+		err := c.CheckSentinels(tc.snts)
+
+		switch {
+		case err == nil && len(tc.err) != 0:
+			t.Errorf("%s: no error, want %q", tc.name, tc.err)
+		case err != nil && err.Error() != tc.err:
+			t.Errorf("%s: %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestDateOnlyEnd(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/expires", "method": "", "rules": [{"rule": "block", "expires": "2030-06-15"}, "pass"]},
+		{"path": "/window", "method": "", "rules": [{"rule": "block", "active": {"from": "2030-06-15", "to": "2030-06-15"}}, "pass"]},
+		{"path": "/minute", "method": "", "rules": [{"rule": "block", "expires": "2030-06-15 12:00"}, "pass"]}
+	]`)
+
+	for _, tc := range []struct {
+		path, now string
+		want      uint8
+	}{
+		{"/expires", "2030-06-15T00:00:00Z", mkruleval.BLOCK},
+		{"/expires", "2030-06-15T23:59:59Z", mkruleval.BLOCK},
+		{"/expires", "2030-06-16T00:00:00Z", mkruleval.PASS},
+		{"/window", "2030-06-14T23:59:59Z", mkruleval.PASS},
+		{"/window", "2030-06-15T00:00:00Z", mkruleval.BLOCK},
+		{"/window", "2030-06-15T23:59:59Z", mkruleval.BLOCK},
+		{"/window", "2030-06-16T00:00:00Z", mkruleval.PASS},
+		{"/minute", "2030-06-15T11:59:59Z", mkruleval.BLOCK},
+		{"/minute", "2030-06-15T12:00:00Z", mkruleval.PASS},
+	} {
+		now, err := time.Parse(time.RFC3339, tc.now)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := g.Evaluate(httptest.NewRequest(http.MethodGet, tc.path, nil), nil, now); got.Action != tc.want {
+			t.Errorf("%s at %s: action %d, want %d", tc.path, tc.now, got.Action, tc.want)
+		}
+	}
+}
+
+func TestBuildDiagnostics(t *testing.T) {
+	for _, tc := range []struct {
+		name, endpoints string
+		conflicts       string
+		code, rule      int
+		line            int
+	}{
+		{"unknown context", `[
+			{"path": "/", "method": "", "rules": [
+				"$ctx == 'jsn' $val == 'x' : block", "pass"]}
+		]`, "", EXIT_INVALID, 0, 3},
+		{"unknown context in except", `[
+			{"path": "/", "method": "", "rules": ["pass",
+				{"rule": "$ctx == 'json' $val == 'x' : block", "except": "$ctx == 'headrs' $key == 'x'"}]}
+		]`, "", EXIT_INVALID, 1, 3},
+		{"unknown context in a sequence", `[
+			{"path": "/", "method": "", "rules": ["pass"],
+				"sequences": [{"key": "ip", "count": 5, "window": "1m", "rule": "$ctx == 'htp' $key == 'x' : block"}]}
+		]`, "", EXIT_INVALID, -1, 2},
+		{"conflicting rules", `[
+			{"path": "/", "method": "", "rules": [
+				"$ctx == 'headers' $key == 'x' : block",
+				"$ctx == 'headers' $key == 'x' : pass"]}
+		]`, "error", EXIT_INVALID, 1, 4},
+	} {
+		var ce *CompileError
+
+		c := Compiler{Conflicts: tc.conflicts}
+		cfg, err := ParseConfig("endpoints.json", []byte(tc.endpoints))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, _, err = c.Build(cfg)
+
+		switch {
+		case !errors.As(err, &ce):
+			t.Errorf("%s: %v, want a compile error", tc.name, err)
+		case ce.Code != tc.code || ce.Rule != tc.rule || ce.Pos.Line != tc.line || ce.Endpoint != "/":
+			t.Errorf("%s: code %d endpoint %q rule %d line %d, want %d \"/\" %d %d", tc.name, ce.Code, ce.Endpoint, ce.Rule, ce.Pos.Line, tc.code, tc.rule, tc.line)
+		}
+	}
+}
+
+func TestWriteSentinelsMode(t *testing.T) {
+	dir := t.TempDir()
+	key := filepath.Join(dir, "key")
+
+	if err := os.WriteFile(key, []byte(strings.Repeat("ab", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		encrypt string
+		deny    os.FileMode
+	}{
+		{"plain", "", 0111},
+		{"encrypted", "aes:" + key, 0077},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Compiler{Encrypt: tt.encrypt}
+			path := filepath.Join(dir, tt.name+".bin")
+
+			if err := c.WriteSentinels(path, nil, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if mode := info.Mode().Perm(); mode&tt.deny != 0 {
+				t.Errorf("mode %v, want none of %v", mode, tt.deny)
+			}
+		})
+	}
+}
+
+func TestSplitPackRef(t *testing.T) {
+	tests := []struct {
+		ref     string
+		repo    string
+		version string
+		file    string
+		err     string
+	}{
+		{"git+https://example.com/packs.git@v1", "https://example.com/packs.git", "v1", "", ""},
+		{"git+https://example.com/packs.git@v1#owasp/pack.mkr", "https://example.com/packs.git", "v1", "owasp/pack.mkr", ""},
+		{"git+https://example.com/packs.git", "", "", "", "missing @version"},
+		{"git+https://example.com/packs.git@v1#../secret", "", "", "", "outside the repository"},
+		{"git+https://example.com/packs.git@v1#/etc/passwd", "", "", "", "outside the repository"},
+		{"git+https://example.com/packs.git@v1#a/../../b", "", "", "", "outside the repository"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			repo, version, file, err := splitPackRef(tt.ref)
+
+			if len(tt.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if repo != tt.repo || version != tt.version || file != tt.file {
+				t.Errorf("got %q %q %q, want %q %q %q", repo, version, file, tt.repo, tt.version, tt.file)
+			}
+		})
+	}
+}
+
+func TestFetchPackLocal(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repo")
+	outside := filepath.Join(dir, "secret")
+
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(repo, "pack.mkr"), []byte("pack"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(outside, filepath.Join(repo, "link.mkr")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "pack"},
+		{"tag", "v1"},
+	} {
+		if _, err := git(repo, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		ref  string
+		data string
+		err  string
+	}{
+		{"default", "git+" + repo + "@v1", "pack", ""},
+		{"file", "git+" + repo + "@v1#pack.mkr", "pack", ""},
+		{"link", "git+" + repo + "@v1#link.mkr", "", "outside the repository"},
+		{"option", "git+--upload-pack=touch@v1", "", "repository '--upload-pack=touch' does not exist"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, data, _, err := fetchPack(tt.ref)
+
+			if len(tt.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != tt.data {
+				t.Errorf("got %q, want %q", data, tt.data)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		endpoints string
+		want      Stats
+	}{
+		{"one endpoint", `[{"method": "GET", "path": "/a", "rules": ["$ctx == 'headers' $val == /x+/ : block", "pass"]}]`,
+			Stats{Sentinels: 1, Rules: 2, SharedRules: 2, Groups: 3, Statements: 4, Regexps: 1, Largest: "GET /a", Contexts: map[string]int{"headers": 1}}},
+		{"shared rules and regexps", `[
+			{"method": "GET", "path": "/a", "rules": ["$val == /x+/ : block"]},
+			{"method": "GET", "path": "/bb", "rules": ["$val == /x+/ : block", "$ctx == 'urlenc|cookie' $val == /x+/ $key == 'q' : block"]}
+		]`, Stats{Sentinels: 2, Rules: 3, SharedRules: 2, Groups: 6, Statements: 8, Regexps: 1, Largest: "GET /bb", Contexts: map[string]int{"cookie": 1, "urlenc": 1}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c Compiler
+
+			cfg, err := ParseConfig("endpoints.json", []byte(tc.endpoints))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			snts, tmpls, types, err := c.Build(cfg)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stats, err := c.Stats(snts, tmpls, types)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+
+			if err = c.EncodeSentinels(&buf, snts, tmpls, types); err != nil {
+				t.Fatal(err)
+			}
+
+			if stats.Size != uint64(buf.Len()) {
+				t.Errorf("size %d, want %d", stats.Size, buf.Len())
+			}
+
+			got := Stats{Sentinels: stats.Sentinels, Rules: stats.Rules, SharedRules: stats.SharedRules, Groups: stats.Groups, Statements: stats.Statements, Regexps: stats.Regexps, Largest: stats.Largest, Contexts: stats.Contexts}
+
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("stats %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckRegexp(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		c       Compiler
+		err     string
+	}{
+		{`(a+)+`, Compiler{Redos: "error"}, "nested quantifiers"},
+		{`(a+)+`, Compiler{Redos: "warn"}, ""},
+		{`(a+)+`, Compiler{Redos: "off"}, ""},
+		{`(\w{2,}x)*`, Compiler{Redos: "error"}, "nested quantifiers"},
+		{`(a|b)*c+`, Compiler{Redos: "error"}, ""},
+		{`(a*)?b`, Compiler{Redos: "error"}, ""},
+		{`(ab{1})+`, Compiler{Redos: "error"}, ""},
+		{`abcd`, Compiler{MaxRegexLength: 3}, "longer than 3"},
+		{`abc`, Compiler{MaxRegexLength: 3}, ""},
+		{`(a)\1`, Compiler{ForbidBackrefs: true}, "uses backreferences"},
+		{`a\\1`, Compiler{ForbidBackrefs: true}, ""},
+	} {
+		err := tc.c.checkRegexp(tc.pattern)
+
+		if len(tc.err) == 0 && err != nil || len(tc.err) != 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v /%s/: error %v, want %q", tc.c, tc.pattern, err, tc.err)
+		}
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	var c Compiler
+
+	cfg, err := ParseConfig("endpoints.json", []byte(`[
+		{"method": "GET", "path": "/a", "rules": ["$path == '/x' : $key == 'q' : block", "$path == '/y' : block", "pass"]},
+		{"method": "GET", "path": "/b", "rules": ["block"]}
+	]`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snts, tmpls, types, err := c.Build(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		c    Compiler
+		err  string
+	}{
+		{"unlimited", Compiler{}, ""},
+		{"within", Compiler{MaxEndpoints: 2, MaxRules: 3, MaxDepth: 3, MaxSize: 1 << 20}, ""},
+		{"endpoints", Compiler{MaxEndpoints: 1}, "2 endpoints exceed -max-endpoints 1"},
+		{"rules", Compiler{MaxRules: 2}, "endpoint GET /a: 3 rules exceed -max-rules-per-endpoint 2"},
+		{"depth", Compiler{MaxDepth: 2}, "endpoint GET /a: rule 0: 3 groups exceed -max-rule-depth 2"},
+		{"size", Compiler{MaxSize: 64}, "exceeds -max-artifact-size 64"},
+	} {
+		err := tc.c.CheckLimits(snts, tmpls, types)
+
+		if len(tc.err) == 0 && err != nil || len(tc.err) != 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: error %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestGuardTypedPath(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/u/{id:int}", "method": "GET", "rules": ["block"]},
+		{"path": "/u/{name}", "method": "GET", "rules": ["block"]},
+		{"path": "/f/{sum:hex}", "method": "GET", "rules": ["block"]},
+		{"path": "/o/{oid:uuid}/items", "method": "GET", "rules": ["block"]},
+		{"path": "/n/{name:alpha}", "method": "GET", "rules": ["block"]},
+		{"path": "/c/{code:[a-c]{2}}", "method": "GET", "rules": ["block"]}
+	]`)
+
+	for _, tc := range []struct {
+		uri  string
+		want string
+	}{
+		{"/u/42", "GET /u/{id:int}"},
+		{"/u/bob", "GET /u/{name}"},
+		{"/f/deadBEEF", "GET /f/{sum:hex}"},
+		{"/f/xyz", ""},
+		{"/o/123e4567-e89b-12d3-a456-426614174000/items", "GET /o/{oid:uuid}/items"},
+		{"/o/123e4567/items", ""},
+		{"/n/abc", "GET /n/{name:alpha}"},
+		{"/n/abc1", ""},
+		{"/c/ab", "GET /c/{code:[a-c]{2}}"},
+		{"/c/abc", ""},
+	} {
+		got := ""
+
+		if i := g.Find(httptest.NewRequest(http.MethodGet, tc.uri, nil)); i >= 0 {
+			got = g.Sentinels[i].Name()
+		}
+
+		if got != tc.want {
+			t.Errorf("%s: endpoint %q, want %q", tc.uri, got, tc.want)
+		}
+	}
+
+	var c Compiler
+
+	cfg, err := ParseConfig("endpoints.json", []byte(`[{"path": "/u/{id:[0-9}", "method": "GET", "rules": ["block"]}]`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err = c.Build(cfg); err == nil || !strings.Contains(err.Error(), "invalid path parameter {id:[0-9}") {
+		t.Errorf("error %v, want an invalid path parameter", err)
+	}
+}
+
+func TestGuardCaseInsensitive(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		endpoints string
+		method    string
+		uri       string
+		want      string
+	}{
+		{"exact", `[{"path": "/Api/Users", "method": "GET", "case_insensitive": true, "rules": ["block"]}]`, "GET", "/Api/Users", "GET /Api/Users"},
+		{"path", `[{"path": "/Api/Users", "method": "GET", "case_insensitive": true, "rules": ["block"]}]`, "GET", "/api/USERS", "GET /Api/Users"},
+		{"method", `[{"path": "/a", "method": "GET", "case_insensitive": true, "rules": ["block"]}]`, "get", "/A", "GET /a"},
+		{"sensitive path", `[{"path": "/Api/Users", "method": "GET", "rules": ["block"]}]`, "GET", "/api/users", ""},
+		{"sensitive method", `[{"path": "/a", "method": "GET", "rules": ["block"]}]`, "get", "/a", ""},
+		{"top level", `{"case_insensitive": true, "endpoints": [{"path": "/Admin", "method": "POST", "rules": ["block"]}]}`, "POST", "/ADMIN", "POST /Admin"},
+		{"typed parameter", `[{"path": "/U/{id:int}", "method": "GET", "case_insensitive": true, "rules": ["block"]}]`, "GET", "/u/7", "GET /U/{id:int}"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newGuard(t, tc.endpoints)
+			got := ""
+
+			if i := g.Find(httptest.NewRequest(tc.method, tc.uri, nil)); i >= 0 {
+				got = g.Sentinels[i].Name()
+			}
+
+			if got != tc.want {
+				t.Errorf("%s %s: endpoint %q, want %q", tc.method, tc.uri, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPriority(t *testing.T) {
+	var c Compiler
+
+	cfg, err := ParseConfig("endpoints.json", []byte(`[
+		{"method": "GET", "path": "/low", "rules": ["block"]},
+		{"method": "GET", "path": "/high", "priority": 10, "block_threshold": 10, "rules": [
+			"$key == 'a' : score 1",
+			{"rule": "$key == 'b' : score 2", "priority": 5},
+			{"rule": "$key == 'c' : score 3", "priority": -1},
+			{"rule": "$key == 'd' : score 4", "priority": 5},
+			"pass"
+		]},
+		{"method": "GET", "path": "/mid", "priority": 1, "rules": ["block"]},
+		{"method": "GET", "path": "/last", "priority": -5, "rules": ["block"]}
+	]`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snts, _, _, err := c.Build(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+
+	for _, snt := range snts {
+		names = append(names, snt.Name())
+	}
+
+	var scores []uint64
+
+	for _, rule := range snts[0].Rules {
+		if act, ok := mkruleval.Action(rule.Groups); ok {
+			scores = append(scores, act.Num)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"endpoints", strings.Join(names, ", "), "GET /high, GET /mid, GET /low, GET /last"},
+		{"rules", fmt.Sprint(scores), "[2 4 1 0 3]"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestCheckConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		rules     string
+		conflicts string
+		err       string
+	}{
+		{"pass before block", `"$key == 'a' : pass", "$key == 'a' : block"`, "error", "rule 1 (block) contradicts rule 0 (pass)"},
+		{"block before pass", `"$key == 'a' $val == 'x' : block", "$key == 'a' $val == 'x' : pass"`, "error", "rule 1 (pass) contradicts rule 0 (block)"},
+		{"same action", `"$key == 'a' : block", "$key == 'a' : block"`, "error", ""},
+		{"other conditions", `"$key == 'a' : pass", "$key == 'b' : block"`, "error", ""},
+		{"score", `"$key == 'a' : score 5", "$key == 'a' : pass"`, "error", ""},
+		{"warn", `"$key == 'a' : pass", "$key == 'a' : block"`, "warn", ""},
+		{"off", `"$key == 'a' : pass", "$key == 'a' : block"`, "off", ""},
+		{"unknown severity", `"block"`, "fatal", "unknown conflicts severity: fatal"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Compiler{Conflicts: tc.conflicts}
+
+			cfg, err := ParseConfig("endpoints.json", []byte(`[{"method": "GET", "path": "/a", "block_threshold": 10, "rules": [`+tc.rules+`]}]`))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, _, err = c.Build(cfg)
+
+			if len(tc.err) == 0 && err != nil || len(tc.err) != 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	cfg, err := ParseConfig("endpoints.json", []byte(`[
+		{"method": "GET", "path": "/a", "owner": "payments", "description": "card form", "rules": [
+			{"rule": "$key == 'pan' : block", "owner": "appsec", "description": "no card numbers in queries"},
+			"pass"
+		]}
+	]`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		strip bool
+		want  [3]mkruleval.Metadata
+	}{
+		{"kept", false, [3]mkruleval.Metadata{{Owner: "payments", Description: "card form"}, {Owner: "appsec", Description: "no card numbers in queries"}, {}}},
+		{"stripped", true, [3]mkruleval.Metadata{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			c := Compiler{StripMetadata: tc.strip}
+			snts, tmpls, types, err := c.Build(cfg)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = c.EncodeSentinels(&buf, snts, tmpls, types); err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, _, _, err := c.DecodeSentinels(&buf)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := [3]mkruleval.Metadata{decoded[0].Meta, decoded[0].Rules[0].Meta, decoded[0].Rules[1].Meta}
+
+			if got != tc.want {
+				t.Errorf("metadata %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyOverlay(t *testing.T) {
+	base := `{"endpoints": [
+		{"method": "POST", "path": "/upload", "rules": ["$key == 'a' : block", "pass"]},
+		{"method": "*", "path": "/any", "block_threshold": 5, "rules": ["block"]}
+	]}`
+
+	for _, tc := range []struct {
+		name    string
+		overlay string
+		want    string
+		err     string
+	}{
+		{"append", `[{"method": "POST", "path": "/upload", "rules": ["$key == 'b' : block"]}]`, "POST /upload [$key == 'a' : block pass $key == 'b' : block]; * /any [block] 5", ""},
+		{"replace", `[{"method": "POST", "path": "/upload", "replace": true, "rules": ["block"]}]`, "POST /upload [block]; * /any [block] 5", ""},
+		{"disable", `[{"method": "post", "path": "/upload", "disable": ["pass"], "rules": ["$key == 'c' : pass"]}]`, "POST /upload [$key == 'a' : block $key == 'c' : pass]; * /any [block] 5", ""},
+		{"any method and settings", `[{"method": "", "path": "/any", "block_threshold": 9}]`, "POST /upload [$key == 'a' : block pass]; * /any [block] 9", ""},
+		{"new endpoint", `{"endpoints": [{"method": "GET", "path": "/debug", "rules": ["block"]}]}`, "POST /upload [$key == 'a' : block pass]; * /any [block] 5; GET /debug [block]", ""},
+		{"defined rule", `[{"method": "POST", "path": "/upload", "rules": ["pass"]}]`, "", "rule pass is already defined"},
+		{"missing rule", `[{"method": "POST", "path": "/upload", "disable": ["block"]}]`, "", "disabled rule block is not in the base"},
+		{"missing endpoint", `[{"method": "GET", "path": "/nope", "replace": true}]`, "", "endpoint GET /nope is not in the base"},
+		{"twice", `[{"method": "GET", "path": "/debug"}, {"method": "GET", "path": "/debug"}]`, "", "endpoint GET /debug is defined twice"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var overlay Overlay
+
+			cfg, err := ParseConfig("base.json", []byte(base))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.HasPrefix(tc.overlay, "[") {
+				err = json.Unmarshal([]byte(tc.overlay), &overlay.Endpoints)
+			} else {
+				err = json.Unmarshal([]byte(tc.overlay), &overlay)
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err = applyOverlay(cfg, overlay)
+
+			if len(tc.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want %q", err, tc.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+
+			for _, endpoint := range cfg.Endpoints {
+				var rules []string
+
+				for _, rule := range endpoint.Rules {
+					rules = append(rules, rule.Rule)
+				}
+
+				desc := fmt.Sprintf("%s %s %v", endpoint.Method, endpoint.Path, rules)
+
+				if endpoint.BlockThreshold != 0 {
+					desc += fmt.Sprintf(" %d", endpoint.BlockThreshold)
+				}
+
+				got = append(got, desc)
+			}
+
+			if strings.Join(got, "; ") != tc.want {
+				t.Errorf("%s, want %s", strings.Join(got, "; "), tc.want)
+			}
+		})
+	}
+}
+
+func TestRulesFile(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rules string
+		want  []string
+		err   string
+	}{
+		{"appended", "# login rules\n$key == 'a' : block\n\n  $key == 'b' : block  \n", []string{"$key == 'c' : block", "$key == 'a' : block", "$key == 'b' : block", "pass"}, ""},
+		{"empty", "# nothing yet\n", []string{"$key == 'c' : block", "pass"}, ""},
+		{"bad line", "$key == 'a' : block\n# comment\n$key === : block\n", nil, "rules/login.rules:3"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c Compiler
+
+			dir := t.TempDir()
+
+			if err := os.MkdirAll(filepath.Join(dir, "rules"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(filepath.Join(dir, "rules", "login.rules"), []byte(tc.rules), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(filepath.Join(dir, "endpoints.json"), []byte(`[{"method": "POST", "path": "/login", "rules": ["$key == 'c' : block"], "rules_file": "rules/login.rules"}, {"method": "", "path": "/", "rules": ["pass"]}]`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			snts, _, _, err := c.Compile(filepath.Join(dir, "endpoints.json"))
+
+			if len(tc.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want %q", err, tc.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+
+			for _, snt := range snts {
+				for _, rule := range snt.Rules {
+					var groups []string
+
+					for _, stmts := range rule.Groups {
+						var conds []string
+
+						for _, stmt := range stmts {
+							conds = append(conds, StmtString(stmt))
+						}
+
+						groups = append(groups, strings.Join(conds, " "))
+					}
+
+					got = append(got, strings.Join(groups, " : "))
+				}
+			}
+
+			if strings.Join(got, ", ") != strings.Join(tc.want, ", ") {
+				t.Errorf("rules %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGuardExcept(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/inline", "method": "", "rules": [{"rule": "$ctx == 'urlenc' $val == /union.+select/i : block", "except": "$key == 'comment'"}, "pass"]},
+		{"path": "/pack", "method": "", "rules": [
+			{"id": "sqli/union", "rule": "$ctx == 'urlenc' $val == /union.+select/i : block"},
+			{"id": "other", "rule": "$ctx == 'urlenc' $val == /drop table/i : block"},
+			{"use": "sqli", "except": "$key | lower == 'comment'"},
+			"pass"
+		]}
+	]`)
+
+	for _, tc := range []struct {
+		uri  string
+		want uint8
+	}{
+		{"/inline?q=1+union+select+2", mkruleval.BLOCK},
+		{"/inline?comment=1+union+select+2", mkruleval.PASS},
+		{"/inline?comment=ok&q=1+union+select+2", mkruleval.BLOCK},
+		{"/pack?q=1+union+select+2", mkruleval.BLOCK},
+		{"/pack?Comment=1+union+select+2", mkruleval.PASS},
+		{"/pack?comment=drop+table+users", mkruleval.BLOCK},
+	} {
+		if got := g.Check(httptest.NewRequest(http.MethodGet, tc.uri, nil), nil); got.Action != tc.want {
+			t.Errorf("%s: action %d, want %d", tc.uri, got.Action, tc.want)
+		}
+	}
+}
+
+func TestGuardContentContexts(t *testing.T) {
+	g := newGuard(t, `{
+		"content_contexts": {"application/vnd.api+json": "json", "text/*": "urlenc"},
+		"endpoints": [{"path": "/", "method": "", "rules": ["$ctx == 'json' $key == 'role' $val == 'admin' : block", "$ctx == 'urlenc' $key == 'role' $val == 'admin' : block", "pass"]}]
+	}`)
+
+	for _, tc := range []struct {
+		contentType string
+		body        string
+		want        uint8
+	}{
+		{"application/vnd.api+json", `{"role": "admin"}`, mkruleval.BLOCK},
+		{"application/vnd.api+json; charset=utf-8", `{"role": "admin"}`, mkruleval.BLOCK},
+		{"application/vnd.api+json", "role=admin", mkruleval.PASS},
+		{"text/plain", "role=admin", mkruleval.BLOCK},
+		{"text/plain", `{"role": "admin"}`, mkruleval.PASS},
+		{"application/json", `{"role": "admin"}`, mkruleval.BLOCK},
+		{"application/x-www-form-urlencoded", "role=admin", mkruleval.BLOCK},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", tc.contentType)
+
+		if got := g.Check(r, []byte(tc.body)); got.Action != tc.want {
+			t.Errorf("%s %s: action %d, want %d", tc.contentType, tc.body, got.Action, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		contentType string
+		ctx         string
+		err         string
+	}{
+		{"application/xml", "urlenc", ""},
+		{"application/xml", "json", "application/xml"},
+		{"text/plain; charset=utf-8", "urlenc", "without parameters"},
+		{"plain", "urlenc", "type/subtype"},
+		{"text/csv", "csv", "unknown context"},
+	} {
+		types := mkruleval.ContentTypes{"application/xml": "urlenc"}
+		err := types.Register(tc.contentType, tc.ctx)
+
+		if len(tc.err) == 0 && err != nil || len(tc.err) != 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("register %s as %s: error %v, want %q", tc.contentType, tc.ctx, err, tc.err)
+		}
+	}
+}
+
+func TestGuardCookie(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/eq", "method": "", "rules": ["$cookie('session') == 'stolen' : block", "pass"]},
+		{"path": "/re", "method": "", "rules": ["$cookie('role') | lower == /^admin$/ : block", "pass"]},
+		{"path": "/ne", "method": "", "rules": ["$cookie('session') != 'valid' : block", "pass"]}
+	]`)
+
+	for _, tc := range []struct {
+		uri    string
+		cookie string
+		want   uint8
+	}{
+		{"/eq", "session=stolen", mkruleval.BLOCK},
+		{"/eq", "other=1; session=stolen", mkruleval.BLOCK},
+		{"/eq", "session=fine", mkruleval.PASS},
+		{"/eq", "other=stolen", mkruleval.PASS},
+		{"/eq", "", mkruleval.PASS},
+		{"/re", "role=ADMIN", mkruleval.BLOCK},
+		{"/re", "role=administrator", mkruleval.PASS},
+		{"/ne", "session=forged", mkruleval.BLOCK},
+		{"/ne", "session=valid", mkruleval.PASS},
+		{"/ne", "", mkruleval.PASS},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.uri, nil)
+
+		if len(tc.cookie) != 0 {
+			r.Header.Set("Cookie", tc.cookie)
+		}
+
+		if got := g.Check(r, nil); got.Action != tc.want {
+			t.Errorf("%s with %q: action %d, want %d", tc.uri, tc.cookie, got.Action, tc.want)
+		}
+	}
+}
+
+func TestGuardScheme(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/api", "method": "", "rules": ["$scheme != 'Bearer' : block", "pass"]},
+		{"path": "/basic", "method": "", "rules": ["$scheme == 'basic' : block", "pass"]}
+	]`)
+
+	for _, tc := range []struct {
+		uri  string
+		auth string
+		want uint8
+	}{
+		{"/api", "Bearer eyJhbGciOiJIUzI1NiJ9.e30.x", mkruleval.PASS},
+		{"/api", "bearer token", mkruleval.PASS},
+		{"/api", "Basic dXNlcjpwYXNz", mkruleval.BLOCK},
+		{"/api", "", mkruleval.PASS},
+		{"/basic", "BASIC dXNlcjpwYXNz", mkruleval.BLOCK},
+		{"/basic", "Basicx dXNlcjpwYXNz", mkruleval.PASS},
+		{"/basic", "Bearer basic", mkruleval.PASS},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.uri, nil)
+
+		if len(tc.auth) != 0 {
+			r.Header.Set("Authorization", tc.auth)
+		}
+
+		if got := g.Check(r, nil); got.Action != tc.want {
+			t.Errorf("%s with %q: action %d, want %d", tc.uri, tc.auth, got.Action, tc.want)
+		}
+	}
+}
+
+func TestJSONPositions(t *testing.T) {
+	data := "[\n  {\"path\": \"/a\", \"method\": \"GET\",\n   \"rules\": [\"pass\",\n     {\"rule\": \"block\"}]},\n {\"rules\": null, \"path\": \"/b\", \"method\": \"\"}\n]"
+
+	cfg, err := ParseConfig("endpoints.json", []byte(data))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		got  Position
+		want string
+	}{
+		{"endpoint 0", cfg.Endpoints[0].Pos(), "endpoints.json:2:3"},
+		{"rule 0", cfg.Endpoints[0].Rules[0].Pos(), "endpoints.json:3:14"},
+		{"rule 1", cfg.Endpoints[0].Rules[1].Pos(), "endpoints.json:4:6"},
+		{"endpoint 1", cfg.Endpoints[1].Pos(), "endpoints.json:5:2"},
+	} {
+		if tc.got.String() != tc.want {
+			t.Errorf("%s at %s, want %s", tc.name, tc.got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		data string
+		line int
+		col  int // 0 when not checked
+	}{
+		{"[\n  {\"path\": \"/a\",,}\n]", 2, 17},
+		{"[\n  {\"path\": \"/a\"}\n  {}\n]", 3, 3},
+		{"[\n  {\"path\": 1}\n]", 2, 0},
+	} {
+		var ce *CompileError
+
+		_, err := ParseConfig("endpoints.json", []byte(tc.data))
+
+		if !errors.As(err, &ce) || ce.Code != EXIT_PARSE || ce.Pos.Line != tc.line || tc.col != 0 && ce.Pos.Col != tc.col {
+			t.Errorf("ParseConfig(%q) = %v, want a parse error at line %d column %d", tc.data, err, tc.line, tc.col)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	var s Store
+
+	dir := t.TempDir()
+	ch := s.Subscribe()
+
+	if s.Current() != nil {
+		t.Fatal("rule set before the first swap")
+	}
+
+	for _, tc := range []struct {
+		name      string
+		endpoints string
+		version   uint64
+		blocked   bool
+		err       string
+	}{
+		{"first", `[{"path": "/", "method": "", "rules": ["block"]}]`, 1, true, ""},
+		{"second", `[{"path": "/", "method": "", "rules": ["pass"]}]`, 2, false, ""},
+		{"invalid", `[{"path": "/", "method": "", "rules": ["$ctx == 'nope' : block"]}]`, 2, false, "nope"},
+		{"third", `[{"path": "/", "method": "", "rules": ["block"]}]`, 3, true, ""},
+	} {
+		path := filepath.Join(dir, tc.name+".json")
+
+		if err := os.WriteFile(path, []byte(tc.endpoints), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := s.Load(path)
+
+		if len(tc.err) == 0 && err != nil || len(tc.err) != 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: Load() = %v, want %q", tc.name, err, tc.err)
+		}
+
+		set := s.Current()
+
+		if set.Version != tc.version {
+			t.Errorf("%s: version %d, want %d", tc.name, set.Version, tc.version)
+		}
+
+		if blocked := set.Guard.Check(httptest.NewRequest("GET", "/", nil), nil).Action == mkruleval.BLOCK; blocked != tc.blocked {
+			t.Errorf("%s: blocked %t, want %t", tc.name, blocked, tc.blocked)
+		}
+	}
+
+	// the subscriber only holds the latest rule set
+	if set := <-ch; set.Version != 3 {
+		t.Errorf("notified of version %d, want 3", set.Version)
+	}
+
+	s.Unsubscribe(ch)
+
+	if _, err := s.Swap(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case set := <-ch:
+		t.Errorf("notified of version %d after Unsubscribe", set.Version)
+	default:
+	}
+}
+
+func TestFilterEndpoints(t *testing.T) {
+	cfg := Config{Endpoints: []Endpoint{
+		{Method: "GET", Path: "/api/users", Labels: []string{"public"}},
+		{Method: "POST", Path: "/api/users/{id}", Labels: []string{"public", "write"}},
+		{Method: "GET", Path: "/admin", Labels: []string{"internal"}},
+		{Method: "", Path: "/"},
+	}}
+
+	for _, tc := range []struct {
+		only, exclude []string
+		want          []string
+		err           string
+	}{
+		{nil, nil, []string{"/api/users", "/api/users/{id}", "/admin", "/"}, ""},
+		{[]string{"label=public"}, nil, []string{"/api/users", "/api/users/{id}"}, ""},
+		{[]string{"label=public"}, []string{"label=write"}, []string{"/api/users"}, ""},
+		{[]string{"method=get"}, nil, []string{"/api/users", "/admin"}, ""},
+		{[]string{"path=/api/*"}, nil, []string{"/api/users", "/api/users/{id}"}, ""},
+		{[]string{"path=/a*"}, nil, []string{"/admin"}, ""},
+		{nil, []string{"path=/api/*", "label=internal"}, []string{"/"}, ""},
+		{[]string{"owner=x"}, nil, nil, "unknown filter: owner"},
+		{[]string{"label"}, nil, nil, "expected label="},
+		{[]string{"path=["}, nil, nil, "syntax error in pattern"},
+	} {
+		var c Compiler
+		var err error
+
+		for _, val := range tc.only {
+			if err == nil {
+				err = c.Only.Set(val)
+			}
+		}
+
+		for _, val := range tc.exclude {
+			if err == nil {
+				err = c.Exclude.Set(val)
+			}
+		}
+
+		if len(tc.err) == 0 && err != nil || len(tc.err) != 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("only %q exclude %q: %v, want %q", tc.only, tc.exclude, err, tc.err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		var got []string
+
+		in := cfg
+		in.Endpoints = slices.Clone(cfg.Endpoints)
+
+		for _, endpoint := range c.filterEndpoints(in).Endpoints {
+			got = append(got, endpoint.Path)
+		}
+
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("only %q exclude %q: %q, want %q", tc.only, tc.exclude, got, tc.want)
+		}
+	}
+}
+
+func TestAnyMethod(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint string
+		want     string
+	}{
+		{`{"path": "/", "method": "*", "rules": ["block"]}`, ""},
+		{`{"path": "/", "method": "", "rules": ["block"]}`, ""},
+		{`{"path": "/", "rules": ["block"]}`, ""},
+		{`{"path": "/", "method": "get", "rules": ["block"]}`, "GET"},
+	} {
+		var c Compiler
+		var buf bytes.Buffer
+
+		cfg, err := ParseConfig("endpoints.json", []byte("["+tc.endpoint+"]"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		snts, tmpls, types, err := c.Build(cfg)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = c.EncodeSentinels(&buf, snts, tmpls, types); err != nil {
+			t.Fatal(err)
+		}
+
+		if snts, _, _, err = c.DecodeSentinels(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if snts[0].Method != tc.want {
+			t.Errorf("%s: method %q, want %q", tc.endpoint, snts[0].Method, tc.want)
+		}
+
+		g, err := mkruleval.NewGuard(snts, tmpls, types)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, method := range []string{"GET", "DELETE"} {
+			blocked := g.Check(httptest.NewRequest(method, "/", nil), nil).Action == mkruleval.BLOCK
+
+			if want := len(tc.want) == 0 || method == tc.want; blocked != want {
+				t.Errorf("%s: %s blocked %t, want %t", tc.endpoint, method, blocked, want)
+			}
+		}
+	}
+}
+
+func TestPathQueryString(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		err  string
+	}{
+		{"/search", ""},
+		{"/files/{name:[a-z]+\\\\.txt?}", ""},
+		{"/search?q=*", "the path cannot have a query string (?q=*), match it with a rule such as $ctx == 'urlenc' $key == 'q'"},
+		{"/search?", "the path cannot have a query string (?), match it with $ctx == 'urlenc' rules"},
+		{"/a?b/c", "the path cannot have a query string (?b)"},
+	} {
+		var c Compiler
+		var ce *CompileError
+
+		cfg, err := ParseConfig("endpoints.json", []byte(`[{"path": "`+tc.path+`", "method": "GET", "rules": ["block"]}]`))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, _, err = c.Build(cfg)
+
+		switch {
+		case len(tc.err) == 0 && err != nil:
+			t.Errorf("%s: %v", tc.path, err)
+		case len(tc.err) != 0 && (!errors.As(err, &ce) || ce.Code != EXIT_INVALID || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: %v, want %q", tc.path, err, tc.err)
+		}
+	}
+}
+
+func TestGuardHeaderPolicies(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/req", "method": "", "required_headers": ["X-Request-ID", "Host"], "rules": ["pass"]},
+		{"path": "/allow", "method": "", "required_headers": ["X-Request-ID"], "allowed_headers": ["Accept"], "rules": ["$ctx == 'headers' $key == 'x-debug' : block", "pass"]}
+	]`)
+
+	for _, tc := range []struct {
+		uri     string
+		headers map[string]string
+		action  uint8
+		status  int
+		strip   []string
+	}{
+		{"/req", map[string]string{"X-Request-ID": "1"}, mkruleval.PASS, 0, nil},
+		{"/req", map[string]string{"x-request-id": "1"}, mkruleval.PASS, 0, nil},
+		{"/req", nil, mkruleval.BLOCK, http.StatusBadRequest, nil},
+		{"/allow", map[string]string{"X-Request-ID": "1", "Accept": "*/*"}, mkruleval.PASS, 0, nil},
+		{"/allow", map[string]string{"X-Request-ID": "1", "Accept": "*/*", "Cookie": "a=b", "X-Forwarded-For": "1.2.3.4"}, mkruleval.PASS, 0, []string{"Cookie", "X-Forwarded-For"}},
+		{"/allow", map[string]string{"X-Request-ID": "1", "X-Debug": "1"}, mkruleval.BLOCK, http.StatusForbidden, []string{"X-Debug"}},
+		{"/allow", map[string]string{"Accept": "*/*"}, mkruleval.BLOCK, http.StatusBadRequest, nil},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.uri, nil)
+
+		for key, val := range tc.headers {
+			r.Header.Set(key, val)
+		}
+
+		got := g.Check(r, nil)
+
+		if got.Action != tc.action || got.Status != tc.status || !slices.Equal(got.Strip, tc.strip) {
+			t.Errorf("%s with %v: action %d status %d strip %q, want %d %d %q", tc.uri, tc.headers, got.Action, got.Status, got.Strip, tc.action, tc.status, tc.strip)
+		}
+	}
+}
+
+func TestGuardCORS(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/api", "method": "POST", "cors": {"origins": ["https://app.example.com", "https://*.example.org"], "headers": ["X-Token"], "credentials": true}, "rules": ["pass"]},
+		{"path": "/open", "method": "GET", "cors": {"origins": ["*"]}, "rules": ["pass"]}
+	]`)
+
+	for _, tc := range []struct {
+		method, uri string
+		headers     map[string]string
+		action      uint8
+		status      int
+		want        map[string]string
+	}{
+		{"POST", "/api", nil, mkruleval.PASS, 0, nil},
+		{"POST", "/api", map[string]string{"Origin": "https://app.example.com"}, mkruleval.PASS, 0, map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Allow-Credentials": "true", "Vary": "Origin"}},
+		{"POST", "/api", map[string]string{"Origin": "https://a.example.org"}, mkruleval.PASS, 0, map[string]string{"Access-Control-Allow-Origin": "https://a.example.org"}},
+		{"POST", "/api", map[string]string{"Origin": "https://example.org"}, mkruleval.BLOCK, http.StatusForbidden, nil},
+		{"POST", "/api", map[string]string{"Origin": "https://evil.com"}, mkruleval.BLOCK, http.StatusForbidden, nil},
+		{"POST", "/api", map[string]string{"Origin": "http://example.com"}, mkruleval.PASS, 0, nil},
+		{"GET", "/open", map[string]string{"Origin": "https://any.com"}, mkruleval.PASS, 0, map[string]string{"Access-Control-Allow-Origin": "*"}},
+		{"OPTIONS", "/api", map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "X-Token, Content-Type"}, mkruleval.RESPOND, http.StatusNoContent, map[string]string{"Access-Control-Allow-Methods": "POST", "Access-Control-Allow-Headers": "x-token, content-type"}},
+		{"OPTIONS", "/api", map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "X-Other"}, mkruleval.BLOCK, http.StatusForbidden, nil},
+		{"OPTIONS", "/api", map[string]string{"Origin": "https://evil.com", "Access-Control-Request-Method": "POST"}, mkruleval.BLOCK, http.StatusForbidden, nil},
+	} {
+		r := httptest.NewRequest(tc.method, tc.uri, nil)
+
+		for key, val := range tc.headers {
+			r.Header.Set(key, val)
+		}
+
+		got := g.Check(r, nil)
+
+		if got.Action != tc.action || got.Status != tc.status {
+			t.Errorf("%s %s with %v: action %d status %d, want %d %d", tc.method, tc.uri, tc.headers, got.Action, got.Status, tc.action, tc.status)
+		}
+
+		for key, val := range tc.want {
+			if got.Headers.Get(key) != val {
+				t.Errorf("%s %s with %v: %s %q, want %q", tc.method, tc.uri, tc.headers, key, got.Headers.Get(key), val)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		cors string
+		err  string
+	}{
+		{`{"origins": ["https://app.example.com:8443"]}`, ""},
+		{`{"origins": ["*"], "credentials": true}`, "credentials"},
+		{`{"origins": ["app.example.com"]}`, "expected an http or https scheme"},
+		{`{"origins": ["https://app.example.com/path"]}`, "an origin has no path"},
+		{`{"origins": ["https://app.example.com:99999"]}`, "invalid port"},
+	} {
+		var c Compiler
+
+		cfg, err := ParseConfig("endpoints.json", []byte(`[{"path": "/", "method": "GET", "cors": `+tc.cors+`, "rules": ["pass"]}]`))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, _, err = c.Build(cfg)
+
+		if len(tc.err) == 0 && err != nil || len(tc.err) != 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("cors %s: %v, want %q", tc.cors, err, tc.err)
+		}
+	}
+}
+
+func TestGuardCSRF(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/form", "method": "POST", "rules": ["$header('X-CSRF-Token') != $cookie('csrf') : block", "pass"]},
+		{"path": "/eq", "method": "POST", "rules": ["$header('x-csrf-token') == $cookie('csrf') : pass", "block"]}
+	]`)
+
+	for _, tc := range []struct {
+		uri    string
+		token  string
+		cookie string
+		want   uint8
+	}{
+		{"/form", "abc", "csrf=abc", mkruleval.PASS},
+		{"/form", "abc", "csrf=abd", mkruleval.BLOCK},
+		{"/form", "ABC", "csrf=abc", mkruleval.BLOCK},
+		{"/form", "", "csrf=abc", mkruleval.BLOCK},
+		{"/form", "abc", "", mkruleval.BLOCK},
+		{"/form", "", "", mkruleval.BLOCK},
+		{"/eq", "abc", "other=1; csrf=abc", mkruleval.PASS},
+		{"/eq", "abc", "csrf=ab", mkruleval.BLOCK},
+		{"/eq", "", "", mkruleval.BLOCK},
+	} {
+		r := httptest.NewRequest(http.MethodPost, tc.uri, nil)
+
+		if len(tc.token) != 0 {
+			r.Header.Set("X-Csrf-Token", tc.token)
+		}
+
+		if len(tc.cookie) != 0 {
+			r.Header.Set("Cookie", tc.cookie)
+		}
+
+		if got := g.Check(r, nil); got.Action != tc.want {
+			t.Errorf("%s with token %q and cookie %q: action %d, want %d", tc.uri, tc.token, tc.cookie, got.Action, tc.want)
+		}
+	}
+}
+
+func TestGuardVarComparison(t *testing.T) {
+	g := newGuard(t, `[
+		{"path": "/redirect", "method": "", "rules": ["$ctx == 'urlenc' $key == 'next' $val != $header('Host') : block", "pass"]},
+		{"path": "/host", "method": "", "rules": ["$header('Host') != $header('X-Forwarded-Host') | lower : block", "pass"]},
+		{"path": "/echo", "method": "", "rules": ["$ctx == 'urlenc' $val | lower == $key : block", "pass"]}
+	]`)
+
+	for _, tc := range []struct {
+		uri     string
+		forward string
+		want    uint8
+	}{
+		{"/redirect?next=example.com", "", mkruleval.PASS},
+		{"/redirect?next=evil.com", "", mkruleval.BLOCK},
+		{"/redirect?other=evil.com", "", mkruleval.PASS},
+		{"/host", "EXAMPLE.com", mkruleval.PASS},
+		{"/host", "evil.com", mkruleval.BLOCK},
+		{"/host", "", mkruleval.BLOCK},
+		{"/echo?a=A", "", mkruleval.BLOCK},
+		{"/echo?a=b", "", mkruleval.PASS},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com"+tc.uri, nil)
+
+		if len(tc.forward) != 0 {
+			r.Header.Set("X-Forwarded-Host", tc.forward)
+		}
+
+		if got := g.Check(r, nil); got.Action != tc.want {
+			t.Errorf("%s forwarded for %q: action %d, want %d", tc.uri, tc.forward, got.Action, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		rule string
+		err  string
+	}{
+		{`"$ctx == 'urlenc' $val == $key : block"`, ""},
+		{`{"rule": "$ctx == 'urlenc' $val == 'x' : block", "except": "$header('a') == $cookie('b')"}`, "except"},
+	} {
+		var c Compiler
+
+		cfg, err := ParseConfig("endpoints.json", []byte(`[{"path": "/", "method": "", "rules": [`+tc.rule+`]}]`))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, _, err = c.Build(cfg)
+
+		if len(tc.err) == 0 && err != nil || len(tc.err) != 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: %v, want %q", tc.rule, err, tc.err)
+		}
+	}
+}
+
+func TestGuardBotPolicy(t *testing.T) {
+	browser := map[string]string{"User-Agent": "Mozilla/5.0", "Accept": "*/*", "Accept-Language": "en", "Accept-Encoding": "gzip"}
+	curl := map[string]string{"User-Agent": "curl/8.5.0"}
+	sum := sha256.Sum256([]byte("user-agent"))
+	monitor := hex.EncodeToString(sum[:8])
+
+	g := newGuard(t, `[
+		{"path": "/strict", "method": "", "bot_policy": {"require_browser_headers": true, "deny_automation": true, "allow_fingerprints": ["`+monitor+`"]}, "rules": ["pass"]},
+		{"path": "/auto", "method": "", "bot_policy": {"deny_automation": true}, "rules": ["pass"]},
+		{"path": "/flag", "method": "", "bot_policy": {"deny_automation": true, "action": "flag"}, "rules": ["pass"]}
+	]`)
+
+	for _, tc := range []struct {
+		uri     string
+		headers map[string]string
+		want    uint8
+	}{
+		{"/strict", browser, mkruleval.PASS},
+		{"/strict", map[string]string{"User-Agent": "Mozilla/5.0", "Accept": "*/*"}, mkruleval.BLOCK},
+		{"/strict", map[string]string{"User-Agent": "Mozilla/5.0 HeadlessChrome", "Accept": "*/*", "Accept-Language": "en", "Accept-Encoding": "gzip"}, mkruleval.BLOCK},
+		{"/strict", map[string]string{"User-Agent": "monitor/1.0"}, mkruleval.PASS},
+		{"/auto", curl, mkruleval.BLOCK},
+		{"/auto", map[string]string{"User-Agent": "python-requests/2.31"}, mkruleval.BLOCK},
+		{"/auto", nil, mkruleval.BLOCK},
+		{"/auto", map[string]string{"User-Agent": "Mozilla/5.0"}, mkruleval.PASS},
+		{"/flag", curl, mkruleval.PASS},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.uri, nil)
+
+		for key, val := range tc.headers {
+			r.Header.Set(key, val)
+		}
+
+		if got := g.Check(r, nil); got.Action != tc.want {
+			t.Errorf("%s with %v: action %d, want %d", tc.uri, tc.headers, got.Action, tc.want)
+		}
+	}
+}
+
+func TestAllowedStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name, data string
+		want       []uint16
+		err        string
+	}{
+		{"endpoints.json", `[{"path": "/", "method": "GET", "allowed_status": [200, 401, 599], "rules": ["pass"]}]`, []uint16{200, 401, 599}, ""},
+		{"endpoints.json", `[{"path": "/", "method": "GET", "rules": ["pass"]}]`, nil, ""},
+		{"endpoints.json", `[{"path": "/", "method": "GET", "allowed_status": [100], "rules": ["pass"]}]`, nil, "invalid allowed status: 100"},
+		{"endpoints.json", `[{"path": "/", "method": "GET", "allowed_status": [600], "rules": ["pass"]}]`, nil, "invalid allowed status: 600"},
+		{"endpoints.mkr", "endpoint GET / {\n    allowed_status 200 404\n    rule pass\n}\n", []uint16{200, 404}, ""},
+		{"endpoints.mkr", "endpoint GET / {\n    allowed_status 200 ok\n    rule pass\n}\n", nil, "invalid status: ok"},
+	} {
+		var c Compiler
+		var buf bytes.Buffer
+
+		cfg, err := ParseConfig(tc.name, []byte(tc.data))
+
+		if err == nil {
+			var snts []mkruleval.Sentinel
+			var tmpls []mkruleval.Template
+			var types mkruleval.ContentTypes
+
+			if snts, tmpls, types, err = c.Build(cfg); err == nil {
+				if err = c.EncodeSentinels(&buf, snts, tmpls, types); err != nil {
+					t.Fatal(err)
+				}
+
+				if snts, _, _, err = c.DecodeSentinels(&buf); err != nil {
+					t.Fatal(err)
+				}
+
+				if !slices.Equal(snts[0].AllowedStatus, tc.want) {
+					t.Errorf("%s: allowed status %v, want %v", tc.data, snts[0].AllowedStatus, tc.want)
+				}
+			}
+		}
+
+		if len(tc.err) == 0 && err != nil || len(tc.err) != 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: %v, want %q", tc.data, err, tc.err)
+		}
+	}
+}
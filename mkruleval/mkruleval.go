@@ -0,0 +1,2833 @@
+// Package mkruleval checks requests against compiled sentinels.
+package mkruleval
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	CTX            = 1
+	KEY            = 2
+	VAL            = 3
+	DEPTH          = 4
+	COOKIE_VAL     = 5
+	SCHEME         = 6
+	CHARSET        = 7
+	DOUBLE_ENCODED = 8
+	FILE_EXT       = 9
+	HEADER_VAL     = 10
+	CAPTURE        = 11
+	PATH_VAR       = 12
+	FINGERPRINT    = 13
+	TLS_VERSION    = 14
+	SNI            = 15
+	CLIENT_CERT_CN = 16
+	PROTO          = 17
+	PSEUDO         = 18
+	PATH_TRAVERSAL = 19
+)
+
+var VarNames = map[uint8]string{
+	CTX:            "$ctx",
+	KEY:            "$key",
+	VAL:            "$val",
+	DEPTH:          "$depth",
+	COOKIE_VAL:     "$cookie",
+	SCHEME:         "$scheme",
+	CHARSET:        "$charset",
+	DOUBLE_ENCODED: "$double_encoded",
+	FILE_EXT:       "$file_ext",
+	HEADER_VAL:     "$header",
+	CAPTURE:        "$",
+	PATH_VAR:       "$path",
+	FINGERPRINT:    "$fingerprint",
+	TLS_VERSION:    "$tls_version",
+	SNI:            "$sni",
+	CLIENT_CERT_CN: "$client_cert_cn",
+	PROTO:          "$proto",
+	PSEUDO:         "$pseudo",
+	PATH_TRAVERSAL: "$path_traversal",
+}
+
+// BoolVars are the variables computed over the item, compared to true or
+// false.
+var BoolVars = map[uint8]bool{DOUBLE_ENCODED: true, PATH_TRAVERSAL: true}
+
+// MAX_CAPTURES is the number of capture slots of a group, $1 to $9.
+const MAX_CAPTURES = 9
+
+const (
+	BLOCK    = 1
+	PASS     = 2
+	EQ       = 3
+	NEQ      = 4
+	SCORE    = 5
+	REDIRECT = 6
+	RESPOND  = 7
+	EQ_VAR   = 8
+	NEQ_VAR  = 9
+	ENTROPY  = 10
+	IS_SQLI  = 11
+	IS_XSS   = 12
+)
+
+const (
+	AUTH_HEADER   = 11
+	HEADERS       = 4
+	URLENC        = 3
+	BASE64        = 9
+	BASE64_URL    = 10
+	COOKIE        = 8
+	JSON          = 5
+	JSON_OBJ      = 6
+	JSON_ARRAY    = 7
+	PATH          = 2
+	HTTP          = 1
+	JWT           = 12
+	TRAILERS      = 13
+	RESPONSE_BODY = 14
+)
+
+const (
+	FLAG_CASE_INSENSITIVE = 1 << 0
+	FLAG_FORBID_CONTROL   = 1 << 1
+)
+
+const (
+	TYPE_NULL    = 1 << 0
+	TYPE_BOOLEAN = 1 << 1
+	TYPE_INTEGER = 1 << 2
+	TYPE_NUMBER  = 1 << 3
+	TYPE_STRING  = 1 << 4
+	TYPE_ARRAY   = 1 << 5
+	TYPE_OBJECT  = 1 << 6
+)
+
+const (
+	SCHEMA_REQUIRED   = 1 << 0
+	SCHEMA_CLOSED     = 1 << 1
+	SCHEMA_ITEMS      = 1 << 2
+	SCHEMA_MAX_LENGTH = 1 << 3
+)
+
+const (
+	COOKIE_SECURE    = 1 << 0
+	COOKIE_HTTP_ONLY = 1 << 1
+	COOKIE_SAME_SITE = 1 << 2
+	COOKIE_FLAG      = 1 << 3
+)
+
+const (
+	CORS_ENABLED     = 1 << 0
+	CORS_CREDENTIALS = 1 << 1
+)
+
+const (
+	BOT_ENABLED         = 1 << 0
+	BOT_BROWSER_HEADERS = 1 << 1
+	BOT_AUTOMATION      = 1 << 2
+	BOT_FLAG            = 1 << 3
+)
+
+const (
+	SEG_LITERAL = 1
+	SEG_ANY     = 2
+	SEG_REGEXP  = 3
+)
+
+const (
+	CUSTOM_CTX_MIN = 48
+	CUSTOM_CTX_MAX = 63
+	CUSTOM_OP_MIN  = 128
+	CUSTOM_OP_MAX  = 255
+)
+
+type Stmt struct {
+	Var        uint8
+	Op         uint8
+	Mods       uint8
+	Arg        string
+	Transforms []uint8
+	Num        uint64
+	Val        string
+	Regexp     string
+	Flags      uint8
+	Bytes      []byte
+	Ref        Ref
+	Slot       uint8
+	Detector   uint8
+}
+
+// Ref is the variable on the right of a cross-value comparison, e.g. the
+// cookie of $header('X-CSRF') == $cookie('csrf'), with its own transforms.
+type Ref struct {
+	Var        uint8
+	Arg        string
+	Transforms []uint8
+}
+
+type Window struct {
+	From uint64
+	To   uint64
+	Cron string
+}
+
+// Metadata is carried in the metadata section of the binary data, apart
+// from the rules, so it can be stripped without changing them.
+type Metadata struct {
+	Owner       string
+	Description string
+}
+
+// SAMPLE_SCALE is the resolution of the rule samples, a sample of n
+// applies a rule to n requests in SAMPLE_SCALE.
+const SAMPLE_SCALE = 10000
+
+type SentinelRule struct {
+	Window  Window
+	Expires uint64
+	Groups  [][]Stmt
+	Meta    Metadata
+
+	// Sample is the share of the requests the rule applies to, out of
+	// SAMPLE_SCALE, 0 for all of them
+	Sample uint16
+
+	// a rule of an experiment is its Variant, from 1, of Variants rules
+	// of which each request is given one
+	Experiment string
+	Variant    uint8
+	Variants   uint8
+}
+
+type Sentinel struct {
+	Method         string
+	Flags          uint8
+	Path           []string
+	Rules          []SentinelRule
+	BlockThreshold uint64
+	Window         Window
+	Meta           Metadata
+	Charsets       []string
+	AllowControl   []string
+	Schema         *SchemaNode
+
+	// header names are lowercase, the allowed ones include the required
+	RequiredHeaders []string
+	AllowedHeaders  []string
+
+	Cookies   CookieAttrs
+	CORS      CORSPolicy
+	Bots      BotChecks
+	Sequences []SequenceRule
+
+	// AllowedStatus lists the statuses the responses may have, any
+	// when empty
+	AllowedStatus []uint16
+}
+
+// BotChecks is the compiled bot policy, no policy without flags. The
+// header names and User-Agent substrings are lowercase, written to the
+// artifact so that runtimes need no list of their own.
+type BotChecks struct {
+	Flags   uint8
+	Headers []string
+	Agents  []string
+	Allow   []string
+	Deny    []string
+}
+
+// SequenceRule is a compiled sequence: the key is the client address when
+// its Var is 0, the window is in seconds, and the groups are the event
+// conditions followed by the action.
+type SequenceRule struct {
+	Key    Ref
+	Count  uint32
+	Window uint32
+	Status []uint16
+	Groups [][]Stmt
+}
+
+// CORSPolicy is the compiled CORS policy, no policy without flags. Origins
+// are lowercase, methods uppercase and headers lowercase.
+type CORSPolicy struct {
+	Flags   uint8
+	Origins []string
+	Methods []string
+	Headers []string
+}
+
+// CookieAttrs is the compiled cookie policy, no policy without flags.
+type CookieAttrs struct {
+	Flags    uint8
+	SameSite string
+}
+
+// SchemaNode is a compiled JSON schema: the allowed types of a value, the
+// length limit of strings, and the nodes of the object properties or of
+// the array items.
+type SchemaNode struct {
+	Key       string       `json:"key,omitempty"`
+	Types     uint8        `json:"types,omitempty"`
+	Flags     uint8        `json:"flags,omitempty"`
+	MaxLength uint64       `json:"max_length,omitempty"`
+	Children  []SchemaNode `json:"children,omitempty"`
+}
+
+func (snt Sentinel) Name() string {
+	return strings.TrimSpace(snt.Method + " /" + strings.Join(snt.Path, "/"))
+}
+
+// AllRules returns the rules of the sentinel followed by the groups of its
+// sequences, for the checks of the statements.
+func (snt Sentinel) AllRules() []SentinelRule {
+	result := slices.Clone(snt.Rules)
+
+	for _, seq := range snt.Sequences {
+		result = append(result, SentinelRule{Groups: seq.Groups})
+	}
+
+	return result
+}
+
+type Segment struct {
+	Kind    uint8
+	Name    string
+	Pattern string
+}
+
+var segmentTypes = map[string]string{
+	"int":   "[0-9]+",
+	"hex":   "[0-9a-fA-F]+",
+	"alpha": "[a-zA-Z]+",
+	"alnum": "[a-zA-Z0-9]+",
+	"uuid":  "[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}",
+}
+
+func ParseSegment(val string) Segment {
+	if val == "*" {
+		return Segment{SEG_ANY, "", ""}
+	}
+
+	if !strings.HasPrefix(val, "{") || !strings.HasSuffix(val, "}") {
+		return Segment{SEG_LITERAL, val, ""}
+	}
+
+	name, pattern, found := strings.Cut(val[1:len(val)-1], ":")
+
+	if !found {
+		return Segment{SEG_ANY, name, ""}
+	}
+
+	if typ, ok := segmentTypes[pattern]; ok {
+		pattern = typ
+	}
+
+	return Segment{SEG_REGEXP, name, pattern}
+}
+
+func (seg Segment) String() string {
+	switch seg.Kind {
+	case SEG_ANY:
+		if len(seg.Name) == 0 {
+			return "*"
+		}
+
+		return "{" + seg.Name + "}"
+	case SEG_REGEXP:
+		return "{" + seg.Name + ":" + seg.Pattern + "}"
+	}
+
+	return seg.Name
+}
+
+type Template struct {
+	Name        string
+	ContentType string
+	Body        string
+}
+
+var customContexts = map[string]uint8{}
+
+func RegisterContext(name string, code uint8) error {
+	if code < CUSTOM_CTX_MIN || code > CUSTOM_CTX_MAX {
+		return fmt.Errorf("context code %d is out of custom range %d-%d", code, CUSTOM_CTX_MIN, CUSTOM_CTX_MAX)
+	}
+
+	if _, err := ContextCode(name); err == nil {
+		return fmt.Errorf("context already defined: %s", name)
+	}
+
+	for other, n := range customContexts {
+		if n == code {
+			return fmt.Errorf("context code %d already used by %s", code, other)
+		}
+	}
+
+	customContexts[name] = code
+
+	return nil
+}
+
+// ContentTypes maps the media types of request bodies to the context
+// decoding them. It comes from the endpoints files or the artifact and
+// goes along with their sentinels and templates.
+type ContentTypes map[string]string
+
+// Register declares the context decoding the bodies of the given media
+// type, type/* covers the whole type.
+func (types ContentTypes) Register(contentType string, ctx string) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return fmt.Errorf("content type %s: %v", contentType, err)
+	}
+
+	if len(params) != 0 || !strings.Contains(mediaType, "/") {
+		return fmt.Errorf("content type %s: expected type/subtype without parameters", contentType)
+	}
+
+	if _, err = ContextCode(ctx); err != nil {
+		return fmt.Errorf("content type %s: %v", contentType, err)
+	}
+
+	if prev, ok := types[mediaType]; ok && prev != ctx {
+		return fmt.Errorf("content type %s is mapped to both %s and %s", mediaType, prev, ctx)
+	}
+
+	types[mediaType] = ctx
+
+	return nil
+}
+
+func (stmt *Stmt) Pipe(name string) error {
+	if stmt.Var == CTX {
+		return fmt.Errorf("transforms are not allowed for $ctx: %s", name)
+	}
+
+	if BoolVars[stmt.Var] {
+		return fmt.Errorf("transforms are not allowed for %s: %s", VarNames[stmt.Var], name)
+	}
+
+	for code, val := range TransformNames {
+		if val == name {
+			stmt.Transforms = append(stmt.Transforms, code)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown transform: %s", name)
+}
+
+func (ref *Ref) Pipe(name string) error {
+	stmt := Stmt{Var: ref.Var, Transforms: ref.Transforms}
+	err := stmt.Pipe(name)
+	ref.Transforms = stmt.Transforms
+
+	return err
+}
+
+// Match tells whether a decoded JSON value satisfies the schema node.
+func (node SchemaNode) Match(v any) bool {
+	if node.Types != 0 && node.Types&jsonType(v) == 0 {
+		return false
+	}
+
+	switch v := v.(type) {
+	case string:
+		if node.Flags&SCHEMA_MAX_LENGTH != 0 && uint64(utf8.RuneCountInString(v)) > node.MaxLength {
+			return false
+		}
+	case map[string]any:
+		for _, child := range node.Children {
+			if child.Flags&SCHEMA_ITEMS != 0 {
+				continue
+			}
+
+			val, ok := v[child.Key]
+
+			if !ok && child.Flags&SCHEMA_REQUIRED != 0 || ok && !child.Match(val) {
+				return false
+			}
+		}
+
+		if node.Flags&SCHEMA_CLOSED != 0 {
+			for key := range v {
+				if !slices.ContainsFunc(node.Children, func(child SchemaNode) bool { return child.Flags&SCHEMA_ITEMS == 0 && child.Key == key }) {
+					return false
+				}
+			}
+		}
+	case []any:
+		for _, child := range node.Children {
+			if child.Flags&SCHEMA_ITEMS == 0 {
+				continue
+			}
+
+			for _, item := range v {
+				if !child.Match(item) {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+func jsonType(v any) uint8 {
+	switch v := v.(type) {
+	case nil:
+		return TYPE_NULL
+	case bool:
+		return TYPE_BOOLEAN
+	case float64:
+		if v == math.Trunc(v) {
+			return TYPE_INTEGER | TYPE_NUMBER
+		}
+
+		return TYPE_NUMBER
+	case string:
+		return TYPE_STRING
+	case []any:
+		return TYPE_ARRAY
+	}
+
+	return TYPE_OBJECT
+}
+
+// SameSiteLevels ranks the SameSite values, the higher the stricter.
+var SameSiteLevels = map[string]int{"none": 1, "lax": 2, "strict": 3}
+
+// Allows tells whether a Set-Cookie header value has the required
+// attributes.
+func (attrs CookieAttrs) Allows(header string) bool {
+	cookie, err := http.ParseSetCookie(header)
+
+	if err != nil {
+		return false
+	}
+
+	if attrs.Flags&COOKIE_SECURE != 0 && !cookie.Secure || attrs.Flags&COOKIE_HTTP_ONLY != 0 && !cookie.HttpOnly {
+		return false
+	}
+
+	if attrs.Flags&COOKIE_SAME_SITE != 0 {
+		level := map[http.SameSite]int{http.SameSiteNoneMode: 1, http.SameSiteLaxMode: 2, http.SameSiteStrictMode: 3}[cookie.SameSite]
+
+		if level < SameSiteLevels[attrs.SameSite] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// allows tells whether the policy accepts the origin, or any origin for
+// an empty one.
+func (policy CORSPolicy) allows(origin string) bool {
+	origin = strings.ToLower(origin)
+
+	for _, allowed := range policy.Origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+
+		prefix, domain, ok := strings.Cut(allowed, "*.")
+
+		if ok && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// responseHeaders returns the CORS headers of the responses to the origin.
+func (policy CORSPolicy) responseHeaders(origin string) http.Header {
+	header := http.Header{}
+
+	if slices.Equal(policy.Origins, []string{"*"}) {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Vary", "Origin")
+	}
+
+	if policy.Flags&CORS_CREDENTIALS != 0 {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	return header
+}
+
+// preflight answers a preflight request for the endpoint method: it is
+// rejected unless the origin, the method and every requested header but
+// the safelisted ones are allowed.
+func (policy CORSPolicy) preflight(r *http.Request, verdict *Verdict) {
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	var requested []string
+
+	for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); len(name) != 0 {
+			requested = append(requested, name)
+		}
+	}
+
+	verdict.Action = BLOCK
+	verdict.Status = http.StatusForbidden
+
+	if !policy.allows(origin) || len(policy.Methods) != 0 && !slices.Contains(policy.Methods, method) {
+		return
+	}
+
+	for _, name := range requested {
+		if !slices.Contains(policy.Headers, name) && !slices.Contains([]string{"accept", "accept-language", "content-language", "content-type"}, name) {
+			return
+		}
+	}
+
+	verdict.Action = RESPOND
+	verdict.Status = http.StatusNoContent
+	verdict.Headers = policy.responseHeaders(origin)
+	verdict.Headers.Set("Access-Control-Allow-Methods", method)
+
+	if len(requested) != 0 {
+		verdict.Headers.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+}
+
+func RegexpBody(val string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(val, "/"), "/")
+}
+
+func RegexpFlagNames(flags uint8) string {
+	var sb strings.Builder
+
+	for _, f := range RegexpFlags {
+		if flags&f.Flag != 0 {
+			sb.WriteByte(f.Name)
+		}
+	}
+
+	return sb.String()
+}
+
+func RegexpSource(stmt Stmt) string {
+	if stmt.Flags == 0 {
+		return RegexpBody(stmt.Regexp)
+	}
+
+	return "(?" + RegexpFlagNames(stmt.Flags) + ")" + RegexpBody(stmt.Regexp)
+}
+
+var contextCodes = map[string]uint8{
+	"headers":     HEADERS,
+	"urlenc":      URLENC,
+	"base64":      BASE64,
+	"cookie":      COOKIE,
+	"json":        JSON,
+	"json_obj":    JSON_OBJ,
+	"json_array":  JSON_ARRAY,
+	"path":        PATH,
+	"http":        HTTP,
+	"auth_header": AUTH_HEADER,
+	"base64_url":  BASE64_URL,
+	"jwt":         JWT,
+	"trailers":    TRAILERS,
+	"response":    RESPONSE_BODY,
+}
+
+func ContextCode(val string) (uint8, error) {
+	if n, ok := contextCodes[val]; ok {
+		return n, nil
+	}
+
+	if n, ok := customContexts[val]; ok {
+		return n, nil
+	}
+
+	return 0, fmt.Errorf("unknown context: %s", val)
+}
+
+func ContextName(code uint8) (string, error) {
+	for name, n := range contextCodes {
+		if n == code {
+			return name, nil
+		}
+	}
+
+	for name, n := range customContexts {
+		if n == code {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown context code: %d", code)
+}
+
+func ContextMask(val string) (uint64, error) {
+	var r uint64 = 0
+
+	contexts := strings.Split(val, "|")
+
+	for _, c := range contexts {
+		ctx := strings.TrimSpace(c)
+		n, err := ContextCode(ctx)
+		if err != nil {
+			return 0, err
+		}
+		r |= (1 << n)
+	}
+
+	return r, nil
+}
+
+const (
+	RE_CASE_INSENSITIVE = 1 << 0
+	RE_DOTALL           = 1 << 1
+	RE_MULTILINE        = 1 << 2
+)
+
+var RegexpFlags = []struct {
+	Flag uint8
+	Name byte
+}{
+	{RE_CASE_INSENSITIVE, 'i'},
+	{RE_DOTALL, 's'},
+	{RE_MULTILINE, 'm'},
+}
+
+const (
+	MOD_NFKC    = 1 << 0
+	MOD_EXCEPT  = 1 << 1
+	MOD_CAPTURE = 1 << 2
+	MOD_LUHN    = 1 << 3
+)
+
+const (
+	TF_LOWER               = 1
+	TF_UPPER               = 2
+	TF_TRIM                = 3
+	TF_URL_DECODE          = 4
+	TF_BASE64_DECODE       = 5
+	TF_HTML_DECODE         = 6
+	TF_COMPRESS_WHITESPACE = 7
+	TF_REMOVE_NULLS        = 8
+)
+
+var TransformNames = map[uint8]string{
+	TF_LOWER:               "lower",
+	TF_UPPER:               "upper",
+	TF_TRIM:                "trim",
+	TF_URL_DECODE:          "url_decode",
+	TF_BASE64_DECODE:       "base64_decode",
+	TF_HTML_DECODE:         "html_decode",
+	TF_COMPRESS_WHITESPACE: "compress_whitespace",
+	TF_REMOVE_NULLS:        "remove_nulls",
+}
+
+func transform(code uint8, val string) string {
+	switch code {
+	case TF_LOWER:
+		return strings.ToLower(val)
+	case TF_UPPER:
+		return strings.ToUpper(val)
+	case TF_TRIM:
+		return strings.TrimSpace(val)
+	case TF_URL_DECODE:
+		if s, err := url.QueryUnescape(val); err == nil {
+			return s
+		}
+	case TF_BASE64_DECODE:
+		for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+			if data, err := enc.DecodeString(val); err == nil {
+				return string(data)
+			}
+		}
+	case TF_HTML_DECODE:
+		return html.UnescapeString(val)
+	case TF_COMPRESS_WHITESPACE:
+		var sb strings.Builder
+
+		space := false
+
+		for _, r := range val {
+			if unicode.IsSpace(r) {
+				space = true
+				continue
+			}
+
+			if space {
+				sb.WriteByte(' ')
+				space = false
+			}
+
+			sb.WriteRune(r)
+		}
+
+		if space {
+			sb.WriteByte(' ')
+		}
+
+		return sb.String()
+	case TF_REMOVE_NULLS:
+		return strings.ReplaceAll(val, "\x00", "")
+	}
+
+	return val
+}
+
+const (
+	DETECT_CC      = 1
+	DETECT_SSN     = 2
+	DETECT_AWS_KEY = 3
+	DETECT_JWT     = 4
+)
+
+// detectorPatterns find the candidates of the detectors, which validate
+// them: card numbers by their Luhn checksum, SSNs by the numbers never
+// assigned, JWTs by a header with an algorithm. Runtimes may use faster
+// scanners as long as they find the same values.
+var detectorPatterns = map[uint8]*regexp.Regexp{
+	DETECT_CC:      regexp.MustCompile(`\b[0-9](?:[ -]?[0-9]){12,18}\b`),
+	DETECT_SSN:     regexp.MustCompile(`\b([0-9]{3})-([0-9]{2})-([0-9]{4})\b`),
+	DETECT_AWS_KEY: regexp.MustCompile(`\b(?:AKIA|ASIA|AIDA|AROA|AGPA|ANPA|ANVA|AIPA)[A-Z2-7]{16}\b`),
+	DETECT_JWT:     regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+}
+
+// detect tells whether the value contains data of the detector.
+func detect(code uint8, val string) bool {
+	for _, m := range detectorPatterns[code].FindAllStringSubmatch(val, -1) {
+		switch code {
+		case DETECT_CC:
+			if luhn(strings.NewReplacer(" ", "", "-", "").Replace(m[0])) {
+				return true
+			}
+		case DETECT_SSN:
+			if m[1] != "000" && m[1] != "666" && m[1][0] != '9' && m[2] != "00" && m[3] != "0000" {
+				return true
+			}
+		case DETECT_JWT:
+			var header map[string]any
+
+			data, err := base64.RawURLEncoding.DecodeString(m[0][:strings.IndexByte(m[0], '.')])
+
+			if err == nil && json.Unmarshal(data, &header) == nil && header["alg"] != nil {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+// entropy is the Shannon entropy of the bytes of a value in bits per
+// byte, from 0 for a repeated byte to 8 for random data.
+func entropy(val string) float64 {
+	var counts [256]int
+	var bits float64
+
+	for i := range len(val) {
+		counts[val[i]]++
+	}
+
+	for _, n := range counts {
+		if n != 0 {
+			p := float64(n) / float64(len(val))
+			bits -= p * math.Log2(p)
+		}
+	}
+
+	return bits
+}
+
+// sqliFingerprints match the token sequences of injections: a union or
+// stacked query, a time or file function, or a string closed early and
+// followed by a comment or a tautology.
+var sqliFingerprints = regexp.MustCompile(`U\(*E|;E|f\(|^s\)*(c|&\(*[1sn](o\(*[1sn]|c|$))|^1\)*&\(*1o\(*1`)
+
+var sqlKeywords = map[string]byte{
+	"union": 'U', "select": 'E', "insert": 'E', "update": 'E', "delete": 'E', "drop": 'E', "alter": 'E', "create": 'E',
+	"truncate": 'E', "exec": 'E', "execute": 'E', "declare": 'E', "shutdown": 'E', "waitfor": 'E',
+	"and": '&', "or": '&', "xor": '&',
+	"like": 'o', "rlike": 'o', "regexp": 'o', "between": 'o', "is": 'o', "in": 'o', "div": 'o', "mod": 'o',
+	"null": '1', "true": '1', "false": '1',
+}
+
+var sqlFunctions = map[string]bool{
+	"sleep": true, "benchmark": true, "pg_sleep": true, "load_file": true, "extractvalue": true, "updatexml": true,
+	"xp_cmdshell": true, "dbms_pipe.receive_message": true, "utl_inaddr.get_host_name": true,
+}
+
+// isSQLi tokenizes the value as SQL as is and as the rest of a single or
+// double quoted string, and matches the first tokens of each against the
+// injection fingerprints.
+func isSQLi(val string) bool {
+	for _, prefix := range []string{"", "'", "\""} {
+		if len(prefix) != 0 && !strings.Contains(val, prefix) {
+			continue
+		}
+
+		if sqliFingerprints.Match(sqlFingerprint(prefix + val)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sqlFingerprint returns the types of the first tokens of a SQL text: s
+// string, 1 number or literal, n name, v variable, k keyword (U union, E
+// statement, & logical, o operator), f function, c comment and the (),;
+// punctuation. Inline comments are dropped, as databases do.
+func sqlFingerprint(sql string) []byte {
+	var fp []byte
+
+	for i := 0; i < len(sql) && len(fp) < 8; {
+		c := sql[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f' || c == '+' && len(fp) == 0:
+			i++
+		case c == '\'' || c == '"':
+			for i++; i < len(sql); i++ {
+				if sql[i] == '\\' {
+					i++
+				} else if sql[i] == c && (i+1 == len(sql) || sql[i+1] != c) {
+					break
+				} else if sql[i] == c {
+					i++
+				}
+			}
+
+			fp, i = append(fp, 's'), i+1
+		case c == '`':
+			if n := strings.IndexByte(sql[i+1:], '`'); n >= 0 {
+				i += n + 2
+			} else {
+				i = len(sql)
+			}
+
+			fp = append(fp, 'n')
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(sql) && sql[i+1] >= '0' && sql[i+1] <= '9':
+			for i++; i < len(sql) && (isWordByte(sql[i]) || sql[i] == '.'); i++ {
+			}
+
+			fp = append(fp, '1')
+		case strings.HasPrefix(sql[i:], "--") || c == '#':
+			return append(fp, 'c')
+		case strings.HasPrefix(sql[i:], "/*!"):
+			for i += 3; i < len(sql) && sql[i] >= '0' && sql[i] <= '9'; i++ {
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			n := strings.Index(sql[i+2:], "*/")
+
+			if n < 0 {
+				return append(fp, 'c')
+			}
+
+			i += n + 4
+		case strings.HasPrefix(sql[i:], "*/"):
+			i += 2
+		case c == '(' || c == ')' || c == ',' || c == ';':
+			fp, i = append(fp, c), i+1
+		case c == '@':
+			for i++; i < len(sql) && (isWordByte(sql[i]) || sql[i] == '@'); i++ {
+			}
+
+			fp = append(fp, 'v')
+		case isWordByte(c):
+			start := i
+
+			for ; i < len(sql) && (isWordByte(sql[i]) || sql[i] == '.'); i++ {
+			}
+
+			word := strings.ToLower(sql[start:i])
+			rest := strings.TrimLeft(sql[i:], " \t\n\r")
+
+			if t, ok := sqlKeywords[word]; ok {
+				fp = append(fp, t)
+			} else if sqlFunctions[word] && strings.HasPrefix(rest, "(") {
+				fp = append(fp, 'f')
+			} else if (word == "all" || word == "distinct") && len(fp) != 0 && fp[len(fp)-1] == 'U' {
+				// union all select is a union select
+				continue
+			} else {
+				fp = append(fp, 'n')
+			}
+		default:
+			start := i
+
+			for ; i < len(sql) && strings.IndexByte("=<>!|&^~+-*/%", sql[i]) >= 0; i++ {
+			}
+
+			if i == start {
+				i++
+			} else if op := sql[start:i]; op == "&&" || op == "||" {
+				fp = append(fp, '&')
+			} else {
+				fp = append(fp, 'o')
+			}
+		}
+	}
+
+	return fp
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$' || c >= 0x80
+}
+
+// xssTags are the elements that run or load code by themselves.
+var xssTags = map[string]bool{
+	"script": true, "iframe": true, "frame": true, "frameset": true, "object": true, "embed": true, "applet": true,
+	"base": true, "meta": true, "link": true, "style": true, "svg": true, "math": true,
+}
+
+// xssURLAttrs are the attributes whose URL a browser follows or loads.
+var xssURLAttrs = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true, "data": true, "xlink:href": true, "background": true, "lowsrc": true, "poster": true,
+}
+
+// isXSS tokenizes the value as HTML: it is a script URL, or has a tag of
+// an element running code, an event handler attribute or a script URL in a
+// link or source attribute.
+func isXSS(val string) bool {
+	html := strings.ToLower(val)
+
+	if scriptURL(html) {
+		return true
+	}
+
+	for rest := html; ; {
+		i := strings.IndexByte(rest, '<')
+
+		if i < 0 {
+			return false
+		}
+
+		rest = rest[i+1:]
+		n := 0
+
+		for ; n < len(rest) && (rest[n] >= 'a' && rest[n] <= 'z' || rest[n] >= '0' && rest[n] <= '9' || rest[n] == '-' || rest[n] == ':'); n++ {
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		if xssTags[rest[:n]] {
+			return true
+		}
+
+		tag := rest[n:]
+
+		if end := strings.IndexByte(tag, '>'); end >= 0 {
+			tag = tag[:end]
+		}
+
+		if xssAttrs(tag) {
+			return true
+		}
+	}
+}
+
+// xssAttrs tells whether the attributes of a tag have an event handler or
+// a script URL.
+func xssAttrs(tag string) bool {
+	const space = " \t\n\r\f"
+
+	for len(tag) != 0 {
+		tag = strings.TrimLeft(tag, space+"/\"'")
+		n := strings.IndexAny(tag, space+"/=")
+
+		if n < 0 {
+			n = len(tag)
+		}
+
+		name := tag[:n]
+		tag = strings.TrimLeft(tag[n:], space)
+
+		if !strings.HasPrefix(tag, "=") {
+			continue
+		}
+
+		if len(name) > 2 && strings.HasPrefix(name, "on") {
+			return true
+		}
+
+		tag = strings.TrimLeft(tag[1:], space)
+		var value string
+
+		if len(tag) != 0 && (tag[0] == '"' || tag[0] == '\'') {
+			value, tag, _ = strings.Cut(tag[1:], tag[:1])
+		} else if n = strings.IndexAny(tag, space); n >= 0 {
+			value, tag = tag[:n], tag[n:]
+		} else {
+			value, tag = tag, ""
+		}
+
+		if xssURLAttrs[name] && scriptURL(value) || name == "style" && strings.Contains(value, "expression(") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scriptURL tells whether a lowercase URL runs a script, ignoring the
+// whitespace and control characters browsers strip from schemes.
+func scriptURL(url string) bool {
+	url = strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+
+		return r
+	}, url)
+
+	return strings.HasPrefix(url, "javascript:") || strings.HasPrefix(url, "vbscript:") || strings.HasPrefix(url, "data:text/html")
+}
+
+// luhn checks the Luhn checksum of a string of digits.
+func luhn(digits string) bool {
+	sum := 0
+
+	for i := range len(digits) {
+		d := int(digits[len(digits)-1-i] - '0')
+
+		if d < 0 || d > 9 {
+			return false
+		}
+
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+
+		sum += d
+	}
+
+	return len(digits) != 0 && sum%10 == 0
+}
+
+var ActionNames = map[uint8]string{BLOCK: "block", PASS: "pass", SCORE: "score", REDIRECT: "redirect", RESPOND: "respond"}
+
+type Item struct {
+	Ctx   uint8
+	Key   string
+	Val   string
+	Depth int
+}
+
+type Input struct {
+	Req  *http.Request
+	Body []byte
+	Val  string
+
+	// Resp is the response body, known to the response rules only
+	Resp []byte
+
+	contexts map[string]string
+
+	// captures are the values of $1 to $9 in the group being matched
+	captures []string
+
+	// nested is set in the groups after the first, whose contexts decode
+	// the value of the item matched before rather than the request
+	nested bool
+}
+
+type Verdict struct {
+	Action   uint8
+	Status   int
+	Location string
+	Template *Template
+	Score    uint64
+	Endpoint int
+	Rule     int
+
+	// Experiment and Variant name the variant of the matching rule, when
+	// it belongs to an experiment
+	Experiment string
+	Variant    uint8
+
+	// Strip lists the headers outside the endpoint allowlist, removed
+	// from the request before it is forwarded
+	Strip []string
+
+	// Headers are set on the response, e.g. the CORS ones
+	Headers http.Header
+
+	// Events are the sequence events counted once the response status
+	// is known
+	Events []SequenceEvent
+}
+
+// SequenceEvent is an event of a sequence rule waiting for the response
+// status of its request.
+type SequenceEvent struct {
+	ID     string
+	Count  uint32
+	Window time.Duration
+	Status []uint16
+}
+
+type Guard struct {
+	Sentinels []Sentinel
+	tmpls     map[string]*Template
+	regexps   map[string]*regexp.Regexp
+	contexts  map[string]string
+	Tracker   *Tracker
+
+	// Responses tells the endpoints with response rules, Bodies those
+	// whose rules or policies read the request body
+	Responses []bool
+	Bodies    []bool
+
+	// Sampled tells whether a rule applied to sample requests in
+	// SAMPLE_SCALE applies to the request, and Variant which variant,
+	// from 1, of an experiment of n variants the request is given. Both
+	// draw at random if nil; the tools set fixed ones so that their
+	// verdicts do not change from run to run.
+	Sampled func(sample uint16) bool
+	Variant func(experiment string, n uint8) uint8
+}
+
+func (g *Guard) sampled(rule SentinelRule) bool {
+	switch {
+	case rule.Sample == 0:
+		return true
+	case g.Sampled != nil:
+		return g.Sampled(rule.Sample)
+	}
+
+	return rand.IntN(SAMPLE_SCALE) < int(rule.Sample)
+}
+
+func (g *Guard) variant(rule SentinelRule) uint8 {
+	if g.Variant != nil {
+		return g.Variant(rule.Experiment, rule.Variants)
+	}
+
+	return uint8(rand.IntN(int(rule.Variants))) + 1
+}
+
+// MAX_TRACKED_KEYS bounds the keys of the sequence rules a tracker holds.
+const MAX_TRACKED_KEYS = 1 << 16
+
+// Tracker is the state of the sequence rules: the times of the last events
+// of each key, at most the count of its sequence. It is kept across the
+// rule swaps of a store.
+type Tracker struct {
+	mu   sync.Mutex
+	keys map[string]*trackedKey
+}
+
+type trackedKey struct {
+	times  []time.Time
+	window time.Duration
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{keys: map[string]*trackedKey{}}
+}
+
+// Count returns the number of events of the key within the window.
+func (t *Tracker) Count(id string, window time.Duration, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+
+	if key := t.keys[id]; key != nil {
+		for _, at := range key.times {
+			if now.Sub(at) < window {
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// Add records an event of the key. When the tracker is full, the keys
+// without events within their window are dropped, then arbitrary ones.
+func (t *Tracker) Add(id string, count uint32, window time.Duration, now time.Time) {
+	// the keys hold one event at least, a sequence of none tracks nothing
+	if count == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := t.keys[id]
+
+	if key == nil {
+		if len(t.keys) >= MAX_TRACKED_KEYS {
+			for name, key := range t.keys {
+				if len(key.times) == 0 || now.Sub(key.times[len(key.times)-1]) >= key.window {
+					delete(t.keys, name)
+				}
+			}
+
+			for name := range t.keys {
+				if len(t.keys) < MAX_TRACKED_KEYS {
+					break
+				}
+
+				delete(t.keys, name)
+			}
+		}
+
+		key = &trackedKey{}
+		t.keys[id] = key
+	}
+
+	key.window = window
+	key.times = append(key.times, now)
+
+	if len(key.times) > int(count) {
+		key.times = key.times[len(key.times)-int(count):]
+	}
+}
+
+// NewGuard prepares the rules for matching, with the content type mapping
+// that came with them.
+func NewGuard(snts []Sentinel, tmpls []Template, types ContentTypes) (*Guard, error) {
+	g := &Guard{Sentinels: snts, tmpls: map[string]*Template{}, regexps: map[string]*regexp.Regexp{}, contexts: types, Tracker: NewTracker(), Responses: make([]bool, len(snts)), Bodies: make([]bool, len(snts))}
+
+	for i := range tmpls {
+		g.tmpls[tmpls[i].Name] = &tmpls[i]
+	}
+
+	for i, snt := range snts {
+		g.Responses[i] = slices.ContainsFunc(snt.Rules, responseRule)
+		g.Bodies[i] = readsBody(snt)
+
+		for _, val := range snt.Path {
+			if seg := ParseSegment(val); seg.Kind == SEG_REGEXP {
+				re, err := regexp.Compile("^(?:" + seg.Pattern + ")$")
+
+				if err != nil {
+					return nil, fmt.Errorf("path parameter %s: %v", val, err)
+				}
+
+				g.regexps[val] = re
+			}
+		}
+
+		for _, rule := range snt.AllRules() {
+			for _, stmts := range rule.Groups {
+				for _, stmt := range stmts {
+					if len(stmt.Regexp) == 0 || g.regexps[RegexpSource(stmt)] != nil {
+						continue
+					}
+
+					re, err := regexp.Compile(RegexpSource(stmt))
+
+					if err != nil {
+						return nil, fmt.Errorf("regexp %s: %v", stmt.Regexp, err)
+					}
+
+					g.regexps[RegexpSource(stmt)] = re
+				}
+			}
+		}
+	}
+
+	return g, nil
+}
+
+func cronFieldMatch(field string, v int) bool {
+	for _, item := range strings.Split(field, ",") {
+		rng, step, _ := strings.Cut(item, "/")
+		lo, hi, a, b, n := "", "", 0, 1<<30, 1
+
+		if len(step) != 0 {
+			n, _ = strconv.Atoi(step)
+		}
+
+		if rng != "*" {
+			lo, hi, _ = strings.Cut(rng, "-")
+
+			if len(hi) == 0 {
+				hi = lo
+			}
+
+			a, _ = strconv.Atoi(lo)
+			b, _ = strconv.Atoi(hi)
+		}
+
+		if v >= a && v <= b && (v-a)%n == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func cronMatch(expr string, t time.Time) bool {
+	fields := strings.Fields(expr)
+	values := []int{t.Minute(), t.Hour(), t.Day(), int(t.Month()), int(t.Weekday())}
+
+	for i, field := range fields {
+		if cronFieldMatch(field, values[i]) {
+			continue
+		}
+
+		if i == 4 && values[i] == 0 && cronFieldMatch(field, 7) {
+			continue
+		}
+
+		return false
+	}
+
+	return true
+}
+
+func (win Window) Contains(t time.Time) bool {
+	now := uint64(t.Unix())
+
+	if win.From != 0 && now < win.From {
+		return false
+	}
+
+	if win.To != 0 && now > win.To {
+		return false
+	}
+
+	return len(win.Cron) == 0 || cronMatch(win.Cron, t)
+}
+
+func (g *Guard) matchPath(pattern []string, path string, fold bool) (int, bool) {
+	var segs []string
+
+	for _, val := range strings.Split(path, "/") {
+		if len(val) != 0 {
+			segs = append(segs, val)
+		}
+	}
+
+	if len(pattern) > len(segs) {
+		return 0, false
+	}
+
+	for i, val := range pattern {
+		switch ParseSegment(val).Kind {
+		case SEG_LITERAL:
+			if val != segs[i] && !(fold && strings.EqualFold(val, segs[i])) {
+				return 0, false
+			}
+		case SEG_REGEXP:
+			if !g.regexps[val].MatchString(segs[i]) {
+				return 0, false
+			}
+		}
+	}
+
+	return len(pattern), true
+}
+
+// sameOrigin tells whether the origin is the one of the request itself,
+// which browsers send on same-origin requests too.
+func sameOrigin(r *http.Request, origin string) bool {
+	scheme := "http"
+
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return strings.EqualFold(origin, scheme+"://"+r.Host)
+}
+
+func (g *Guard) Find(r *http.Request) int {
+	found, best := -1, -1
+
+	for i, snt := range g.Sentinels {
+		fold := snt.Flags&FLAG_CASE_INSENSITIVE != 0
+
+		if len(snt.Method) != 0 && snt.Method != "*" && snt.Method != r.Method && !(fold && strings.EqualFold(snt.Method, r.Method)) {
+			continue
+		}
+
+		if n, ok := g.matchPath(snt.Path, r.URL.Path, fold); ok && n > best {
+			found, best = i, n
+		}
+	}
+
+	return found
+}
+
+func jsonStr(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	data, _ := json.Marshal(v)
+
+	return string(data)
+}
+
+func flattenJSON(v any, depth int, out []Item) []Item {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, val := range v {
+			out = append(out, Item{JSON_OBJ, key, jsonStr(val), depth})
+			out = flattenJSON(val, depth+1, out)
+		}
+	case []any:
+		for i, val := range v {
+			out = append(out, Item{JSON_ARRAY, strconv.Itoa(i), jsonStr(val), depth})
+			out = flattenJSON(val, depth+1, out)
+		}
+	}
+
+	return out
+}
+
+func decodeJWT(token string) []Item {
+	var result []Item
+
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil
+	}
+
+	for i, key := range []string{"header", "payload"} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+
+		if err != nil || !json.Valid(data) {
+			return nil
+		}
+
+		result = append(result, Item{JWT, key, string(data), 0})
+	}
+
+	return result
+}
+
+// request tells whether the contexts decode the request, else Val.
+func (in Input) request() bool {
+	return in.Req != nil && !in.nested
+}
+
+func (in Input) data() string {
+	if in.request() {
+		return string(in.Body)
+	}
+
+	return in.Val
+}
+
+// bodyContext looks up the context mapped to the request content type, it
+// reports false when the body decoder has to be guessed.
+func (in Input) bodyContext() (uint8, bool) {
+	if !in.request() {
+		return 0, false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(in.Req.Header.Get("Content-Type"))
+
+	if err != nil {
+		return 0, false
+	}
+
+	ctx, ok := in.contexts[mediaType]
+
+	if !ok {
+		major, _, _ := strings.Cut(mediaType, "/")
+
+		if ctx, ok = in.contexts[major+"/*"]; !ok {
+			return 0, false
+		}
+	}
+
+	code, err := ContextCode(ctx)
+
+	return code, err == nil
+}
+
+// requestVars are the variables of the request as a whole rather than of
+// its items.
+var requestVars = map[uint8]bool{CHARSET: true, FILE_EXT: true, PATH_VAR: true, FINGERPRINT: true, TLS_VERSION: true, SNI: true, CLIENT_CERT_CN: true, PROTO: true, PSEUDO: true}
+
+// TLSVersions are the values of $tls_version, empty without TLS.
+var TLSVersions = map[uint16]string{tls.VersionTLS10: "1.0", tls.VersionTLS11: "1.1", tls.VersionTLS12: "1.2", tls.VersionTLS13: "1.3"}
+
+func (in Input) requestVar(v uint8, name string) string {
+	switch v {
+	case CHARSET:
+		return in.charset()
+	case FILE_EXT:
+		return in.fileExt()
+	case PATH_VAR:
+		if in.Req != nil {
+			return in.Req.URL.Path
+		}
+	case FINGERPRINT:
+		return in.fingerprint()
+	case PROTO, PSEUDO:
+		return in.proto(v, name)
+	}
+
+	if in.Req == nil || in.Req.TLS == nil {
+		return ""
+	}
+
+	switch v {
+	case TLS_VERSION:
+		return TLSVersions[in.Req.TLS.Version]
+	case SNI:
+		return strings.ToLower(in.Req.TLS.ServerName)
+	case CLIENT_CERT_CN:
+		// only a certificate the server verified has a trusted name
+		if len(in.Req.TLS.VerifiedChains) != 0 {
+			return in.Req.TLS.VerifiedChains[0][0].Subject.CommonName
+		}
+	}
+
+	return ""
+}
+
+// RequestWide tells the conditions tested once on the whole request rather
+// than on each item: those of request variables and the cross-value
+// comparisons of request values.
+func RequestWide(stmt Stmt) bool {
+	if stmt.Ref.Var != 0 {
+		return !ItemVar(stmt.Var) && !ItemVar(stmt.Ref.Var)
+	}
+
+	return requestVars[stmt.Var]
+}
+
+func ItemVar(v uint8) bool {
+	return v == KEY || v == VAL || v == CAPTURE
+}
+
+// values returns the values of a variable for a cross-value comparison:
+// the key or value of the item, else the values of the request, with the
+// Host header that net/http keeps apart.
+func (in Input) values(v uint8, name string, item Item) []string {
+	var result []string
+
+	switch v {
+	case KEY:
+		return []string{item.Key}
+	case VAL:
+		return []string{item.Val}
+	case CAPTURE:
+		if n, _ := strconv.Atoi(name); n < len(in.captures) {
+			return []string{in.captures[n]}
+		}
+
+		return nil
+	}
+
+	if in.Req == nil {
+		return nil
+	}
+
+	switch v {
+	case CHARSET, FILE_EXT, PATH_VAR, FINGERPRINT, TLS_VERSION, SNI, CLIENT_CERT_CN, PROTO, PSEUDO:
+		return []string{in.requestVar(v, name)}
+	case SCHEME:
+		in.nested = false
+
+		for _, item := range in.Items(AUTH_HEADER) {
+			result = append(result, item.Key)
+		}
+	case COOKIE_VAL:
+		for _, c := range in.Req.Cookies() {
+			if c.Name == name {
+				result = append(result, c.Value)
+			}
+		}
+	case HEADER_VAL:
+		if strings.EqualFold(name, "Host") {
+			return []string{in.Req.Host}
+		}
+
+		result = in.Req.Header.Values(name)
+	}
+
+	return result
+}
+
+// proto returns $proto, the HTTP version of the request, or a pseudo-header
+// of an HTTP/2 or HTTP/3 request, empty for the older versions.
+func (in Input) proto(v uint8, name string) string {
+	if in.Req == nil {
+		return ""
+	}
+
+	if v == PROTO {
+		if in.Req.ProtoMajor >= 2 {
+			return strconv.Itoa(in.Req.ProtoMajor)
+		}
+
+		return fmt.Sprintf("%d.%d", in.Req.ProtoMajor, in.Req.ProtoMinor)
+	}
+
+	if in.Req.ProtoMajor < 2 {
+		return ""
+	}
+
+	switch name {
+	case ":method":
+		return in.Req.Method
+	case ":scheme":
+		if in.Req.TLS != nil {
+			return "https"
+		}
+
+		return "http"
+	case ":authority":
+		return in.Req.Host
+	case ":path":
+		if len(in.Req.RequestURI) != 0 {
+			return in.Req.RequestURI
+		}
+
+		return in.Req.URL.RequestURI()
+	}
+
+	return ""
+}
+
+// fingerprint returns the $fingerprint of the request: the first 8 bytes
+// in hex of the SHA-256 of its lowercase header names, Host and the
+// pseudo-headers excluded, each once and joined with commas. Runtimes take
+// the names in their order on the wire; net/http does not keep it, so the
+// engine takes them sorted.
+func (in Input) fingerprint() string {
+	var names []string
+
+	if in.Req == nil {
+		return ""
+	}
+
+	for name := range in.Req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+
+	slices.Sort(names)
+	sum := sha256.Sum256([]byte(strings.Join(names, ",")))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// isBot applies the bot policy: an allowed fingerprint passes and a denied
+// one is a bot, as are the requests missing a browser header or sent by an
+// automated client.
+func (in Input) isBot(bots BotChecks) bool {
+	fp := in.fingerprint()
+
+	if slices.Contains(bots.Allow, fp) {
+		return false
+	}
+
+	if slices.Contains(bots.Deny, fp) {
+		return true
+	}
+
+	agent := strings.ToLower(in.Req.UserAgent())
+
+	if bots.Flags&BOT_BROWSER_HEADERS != 0 {
+		if !strings.HasPrefix(agent, "mozilla/") {
+			return true
+		}
+
+		for _, name := range bots.Headers {
+			if len(in.Req.Header.Values(name)) == 0 {
+				return true
+			}
+		}
+	}
+
+	if bots.Flags&BOT_AUTOMATION != 0 {
+		if len(agent) == 0 {
+			return true
+		}
+
+		for _, val := range bots.Agents {
+			if strings.Contains(agent, val) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// sequenceKey returns the key of a sequence in the request: the client
+// address, or the first value of the request value.
+func (in Input) sequenceKey(key Ref) (string, bool) {
+	if key.Var == 0 {
+		host, _, err := net.SplitHostPort(in.Req.RemoteAddr)
+
+		if err != nil {
+			host = in.Req.RemoteAddr
+		}
+
+		return host, len(host) != 0
+	}
+
+	if vals := in.values(key.Var, key.Arg, Item{}); len(vals) != 0 && len(vals[0]) != 0 {
+		return vals[0], true
+	}
+
+	return "", false
+}
+
+// fileExt returns the extension of the last segment of the request path,
+// lowercased and without the dot, or an empty string.
+func (in Input) fileExt() string {
+	if in.Req == nil {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimPrefix(path.Ext(in.Req.URL.Path), "."))
+}
+
+// charset tells the encoding of the request body: the one of its byte
+// order mark, else the declared one, else utf-16 for bodies starting with
+// a NUL byte in either position and utf-8 otherwise. A body declared as
+// utf-8 or us-ascii which is not valid in it is reported as binary.
+func (in Input) charset() string {
+	if in.Req == nil {
+		return ""
+	}
+
+	body := in.Body
+
+	switch {
+	case bytes.HasPrefix(body, []byte{0xef, 0xbb, 0xbf}):
+		return "utf-8"
+	case bytes.HasPrefix(body, []byte{0xfe, 0xff}):
+		return "utf-16be"
+	case bytes.HasPrefix(body, []byte{0xff, 0xfe}):
+		return "utf-16le"
+	}
+
+	_, params, _ := mime.ParseMediaType(in.Req.Header.Get("Content-Type"))
+	charset := strings.ToLower(params["charset"])
+
+	switch {
+	case len(charset) != 0:
+	case len(body) >= 2 && body[0] == 0:
+		return "utf-16be"
+	case len(body) >= 2 && body[1] == 0:
+		return "utf-16le"
+	default:
+		charset = "utf-8"
+	}
+
+	if charset == "utf-8" && !utf8.Valid(body) || charset == "us-ascii" && slices.ContainsFunc(body, func(b byte) bool { return b > unicode.MaxASCII }) {
+		return "binary"
+	}
+
+	return charset
+}
+
+// hasControlChars reports NUL and C0 control characters in the keys and
+// values of the parameters: query and form, json, cookies and path
+// segments, except for the allowed keys.
+func (in Input) hasControlChars(allow []string) bool {
+	control := func(val string) bool {
+		return strings.ContainsFunc(val, func(r rune) bool { return r < 0x20 })
+	}
+
+	for _, ctx := range []uint8{URLENC, JSON, PATH} {
+		for _, item := range in.Items(ctx) {
+			if (control(item.Key) || control(item.Val)) && !slices.Contains(allow, item.Key) {
+				return true
+			}
+		}
+	}
+
+	if in.Req == nil {
+		return false
+	}
+
+	// the cookie parser drops the cookies with control characters, which
+	// still reach the application, so the header is read as is
+	for _, line := range in.Req.Header.Values("Cookie") {
+		for _, part := range strings.Split(line, ";") {
+			key, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+
+			if (control(key) || control(val)) && !slices.Contains(allow, key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchSchema tells whether the request body is JSON satisfying the
+// schema; requests without a body are not checked.
+func (in Input) matchSchema(node SchemaNode) bool {
+	var v any
+
+	if len(bytes.TrimSpace(in.Body)) == 0 {
+		return true
+	}
+
+	if json.Unmarshal(in.Body, &v) != nil {
+		return false
+	}
+
+	return node.Match(v)
+}
+
+func (in Input) Items(ctx uint8) []Item {
+	var result []Item
+
+	switch ctx {
+	case HEADERS:
+		if in.Req == nil {
+			return nil
+		}
+
+		result = append(result, Item{HEADERS, "Host", in.Req.Host, 0})
+
+		for key, vals := range in.Req.Header {
+			for _, val := range vals {
+				result = append(result, Item{HEADERS, key, val, 0})
+			}
+		}
+	case TRAILERS:
+		// net/http fills the trailers once the body was read to its
+		// end, the announced ones are empty until then
+		if in.Req == nil {
+			return nil
+		}
+
+		for key, vals := range in.Req.Trailer {
+			for _, val := range vals {
+				result = append(result, Item{TRAILERS, key, val, 0})
+			}
+		}
+	case RESPONSE_BODY:
+		var v any
+
+		if in.Resp == nil {
+			return nil
+		}
+
+		// the whole body, and its values when it is a JSON document
+		result = append(result, Item{RESPONSE_BODY, "body", string(in.Resp), 0})
+
+		if json.Unmarshal(in.Resp, &v) == nil {
+			for _, item := range flattenJSON(v, 0, nil) {
+				item.Ctx = RESPONSE_BODY
+				result = append(result, item)
+			}
+		}
+	case COOKIE:
+		var cookies []*http.Cookie
+
+		if in.request() {
+			cookies = in.Req.Cookies()
+		} else {
+			cookies, _ = http.ParseCookie(in.Val)
+		}
+
+		for _, c := range cookies {
+			result = append(result, Item{COOKIE, c.Name, c.Value, 0})
+		}
+	case URLENC:
+		var vals url.Values
+
+		if in.request() {
+			vals = in.Req.URL.Query()
+
+			body, mapped := in.bodyContext()
+
+			if body == URLENC || !mapped && strings.HasPrefix(in.Req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+				form, _ := url.ParseQuery(string(in.Body))
+
+				for key, val := range form {
+					vals[key] = append(vals[key], val...)
+				}
+			}
+		} else {
+			vals, _ = url.ParseQuery(in.Val)
+		}
+
+		for key, list := range vals {
+			for _, val := range list {
+				result = append(result, Item{URLENC, key, val, 0})
+			}
+		}
+	case PATH:
+		path := in.Val
+
+		if in.request() {
+			path = in.Req.URL.Path
+		}
+
+		for _, val := range strings.Split(path, "/") {
+			if len(val) != 0 {
+				result = append(result, Item{PATH, strconv.Itoa(len(result)), val, 0})
+			}
+		}
+	case HTTP:
+		if in.Req == nil {
+			return nil
+		}
+
+		var headers strings.Builder
+
+		_ = in.Req.Header.Write(&headers)
+
+		scheme := "http"
+
+		if in.Req.TLS != nil {
+			scheme = "https"
+		}
+
+		result = append(result,
+			Item{HTTP, "method", in.Req.Method, 0},
+			Item{HTTP, "scheme", scheme, 0},
+			Item{HTTP, "uri", in.Req.RequestURI, 0},
+			Item{HTTP, "path", in.Req.URL.Path, 0},
+			Item{HTTP, "query", in.Req.URL.RawQuery, 0},
+			Item{HTTP, "headers", headers.String(), 0},
+			Item{HTTP, "body", string(in.Body), 0})
+	case JSON, JSON_OBJ, JSON_ARRAY:
+		var v any
+
+		if body, mapped := in.bodyContext(); mapped && body != JSON && body != JSON_OBJ && body != JSON_ARRAY {
+			return nil
+		}
+
+		if json.Unmarshal([]byte(in.data()), &v) != nil {
+			return nil
+		}
+
+		for _, item := range flattenJSON(v, 0, nil) {
+			if ctx == JSON || item.Ctx == ctx {
+				result = append(result, item)
+			}
+		}
+	case BASE64, BASE64_URL:
+		encs := []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding}
+		data := strings.TrimSpace(in.data())
+
+		if body, mapped := in.bodyContext(); mapped && body != ctx || len(data) == 0 {
+			return nil
+		}
+
+		if ctx == BASE64_URL {
+			encs = []*base64.Encoding{base64.URLEncoding, base64.RawURLEncoding}
+		}
+
+		// the decoded data is a single value, padded or not
+		for _, enc := range encs {
+			if val, err := enc.DecodeString(data); err == nil {
+				return []Item{{ctx, "0", string(val), 0}}
+			}
+		}
+	case AUTH_HEADER:
+		header := in.Val
+
+		if in.request() {
+			header = in.Req.Header.Get("Authorization")
+		}
+
+		if scheme, cred, _ := strings.Cut(strings.TrimSpace(header), " "); len(scheme) != 0 {
+			result = append(result, Item{AUTH_HEADER, scheme, strings.TrimSpace(cred), 0})
+		}
+	case JWT:
+		token := in.Val
+
+		if in.request() {
+			scheme, cred, _ := strings.Cut(in.Req.Header.Get("Authorization"), " ")
+
+			if !strings.EqualFold(scheme, "Bearer") {
+				return nil
+			}
+
+			token = cred
+		}
+
+		result = decodeJWT(strings.TrimSpace(token))
+	}
+
+	return result
+}
+
+// operandValue applies the transforms and normalization of a statement.
+func operandValue(stmt Stmt, val string) string {
+	for _, tf := range stmt.Transforms {
+		val = transform(tf, val)
+	}
+
+	if stmt.Mods&MOD_NFKC != 0 {
+		val = norm.NFKC.String(val)
+	}
+
+	return val
+}
+
+// capture keeps the groups of a capturing statement that matched in the
+// slots from its own on.
+func (g *Guard) capture(stmt Stmt, val string, captures []string) {
+	groups := g.regexps[RegexpSource(stmt)].FindStringSubmatch(operandValue(stmt, val))
+
+	for i := 1; i < len(groups) && int(stmt.Slot)+i-1 < len(captures); i++ {
+		captures[int(stmt.Slot)+i-1] = groups[i]
+	}
+}
+
+func (g *Guard) test(stmt Stmt, val string, fold bool) bool {
+	var ok bool
+
+	val = operandValue(stmt, val)
+
+	switch stmt.Op {
+	case ENTROPY:
+		return entropy(val)*100 > float64(stmt.Num)
+	case IS_SQLI:
+		return isSQLi(val)
+	case IS_XSS:
+		return isXSS(val)
+	}
+
+	if len(stmt.Regexp) != 0 && stmt.Mods&MOD_LUHN != 0 {
+		ok = slices.ContainsFunc(g.regexps[RegexpSource(stmt)].FindAllString(val, -1), func(m string) bool {
+			return luhn(strings.NewReplacer(" ", "", "-", "").Replace(m))
+		})
+	} else if len(stmt.Regexp) != 0 {
+		ok = g.regexps[RegexpSource(stmt)].MatchString(val)
+	} else if stmt.Detector != 0 {
+		ok = detect(stmt.Detector, val)
+	} else if len(stmt.Bytes) != 0 {
+		ok = string(stmt.Bytes) == val
+	} else if fold {
+		ok = strings.EqualFold(stmt.Val, val)
+	} else {
+		ok = stmt.Val == val
+	}
+
+	switch stmt.Op {
+	case EQ:
+		return ok
+	case NEQ:
+		return !ok
+	}
+
+	return false
+}
+
+// testCross compares the values of the two sides of a cross-value
+// comparison, each after its transforms: equal when both are present and
+// one value of each is the same, in constant time since they are often
+// tokens. Not equal is the opposite, so a missing value is never equal.
+func (g *Guard) testCross(stmt Stmt, in Input, item Item) bool {
+	var refs []string
+
+	ok := false
+
+	// the values may be the header map's own slice, not changed in place
+	for _, ref := range in.values(stmt.Ref.Var, stmt.Ref.Arg, item) {
+		for _, tf := range stmt.Ref.Transforms {
+			ref = transform(tf, ref)
+		}
+
+		refs = append(refs, ref)
+	}
+
+	for _, val := range in.values(stmt.Var, stmt.Arg, item) {
+		for _, tf := range stmt.Transforms {
+			val = transform(tf, val)
+		}
+
+		for _, ref := range refs {
+			ok = ok || hmac.Equal([]byte(val), []byte(ref))
+		}
+	}
+
+	return ok == (stmt.Op == EQ_VAR)
+}
+
+// doubleEncoded reports values, decoded once already, that still decode
+// to something else: percent-encoding applied twice to slip past rules.
+func doubleEncoded(val string) bool {
+	decoded, err := url.PathUnescape(val)
+
+	return err == nil && decoded != val
+}
+
+// traversalEscapes are the encodings of dots and slashes that percent
+// decoding leaves: IIS %u escapes and overlong UTF-8 sequences, which
+// lenient servers still decode.
+var traversalEscapes = regexp.MustCompile(`(?i)%u(002e|002f|2215|005c)`)
+
+var traversalChars = map[string]string{"%u002e": ".", "%u002f": "/", "%u2215": "/", "%u005c": "\\"}
+
+var overlongChars = strings.NewReplacer("\xc0\xae", ".", "\xe0\x80\xae", ".", "\xc0\xaf", "/", "\xe0\x80\xaf", "/", "\xc1\x9c", "\\")
+
+// pathTraversal canonicalizes a value as servers may, decoding it until
+// it no longer changes, replacing backslashes and dropping path
+// parameters, and reports a .. segment.
+func pathTraversal(val string) bool {
+	for range 4 {
+		decoded := traversalEscapes.ReplaceAllStringFunc(val, func(m string) string {
+			return traversalChars[strings.ToLower(m)]
+		})
+
+		if d, err := url.PathUnescape(decoded); err == nil {
+			decoded = d
+		}
+
+		decoded = overlongChars.Replace(decoded)
+
+		if decoded == val {
+			break
+		}
+
+		val = decoded
+	}
+
+	for _, seg := range strings.Split(strings.ReplaceAll(val, "\\", "/"), "/") {
+		if seg, _, _ = strings.Cut(seg, ";"); seg == ".." {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *Guard) matchItem(stmts []Stmt, item Item, in Input) bool {
+	for _, stmt := range stmts {
+		var ok bool
+
+		if stmt.Ref.Var != 0 {
+			if !g.testCross(stmt, in, item) {
+				return false
+			}
+
+			continue
+		}
+
+		switch stmt.Var {
+		case CTX:
+			n, _ := ContextMask(stmt.Val)
+			in := n&(1<<item.Ctx) != 0 || n&(1<<JSON) != 0 && (item.Ctx == JSON_OBJ || item.Ctx == JSON_ARRAY)
+			ok = in == (stmt.Op == EQ)
+		case KEY:
+			ok = g.test(stmt, item.Key, item.Ctx == HEADERS || item.Ctx == TRAILERS)
+		case VAL:
+			ok = g.test(stmt, item.Val, false)
+		case COOKIE_VAL:
+			ok = item.Ctx == COOKIE && item.Key == stmt.Arg && g.test(stmt, item.Val, false)
+		case HEADER_VAL:
+			ok = item.Ctx == HEADERS && strings.EqualFold(item.Key, stmt.Arg) && g.test(stmt, item.Val, false)
+		case SCHEME:
+			ok = item.Ctx == AUTH_HEADER && g.test(stmt, item.Key, true)
+		case DOUBLE_ENCODED:
+			ok = g.test(stmt, strconv.FormatBool(doubleEncoded(item.Val)), false)
+		case PATH_TRAVERSAL:
+			ok = g.test(stmt, strconv.FormatBool(pathTraversal(item.Val)), false)
+		case DEPTH:
+			ok = g.test(stmt, strconv.Itoa(item.Depth), false)
+		default:
+			ok = true
+		}
+
+		if !ok {
+			return false
+		}
+
+		if stmt.Mods&MOD_CAPTURE != 0 {
+			val := item.Val
+
+			if stmt.Var == KEY || stmt.Var == SCHEME {
+				val = item.Key
+			}
+
+			g.capture(stmt, val, in.captures)
+		}
+	}
+
+	return true
+}
+
+// matchGroup returns the items matching a group, with the captures made
+// up to each of them.
+func (g *Guard) matchGroup(stmts []Stmt, in Input) ([]Item, [][]string) {
+	var result []Item
+	var captures [][]string
+	var except []Stmt
+
+	stmts, except = splitExcept(stmts)
+
+	// request-wide conditions are tested once, a group of only those
+	// yields the request itself
+	request, seen := Item{}, false
+
+	in.captures = slices.Clone(in.captures)
+
+	if in.captures == nil && slices.ContainsFunc(stmts, func(stmt Stmt) bool { return stmt.Mods&MOD_CAPTURE != 0 }) {
+		in.captures = make([]string, MAX_CAPTURES+1)
+	}
+
+	for _, stmt := range stmts {
+		if !RequestWide(stmt) {
+			continue
+		}
+
+		if stmt.Ref.Var != 0 {
+			if !g.testCross(stmt, in, Item{}) {
+				return nil, nil
+			}
+
+			continue
+		}
+
+		val := in.requestVar(stmt.Var, stmt.Arg)
+
+		if !g.test(stmt, val, true) {
+			return nil, nil
+		}
+
+		if stmt.Mods&MOD_CAPTURE != 0 {
+			g.capture(stmt, val, in.captures)
+		}
+
+		if !seen {
+			request.Val, seen = val, true
+		}
+	}
+
+	stmts = slices.DeleteFunc(stmts, RequestWide)
+
+	if len(stmts) == 0 {
+		return []Item{request}, [][]string{in.captures}
+	}
+
+	// $header, $cookie and $scheme read the request in every group: a
+	// group of only those matches its items, next to conditions on the
+	// value of the item before they are tested on the request apart
+	src := in
+
+	if in.nested && !slices.ContainsFunc(stmts, func(stmt Stmt) bool { return !readsRequest(stmt) }) {
+		src.nested = false
+	} else if in.nested {
+		for _, stmt := range stmts {
+			if readsRequest(stmt) && !g.matchRequest(stmt, in) {
+				return nil, nil
+			}
+		}
+
+		stmts = slices.DeleteFunc(stmts, readsRequest)
+	}
+
+	mask := groupMask(stmts)
+
+	// the contexts of the conditions are covered by the mask
+	stmts = slices.DeleteFunc(stmts, func(stmt Stmt) bool { return stmt.Var == CTX })
+
+	for ctx := uint8(1); ctx < 64; ctx++ {
+		if mask&(1<<ctx) == 0 {
+			continue
+		}
+
+		for _, item := range src.Items(ctx) {
+			// the captures of the item add to those of the request
+			local := in
+			local.captures = slices.Clone(in.captures)
+
+			if g.matchItem(stmts, item, local) && (len(except) == 0 || !g.matchItem(except, item, local)) {
+				result = append(result, item)
+				captures = append(captures, local.captures)
+			}
+		}
+	}
+
+	return result, captures
+}
+
+// readsRequest tells the item conditions on the request whichever group
+// they are in: $header, $cookie and $scheme.
+func readsRequest(stmt Stmt) bool {
+	return stmt.Ref.Var == 0 && (stmt.Var == HEADER_VAL || stmt.Var == COOKIE_VAL || stmt.Var == SCHEME)
+}
+
+// matchRequest tells whether an item of the request matches a condition
+// that reads the request in a group after the first, adding its captures
+// to those of the group.
+func (g *Guard) matchRequest(stmt Stmt, in Input) bool {
+	in.nested = false
+	mask := groupMask([]Stmt{stmt})
+
+	for ctx := uint8(1); ctx < 64; ctx++ {
+		if mask&(1<<ctx) == 0 {
+			continue
+		}
+
+		for _, item := range in.Items(ctx) {
+			if g.matchItem([]Stmt{stmt}, item, in) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// groupMask returns the contexts whose items the item conditions of a
+// group are matched on.
+func groupMask(stmts []Stmt) uint64 {
+	var mask uint64 = ^uint64(0)
+
+	for _, stmt := range stmts {
+		// the items of a cross-value comparison are those of the other
+		// conditions, its request value is not one of them
+		if stmt.Ref.Var != 0 {
+			continue
+		}
+
+		if stmt.Var == COOKIE_VAL {
+			mask &= 1 << COOKIE
+		}
+
+		if stmt.Var == HEADER_VAL {
+			mask &= 1 << HEADERS
+		}
+
+		if stmt.Var == SCHEME {
+			mask &= 1 << AUTH_HEADER
+		}
+
+		if stmt.Var != CTX {
+			continue
+		}
+
+		n, _ := ContextMask(stmt.Val)
+
+		if stmt.Op == EQ {
+			mask &= n
+		} else {
+			mask &^= n
+		}
+	}
+
+	return mask
+}
+
+// bodyContexts are the contexts whose items come from the request body,
+// trailers included as they are only known once it was read.
+const bodyContexts = 1<<URLENC | 1<<HTTP | 1<<JSON | 1<<JSON_OBJ | 1<<JSON_ARRAY | 1<<BASE64 | 1<<BASE64_URL | 1<<TRAILERS
+
+// readsBody tells whether the policies or the rules of a sentinel read the
+// request body.
+func readsBody(snt Sentinel) bool {
+	if len(snt.Charsets) != 0 || snt.Flags&FLAG_FORBID_CONTROL != 0 || snt.Schema != nil {
+		return true
+	}
+
+	for _, seq := range snt.Sequences {
+		if seq.Key.Var == CHARSET {
+			return true
+		}
+	}
+
+	for _, rule := range snt.AllRules() {
+		for _, stmts := range rule.Groups {
+			if slices.ContainsFunc(stmts, func(stmt Stmt) bool { return stmt.Var == CHARSET || stmt.Ref.Var == CHARSET }) {
+				return true
+			}
+
+			items := slices.ContainsFunc(stmts, func(stmt Stmt) bool { return stmt.Var != 0 && !RequestWide(stmt) })
+
+			if items && groupMask(stmts)&bodyContexts != 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// splitExcept separates the exclusion statements of a group.
+func splitExcept(stmts []Stmt) ([]Stmt, []Stmt) {
+	var conds, except []Stmt
+
+	for _, stmt := range stmts {
+		if stmt.Mods&MOD_EXCEPT != 0 {
+			except = append(except, stmt)
+		} else {
+			conds = append(conds, stmt)
+		}
+	}
+
+	return conds, except
+}
+
+func (g *Guard) matchGroups(groups [][]Stmt, in Input) bool {
+	var conds []Stmt
+
+	if len(groups) == 0 {
+		return true
+	}
+
+	for _, stmt := range groups[0] {
+		if stmt.Var != 0 {
+			conds = append(conds, stmt)
+		}
+	}
+
+	if len(conds) == 0 {
+		return g.matchGroups(groups[1:], in)
+	}
+
+	items, captures := g.matchGroup(conds, in)
+
+	// the later groups decode the item, the request and its variables
+	// stay known to them
+	for i, item := range items {
+		next := in
+		next.Val, next.captures, next.nested = item.Val, captures[i], true
+
+		if g.matchGroups(groups[1:], next) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func Action(groups [][]Stmt) (Stmt, bool) {
+	for i := len(groups) - 1; i >= 0; i-- {
+		for j := len(groups[i]) - 1; j >= 0; j-- {
+			if groups[i][j].Var == 0 {
+				return groups[i][j], true
+			}
+		}
+	}
+
+	return Stmt{}, false
+}
+
+func (g *Guard) Check(r *http.Request, body []byte) Verdict {
+	return g.Evaluate(r, body, time.Now()).Verdict
+}
+
+// Evaluation is the verdict on a request with the indices of the rules of
+// the endpoint that matched it, in order; all of them are score rules but
+// the last one, unless the threshold was reached.
+type Evaluation struct {
+	Verdict
+	Matched []int
+
+	// the sample draws of the rules and the variants of the experiments
+	// given to the request, which its response rules reuse
+	draws    map[int]bool
+	variants map[string]uint8
+}
+
+// applies tells whether the i-th rule of the endpoint applies to the
+// request: whether the request is in its sample and given its variant.
+// Each is drawn once per request, the response rules see the same ones.
+func (g *Guard) applies(eval *Evaluation, i int, rule SentinelRule) bool {
+	if eval.draws == nil {
+		eval.draws, eval.variants = map[int]bool{}, map[string]uint8{}
+	}
+
+	sampled, ok := eval.draws[i]
+
+	if !ok {
+		sampled = g.sampled(rule)
+		eval.draws[i] = sampled
+	}
+
+	if !sampled || len(rule.Experiment) == 0 {
+		return sampled
+	}
+
+	if _, ok := eval.variants[rule.Experiment]; !ok {
+		eval.variants[rule.Experiment] = g.variant(rule)
+	}
+
+	return eval.variants[rule.Experiment] == rule.Variant
+}
+
+// Evaluate runs the rules as the WAF does at the given time: the endpoint
+// lookup, its window and request-wide policies, the sequences, then the
+// rules in order until an action other than score is taken or the score
+// reaches the threshold. It is the reference for the runtime semantics;
+// the sequence events it counts stay in the guard.
+func (g *Guard) Evaluate(r *http.Request, body []byte, now time.Time) Evaluation {
+	eval := Evaluation{Verdict: Verdict{Action: PASS, Endpoint: g.Find(r), Rule: -1}}
+	verdict := &eval.Verdict
+
+	// a preflight request is answered by the endpoint of the method it
+	// asks for, when that endpoint has a CORS policy
+	if method := r.Header.Get("Access-Control-Request-Method"); r.Method == http.MethodOptions && len(method) != 0 && len(r.Header.Get("Origin")) != 0 {
+		lookup := r.WithContext(r.Context())
+		lookup.Method = method
+
+		if i := g.Find(lookup); i >= 0 && g.Sentinels[i].CORS.Flags != 0 && g.Sentinels[i].Window.Contains(now) {
+			verdict.Endpoint = i
+			g.Sentinels[i].CORS.preflight(r, verdict)
+			return eval
+		}
+	}
+
+	if verdict.Endpoint < 0 {
+		return eval
+	}
+
+	snt := g.Sentinels[verdict.Endpoint]
+	in := Input{Req: r, Body: body, contexts: g.contexts}
+
+	if !snt.Window.Contains(now) {
+		return eval
+	}
+
+	if origin := r.Header.Get("Origin"); snt.CORS.Flags != 0 && len(origin) != 0 && !sameOrigin(r, origin) {
+		if !snt.CORS.allows(origin) || len(snt.CORS.Methods) != 0 && !slices.Contains(snt.CORS.Methods, r.Method) {
+			verdict.Action = BLOCK
+			verdict.Status = http.StatusForbidden
+			return eval
+		}
+
+		verdict.Headers = snt.CORS.responseHeaders(origin)
+	}
+
+	if len(snt.Charsets) != 0 && !slices.Contains(snt.Charsets, in.charset()) {
+		verdict.Action = BLOCK
+		verdict.Status = http.StatusUnsupportedMediaType
+		return eval
+	}
+
+	if snt.Flags&FLAG_FORBID_CONTROL != 0 && in.hasControlChars(snt.AllowControl) {
+		verdict.Action = BLOCK
+		verdict.Status = http.StatusBadRequest
+		return eval
+	}
+
+	for _, name := range snt.RequiredHeaders {
+		// net/http moves the Host header out of the header map
+		if len(r.Header.Values(name)) == 0 && (name != "host" || len(r.Host) == 0) {
+			verdict.Action = BLOCK
+			verdict.Status = http.StatusBadRequest
+			return eval
+		}
+	}
+
+	if snt.Bots.Flags != 0 && in.isBot(snt.Bots) {
+		if snt.Bots.Flags&BOT_FLAG == 0 {
+			verdict.Action = BLOCK
+			verdict.Status = http.StatusForbidden
+			return eval
+		}
+
+		slog.Warn("bot policy violated", "method", r.Method, "path", r.URL.Path, "fingerprint", in.fingerprint())
+	}
+
+	if len(snt.AllowedHeaders) != 0 {
+		for name := range r.Header {
+			if !slices.Contains(snt.AllowedHeaders, strings.ToLower(name)) {
+				verdict.Strip = append(verdict.Strip, name)
+			}
+		}
+
+		slices.Sort(verdict.Strip)
+	}
+
+	if snt.Schema != nil && !in.matchSchema(*snt.Schema) {
+		verdict.Action = BLOCK
+		verdict.Status = http.StatusBadRequest
+		return eval
+	}
+
+	// a key is acted on once it reached the count, the request making
+	// the count-th event still goes through
+	for i, seq := range snt.Sequences {
+		key, ok := in.sequenceKey(seq.Key)
+
+		if !ok {
+			continue
+		}
+
+		id := fmt.Sprintf("%s\x00%d\x00%s", snt.Name(), i, key)
+		window := time.Duration(seq.Window) * time.Second
+		reached := g.Tracker.Count(id, window, now) >= int(seq.Count)
+
+		if g.matchGroups(seq.Groups, in) {
+			if len(seq.Status) == 0 {
+				g.Tracker.Add(id, seq.Count, window, now)
+			} else {
+				verdict.Events = append(verdict.Events, SequenceEvent{ID: id, Count: seq.Count, Window: window, Status: seq.Status})
+			}
+		}
+
+		if act, _ := Action(seq.Groups); reached && g.apply(verdict, act, snt.BlockThreshold) {
+			return eval
+		}
+	}
+
+	for i, rule := range snt.Rules {
+		act, ok := Action(rule.Groups)
+
+		if !ok || !rule.Window.Contains(now) || (rule.Expires != 0 && uint64(now.Unix()) >= rule.Expires) {
+			continue
+		}
+
+		// each request is given one variant of every experiment
+		if !g.applies(&eval, i, rule) {
+			continue
+		}
+
+		if !g.matchGroups(rule.Groups, in) {
+			continue
+		}
+
+		verdict.Rule = i
+		verdict.Experiment, verdict.Variant = rule.Experiment, rule.Variant
+		eval.Matched = append(eval.Matched, i)
+
+		if g.apply(verdict, act, snt.BlockThreshold) {
+			return eval
+		}
+	}
+
+	verdict.Rule = -1
+
+	return eval
+}
+
+// apply takes an action on the verdict and tells whether it ends the
+// evaluation, which all actions do but a score below the threshold.
+func (g *Guard) apply(verdict *Verdict, act Stmt, threshold uint64) bool {
+	switch act.Op {
+	case SCORE:
+		verdict.Score += act.Num
+
+		if verdict.Score < threshold {
+			return false
+		}
+
+		verdict.Action = BLOCK
+		verdict.Status = http.StatusForbidden
+	case BLOCK:
+		verdict.Action = BLOCK
+		verdict.Status = http.StatusForbidden
+	case REDIRECT:
+		verdict.Action = REDIRECT
+		verdict.Status = http.StatusFound
+		verdict.Location = act.Val
+	case RESPOND:
+		verdict.Action = RESPOND
+		verdict.Status = int(act.Num)
+		verdict.Template = g.tmpls[act.Val]
+	default:
+		verdict.Action = PASS
+	}
+
+	return true
+}
+
+// responseRule tells the rules reading the response context, which are
+// run again once the response body is known.
+func responseRule(rule SentinelRule) bool {
+	for _, stmts := range rule.Groups {
+		for _, stmt := range stmts {
+			if n, _ := ContextMask(stmt.Val); stmt.Var == CTX && stmt.Op == EQ && n&(1<<RESPONSE_BODY) != 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// CheckResponse runs the response rules of the endpoint of an evaluation
+// on the response body of its request, in order as Evaluate does, with a
+// score of their own. The rules keep the sample draws and variants the
+// request was given. A block withholds the response with a 502.
+func (g *Guard) CheckResponse(eval *Evaluation, r *http.Request, body []byte, resp []byte) Verdict {
+	verdict := Verdict{Action: PASS, Endpoint: eval.Endpoint, Rule: -1}
+	now := time.Now()
+
+	if eval.Endpoint < 0 || !g.Responses[eval.Endpoint] {
+		return verdict
+	}
+
+	snt := g.Sentinels[eval.Endpoint]
+	in := Input{Req: r, Body: body, Resp: resp, contexts: g.contexts}
+
+	if resp == nil {
+		in.Resp = []byte{}
+	}
+
+	for i, rule := range snt.Rules {
+		act, ok := Action(rule.Groups)
+
+		if !ok || !responseRule(rule) || !rule.Window.Contains(now) || (rule.Expires != 0 && uint64(now.Unix()) >= rule.Expires) {
+			continue
+		}
+
+		if !g.applies(eval, i, rule) {
+			continue
+		}
+
+		if !g.matchGroups(rule.Groups, in) {
+			continue
+		}
+
+		verdict.Rule = i
+		verdict.Experiment, verdict.Variant = rule.Experiment, rule.Variant
+
+		if g.apply(&verdict, act, snt.BlockThreshold) {
+			if verdict.Action == BLOCK {
+				verdict.Status = http.StatusBadGateway
+			}
+
+			return verdict
+		}
+	}
+
+	verdict.Rule = -1
+	verdict.Experiment, verdict.Variant = "", 0
+
+	return verdict
+}
@@ -0,0 +1,419 @@
+// Package mkrulhttp enforces compiled sentinels in HTTP handlers.
+package mkrulhttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tantalsec/Mkrul"
+	"github.com/tantalsec/Mkrul/mkruleval"
+)
+
+// MAX_BODY is the default size of the request and response bodies the
+// rules are checked on, see MaxBody.
+const MAX_BODY = 1 << 20
+
+// Option configures the middleware.
+type Option func(*options)
+
+type options struct {
+	maxBody int
+}
+
+// MaxBody sets the size of the bodies the rules are checked on. A request
+// body over it is refused with a 413 on the endpoints whose rules or
+// policies read the body, a response body over it is withheld with a 502
+// on the endpoints with response rules.
+func MaxBody(n int) Option {
+	return func(o *options) {
+		o.maxBody = n
+	}
+}
+
+type Metrics struct {
+	mu        sync.Mutex
+	compiles  uint64
+	errors    uint64
+	last      time.Time
+	duration  time.Duration
+	sentinels int
+	rules     int
+	verdicts  map[uint8]uint64
+}
+
+var DefaultMetrics = Metrics{verdicts: map[uint8]uint64{}}
+
+func (m *Metrics) Compiled(d time.Duration, snts []mkruleval.Sentinel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.compiles++
+	m.last = time.Now()
+	m.duration = d
+	m.sentinels = len(snts)
+	m.rules = 0
+
+	for _, snt := range snts {
+		m.rules += len(snt.Rules)
+	}
+}
+
+func (m *Metrics) Failed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.errors++
+}
+
+func (m *Metrics) Verdict(act uint8) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.verdicts[act]++
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP mkrul_compiles_total Successful compilations.\n# TYPE mkrul_compiles_total counter\nmkrul_compiles_total %d\n", m.compiles)
+	fmt.Fprintf(w, "# HELP mkrul_compile_errors_total Failed compilations.\n# TYPE mkrul_compile_errors_total counter\nmkrul_compile_errors_total %d\n", m.errors)
+
+	if !m.last.IsZero() {
+		fmt.Fprintf(w, "# HELP mkrul_last_compile_timestamp_seconds Time of the last successful compilation.\n# TYPE mkrul_last_compile_timestamp_seconds gauge\nmkrul_last_compile_timestamp_seconds %d\n", m.last.Unix())
+	}
+
+	fmt.Fprintf(w, "# HELP mkrul_compile_duration_seconds Duration of the last successful compilation.\n# TYPE mkrul_compile_duration_seconds gauge\nmkrul_compile_duration_seconds %g\n", m.duration.Seconds())
+	fmt.Fprintf(w, "# HELP mkrul_sentinels Number of compiled sentinels.\n# TYPE mkrul_sentinels gauge\nmkrul_sentinels %d\n", m.sentinels)
+	fmt.Fprintf(w, "# HELP mkrul_rules Number of compiled rules.\n# TYPE mkrul_rules gauge\nmkrul_rules %d\n", m.rules)
+
+	if len(m.verdicts) != 0 {
+		fmt.Fprintf(w, "# HELP mkrul_requests_total Requests checked in serve mode by action.\n# TYPE mkrul_requests_total counter\n")
+
+		for act := uint8(mkruleval.BLOCK); act <= mkruleval.RESPOND; act++ {
+			if n, ok := m.verdicts[act]; ok {
+				fmt.Fprintf(w, "mkrul_requests_total{action=\"%s\"} %d\n", mkruleval.ActionNames[act], n)
+			}
+		}
+	}
+}
+
+func Middleware(snts []mkruleval.Sentinel, tmpls []mkruleval.Template, types mkruleval.ContentTypes, opts ...Option) (func(http.Handler) http.Handler, error) {
+	var store mkrul.Store
+
+	if _, err := store.Swap(snts, tmpls, types); err != nil {
+		return nil, err
+	}
+
+	return StoreMiddleware(&store, opts...), nil
+}
+
+// StoreMiddleware checks the requests against the current rules of the
+// store; the requests pass while it is empty.
+func StoreMiddleware(s *mkrul.Store, opts ...Option) func(http.Handler) http.Handler {
+	o := options{maxBody: MAX_BODY}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body []byte
+
+			set := s.Current()
+
+			if set == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// the body is read only for the endpoints whose rules read
+			// it, the others get the request stream as it is
+			if i := set.Guard.Find(r); i >= 0 && set.Guard.Bodies[i] {
+				data, err := io.ReadAll(io.LimitReader(r.Body, int64(o.maxBody)+1))
+
+				if err != nil {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+
+				// the rules see the body in full or the request is
+				// refused, no byte they did not check goes to the handler
+				if len(data) > o.maxBody {
+					http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+					return
+				}
+
+				body = data
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+
+			eval := set.Guard.Evaluate(r, body, time.Now())
+			verdict := eval.Verdict
+
+			DefaultMetrics.Verdict(verdict.Action)
+
+			if verdict.Action != mkruleval.PASS {
+				attrs := []any{"method", r.Method, "path", r.URL.Path, "endpoint", verdict.Endpoint, "rule", verdict.Rule, "action", mkruleval.ActionNames[verdict.Action]}
+
+				if len(verdict.Experiment) != 0 {
+					attrs = append(attrs, "experiment", verdict.Experiment, "variant", verdict.Variant)
+				}
+
+				slog.Info("request matched", attrs...)
+			}
+
+			for name, vals := range verdict.Headers {
+				w.Header()[name] = vals
+			}
+
+			if verdict.Action != mkruleval.PASS {
+				writeVerdict(w, r, verdict)
+				return
+			}
+
+			for _, name := range verdict.Strip {
+				r.Header.Del(name)
+			}
+
+			var pw *PolicyWriter
+
+			if verdict.Endpoint >= 0 {
+				snt := set.Guard.Sentinels[verdict.Endpoint]
+				scan := set.Guard.Responses[verdict.Endpoint]
+
+				if snt.Cookies.Flags != 0 || len(snt.AllowedStatus) != 0 || len(verdict.Headers) != 0 || len(verdict.Events) != 0 || scan {
+					pw = &PolicyWriter{ResponseWriter: w, max: o.maxBody, attrs: snt.Cookies, status: snt.AllowedStatus, headers: verdict.Headers, req: r, events: verdict.Events, tracker: set.Guard.Tracker}
+					w = pw
+				}
+
+				if scan {
+					pw.guard, pw.eval, pw.body = set.Guard, &eval, body
+				}
+			}
+
+			next.ServeHTTP(w, r)
+
+			if pw != nil {
+				pw.finish()
+			}
+		})
+	}
+}
+
+// writeVerdict answers the request for a verdict other than pass.
+func writeVerdict(w http.ResponseWriter, r *http.Request, verdict mkruleval.Verdict) {
+	switch verdict.Action {
+	case mkruleval.BLOCK:
+		http.Error(w, http.StatusText(verdict.Status), verdict.Status)
+	case mkruleval.REDIRECT:
+		http.Redirect(w, r, verdict.Location, verdict.Status)
+	case mkruleval.RESPOND:
+		if verdict.Template != nil {
+			w.Header().Set("Content-Type", verdict.Template.ContentType)
+			w.WriteHeader(verdict.Status)
+			_, _ = io.WriteString(w, verdict.Template.Body)
+		} else {
+			w.WriteHeader(verdict.Status)
+		}
+	}
+}
+
+// PolicyWriter enforces the response policies of an endpoint: it sets the
+// headers of the verdict over the upstream ones, and drops the Set-Cookie
+// headers missing an attribute required by the cookie policy, or only logs
+// them when the policy flags them. It also counts the sequence events of
+// the request the response status makes, and replaces the responses with
+// a status outside the allowed ones by a 502.
+//
+// For an endpoint with response rules, the response is held back until
+// the handler returns and checked against them; responses over the body
+// size of the middleware are withheld with a 502, as a block would.
+type PolicyWriter struct {
+	http.ResponseWriter
+	max     int
+	attrs   mkruleval.CookieAttrs
+	status  []uint16
+	headers http.Header
+	req     *http.Request
+	events  []mkruleval.SequenceEvent
+	tracker *mkruleval.Tracker
+	checked bool
+	denied  bool
+
+	// guard runs the response rules of the endpoint of eval, body is the
+	// request body
+	guard *mkruleval.Guard
+	eval  *mkruleval.Evaluation
+	body  []byte
+	code  int
+	buf   bytes.Buffer
+	sent  bool
+}
+
+func (cw *PolicyWriter) WriteHeader(status int) {
+	// informational responses precede the final one
+	if status < 200 && !cw.checked {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if !cw.checked {
+		cw.checked = true
+		header := cw.Header()
+		var kept []string
+
+		for _, event := range cw.events {
+			if slices.Contains(event.Status, uint16(status)) {
+				cw.tracker.Add(event.ID, event.Count, event.Window, time.Now())
+			}
+		}
+
+		for name, vals := range cw.headers {
+			header[name] = vals
+		}
+
+		for _, val := range header.Values("Set-Cookie") {
+			if cw.attrs.Allows(val) {
+				kept = append(kept, val)
+				continue
+			}
+
+			name, _, _ := strings.Cut(val, "=")
+
+			if cw.attrs.Flags&mkruleval.COOKIE_FLAG != 0 {
+				slog.Warn("cookie policy violated", "method", cw.req.Method, "path", cw.req.URL.Path, "cookie", strings.TrimSpace(name))
+				kept = append(kept, val)
+			} else {
+				slog.Info("cookie stripped", "method", cw.req.Method, "path", cw.req.URL.Path, "cookie", strings.TrimSpace(name))
+			}
+		}
+
+		if cw.attrs.Flags != 0 {
+			header.Del("Set-Cookie")
+
+			for _, val := range kept {
+				header.Add("Set-Cookie", val)
+			}
+		}
+
+		// the upstream headers and body are dropped with the status
+		if len(cw.status) != 0 && !slices.Contains(cw.status, uint16(status)) {
+			slog.Warn("response status denied", "method", cw.req.Method, "path", cw.req.URL.Path, "status", status)
+			cw.denied = true
+			clear(header)
+			http.Error(cw.ResponseWriter, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+	}
+
+	if cw.guard != nil && !cw.sent {
+		cw.code = status
+		return
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *PolicyWriter) Write(data []byte) (int, error) {
+	if !cw.checked {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.denied {
+		return len(data), nil
+	}
+
+	if cw.guard != nil && !cw.sent {
+		if cw.buf.Len()+len(data) <= cw.max {
+			return cw.buf.Write(data)
+		}
+
+		// no byte the rules did not check goes to the client, the
+		// upstream headers go with the body
+		slog.Warn("response too large to check", "method", cw.req.Method, "path", cw.req.URL.Path)
+		DefaultMetrics.Verdict(mkruleval.BLOCK)
+
+		cw.denied = true
+		cw.buf.Reset()
+		clear(cw.Header())
+		http.Error(cw.ResponseWriter, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+
+		return len(data), nil
+	}
+
+	return cw.ResponseWriter.Write(data)
+}
+
+// send writes the held back status and body.
+func (cw *PolicyWriter) send() error {
+	cw.sent = true
+	cw.ResponseWriter.WriteHeader(cw.code)
+	_, err := cw.ResponseWriter.Write(cw.buf.Bytes())
+	cw.buf.Reset()
+
+	return err
+}
+
+// finish applies the policies to the implicit 200 of a handler that wrote
+// nothing, then checks the held back response against the response rules
+// and sends it or the answer of their verdict.
+func (cw *PolicyWriter) finish() {
+	if !cw.checked {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.guard == nil || cw.denied || cw.sent {
+		return
+	}
+
+	verdict := cw.guard.CheckResponse(cw.eval, cw.req, cw.body, cw.buf.Bytes())
+
+	if verdict.Action == mkruleval.PASS {
+		_ = cw.send()
+		return
+	}
+
+	DefaultMetrics.Verdict(verdict.Action)
+	attrs := []any{"method", cw.req.Method, "path", cw.req.URL.Path, "endpoint", verdict.Endpoint, "rule", verdict.Rule, "action", mkruleval.ActionNames[verdict.Action]}
+
+	if len(verdict.Experiment) != 0 {
+		attrs = append(attrs, "experiment", verdict.Experiment, "variant", verdict.Variant)
+	}
+
+	slog.Info("response matched", attrs...)
+
+	// the upstream headers go with the body they described
+	cw.sent = true
+	clear(cw.Header())
+	writeVerdict(cw.ResponseWriter, cw.req, verdict)
+}
+
+// FlushError flushes the response unless it is held back for the
+// response rules.
+func (cw *PolicyWriter) FlushError() error {
+	if !cw.checked {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.denied || cw.guard != nil && !cw.sent {
+		return nil
+	}
+
+	return http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (cw *PolicyWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
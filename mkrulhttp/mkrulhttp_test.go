@@ -0,0 +1,332 @@
+package mkrulhttp
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tantalsec/Mkrul"
+	"github.com/tantalsec/Mkrul/mkruleval"
+)
+
+// compile builds the sentinels of the endpoints given in JSON.
+func compile(t *testing.T, endpoints string) ([]mkruleval.Sentinel, []mkruleval.Template, mkruleval.ContentTypes) {
+	var c mkrul.Compiler
+
+	cfg, err := mkrul.ParseConfig("endpoints.json", []byte(endpoints))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snts, tmpls, types, err := c.Build(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return snts, tmpls, types
+}
+
+// serve wraps the handler in the middleware of the endpoints.
+func serve(t *testing.T, endpoints string, next http.Handler, opts ...Option) http.Handler {
+	snts, tmpls, types := compile(t, endpoints)
+	mw, err := Middleware(snts, tmpls, types, opts...)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mw(next)
+}
+
+func TestMiddlewareBody(t *testing.T) {
+	var seen int
+
+	h := serve(t, `[{"path": "/", "method": "", "rules": ["$ctx == 'json' $key == 'cmd' : block", "pass"]}]`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		seen = len(data)
+	}))
+
+	padded := `{"pad": "` + strings.Repeat("a", MAX_BODY) + `", "cmd": "x"}`
+
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"cmd": "x"}`, http.StatusForbidden},
+		{`{"ok": "x"}`, http.StatusOK},
+		{strings.Repeat(" ", MAX_BODY-len(`{"ok": 1}`)) + `{"ok": 1}`, http.StatusOK},
+		{padded, http.StatusRequestEntityTooLarge},
+	} {
+		seen = -1
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(tc.body))))
+
+		if w.Code != tc.status {
+			t.Errorf("body of %d bytes: status %d, want %d", len(tc.body), w.Code, tc.status)
+		}
+
+		if tc.status == http.StatusOK && seen != len(tc.body) {
+			t.Errorf("body of %d bytes: handler read %d", len(tc.body), seen)
+		}
+
+		if tc.status != http.StatusOK && seen != -1 {
+			t.Errorf("body of %d bytes: handler called on status %d", len(tc.body), w.Code)
+		}
+	}
+}
+
+func TestMiddlewareBodyLimit(t *testing.T) {
+	var seen int
+
+	endpoints := `[
+		{"path": "/json", "method": "", "rules": ["$ctx == 'json' $key == 'cmd' : block", "pass"]},
+		{"path": "/headers", "method": "", "rules": ["$ctx == 'headers' $key == 'x-cmd' : block", "pass"]},
+		{"path": "/any", "method": "", "rules": ["$val == 'cmd' : block", "pass"]}
+	]`
+
+	h := serve(t, endpoints, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		seen = len(data)
+	}), MaxBody(64))
+
+	large := `{"pad": "` + strings.Repeat("a", 64) + `"}`
+
+	for _, tc := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/json", `{"cmd": "x"}`, http.StatusForbidden},
+		{"/json", large, http.StatusRequestEntityTooLarge},
+		{"/any", large, http.StatusRequestEntityTooLarge},
+		{"/headers", large, http.StatusOK},
+		{"/unmatched", large, http.StatusOK},
+	} {
+		seen = -1
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)))
+
+		if w.Code != tc.status {
+			t.Errorf("%s with %d bytes: status %d, want %d", tc.path, len(tc.body), w.Code, tc.status)
+		}
+
+		if tc.status == http.StatusOK && seen != len(tc.body) {
+			t.Errorf("%s with %d bytes: handler read %d", tc.path, len(tc.body), seen)
+		}
+	}
+}
+
+// upstream answers with the status, a header and the body.
+func upstream(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "1")
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, body)
+	}
+}
+
+func TestPolicyWriterResponseRules(t *testing.T) {
+	endpoints := `[{"path": "/", "method": "", "rules": ["$ctx == 'response' $val == /secret/ : block", "pass"]}]`
+	large := strings.Repeat("a", MAX_BODY) + "secret"
+
+	for _, tc := range []struct {
+		name, body string
+		status     int
+		upstream   bool
+	}{
+		{"clean", "public data", http.StatusOK, true},
+		{"leak", "the secret data", http.StatusBadGateway, false},
+		{"over MAX_BODY", large, http.StatusBadGateway, false},
+	} {
+		w := httptest.NewRecorder()
+		serve(t, endpoints, upstream(http.StatusOK, tc.body)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.status)
+		}
+
+		if got := w.Header().Get("X-Upstream") == "1"; got != tc.upstream {
+			t.Errorf("%s: upstream headers sent: %v", tc.name, got)
+		}
+
+		if tc.upstream && w.Body.String() != tc.body {
+			t.Errorf("%s: body of %d bytes, want %d", tc.name, w.Body.Len(), len(tc.body))
+		}
+
+		if !tc.upstream && strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("%s: held back body sent", tc.name)
+		}
+	}
+}
+
+func TestPolicyWriterFlushHeldBack(t *testing.T) {
+	endpoints := `[{"path": "/", "method": "", "rules": ["$ctx == 'response' $val == /secret/ : block", "pass"]}]`
+
+	h := serve(t, endpoints, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "the secret ")
+
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("flush: %v", err)
+		}
+
+		_, _ = io.WriteString(w, "data")
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Flushed {
+		t.Error("held back response flushed")
+	}
+
+	if w.Code != http.StatusBadGateway || strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("status %d, body %q, want the block", w.Code, w.Body.String())
+	}
+}
+
+func TestPolicyWriterAllowedStatus(t *testing.T) {
+	endpoints := `[{"path": "/", "method": "", "allowed_status": [200, 404], "rules": ["pass"]}]`
+
+	for _, tc := range []struct {
+		status, want int
+	}{
+		{http.StatusOK, http.StatusOK},
+		{http.StatusNotFound, http.StatusNotFound},
+		{http.StatusInternalServerError, http.StatusBadGateway},
+	} {
+		w := httptest.NewRecorder()
+		serve(t, endpoints, upstream(tc.status, "upstream body")).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if w.Code != tc.want {
+			t.Errorf("upstream %d: status %d, want %d", tc.status, w.Code, tc.want)
+		}
+
+		denied := tc.want == http.StatusBadGateway
+
+		if denied == (w.Header().Get("X-Upstream") == "1") || denied == strings.Contains(w.Body.String(), "upstream body") {
+			t.Errorf("upstream %d: headers %v, body %q", tc.status, w.Header(), w.Body.String())
+		}
+	}
+}
+
+func TestPolicyWriterCookies(t *testing.T) {
+	for _, tc := range []struct {
+		action string
+		want   []string
+	}{
+		{"", []string{"a=1; Secure; HttpOnly"}},
+		{"flag", []string{"a=1; Secure; HttpOnly", "b=2"}},
+	} {
+		endpoints := `[{"path": "/", "method": "", "cookie_policy": {"secure": true, "http_only": true, "action": "` + tc.action + `"}, "rules": ["pass"]}]`
+
+		h := serve(t, endpoints, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Set-Cookie", "a=1; Secure; HttpOnly")
+			w.Header().Add("Set-Cookie", "b=2")
+		}))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if got := w.Header().Values("Set-Cookie"); !slices.Equal(got, tc.want) {
+			t.Errorf("action %q: cookies %q, want %q", tc.action, got, tc.want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	snts, _, _ := compile(t, `[
+		{"method": "GET", "path": "/a", "rules": ["$path == '/x' : block", "pass"]},
+		{"method": "GET", "path": "/b", "rules": ["block"]}
+	]`)
+
+	for _, tc := range []struct {
+		name   string
+		record func(m *Metrics)
+		want   []string
+		absent []string
+	}{
+		{"empty", func(m *Metrics) {}, []string{"mkrul_compiles_total 0", "mkrul_compile_errors_total 0", "mkrul_sentinels 0"}, []string{"mkrul_last_compile_timestamp_seconds", "mkrul_requests_total"}},
+		{"compiled", func(m *Metrics) { m.Compiled(2*time.Second, snts) }, []string{"mkrul_compiles_total 1", "mkrul_compile_duration_seconds 2", "mkrul_sentinels 2", "mkrul_rules 3", "mkrul_last_compile_timestamp_seconds"}, nil},
+		{"failed", func(m *Metrics) { m.Failed(); m.Failed() }, []string{"mkrul_compiles_total 0", "mkrul_compile_errors_total 2"}, nil},
+		{"verdicts", func(m *Metrics) {
+			m.Verdict(mkruleval.BLOCK)
+			m.Verdict(mkruleval.BLOCK)
+			m.Verdict(mkruleval.PASS)
+		}, []string{`mkrul_requests_total{action="block"} 2`, `mkrul_requests_total{action="pass"} 1`}, []string{`action="score"`}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := Metrics{verdicts: map[uint8]uint64{}}
+			tc.record(&m)
+
+			rec := httptest.NewRecorder()
+			m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+			body := rec.Body.String()
+
+			for _, want := range tc.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("metrics without %q:\n%s", want, body)
+				}
+			}
+
+			for _, absent := range tc.absent {
+				if strings.Contains(body, absent) {
+					t.Errorf("metrics with %q:\n%s", absent, body)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareTrailers(t *testing.T) {
+	h := serve(t, `[{"path": "/", "method": "", "rules": ["$ctx == 'trailers' $key == 'grpc-status' $val != '0' : block", "pass"]}]`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		header, trailer string
+		status          int
+	}{
+		{"", "0", http.StatusOK},
+		{"", "2", http.StatusForbidden},
+		{"", "", http.StatusOK},
+		{"2", "", http.StatusOK},
+	} {
+		// a reader of unknown length makes the body chunked, which
+		// trailers need
+		req, err := http.NewRequest(http.MethodPost, srv.URL, io.MultiReader(strings.NewReader("data")))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(tc.header) != 0 {
+			req.Header.Set("Grpc-Status", tc.header)
+		}
+
+		if len(tc.trailer) != 0 {
+			req.Trailer = http.Header{"Grpc-Status": {tc.trailer}}
+		}
+
+		resp, err := srv.Client().Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("header %q trailer %q: status %d, want %d", tc.header, tc.trailer, resp.StatusCode, tc.status)
+		}
+	}
+}